@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Absence is a period a resident is away. The AbsenceScheduler makes them unavailable, handing
+// their tasks on, once Start is reached and, if it did so, available again at End.
+type Absence struct {
+	Id         int       `bson:"id" json:"id"`
+	ResidentId string    `bson:"residentId" json:"residentId"`
+	Start      time.Time `bson:"start" json:"start"`
+	End        time.Time `bson:"end" json:"end"`
+	//started, the resident is away
+	Active bool `bson:"active" json:"active"`
+	//the resident was available when it started and was made unavailable for it, so its end makes
+	//them available again
+	MadeUnavailable bool `bson:"madeUnavailable" json:"madeUnavailable"`
+}
+
+// AbsenceRequest registers the caller as away from the first to the last day, both "2006-01-02"
+// dates in the floor's timezone.
+type AbsenceRequest struct {
+	Revision *int64 `json:"revision,omitempty"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+}
+
+// newAbsence turns req into an absence of residentId from the start of From to the end of To.
+func newAbsence(f Floor, residentId string, req AbsenceRequest, now time.Time) (Absence, error) {
+	loc := floorLocation(f)
+	from, err := time.ParseInLocation(time.DateOnly, req.From, loc)
+	if err != nil {
+		return Absence{}, fmt.Errorf("invalid from date %q", req.From)
+	}
+	to, err := time.ParseInLocation(time.DateOnly, req.To, loc)
+	if err != nil {
+		return Absence{}, fmt.Errorf("invalid to date %q", req.To)
+	}
+	if to.Before(from) {
+		return Absence{}, fmt.Errorf("to must not be before from")
+	}
+	a := Absence{ResidentId: residentId, Start: from, End: to.AddDate(0, 0, 1)}
+	if !now.Before(a.End) {
+		return Absence{}, fmt.Errorf("absence is over already")
+	}
+	return a, nil
+}
+
+// overlappingAbsence returns an absence of the same resident that shares time with a.
+func overlappingAbsence(absences []Absence, a Absence) (Absence, bool) {
+	for _, other := range absences {
+		if other.ResidentId == a.ResidentId && other.Id != a.Id && a.Start.Before(other.End) && other.Start.Before(a.End) {
+			return other, true
+		}
+	}
+	return Absence{}, false
+}
+
+func findAbsence(absences []Absence, absenceId int) (Absence, error) {
+	for _, a := range absences {
+		if a.Id == absenceId {
+			return a, nil
+		}
+	}
+	return Absence{}, fmt.Errorf("absence with id %d not found", absenceId)
+}
+
+func withoutAbsence(absences []Absence, absenceId int) []Absence {
+	rest := []Absence{}
+	for _, a := range absences {
+		if a.Id != absenceId {
+			rest = append(rest, a)
+		}
+	}
+	return rest
+}
+
+// absenceDue reports whether a has to be started or ended at now.
+func absenceDue(a Absence, now time.Time) bool {
+	return !now.Before(a.End) || (!a.Active && !now.Before(a.Start))
+}
+
+// startAbsence makes the resident of a unavailable like RESIDENT_UNAVAILABLE does, handing their
+// tasks on, and marks a active. Room, tasks, absences and notifications are saved in one write.
+func startAbsence(f Floor, a Absence, actorId string, now time.Time) (Floor, error) {
+	roomIndex, err := findRoom(f.Rooms, a.ResidentId)
+	if err != nil {
+		//the resident moved out in the meantime
+		f.Absences = withoutAbsence(f.Absences, a.Id)
+		return updateAbsences(f, -1)
+	}
+	wasAvailable := f.Rooms[roomIndex].Resident.Available
+	absences := make([]Absence, len(f.Absences))
+	for i, other := range f.Absences {
+		if other.Id == a.Id {
+			other.Active = true
+			other.MadeUnavailable = wasAvailable
+		}
+		absences[i] = other
+	}
+	var msgs []OutboxMessage
+	var history []HistoryEntry
+	if wasAvailable {
+		_, _, msgs, history = reassignTasks(&f, f.Rooms[roomIndex], actorId, now)
+		f.Rooms[roomIndex].Resident.Available = false
+	}
+	f.Absences = absences
+	fUp, err := updateAbsences(f, roomIndex, msgs...)
+	if err != nil {
+		return Floor{}, err
+	}
+	if wasAvailable {
+		recordAvailabilityChange(fUp, roomIndex, "RESIDENT_UNAVAILABLE", actorId, now)
+		recordHistory(history)
+	}
+	return fUp, nil
+}
+
+// endAbsence removes a and makes the resident available again if a made them unavailable, the
+// unassigned pool is spread again then. A resident who was unavailable already when a started stays so.
+func endAbsence(f Floor, a Absence, actorId string, now time.Time) (Floor, error) {
+	f.Absences = withoutAbsence(f.Absences, a.Id)
+	roomIndex, err := findRoom(f.Rooms, a.ResidentId)
+	if err != nil || !a.MadeUnavailable || f.Rooms[roomIndex].Resident.Available {
+		return updateAbsences(f, -1)
+	}
+	f.Rooms[roomIndex].Resident.Available = true
+	picked, history := pickUpPooledTasks(&f, actorId, now)
+	fUp, err := updateAbsences(f, roomIndex, pickedUpMessages(f, picked, actorId)...)
+	if err != nil {
+		return Floor{}, err
+	}
+	recordAvailabilityChange(fUp, roomIndex, "RESIDENT_AVAILABLE", actorId, now)
+	recordHistory(history)
+	return fUp, nil
+}
+
+func recordAvailabilityChange(f Floor, roomIndex int, action string, actorId string, now time.Time) {
+	entry := newAvailabilityEntry(f, f.Rooms[roomIndex], action, now)
+	entry.ActorId = actorId
+	recordHistory([]HistoryEntry{entry})
+}
+
+// HandleAddAbsence registers an absence of the caller.
+func HandleAddAbsence(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerFloorFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req AbsenceRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.Error("addAbsence decoding data payload", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	floor, err := FindFloor(identity.FloorId)
+	if err != nil {
+		logger.Error("addAbsence getFloor", slog.Any("error", err), slog.String("floor id", identity.FloorId))
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, "error.floorNotFound", http.StatusUnprocessableEntity)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkClientRevision(w, floor, req.Revision) {
+		return
+	}
+	if _, err := findRoom(floor.Rooms, identity.UserId); err != nil {
+		writeError(w, r, "error.userNotInFloor", http.StatusUnprocessableEntity)
+		return
+	}
+	absence, err := newAbsence(floor, identity.UserId, req, time.Now())
+	if err != nil {
+		writeError(w, r, "error.invalidAbsence", http.StatusBadRequest, "Error", err.Error())
+		return
+	}
+	if other, ok := overlappingAbsence(floor.Absences, absence); ok {
+		loc := floorLocation(floor)
+		writeError(w, r, "error.absenceOverlap", http.StatusConflict,
+			"From", other.Start.In(loc).Format(time.DateOnly), "To", other.End.In(loc).AddDate(0, 0, -1).Format(time.DateOnly))
+		return
+	}
+	absence.Id = 1
+	if len(floor.Absences) > 0 {
+		absence.Id = floor.Absences[len(floor.Absences)-1].Id + 1
+	}
+
+	fUp, err := insertAbsence(floor, absence)
+	if err != nil {
+		writeDBError(w, err, floor.Id, "addAbsence updating DB", slog.Any("absence", absence))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(fUp)
+}
+
+// HandleDeleteAbsence cancels an absence of the caller. An absence that already started ends
+// right away.
+func HandleDeleteAbsence(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerFloorFromPath(w, r)
+	if !ok {
+		return
+	}
+	absenceId, err := strconv.Atoi(r.PathValue("absenceId"))
+	if err != nil {
+		writeError(w, r, "error.invalidAbsenceId", http.StatusBadRequest)
+		return
+	}
+	floor, err := FindFloor(identity.FloorId)
+	if err != nil {
+		logger.Error("deleteAbsence getFloor", slog.Any("error", err), slog.String("floor id", identity.FloorId))
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, "error.floorNotFound", http.StatusUnprocessableEntity)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	absence, err := findAbsence(floor.Absences, absenceId)
+	if err != nil || absence.ResidentId != identity.UserId {
+		writeError(w, r, "error.absenceNotFound", http.StatusNotFound)
+		return
+	}
+	fUp, err := endAbsence(floor, absence, identity.UserId, time.Now())
+	if err != nil {
+		writeDBError(w, err, floor.Id, "deleteAbsence updating DB", slog.Any("absence", absence))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fUp)
+}
+
+// AbsenceScheduler starts and ends absences. Like votings, absences live in the floor, so the
+// ones that started or ended while the server was down are picked up on start.
+type AbsenceScheduler struct {
+	clock    Clock
+	interval time.Duration
+}
+
+func newAbsenceScheduler(clock Clock, interval time.Duration) *AbsenceScheduler {
+	return &AbsenceScheduler{clock: clock, interval: interval}
+}
+
+// start switches due absences right away and then every interval until ctx is done.
+func (s *AbsenceScheduler) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			if _, err := s.runOnce(); err != nil {
+				logger.Error("absenceScheduler run", slog.Any("error", err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// runOnce starts or ends every due absence and returns how many were switched.
+func (s *AbsenceScheduler) runOnce() (int, error) {
+	now := s.clock.Now()
+	floors, err := findFloorsWithAbsences()
+	if err != nil {
+		return 0, fmt.Errorf("absenceScheduler finding floors: %w", err)
+	}
+	switched := 0
+	for _, f := range floors {
+		for _, a := range f.Absences {
+			if !absenceDue(a, now) {
+				continue
+			}
+			if err := switchAbsence(f.Id.Hex(), a.Id, now); err != nil {
+				logger.Error("absenceScheduler switch", slog.Any("error", err), slog.Any("floor id", f.Id), slog.Any("absence", a))
+				continue
+			}
+			switched++
+		}
+	}
+	return switched, nil
+}
+
+// switchAbsence starts or ends a due absence on the latest floor revision, retrying when a
+// resident writes the floor at the same time.
+func switchAbsence(floorId string, absenceId int, now time.Time) error {
+	var err error
+	for i := 0; i < 3; i++ {
+		var f Floor
+		f, err = FindFloor(floorId)
+		if err != nil {
+			return err
+		}
+		a, aErr := findAbsence(f.Absences, absenceId)
+		if aErr != nil || !absenceDue(a, now) {
+			//cancelled or switched in the meantime
+			return nil
+		}
+		if !now.Before(a.End) {
+			_, err = endAbsence(f, a, systemActor, now)
+		} else {
+			_, err = startAbsence(f, a, systemActor, now)
+		}
+		if errors.Is(err, ErrRevisionConflict) {
+			continue
+		}
+		return err
+	}
+	return err
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_newAbsence(t *testing.T) {
+	f := Floor{Timezone: "Europe/Berlin"}
+	loc, _ := time.LoadLocation("Europe/Berlin")
+	now := time.Date(2026, 7, 1, 12, 0, 0, 0, loc)
+	tests := []struct {
+		name      string
+		req       AbsenceRequest
+		wantStart time.Time
+		wantEnd   time.Time
+		wantErr   bool
+	}{
+		{name: "should cover whole days in floor time", req: AbsenceRequest{From: "2026-08-01", To: "2026-08-14"},
+			wantStart: time.Date(2026, 8, 1, 0, 0, 0, 0, loc), wantEnd: time.Date(2026, 8, 15, 0, 0, 0, 0, loc)},
+		{name: "should accept a single day", req: AbsenceRequest{From: "2026-08-01", To: "2026-08-01"},
+			wantStart: time.Date(2026, 8, 1, 0, 0, 0, 0, loc), wantEnd: time.Date(2026, 8, 2, 0, 0, 0, 0, loc)},
+		{name: "should accept an absence that started already", req: AbsenceRequest{From: "2026-06-28", To: "2026-07-01"},
+			wantStart: time.Date(2026, 6, 28, 0, 0, 0, 0, loc), wantEnd: time.Date(2026, 7, 2, 0, 0, 0, 0, loc)},
+		{name: "should reject end before start", req: AbsenceRequest{From: "2026-08-14", To: "2026-08-01"}, wantErr: true},
+		{name: "should reject past absence", req: AbsenceRequest{From: "2026-06-01", To: "2026-06-30"}, wantErr: true},
+		{name: "should reject bad date", req: AbsenceRequest{From: "01.08.2026", To: "2026-08-14"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newAbsence(f, "a", tt.req, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newAbsence: got %v wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (!got.Start.Equal(tt.wantStart) || !got.End.Equal(tt.wantEnd)) {
+				t.Errorf("newAbsence: got %v to %v want %v to %v", got.Start, got.End, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func Test_overlappingAbsence(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 8, d, 0, 0, 0, 0, time.UTC) }
+	absences := []Absence{{Id: 1, ResidentId: "a", Start: day(1), End: day(8)}, {Id: 2, ResidentId: "b", Start: day(10), End: day(12)}}
+	tests := []struct {
+		name    string
+		absence Absence
+		want    bool
+	}{
+		{name: "should find overlap", absence: Absence{ResidentId: "a", Start: day(7), End: day(9)}, want: true},
+		{name: "should allow back to back absences", absence: Absence{ResidentId: "a", Start: day(8), End: day(9)}},
+		{name: "should ignore absences of others", absence: Absence{ResidentId: "a", Start: day(10), End: day(11)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, got := overlappingAbsence(absences, tt.absence); got != tt.want {
+				t.Errorf("overlappingAbsence: got %v want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_absenceDue(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		absence Absence
+		want    bool
+	}{
+		{name: "should wait for start", absence: Absence{Start: now.Add(time.Hour), End: now.Add(2 * time.Hour)}},
+		{name: "should start", absence: Absence{Start: now, End: now.Add(time.Hour)}, want: true},
+		{name: "should not start twice", absence: Absence{Start: now, End: now.Add(time.Hour), Active: true}},
+		{name: "should end", absence: Absence{Start: now.Add(-time.Hour), End: now, Active: true}, want: true},
+		{name: "should drop absence that was never started", absence: Absence{Start: now.Add(-time.Hour), End: now}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := absenceDue(tt.absence, now); got != tt.want {
+				t.Errorf("absenceDue: got %v want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_HandleAbsences(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /floor/{id}/absences", HandleAddAbsence)
+	mux.HandleFunc("DELETE /floor/{id}/absences/{absenceId}", HandleDeleteAbsence)
+	f, err := insertTestFloor(FloorStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(req AbsenceRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(req)
+		r, _ := http.NewRequest("POST", "/floor/"+f.Id.Hex()+"/absences", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(r, "2", f.Id.Hex()))
+		return rr
+	}
+	from := time.Now().AddDate(0, 0, 7).Format(time.DateOnly)
+	to := time.Now().AddDate(0, 0, 14).Format(time.DateOnly)
+
+	var absence Absence
+	t.Run("should register absence", func(t *testing.T) {
+		rr := add(AbsenceRequest{From: from, To: to})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+		var fUp Floor
+		json.Unmarshal(rr.Body.Bytes(), &fUp)
+		if len(fUp.Absences) != 1 || fUp.Absences[0].ResidentId != "2" || fUp.Absences[0].Active {
+			t.Fatalf("absence not stored: %+v", fUp.Absences)
+		}
+		absence = fUp.Absences[0]
+	})
+
+	t.Run("should reject overlapping absence", func(t *testing.T) {
+		if rr := add(AbsenceRequest{From: to, To: to}); rr.Code != http.StatusConflict {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+		}
+	})
+
+	t.Run("should cancel absence", func(t *testing.T) {
+		r, _ := http.NewRequest("DELETE", "/floor/"+f.Id.Hex()+"/absences/"+strconv.Itoa(absence.Id), nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(r, "2", f.Id.Hex()))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		var fUp Floor
+		json.Unmarshal(rr.Body.Bytes(), &fUp)
+		if len(fUp.Absences) != 0 {
+			t.Errorf("absence not cancelled: %+v", fUp.Absences)
+		}
+	})
+}
+
+func Test_absenceScheduler(t *testing.T) {
+	now := time.Now()
+	fStub := FloorStub
+	fStub.Absences = []Absence{
+		{Id: 1, ResidentId: "2", Start: now.Add(time.Hour), End: now.Add(3 * time.Hour)},
+		//resident 5 is unavailable already
+		{Id: 2, ResidentId: "5", Start: now.Add(time.Hour), End: now.Add(3 * time.Hour)},
+	}
+	f, err := insertTestFloor(fStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	residentAvailable := func(t *testing.T, residentId string) (Floor, bool) {
+		fUp, err := FindFloor(f.Id.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		roomIndex, _ := findRoom(fUp.Rooms, residentId)
+		return fUp, fUp.Rooms[roomIndex].Resident.Available
+	}
+
+	t.Run("should make resident unavailable once absence starts", func(t *testing.T) {
+		if _, err := newAbsenceScheduler(fakeClock{now: now.Add(2 * time.Hour)}, time.Minute).runOnce(); err != nil {
+			t.Error(err)
+		}
+		fUp, available := residentAvailable(t, "2")
+		if available {
+			t.Errorf("resident still available")
+		}
+		if len(fUp.Absences) != 2 || !fUp.Absences[0].Active || !fUp.Absences[0].MadeUnavailable {
+			t.Errorf("absence not started: %+v", fUp.Absences)
+		}
+		if !fUp.Absences[1].Active || fUp.Absences[1].MadeUnavailable {
+			t.Errorf("absence of unavailable resident not started without switching: %+v", fUp.Absences[1])
+		}
+	})
+	t.Run("should make resident available again once absence ends", func(t *testing.T) {
+		if _, err := newAbsenceScheduler(fakeClock{now: now.Add(4 * time.Hour)}, time.Minute).runOnce(); err != nil {
+			t.Error(err)
+		}
+		fUp, available := residentAvailable(t, "2")
+		if !available {
+			t.Errorf("resident still unavailable")
+		}
+		if len(fUp.Absences) != 0 {
+			t.Errorf("absence not removed: %+v", fUp.Absences)
+		}
+		if _, available := residentAvailable(t, "5"); available {
+			t.Errorf("resident who was unavailable before the absence made available")
+		}
+	})
+}
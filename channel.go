@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"time"
+
+	expo "github.com/oliveroneill/exponent-server-sdk-golang/sdk"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type ChannelRequest struct {
+	Type     string `json:"type"`
+	Address  string `json:"address"`
+	P256dh   string `json:"p256dh,omitempty"`
+	Auth     string `json:"auth,omitempty"`
+	Platform string `json:"platform,omitempty"`
+}
+
+func validateChannel(ch Channel) error {
+	switch ch.Type {
+	case ChannelExpo:
+		if _, err := expo.NewExponentPushToken(ch.Address); err != nil {
+			return fmt.Errorf("Invalid Expo push token")
+		}
+	case ChannelWebPush:
+		u, err := url.Parse(ch.Address)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("Web push endpoint must be an https URL")
+		}
+		if key, err := base64.RawURLEncoding.DecodeString(ch.P256dh); err != nil || len(key) != 65 {
+			return fmt.Errorf("Invalid p256dh key")
+		}
+		if auth, err := base64.RawURLEncoding.DecodeString(ch.Auth); err != nil || len(auth) != 16 {
+			return fmt.Errorf("Invalid auth secret")
+		}
+	case ChannelEmail:
+		addr, err := mail.ParseAddress(ch.Address)
+		if err != nil || addr.Address != ch.Address {
+			return fmt.Errorf("Invalid email address")
+		}
+	default:
+		return fmt.Errorf("Unknown channel type %s", ch.Type)
+	}
+	return nil
+}
+
+// addChannel adds ch to the resident. Registering a known address again only refreshes it, so a
+// resident has one channel per device.
+func addChannel(res *Resident, ch Channel) {
+	for i, c := range res.Channels {
+		if c.Type == ch.Type && c.Address == ch.Address {
+			ch.CreatedAt = c.CreatedAt
+			res.Channels[i] = ch
+			return
+		}
+	}
+	res.Channels = append(res.Channels, ch)
+}
+
+func removeChannel(res *Resident, chType string, address string) bool {
+	for i, c := range res.Channels {
+		if c.Type == chType && c.Address == address {
+			res.Channels = append(res.Channels[:i], res.Channels[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// pruneChannel removes a channel the push service reported as gone from every resident of the
+// floor that registered it.
+func pruneChannel(fId primitive.ObjectID, chType string, address string) error {
+	for attempt := 0; attempt < 3; attempt++ {
+		f, err := getUpdatedFloor(fId)
+		if err != nil {
+			return err
+		}
+		pruned := false
+		for i := range f.Rooms {
+			if removeChannel(&f.Rooms[i].Resident, chType, address) {
+				pruned = true
+			}
+		}
+		if !pruned {
+			return nil
+		}
+		_, err = updateRooms(f)
+		if !errors.Is(err, ErrRevisionConflict) {
+			return err
+		}
+	}
+	return ErrRevisionConflict
+}
+
+// callerRoom loads the caller's floor and the index of their room.
+func callerRoom(w http.ResponseWriter, r *http.Request, identity Identity, ctx string) (Floor, int, bool) {
+	floor, err := FindFloor(identity.FloorId)
+	if err != nil {
+		logger.Error(ctx+" getFloor", slog.Any("error", err), slog.String("floor id", identity.FloorId))
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, "error.floorNotFound", http.StatusUnprocessableEntity)
+			return Floor{}, 0, false
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return Floor{}, 0, false
+	}
+	roomIndex, err := findRoom(floor.Rooms, identity.UserId)
+	if err != nil {
+		writeError(w, r, "error.userNotInFloor", http.StatusUnprocessableEntity)
+		return Floor{}, 0, false
+	}
+	return floor, roomIndex, true
+}
+
+func HandleListChannels(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerFloorIdentity(w, r)
+	if !ok {
+		return
+	}
+	floor, roomIndex, ok := callerRoom(w, r, identity, "listChannels")
+	if !ok {
+		return
+	}
+	channels := floor.Rooms[roomIndex].Resident.Channels
+	if channels == nil {
+		channels = []Channel{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(channels)
+}
+
+func HandleAddChannel(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerFloorIdentity(w, r)
+	if !ok {
+		return
+	}
+	var req ChannelRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.Error("addChannel decoding data payload", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	ch := Channel{Type: req.Type, Address: req.Address, P256dh: req.P256dh, Auth: req.Auth, Platform: req.Platform, CreatedAt: now, LastSeen: now}
+	if err = validateChannel(ch); err != nil {
+		writeError(w, r, "error.invalidChannel", http.StatusBadRequest, "Error", err.Error())
+		return
+	}
+	floor, roomIndex, ok := callerRoom(w, r, identity, "addChannel")
+	if !ok {
+		return
+	}
+	addChannel(&floor.Rooms[roomIndex].Resident, ch)
+	fUp, err := updateRoom(floor, roomIndex)
+	if err != nil {
+		writeDBError(w, err, floor.Id, "addChannel updating DB room", slog.Any("request", req))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(fUp.Rooms[roomIndex].Resident.Channels)
+}
+
+func HandleDeleteChannel(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerFloorIdentity(w, r)
+	if !ok {
+		return
+	}
+	floor, roomIndex, ok := callerRoom(w, r, identity, "deleteChannel")
+	if !ok {
+		return
+	}
+	if !removeChannel(&floor.Rooms[roomIndex].Resident, r.URL.Query().Get("type"), r.URL.Query().Get("address")) {
+		writeError(w, r, "error.channelNotFound", http.StatusNotFound)
+		return
+	}
+	if _, err := updateRoom(floor, roomIndex); err != nil {
+		writeDBError(w, err, floor.Id, "deleteChannel updating DB room")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleVapidPublicKey hands browser clients the key to subscribe to Web Push with.
+func HandleVapidPublicKey(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	wp, ok := notifiers[ChannelWebPush].(*WebPushNotifier)
+	if !ok {
+		writeError(w, r, "error.webPushNotConfigured", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"publicKey": wp.publicKey()})
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
-	"reflect"
+	"log/slog"
 	"strconv"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -14,6 +16,13 @@ import (
 )
 
 var collection *mongo.Collection
+var votingArchiveCollection *mongo.Collection
+var invitationCollection *mongo.Collection
+var historyCollection *mongo.Collection
+var outboxCollection *mongo.Collection
+var expoTicketCollection *mongo.Collection
+var preferencesCollection *mongo.Collection
+var floorChangeCollection *mongo.Collection
 var client *mongo.Client
 var DB_URI = "mongodb://localhost:27018"
 
@@ -35,6 +44,53 @@ func initMongo(ctx context.Context) {
 		log.Fatal(err)
 	}
 	collection = client.Database("wg-planer").Collection("floor")
+	votingArchiveCollection = client.Database("wg-planer").Collection("votingArchive")
+	invitationCollection = client.Database("wg-planer").Collection("invitations")
+	historyCollection = client.Database("wg-planer").Collection("history")
+	outboxCollection = client.Database("wg-planer").Collection("outbox")
+	expoTicketCollection = client.Database("wg-planer").Collection("expoTickets")
+	preferencesCollection = client.Database("wg-planer").Collection("notificationPreferences")
+	floorChangeCollection = client.Database("wg-planer").Collection("floorChanges")
+	ensureIndexes(ctx)
+}
+
+func ensureIndexes(ctx context.Context) {
+	_, err := invitationCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"expiresAt": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		{Keys: bson.M{"code": 1}, Options: options.Index().SetUnique(true)},
+	})
+	if err != nil {
+		log.Fatal("creating invitation indexes ", err)
+	}
+	_, err = historyCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "floorId", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "floorId", Value: 1}, {Key: "timestamp", Value: -1}}},
+	})
+	if err != nil {
+		log.Fatal("creating history indexes ", err)
+	}
+	_, err = outboxCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+		{Keys: bson.M{"sentAt": 1}, Options: options.Index().SetExpireAfterSeconds(int32((7 * 24 * time.Hour).Seconds()))},
+	})
+	if err != nil {
+		log.Fatal("creating outbox indexes ", err)
+	}
+	_, err = votingArchiveCollection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "floorId", Value: 1}, {Key: "_id", Value: -1}}})
+	if err != nil {
+		log.Fatal("creating voting archive indexes ", err)
+	}
+	_, err = expoTicketCollection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"createdAt": 1}})
+	if err != nil {
+		log.Fatal("creating expo ticket indexes ", err)
+	}
+	_, err = floorChangeCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "floorId", Value: 1}, {Key: "revision", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"createdAt": 1}, Options: options.Index().SetExpireAfterSeconds(int32(floorChangeRetention.Seconds()))},
+	})
+	if err != nil {
+		log.Fatal("creating floor change indexes ", err)
+	}
 }
 
 func disconnectMongo(ctx context.Context) {
@@ -72,6 +128,7 @@ func FindFloor(floorId string) (Floor, error) {
 	if err != nil {
 		return floor, err
 	}
+	markOverdue(&floor, time.Now())
 	return floor, nil
 }
 
@@ -88,169 +145,673 @@ func getUpdatedFloor(fId primitive.ObjectID) (Floor, error) {
 	if err != nil {
 		return Floor{}, err
 	}
+	markOverdue(&f, time.Now())
 	return f, nil
 }
 
-func updateTasks(f Floor) (Floor, error) {
-	result, err := collection.UpdateOne(context.Background(), bson.M{"_id": f.Id}, bson.M{"$set": bson.M{"tasks": f.Tasks}})
+var ErrRevisionConflict = errors.New("floor was changed in between, revision conflict")
+
+// revisionFilter matches the floor only while it is still at the given revision.
+// Floors stored before revisions were introduced have no revision field and count as 0.
+func revisionFilter(fId primitive.ObjectID, revision int64) bson.M {
+	if revision == 0 {
+		return bson.M{"_id": fId, "$or": bson.A{bson.M{"revision": 0}, bson.M{"revision": bson.M{"$exists": false}}}}
+	}
+	return bson.M{"_id": fId, "revision": revision}
+}
+
+// updateFloorAtRevision applies update only if the floor is still at revision and bumps the revision.
+// It returns ErrRevisionConflict if someone else wrote the floor in between. The JSON Patch of the
+// write is recorded as the floor change of the new revision.
+func updateFloorAtRevision(fId primitive.ObjectID, revision int64, update bson.M, opts ...*options.FindOneAndUpdateOptions) (Floor, error) {
+	update["$inc"] = bson.M{"revision": 1}
+	opts = append(opts, options.FindOneAndUpdate().SetReturnDocument(options.After))
+	//every write bumps the revision, so the floor read at revision is exactly what the update sees
+	var before Floor
+	err := collection.FindOne(context.Background(), revisionFilter(fId, revision)).Decode(&before)
+	var fUpdated Floor
+	if err == nil {
+		err = collection.FindOneAndUpdate(context.Background(), revisionFilter(fId, revision), update, opts...).Decode(&fUpdated)
+	}
+	if err == mongo.ErrNoDocuments {
+		count, cErr := collection.CountDocuments(context.Background(), bson.M{"_id": fId})
+		if cErr != nil {
+			return Floor{}, cErr
+		}
+		if count == 0 {
+			return Floor{}, mongo.ErrNoDocuments
+		}
+		return Floor{}, ErrRevisionConflict
+	}
 	if err != nil {
 		return Floor{}, err
 	}
-	if result.ModifiedCount == 0 {
-		return f, nil
+	if err := relayOutbox(fUpdated); err != nil {
+		//the messages stay in the floor and are relayed by the dispatcher
+		logger.Error("updateFloorAtRevision relaying outbox", slog.Any("error", err), slog.Any("floor id", fId))
 	}
-	fUpdated, err := getUpdatedFloor(f.Id)
+	fUpdated.PendingOutbox = nil
+	now := time.Now()
+	change, err := recordFloorChange(before, fUpdated, now)
 	if err != nil {
-		return Floor{}, err
+		logger.Error("updateFloorAtRevision recording change", slog.Any("error", err), slog.Any("floor id", fId), slog.Int64("revision", fUpdated.Revision))
 	}
+	markOverdue(&fUpdated, now)
+	publishFloorChange(fUpdated, update, change.Patch)
 	return fUpdated, nil
 }
 
-func InsertTask(fId primitive.ObjectID, task Task) (Floor, error) {
-	_, err := collection.UpdateOne(context.Background(),
-		bson.M{"_id": fId},
-		bson.M{"$push": bson.M{"tasks": task}})
+// withOutbox adds msgs to the floor's pending outbox as part of update.
+func withOutbox(update bson.M, msgs []OutboxMessage) bson.M {
+	if len(msgs) == 0 {
+		return update
+	}
+	push, _ := update["$push"].(bson.M)
+	if push == nil {
+		push = bson.M{}
+	}
+	push["pendingOutbox"] = bson.M{"$each": msgs}
+	update["$push"] = push
+	return update
+}
+
+func updateTasks(f Floor, msgs ...OutboxMessage) (Floor, error) {
+	return updateFloorAtRevision(f.Id, f.Revision, withOutbox(bson.M{"$set": bson.M{"tasks": f.Tasks}}, msgs))
+}
+
+func updateQuorumPolicies(f Floor) (Floor, error) {
+	return updateFloorAtRevision(f.Id, f.Revision, bson.M{"$set": bson.M{"quorumPolicies": f.QuorumPolicies}})
+}
+
+func InsertTask(f Floor, task Task) (Floor, error) {
+	return updateFloorAtRevision(f.Id, f.Revision, bson.M{"$push": bson.M{"tasks": task}})
+}
+
+func deleteTask(f Floor, taskId string) (Floor, error) {
+	return updateFloorAtRevision(f.Id, f.Revision, bson.M{"$pull": bson.M{"tasks": bson.M{"id": taskId}}})
+}
+
+func InsertVoting(f Floor, voting Voting, msgs ...OutboxMessage) (Floor, error) {
+	return updateFloorAtRevision(f.Id, f.Revision, withOutbox(bson.M{"$push": bson.M{"votings": voting}}, msgs))
+}
+
+func FindVoting(fId primitive.ObjectID, votingId int) (Voting, error) {
+	var floor Floor
+	err := collection.FindOne(context.Background(), bson.M{"_id": fId}).Decode(&floor)
 	if err != nil {
-		return Floor{}, err
+		return Voting{}, err
 	}
+	return findVoting(floor.Votings, votingId)
+}
 
-	fUpdated, err := getUpdatedFloor(fId)
+func findVoting(votings []Voting, votingId int) (Voting, error) {
+	for _, v := range votings {
+		if v.Id == votingId {
+			return v, nil
+		}
+	}
+	return Voting{}, fmt.Errorf("voting with id %d not found", votingId)
+}
+
+func updateVoting(f Floor, voting Voting) (Floor, error) {
+	return updateFloorAtRevision(f.Id, f.Revision,
+		bson.M{"$set": bson.M{"votings.$[elem]": voting}},
+		options.FindOneAndUpdate().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"elem.id": voting.Id}}}))
+}
+
+func deleteVoting(f Floor, votingId int, msgs ...OutboxMessage) (Floor, error) {
+	return updateFloorAtRevision(f.Id, f.Revision, withOutbox(bson.M{"$pull": bson.M{"votings": bson.M{"id": votingId}}}, msgs))
+}
+
+func insertSwap(f Floor, swap Swap, msgs ...OutboxMessage) (Floor, error) {
+	return updateFloorAtRevision(f.Id, f.Revision, withOutbox(bson.M{"$push": bson.M{"swaps": swap}}, msgs))
+}
+
+// closeSwap removes the swap and writes set, the tasks an accepted swap changed, in one update.
+func closeSwap(f Floor, swapId int, set bson.M, msgs ...OutboxMessage) (Floor, error) {
+	update := bson.M{"$pull": bson.M{"swaps": bson.M{"id": swapId}}}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	return updateFloorAtRevision(f.Id, f.Revision, withOutbox(update, msgs))
+}
+
+func updateSwaps(f Floor, msgs ...OutboxMessage) (Floor, error) {
+	return updateFloorAtRevision(f.Id, f.Revision, withOutbox(bson.M{"$set": bson.M{"swaps": f.Swaps}}, msgs))
+}
+
+func insertAbsence(f Floor, absence Absence) (Floor, error) {
+	return updateFloorAtRevision(f.Id, f.Revision, bson.M{"$push": bson.M{"absences": absence}})
+}
+
+// updateAbsences writes the absences of f together with msgs and, if roomIndex is not negative,
+// the room at roomIndex and the tasks.
+func updateAbsences(f Floor, roomIndex int, msgs ...OutboxMessage) (Floor, error) {
+	set := bson.M{"absences": f.Absences}
+	if roomIndex >= 0 {
+		set["rooms."+strconv.Itoa(roomIndex)] = f.Rooms[roomIndex]
+		set["tasks"] = f.Tasks
+	}
+	return updateFloorAtRevision(f.Id, f.Revision, withOutbox(bson.M{"$set": set}, msgs))
+}
+
+// findFloorsWithDueTasks returns floors that have an assigned task with a due date.
+func findFloorsWithDueTasks() ([]Floor, error) {
+	cursor, err := collection.Find(context.Background(), bson.M{"tasks": bson.M{"$elemMatch": bson.M{
+		"assignedTo": bson.M{"$gte": 0},
+		"dueDate":    bson.M{"$gt": time.Time{}},
+	}}})
 	if err != nil {
-		return Floor{}, err
+		return nil, err
 	}
-	return fUpdated, nil
+	var floors []Floor
+	if err = cursor.All(context.Background(), &floors); err != nil {
+		return nil, err
+	}
+	return floors, nil
 }
 
-func deleteTask(fId primitive.ObjectID, taskId string) (Floor, error) {
-	_, err := collection.UpdateOne(context.Background(),
-		bson.M{"_id": fId},
-		bson.M{"$pull": bson.M{"tasks": bson.M{"id": taskId}}})
+func findFloorsWithVotings() ([]Floor, error) {
+	cursor, err := collection.Find(context.Background(), bson.M{"votings.0": bson.M{"$exists": true}})
 	if err != nil {
-		return Floor{}, err
+		return nil, err
 	}
-	fUpdated, err := getUpdatedFloor(fId)
+	var floors []Floor
+	if err = cursor.All(context.Background(), &floors); err != nil {
+		return nil, err
+	}
+	return floors, nil
+}
+
+func insertResolvedVoting(rv ResolvedVoting) error {
+	_, err := votingArchiveCollection.InsertOne(context.Background(), rv)
+	return err
+}
+
+// closeVoting removes the voting and writes set, the fields an accepted voting changed, in one update.
+func closeVoting(f Floor, votingId int, set bson.M, msgs ...OutboxMessage) (Floor, error) {
+	update := bson.M{"$pull": bson.M{"votings": bson.M{"id": votingId}}}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	return updateFloorAtRevision(f.Id, f.Revision, withOutbox(update, msgs))
+}
+
+func findFloorsWithSwaps() ([]Floor, error) {
+	cursor, err := collection.Find(context.Background(), bson.M{"swaps.0": bson.M{"$exists": true}})
 	if err != nil {
-		return Floor{}, err
+		return nil, err
 	}
-	return fUpdated, nil
+	var floors []Floor
+	if err = cursor.All(context.Background(), &floors); err != nil {
+		return nil, err
+	}
+	return floors, nil
 }
 
-func InsertVoting(fId primitive.ObjectID, voting Voting) (Floor, error) {
-	_, err := collection.UpdateOne(context.Background(),
-		bson.M{"_id": fId},
-		bson.M{"$push": bson.M{"votings": voting}})
+func findFloorsWithAbsences() ([]Floor, error) {
+	cursor, err := collection.Find(context.Background(), bson.M{"absences.0": bson.M{"$exists": true}})
 	if err != nil {
-		return Floor{}, err
+		return nil, err
 	}
+	var floors []Floor
+	if err = cursor.All(context.Background(), &floors); err != nil {
+		return nil, err
+	}
+	return floors, nil
+}
+
+// findResolvedVotings returns the archived votings of the floor, latest first.
+func findResolvedVotings(fId primitive.ObjectID, filter VotingFilter) ([]ResolvedVoting, error) {
+	query := bson.M{"floorId": fId}
+	if filter.Type != "" {
+		query["voting.type"] = filter.Type
+	}
+	if !filter.Cursor.IsZero() {
+		query["_id"] = bson.M{"$lt": filter.Cursor}
+	}
+	opts := options.Find().SetSort(bson.M{"_id": -1}).SetLimit(filter.Limit)
+	cursor, err := votingArchiveCollection.Find(context.Background(), query, opts)
+	if err != nil {
+		return nil, err
+	}
+	votings := []ResolvedVoting{}
+	if err = cursor.All(context.Background(), &votings); err != nil {
+		return nil, err
+	}
+	return votings, nil
+}
 
+// deleteAllVotings is used to reset test floors and ignores concurrent writers.
+func deleteAllVotings(fId primitive.ObjectID) (Floor, error) {
+	update := bson.M{"$unset": bson.M{"votings": []Voting{}}, "$inc": bson.M{"revision": 1}}
+	_, err := collection.UpdateOne(context.Background(), bson.M{"_id": fId}, update)
+	if err != nil {
+		return Floor{}, err
+	}
 	fUpdated, err := getUpdatedFloor(fId)
 	if err != nil {
 		return Floor{}, err
 	}
+	if err := relayOutbox(fUpdated); err != nil {
+		//the messages stay in the floor and are relayed by the dispatcher
+		logger.Error("updateFloorAtRevision relaying outbox", slog.Any("error", err), slog.Any("floor id", fId))
+	}
+	fUpdated.PendingOutbox = nil
+	markOverdue(&fUpdated, time.Now())
+	//no patch, clients catching up past this revision refetch
+	publishFloorChange(fUpdated, update, nil)
 	return fUpdated, nil
 }
 
-func FindVoting(fId primitive.ObjectID, votingId int) (Voting, error) {
-	var voting Voting
-	//TODO make it work
-	// err := collection.FindOne(context.Background(),
-	// 	bson.M{"_id": fId, "votings.id": votingId},
-	// 	options.FindOne().SetProjection(bson.M{"votings.$": votingId})).Decode(&voting)
+func updateRoom(f Floor, roomIndex int) (Floor, error) {
+	return updateFloorAtRevision(f.Id, f.Revision, bson.M{"$set": bson.M{"rooms." + strconv.Itoa(roomIndex): f.Rooms[roomIndex]}})
+}
 
-	var floor Floor
-	err := collection.FindOne(context.Background(), bson.M{"_id": fId}).Decode(&floor)
+// updateAvailability writes the room at roomIndex and the tasks that moved with the resident's
+// availability together with msgs.
+func updateAvailability(f Floor, roomIndex int, msgs ...OutboxMessage) (Floor, error) {
+	return updateFloorAtRevision(f.Id, f.Revision, withOutbox(bson.M{"$set": bson.M{"rooms." + strconv.Itoa(roomIndex): f.Rooms[roomIndex], "tasks": f.Tasks}}, msgs))
+}
+
+func updateRooms(f Floor) (Floor, error) {
+	return updateFloorAtRevision(f.Id, f.Revision, bson.M{"$set": bson.M{"rooms": f.Rooms}})
+}
+
+func insertInvitation(inv Invitation) (Invitation, error) {
+	res, err := invitationCollection.InsertOne(context.Background(), inv)
 	if err != nil {
-		return Voting{}, err
+		return Invitation{}, err
 	}
-	for _, v := range floor.Votings {
-		if v.Id == votingId {
-			voting = v
-			break
-		}
+	inv.Id = res.InsertedID.(primitive.ObjectID)
+	return inv, nil
+}
+
+// redeemInvitation marks an unused, unexpired invitation as redeemed by userId. Codes are single use,
+// a second redeem of the same code finds no document.
+func redeemInvitation(code string, userId string, now time.Time) (Invitation, error) {
+	var inv Invitation
+	err := invitationCollection.FindOneAndUpdate(context.Background(),
+		bson.M{"code": code, "redeemedBy": bson.M{"$exists": false}, "expiresAt": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"redeemedBy": userId, "expiresAt": now.Add(inviteRedeemWindow)}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&inv)
+	return inv, err
+}
+
+// findRedeemedInvitation returns the invitation the resident redeemed for the room, it fails with
+// mongo.ErrNoDocuments if there is none.
+func findRedeemedInvitation(fId primitive.ObjectID, roomId int, userId string, now time.Time) (Invitation, error) {
+	var inv Invitation
+	err := invitationCollection.FindOne(context.Background(),
+		bson.M{"floorId": fId, "room.id": roomId, "redeemedBy": userId, "expiresAt": bson.M{"$gt": now}}).Decode(&inv)
+	return inv, err
+}
+
+func findOpenInvitations(fId primitive.ObjectID, now time.Time) ([]Invitation, error) {
+	cursor, err := invitationCollection.Find(context.Background(),
+		bson.M{"floorId": fId, "expiresAt": bson.M{"$gt": now}},
+		options.Find().SetSort(bson.M{"createdAt": -1}))
+	if err != nil {
+		return nil, err
+	}
+	invitations := []Invitation{}
+	if err = cursor.All(context.Background(), &invitations); err != nil {
+		return nil, err
 	}
+	return invitations, nil
+}
 
-	if reflect.DeepEqual(voting, Voting{}) {
-		return Voting{}, fmt.Errorf("voting with id %d not found", votingId)
+func deleteInvitation(fId primitive.ObjectID, invitationId primitive.ObjectID) (bool, error) {
+	res, err := invitationCollection.DeleteOne(context.Background(), bson.M{"_id": invitationId, "floorId": fId})
+	if err != nil {
+		return false, err
 	}
+	return res.DeletedCount > 0, nil
+}
 
-	return voting, nil
+func insertHistoryEntries(entries []HistoryEntry) error {
+	docs := make([]interface{}, len(entries))
+	for i, e := range entries {
+		docs[i] = e
+	}
+	_, err := historyCollection.InsertMany(context.Background(), docs)
+	return err
 }
 
-func updateVoting(fId primitive.ObjectID, voting Voting) (Floor, error) {
-	//TODO remove upsert option
-	_, err := collection.UpdateOne(context.Background(),
-		bson.M{"_id": fId},
-		bson.M{"$set": bson.M{"votings.$[elem]": voting}},
-		options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"elem.id": voting.Id}}}).SetUpsert(true))
+// findHistoryEntries returns the floor's history newest first, continuing after filter.Cursor if set.
+func findHistoryEntries(fId primitive.ObjectID, filter HistoryFilter) ([]HistoryEntry, error) {
+	query := bson.M{"floorId": fId}
+	if filter.TaskId != "" {
+		query["taskId"] = filter.TaskId
+	}
+	if filter.Action != "" {
+		query["action"] = filter.Action
+	}
+	if filter.ResidentId != "" {
+		query["$or"] = bson.A{
+			bson.M{"actorId": filter.ResidentId},
+			bson.M{"fromResident": filter.ResidentId},
+			bson.M{"toResident": filter.ResidentId},
+		}
+	}
+	timestamp := bson.M{}
+	if !filter.From.IsZero() {
+		timestamp["$gte"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		timestamp["$lt"] = filter.To
+	}
+	if len(timestamp) > 0 {
+		query["timestamp"] = timestamp
+	}
+	if !filter.Cursor.IsZero() {
+		query["_id"] = bson.M{"$lt": filter.Cursor}
+	}
+	opts := options.Find().SetSort(bson.M{"_id": -1})
+	if filter.Limit > 0 {
+		opts.SetLimit(filter.Limit)
+	}
+	cursor, err := historyCollection.Find(context.Background(), query, opts)
 	if err != nil {
-		return Floor{}, err
+		return nil, err
+	}
+	entries := []HistoryEntry{}
+	if err = cursor.All(context.Background(), &entries); err != nil {
+		return nil, err
 	}
+	return entries, nil
+}
 
-	fUpdated, err := getUpdatedFloor(fId)
+// findAvailabilityHistory returns the resident level availability changes before to, oldest first.
+func findAvailabilityHistory(fId primitive.ObjectID, to time.Time) ([]HistoryEntry, error) {
+	query := bson.M{
+		"floorId":   fId,
+		"taskId":    "",
+		"action":    bson.M{"$in": bson.A{"RESIDENT_AVAILABLE", "RESIDENT_UNAVAILABLE"}},
+		"timestamp": bson.M{"$lt": to},
+	}
+	cursor, err := historyCollection.Find(context.Background(), query, options.Find().SetSort(bson.M{"timestamp": 1}))
 	if err != nil {
-		return Floor{}, err
+		return nil, err
 	}
-	return fUpdated, nil
+	entries := []HistoryEntry{}
+	if err = cursor.All(context.Background(), &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
 }
 
-func deleteVoting(fId primitive.ObjectID, votingId int) (Floor, error) {
-	_, err := collection.UpdateOne(context.Background(),
-		bson.M{"_id": fId},
-		bson.M{"$pull": bson.M{"votings": bson.M{"id": votingId}}})
-	// _, err := collection.UpdateOne(context.Background(),
-	// 	bson.M{"_id": fId},
-	// 	bson.M{"$unset": bson.M{"votings.$[elem]": nil}},
-	// 	options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"elem.id": votingId}}}))
+// migrateTaskRecurrences gives every task stored without a recurrence the default one. A floor
+// written concurrently is left for the next start.
+func migrateTaskRecurrences() {
+	cursor, err := collection.Find(context.Background(), bson.M{"tasks": bson.M{"$elemMatch": bson.M{"recurrence": bson.M{"$exists": false}}}})
 	if err != nil {
-		return Floor{}, err
+		logger.Error("migrateTaskRecurrences finding floors", slog.Any("error", err))
+		return
+	}
+	var floors []Floor
+	if err = cursor.All(context.Background(), &floors); err != nil {
+		logger.Error("migrateTaskRecurrences decoding floors", slog.Any("error", err))
+		return
+	}
+	for _, f := range floors {
+		f, migrated := migrateRecurrence(f)
+		if !migrated {
+			continue
+		}
+		if _, err := updateTasks(f); err != nil {
+			logger.Error("migrateTaskRecurrences updating tasks", slog.Any("error", err), slog.Any("floor id", f.Id))
+		}
 	}
-	fUpdated, err := getUpdatedFloor(fId)
+}
+
+// insertOutboxMessages stores msgs, messages whose key is already in the outbox are skipped.
+func insertOutboxMessages(msgs []OutboxMessage) error {
+	docs := make([]interface{}, len(msgs))
+	for i, m := range msgs {
+		docs[i] = m
+	}
+	_, err := outboxCollection.InsertMany(context.Background(), docs, options.InsertMany().SetOrdered(false))
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) && bwe.WriteConcernError == nil {
+		for _, we := range bwe.WriteErrors {
+			if !mongo.IsDuplicateKeyError(we) {
+				return err
+			}
+		}
+		return nil
+	}
+	return err
+}
+
+func removePendingOutbox(fId primitive.ObjectID, keys []string) error {
+	_, err := collection.UpdateOne(context.Background(), bson.M{"_id": fId}, bson.M{"$pull": bson.M{"pendingOutbox": bson.M{"_id": bson.M{"$in": keys}}}})
+	return err
+}
+
+func findFloorsWithPendingOutbox() ([]Floor, error) {
+	cursor, err := collection.Find(context.Background(), bson.M{"pendingOutbox.0": bson.M{"$exists": true}})
 	if err != nil {
-		return Floor{}, err
+		return nil, err
 	}
-	return fUpdated, nil
+	var floors []Floor
+	if err = cursor.All(context.Background(), &floors); err != nil {
+		return nil, err
+	}
+	return floors, nil
 }
 
-func deleteAllVotings(fId primitive.ObjectID) (Floor, error) {
-	_, err := collection.UpdateOne(context.Background(),
-		bson.M{"_id": fId},
-		bson.M{"$unset": bson.M{"votings": []Voting{}}})
+// claimOutboxMessage hands out the next due message until lockedUntil, including messages
+// whose previous claim ran out.
+func claimOutboxMessage(now time.Time, lockedUntil time.Time) (OutboxMessage, error) {
+	filter := bson.M{"$or": bson.A{
+		bson.M{"status": OutboxPending, "nextAttemptAt": bson.M{"$lte": now}},
+		bson.M{"status": OutboxSending, "lockedUntil": bson.M{"$lte": now}},
+	}}
+	update := bson.M{"$set": bson.M{"status": OutboxSending, "lockedUntil": lockedUntil}}
+	opts := options.FindOneAndUpdate().SetSort(bson.M{"nextAttemptAt": 1}).SetReturnDocument(options.After)
+	var m OutboxMessage
+	err := outboxCollection.FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&m)
+	return m, err
+}
+
+func markOutboxSent(key string, now time.Time) error {
+	_, err := outboxCollection.UpdateOne(context.Background(), bson.M{"_id": key}, bson.M{
+		"$set":   bson.M{"status": OutboxSent, "sentAt": now},
+		"$unset": bson.M{"lockedUntil": ""},
+	})
+	return err
+}
+
+// markOutboxHeld puts m back in line for until without counting an attempt.
+func markOutboxHeld(key string, until time.Time, digest bool) error {
+	_, err := outboxCollection.UpdateOne(context.Background(), bson.M{"_id": key}, bson.M{
+		"$set":   bson.M{"status": OutboxPending, "nextAttemptAt": until, "digest": digest},
+		"$unset": bson.M{"lockedUntil": ""},
+	})
+	return err
+}
+
+// markOutboxSkipped drops a message the resident muted, sentAt lets it expire like a sent one.
+func markOutboxSkipped(key string, now time.Time) error {
+	_, err := outboxCollection.UpdateOne(context.Background(), bson.M{"_id": key}, bson.M{
+		"$set":   bson.M{"status": OutboxSkipped, "sentAt": now},
+		"$unset": bson.M{"lockedUntil": ""},
+	})
+	return err
+}
+
+func markOutboxFailed(key string, status string, attempts int, nextAttemptAt time.Time, lastError string) error {
+	_, err := outboxCollection.UpdateOne(context.Background(), bson.M{"_id": key}, bson.M{
+		"$set":   bson.M{"status": status, "attempts": attempts, "nextAttemptAt": nextAttemptAt, "lastError": lastError},
+		"$unset": bson.M{"lockedUntil": ""},
+	})
+	return err
+}
+
+func findOutboxMessages(status string, limit int64) ([]OutboxMessage, error) {
+	opts := options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(limit)
+	cursor, err := outboxCollection.Find(context.Background(), bson.M{"status": status}, opts)
 	if err != nil {
-		return Floor{}, err
+		return nil, err
 	}
-	fUpdated, err := getUpdatedFloor(fId)
+	messages := []OutboxMessage{}
+	if err = cursor.All(context.Background(), &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// retryOutboxMessage puts a dead or failing message back in line with a fresh attempt budget.
+func retryOutboxMessage(key string, now time.Time) (bool, error) {
+	filter := bson.M{"_id": key, "$or": bson.A{
+		bson.M{"status": OutboxDead},
+		bson.M{"status": OutboxPending, "attempts": bson.M{"$gt": 0}},
+	}}
+	res, err := outboxCollection.UpdateOne(context.Background(), filter, bson.M{"$set": bson.M{"status": OutboxPending, "attempts": 0, "nextAttemptAt": now}})
 	if err != nil {
-		return Floor{}, err
+		return false, err
 	}
-	return fUpdated, nil
+	return res.ModifiedCount > 0, nil
 }
 
-func updateRoom(f Floor, roomIndex int) (Floor, error) {
-	result, err := collection.UpdateOne(context.Background(), bson.M{"_id": f.Id}, bson.M{"$set": bson.M{"rooms." + strconv.Itoa(roomIndex): f.Rooms[roomIndex]}})
+// migrateExpoPushTokens turns the single expoPushToken residents had before channels existed into an
+// EXPO channel. A floor written concurrently is left for the next start.
+func migrateExpoPushTokens() {
+	filter := bson.M{"rooms.resident.expoPushToken": bson.M{"$exists": true}}
+	cursor, err := collection.Find(context.Background(), filter)
 	if err != nil {
-		return Floor{}, err
+		logger.Error("migrateExpoPushTokens finding floors", slog.Any("error", err))
+		return
+	}
+	var docs []bson.Raw
+	if err = cursor.All(context.Background(), &docs); err != nil {
+		logger.Error("migrateExpoPushTokens decoding floors", slog.Any("error", err))
+		return
+	}
+	for _, doc := range docs {
+		var f Floor
+		var legacy struct {
+			Rooms []struct {
+				Resident struct {
+					ExpoPushToken string `bson:"expoPushToken"`
+				} `bson:"resident"`
+			} `bson:"rooms"`
+		}
+		if err := bson.Unmarshal(doc, &f); err != nil {
+			logger.Error("migrateExpoPushTokens decoding floor", slog.Any("error", err))
+			continue
+		}
+		if err := bson.Unmarshal(doc, &legacy); err != nil {
+			logger.Error("migrateExpoPushTokens decoding tokens", slog.Any("error", err), slog.Any("floor id", f.Id))
+			continue
+		}
+		for i, r := range legacy.Rooms {
+			if token := r.Resident.ExpoPushToken; token != "" && i < len(f.Rooms) {
+				addChannel(&f.Rooms[i].Resident, Channel{Type: ChannelExpo, Address: token, CreatedAt: time.Now()})
+			}
+		}
+		//the rooms are written without the legacy field, which drops it
+		_, err := updateFloorAtRevision(f.Id, f.Revision, bson.M{"$set": bson.M{"rooms": f.Rooms}})
+		if err != nil {
+			logger.Error("migrateExpoPushTokens updating floor", slog.Any("error", err), slog.Any("floor id", f.Id))
+		}
 	}
-	if result.ModifiedCount == 0 {
-		return f, nil
+}
+
+func insertExpoTicket(t ExpoTicket) error {
+	_, err := expoTicketCollection.InsertOne(context.Background(), t)
+	return err
+}
+
+// findExpoTickets returns the oldest tickets sent before the given time.
+func findExpoTickets(before time.Time, limit int64) ([]ExpoTicket, error) {
+	opts := options.Find().SetSort(bson.M{"createdAt": 1}).SetLimit(limit)
+	cursor, err := expoTicketCollection.Find(context.Background(), bson.M{"createdAt": bson.M{"$lte": before}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var tickets []ExpoTicket
+	if err = cursor.All(context.Background(), &tickets); err != nil {
+		return nil, err
+	}
+	return tickets, nil
+}
+
+func deleteExpoTickets(ids []string) error {
+	if len(ids) == 0 {
+		return nil
 	}
-	fUpdated, err := getUpdatedFloor(f.Id)
+	_, err := expoTicketCollection.DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+// findNotificationPreferences returns the preferences of every given user, defaults for users
+// that never set any.
+func findNotificationPreferences(userIds []string) (map[string]NotificationPreferences, error) {
+	cursor, err := preferencesCollection.Find(context.Background(), bson.M{"_id": bson.M{"$in": userIds}})
 	if err != nil {
-		return Floor{}, err
+		return nil, err
 	}
-	return fUpdated, nil
+	var stored []NotificationPreferences
+	if err = cursor.All(context.Background(), &stored); err != nil {
+		return nil, err
+	}
+	prefs := make(map[string]NotificationPreferences, len(userIds))
+	for _, id := range userIds {
+		prefs[id] = defaultNotificationPreferences(id)
+	}
+	for _, p := range stored {
+		prefs[p.UserId] = p
+	}
+	return prefs, nil
+}
+
+func upsertNotificationPreferences(p NotificationPreferences) error {
+	_, err := preferencesCollection.ReplaceOne(context.Background(), bson.M{"_id": p.UserId}, p, options.Replace().SetUpsert(true))
+	return err
 }
 
-func updateExpoPushToken(f Floor, roomIndex int) (Floor, error) {
-	result, err := collection.UpdateOne(context.Background(), bson.M{"_id": f.Id}, bson.M{"$set": bson.M{"rooms." + strconv.Itoa(roomIndex): f.Rooms[roomIndex]}})
+func insertFloorChange(c FloorChange) error {
+	_, err := floorChangeCollection.InsertOne(context.Background(), c)
+	return err
+}
+
+// findFloorChanges returns the changes of the floor after revision since up to revision upTo, oldest first.
+func findFloorChanges(fId primitive.ObjectID, since int64, upTo int64) ([]FloorChange, error) {
+	cursor, err := floorChangeCollection.Find(context.Background(),
+		bson.M{"floorId": fId, "revision": bson.M{"$gt": since, "$lte": upTo}},
+		options.Find().SetSort(bson.M{"revision": 1}))
 	if err != nil {
-		return Floor{}, fmt.Errorf("error updating expo push token in DB %w", err)
+		return nil, err
+	}
+	changes := []FloorChange{}
+	if err = cursor.All(context.Background(), &changes); err != nil {
+		return nil, err
 	}
-	if result.ModifiedCount == 0 {
-		return Floor{}, fmt.Errorf("error updating expo push token in DB, no documents modified")
+	return changes, nil
+}
+
+// findFloorChangesAt returns the changes of the given floor revisions keyed by floor id and revision.
+func findFloorChangesAt(revisions map[primitive.ObjectID][]int64) (map[string]FloorChange, error) {
+	var or bson.A
+	for fId, revs := range revisions {
+		or = append(or, bson.M{"floorId": fId, "revision": bson.M{"$in": revs}})
+	}
+	changes := map[string]FloorChange{}
+	if len(or) == 0 {
+		return changes, nil
 	}
-	fUpdated, err := getUpdatedFloor(f.Id)
+	cursor, err := floorChangeCollection.Find(context.Background(), bson.M{"$or": or})
 	if err != nil {
-		return Floor{}, fmt.Errorf("error getting updated floor from DB %w", err)
+		return nil, err
 	}
-	return fUpdated, nil
+	var found []FloorChange
+	if err = cursor.All(context.Background(), &found); err != nil {
+		return nil, err
+	}
+	for _, c := range found {
+		changes[floorRevisionKey(c.FloorId, c.Revision)] = c
+	}
+	return changes, nil
 }
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// events kept per floor for clients reconnecting with Last-Event-ID
+var eventReplaySize = getEnvInt("EVENT_REPLAY_SIZE", 100)
+
+// interval of the comment lines that keep idle streams open through proxies
+var eventHeartbeat = 25 * time.Second
+
+// events buffered per client, a client that falls further behind is dropped and reconnects
+const eventClientBuffer = 64
+
+// floorEventFields maps the floor fields a write can touch to their name in the Floor JSON.
+var floorEventFields = map[string]string{
+	"tasks":          "Tasks",
+	"rooms":          "Rooms",
+	"votings":        "Votings",
+	"residents":      "Residents",
+	"timezone":       "Timezone",
+	"reminderPolicy": "ReminderPolicy",
+	"rotation":       "Rotation",
+	"quorumPolicies": "QuorumPolicies",
+	"swaps":          "Swaps",
+	"absences":       "Absences",
+}
+
+// FloorEvent is one floor write as sent to stream clients. Id is the floor revision after the
+// write, Data is JSON with the revision, the JSON Patch of the write and the current value of
+// every field the write touched.
+type FloorEvent struct {
+	Id   int64
+	Type string
+	Data []byte
+}
+
+// EventBroker fans floor events out to the clients streaming the floor and keeps the latest
+// events of every floor for replay. It lives in memory, clients of another instance only see
+// the changes on reconnect.
+type EventBroker struct {
+	mu      sync.Mutex
+	clients map[primitive.ObjectID]map[chan FloorEvent]struct{}
+	recent  map[primitive.ObjectID][]FloorEvent
+}
+
+func newEventBroker() *EventBroker {
+	return &EventBroker{
+		clients: map[primitive.ObjectID]map[chan FloorEvent]struct{}{},
+		recent:  map[primitive.ObjectID][]FloorEvent{},
+	}
+}
+
+var floorEvents = newEventBroker()
+
+// publish sends ev to every client of fId. Clients with a full buffer are dropped.
+func (b *EventBroker) publish(fId primitive.ObjectID, ev FloorEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	recent := append(b.recent[fId], ev)
+	//writes finish in any order, keep the replay sorted by revision
+	sort.SliceStable(recent, func(i, j int) bool { return recent[i].Id < recent[j].Id })
+	if len(recent) > eventReplaySize {
+		recent = recent[len(recent)-eventReplaySize:]
+	}
+	b.recent[fId] = recent
+	for ch := range b.clients[fId] {
+		select {
+		case ch <- ev:
+		default:
+			delete(b.clients[fId], ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe registers a client of fId and returns the kept events after lastId. replayed is
+// false if events after lastId are no longer kept and the client needs a snapshot instead.
+func (b *EventBroker) subscribe(fId primitive.ObjectID, lastId int64) (ch chan FloorEvent, missed []FloorEvent, replayed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch = make(chan FloorEvent, eventClientBuffer)
+	if b.clients[fId] == nil {
+		b.clients[fId] = map[chan FloorEvent]struct{}{}
+	}
+	b.clients[fId][ch] = struct{}{}
+	recent := b.recent[fId]
+	if len(recent) == 0 || recent[0].Id > lastId+1 {
+		return ch, nil, false
+	}
+	for _, ev := range recent {
+		if ev.Id > lastId {
+			missed = append(missed, ev)
+		}
+	}
+	return ch, missed, true
+}
+
+func (b *EventBroker) unsubscribe(fId primitive.ObjectID, ch chan FloorEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.clients[fId][ch]; !ok {
+		return
+	}
+	delete(b.clients[fId], ch)
+	if len(b.clients[fId]) == 0 {
+		delete(b.clients, fId)
+	}
+	close(ch)
+}
+
+// changedFields returns the floor fields an update document writes.
+func changedFields(update bson.M) []string {
+	var fields []string
+	for _, op := range update {
+		set, ok := op.(bson.M)
+		if !ok {
+			continue
+		}
+		for path := range set {
+			field, _, _ := strings.Cut(path, ".")
+			if _, ok := floorEventFields[field]; ok && !slices.Contains(fields, field) {
+				fields = append(fields, field)
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// changeEvent is the event for a write of fields with patch that left the floor at f.
+func changeEvent(f Floor, fields []string, patch []PatchOp) (FloorEvent, error) {
+	values := map[string]any{
+		"Tasks":          f.Tasks,
+		"Rooms":          f.Rooms,
+		"Votings":        f.Votings,
+		"Residents":      f.Residents,
+		"Timezone":       f.Timezone,
+		"ReminderPolicy": f.ReminderPolicy,
+		"Rotation":       f.Rotation,
+		"QuorumPolicies": f.QuorumPolicies,
+		"Swaps":          f.Swaps,
+		"Absences":       f.Absences,
+	}
+	change := map[string]any{"Revision": f.Revision, "Patch": patch}
+	for _, field := range fields {
+		name := floorEventFields[field]
+		change[name] = values[name]
+	}
+	data, err := json.Marshal(change)
+	if err != nil {
+		return FloorEvent{}, err
+	}
+	return FloorEvent{Id: f.Revision, Type: "change", Data: data}, nil
+}
+
+// publishFloorChange announces a successful write of update to the floor's stream clients. patch
+// is nil if the write's patch is unknown.
+func publishFloorChange(f Floor, update bson.M, patch []PatchOp) {
+	fields := changedFields(update)
+	if len(fields) == 0 {
+		return
+	}
+	ev, err := changeEvent(f, fields, patch)
+	if err != nil {
+		logger.Error("publishFloorChange marshalling event", slog.Any("error", err), slog.Any("floor id", f.Id))
+		return
+	}
+	floorEvents.publish(f.Id, ev)
+}
+
+func writeEvent(w http.ResponseWriter, ev FloorEvent) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Id, ev.Type, ev.Data)
+	if err != nil {
+		return err
+	}
+	return http.NewResponseController(w).Flush()
+}
+
+// HandleFloorEvents streams the changes of the caller's floor as Server-Sent Events. The event id
+// is the floor revision: a client reconnecting with Last-Event-ID gets the changes it missed, or
+// a snapshot of the whole floor if they are no longer kept. New clients start with a snapshot.
+func HandleFloorEvents(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerFloorFromPath(w, r)
+	if !ok {
+		return
+	}
+	fId, err := primitive.ObjectIDFromHex(identity.FloorId)
+	if err != nil {
+		writeError(w, r, "error.invalidFloorId", http.StatusBadRequest)
+		return
+	}
+	lastId := int64(-1)
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		if lastId, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeError(w, r, "error.invalidLastEventId", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ch, missed, replayed := floorEvents.subscribe(fId, lastId)
+	defer floorEvents.unsubscribe(fId, ch)
+	var snapshot FloorEvent
+	if !replayed {
+		floor, err := FindFloor(identity.FloorId)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				writeError(w, r, "error.floorNotFound", http.StatusNotFound)
+				return
+			}
+			writeError(w, r, "error.getFloor", http.StatusInternalServerError, "Error", err.Error())
+			return
+		}
+		data, err := json.Marshal(floor)
+		if err != nil {
+			logger.Error("floorEvents marshalling snapshot", slog.Any("error", err), slog.Any("floor id", fId))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		snapshot = FloorEvent{Id: floor.Revision, Type: "snapshot", Data: data}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	//a client that already is at the floor's revision needs no snapshot
+	if !replayed && snapshot.Id != lastId {
+		missed = []FloorEvent{snapshot}
+	}
+	for _, ev := range missed {
+		if err := writeEvent(w, ev); err != nil {
+			return
+		}
+	}
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, open := <-ch:
+			if !open {
+				//too slow, the client reconnects with Last-Event-ID
+				return
+			}
+			//already part of the snapshot
+			if ev.Id <= snapshot.Id {
+				continue
+			}
+			if err := writeEvent(w, ev); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			if err := http.NewResponseController(w).Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
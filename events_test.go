@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func Test_changedFields(t *testing.T) {
+	update := bson.M{
+		"$set":  bson.M{"rooms.3": Room{}, "votings.$[elem]": Voting{}},
+		"$push": bson.M{"pendingOutbox": bson.M{}, "tasks": Task{}},
+		"$inc":  bson.M{"revision": 1},
+	}
+	if got := changedFields(update); !slices.Equal(got, []string{"rooms", "tasks", "votings"}) {
+		t.Errorf("wrong fields: %v", got)
+	}
+	if got := changedFields(bson.M{"$pull": bson.M{"pendingOutbox": bson.M{}}}); len(got) != 0 {
+		t.Errorf("expected outbox only write to change nothing, got %v", got)
+	}
+}
+
+func Test_EventBroker(t *testing.T) {
+	b := newEventBroker()
+	fId := primitive.NewObjectID()
+	for _, id := range []int64{3, 2, 4} {
+		b.publish(fId, FloorEvent{Id: id, Type: "change"})
+	}
+
+	t.Run("should replay kept events after last id in order", func(t *testing.T) {
+		ch, missed, replayed := b.subscribe(fId, 2)
+		defer b.unsubscribe(fId, ch)
+		if !replayed || len(missed) != 2 || missed[0].Id != 3 || missed[1].Id != 4 {
+			t.Errorf("wrong replay: %v %+v", replayed, missed)
+		}
+	})
+
+	t.Run("should ask for snapshot if events are no longer kept", func(t *testing.T) {
+		ch, _, replayed := b.subscribe(fId, 0)
+		defer b.unsubscribe(fId, ch)
+		if replayed {
+			t.Errorf("expected snapshot to be needed")
+		}
+	})
+
+	t.Run("should drop client that falls behind", func(t *testing.T) {
+		ch, _, _ := b.subscribe(fId, 4)
+		for i := 0; i <= eventClientBuffer; i++ {
+			b.publish(fId, FloorEvent{Id: int64(5 + i)})
+		}
+		n := 0
+		for range ch {
+			n++
+		}
+		if n != eventClientBuffer {
+			t.Errorf("expected %v buffered events before drop, got %v", eventClientBuffer, n)
+		}
+		b.unsubscribe(fId, ch)
+	})
+}
+
+// readEvents reads events of an event stream until it has n of them.
+func readEvents(t *testing.T, sc *bufio.Scanner, n int) []FloorEvent {
+	var events []FloorEvent
+	var ev FloorEvent
+	for len(events) < n && sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			if ev.Type != "" {
+				events = append(events, ev)
+			}
+			ev = FloorEvent{}
+		case strings.HasPrefix(line, "id: "):
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "id: ")), &ev.Id)
+		case strings.HasPrefix(line, "event: "):
+			ev.Type = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.Data = []byte(strings.TrimPrefix(line, "data: "))
+		}
+	}
+	if len(events) < n {
+		t.Fatalf("stream ended after %v events: %v", len(events), sc.Err())
+	}
+	return events
+}
+
+func Test_HandleFloorEvents(t *testing.T) {
+	fId := primitive.NewObjectID()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /floor/{id}/events", HandleFloorEvents)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, asResident(r, "1", fId.Hex()))
+	}))
+	defer server.Close()
+	for id := int64(1); id <= 3; id++ {
+		floorEvents.publish(fId, FloorEvent{Id: id, Type: "change", Data: []byte(`{}`)})
+	}
+
+	t.Run("should deny other floors", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/floor/" + floorId + "/events")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusForbidden)
+		}
+	})
+
+	t.Run("should reject invalid Last-Event-ID", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", server.URL+"/floor/"+fId.Hex()+"/events", nil)
+		req.Header.Set("Last-Event-ID", "abc")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("should replay missed events and stream new ones", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/floor/"+fId.Hex()+"/events", nil)
+		req.Header.Set("Last-Event-ID", "1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("wrong content type %v", ct)
+		}
+		sc := bufio.NewScanner(resp.Body)
+		if events := readEvents(t, sc, 2); events[0].Id != 2 || events[1].Id != 3 {
+			t.Errorf("wrong replay: %+v", events)
+		}
+		floorEvents.publish(fId, FloorEvent{Id: 4, Type: "change", Data: []byte(`{"Revision":4}`)})
+		if events := readEvents(t, sc, 1); events[0].Id != 4 || string(events[0].Data) != `{"Revision":4}` {
+			t.Errorf("wrong live event: %+v", events)
+		}
+	})
+}
+
+func Test_floorChangeEvents(t *testing.T) {
+	f, err := insertTestFloor(FloorStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, _, _ := floorEvents.subscribe(f.Id, f.Revision)
+	defer floorEvents.unsubscribe(f.Id, ch)
+
+	f.Tasks[0].Name = "Bad putzen"
+	fUp, err := updateTasks(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-ch:
+		var change map[string]json.RawMessage
+		if err := json.Unmarshal(ev.Data, &change); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Id != fUp.Revision || ev.Type != "change" || change["Tasks"] == nil || change["Rooms"] != nil {
+			t.Errorf("wrong event: %v %s", ev.Id, ev.Data)
+		}
+		if !strings.Contains(string(change["Tasks"]), "Bad putzen") {
+			t.Errorf("event misses the changed task: %s", change["Tasks"])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event published")
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	expo "github.com/oliveroneill/exponent-server-sdk-golang/sdk"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Expo keeps receipts for a day and recommends fetching them not before 15 minutes after sending
+var expoReceiptDelay = 15 * time.Minute
+var expoReceiptExpiry = 24 * time.Hour
+
+const expoMaxReceiptIds = 1000
+
+// Expo takes at most 100 messages per request and asks for no more than 6 concurrent requests
+const expoMaxBatch = 100
+
+var expoMaxConcurrentRequests = 6
+
+// Expo rejects notifications whose payload is larger than 4 KB
+const expoMaxPayload = 4096
+
+// ExpoTicket remembers a message Expo accepted so its receipt can be checked later.
+type ExpoTicket struct {
+	Id        string             `bson:"_id"`
+	FloorId   primitive.ObjectID `bson:"floorId"`
+	Token     string             `bson:"token"`
+	CreatedAt time.Time          `bson:"createdAt"`
+}
+
+type ExpoNotifier struct {
+	client      *expo.PushClient
+	httpClient  *http.Client
+	receiptsURL string
+	accessToken string
+	saveTicket  func(ExpoTicket) error
+}
+
+// newExpoNotifier talks to the Expo push API at baseURL, the access token is only needed if
+// enhanced push security is enabled for the project.
+func newExpoNotifier(baseURL string, accessToken string) *ExpoNotifier {
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	return &ExpoNotifier{
+		client:      expo.NewPushClient(&expo.ClientConfig{Host: baseURL, AccessToken: accessToken, HTTPClient: httpClient}),
+		httpClient:  httpClient,
+		receiptsURL: baseURL + expo.DefaultBaseAPIURL + "/push/getReceipts",
+		accessToken: accessToken,
+		saveTicket:  insertExpoTicket,
+	}
+}
+
+func (e *ExpoNotifier) Send(ch Channel, n Notification) error {
+	return e.SendBatch([]Delivery{{Channel: ch, Notification: n}})[0]
+}
+
+// SendBatch publishes the deliveries in chunks of expoMaxBatch, at most expoMaxConcurrentRequests
+// chunks at a time.
+func (e *ExpoNotifier) SendBatch(ds []Delivery) []error {
+	errs := make([]error, len(ds))
+	var messages []expo.PushMessage
+	var idx []int
+	for i, d := range ds {
+		pushMessage, err := expoPushMessage(d)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		messages = append(messages, pushMessage)
+		idx = append(idx, i)
+	}
+	sem := make(chan struct{}, expoMaxConcurrentRequests)
+	var wg sync.WaitGroup
+	for start := 0; start < len(messages); start += expoMaxBatch {
+		end := min(start+expoMaxBatch, len(messages))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			responses, err := e.client.PublishMultiple(messages[start:end])
+			for j := start; j < end; j++ {
+				if err != nil {
+					errs[idx[j]] = fmt.Errorf("error publishing expo notification push messages: %w", err)
+					continue
+				}
+				errs[idx[j]] = e.checkTicket(responses[j-start], ds[idx[j]])
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+func expoPushMessage(d Delivery) (expo.PushMessage, error) {
+	pushToken, err := expo.NewExponentPushToken(d.Channel.Address)
+	if err != nil {
+		return expo.PushMessage{}, fmt.Errorf("error creating push token from %s: %w", d.Channel.Address, err)
+	}
+
+	var m map[string]string = make(map[string]string)
+
+	m["FloorId"] = d.Notification.FloorId
+	m["Type"] = d.Notification.Type
+	if d.Notification.Revision > 0 {
+		m["Revision"] = strconv.FormatInt(d.Notification.Revision, 10)
+	}
+	//TODO reanme to payload
+	m["Patch"] = string(d.Notification.Payload)
+
+	msg := expo.PushMessage{
+		To:       []expo.ExponentPushToken{pushToken},
+		Body:     d.Notification.Body,
+		Data:     m,
+		Sound:    "default",
+		Title:    d.Notification.Title,
+		Priority: expo.DefaultPriority,
+	}
+	//a patch too large to push is left out, the client catches up to Revision through /changes
+	if b, err := json.Marshal(msg); err == nil && len(b) > expoMaxPayload {
+		delete(m, "Patch")
+	}
+	return msg, nil
+}
+
+// checkTicket turns the ticket Expo returned for d into its delivery result and remembers accepted
+// tickets for the receipt check.
+func (e *ExpoNotifier) checkTicket(response expo.PushResponse, d Delivery) error {
+	if err := response.ValidateResponse(); err != nil {
+		var notRegistered *expo.DeviceNotRegisteredError
+		if errors.As(err, &notRegistered) {
+			return fmt.Errorf("%w: expo token %s", ErrChannelGone, d.Channel.Address)
+		}
+		return fmt.Errorf("error invalid response when sending notification reponse: %v", response)
+	}
+	if response.ID != "" {
+		fId, _ := primitive.ObjectIDFromHex(d.Notification.FloorId)
+		ticket := ExpoTicket{Id: response.ID, FloorId: fId, Token: d.Channel.Address, CreatedAt: time.Now()}
+		if err := e.saveTicket(ticket); err != nil {
+			logger.Error("expoNotifier saving ticket", slog.Any("error", err), slog.String("ticket", response.ID))
+		}
+	}
+	return nil
+}
+
+// fetchReceipts asks Expo for the receipts of the given tickets. Tickets without a receipt yet are
+// missing from the result.
+func (e *ExpoNotifier) fetchReceipts(ids []string) (map[string]expo.PushResponse, error) {
+	body, err := json.Marshal(map[string][]string{"ids": ids})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", e.receiptsURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+e.accessToken)
+	}
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching expo receipts: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("fetching expo receipts: expo answered %d", resp.StatusCode)
+	}
+	var receipts struct {
+		Data   map[string]expo.PushResponse `json:"data"`
+		Errors []map[string]string          `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&receipts); err != nil {
+		return nil, fmt.Errorf("decoding expo receipts: %w", err)
+	}
+	if receipts.Errors != nil {
+		return nil, fmt.Errorf("fetching expo receipts: %v", receipts.Errors)
+	}
+	return receipts.Data, nil
+}
+
+// ExpoReceiptChecker fetches the receipts of sent Expo messages and prunes tokens of devices
+// that are no longer registered.
+type ExpoReceiptChecker struct {
+	clock    Clock
+	interval time.Duration
+	expo     *ExpoNotifier
+}
+
+func newExpoReceiptChecker(clock Clock, interval time.Duration, e *ExpoNotifier) *ExpoReceiptChecker {
+	return &ExpoReceiptChecker{clock: clock, interval: interval, expo: e}
+}
+
+func (c *ExpoReceiptChecker) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			if _, err := c.runOnce(); err != nil {
+				logger.Error("expoReceiptChecker run", slog.Any("error", err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// runOnce checks the receipts of tickets old enough to have one and returns the number of pruned
+// tokens. Tickets without a receipt are kept until Expo would have dropped the receipt anyway.
+func (c *ExpoReceiptChecker) runOnce() (int, error) {
+	now := c.clock.Now()
+	tickets, err := findExpoTickets(now.Add(-expoReceiptDelay), expoMaxReceiptIds)
+	if err != nil {
+		return 0, fmt.Errorf("expoReceiptChecker finding tickets: %w", err)
+	}
+	if len(tickets) == 0 {
+		return 0, nil
+	}
+	ids := make([]string, len(tickets))
+	for i, t := range tickets {
+		ids[i] = t.Id
+	}
+	receipts, err := c.expo.fetchReceipts(ids)
+	if err != nil {
+		return 0, err
+	}
+	var done []string
+	pruned := 0
+	for _, t := range tickets {
+		receipt, ok := receipts[t.Id]
+		if !ok {
+			if now.Sub(t.CreatedAt) > expoReceiptExpiry {
+				done = append(done, t.Id)
+			}
+			continue
+		}
+		var notRegistered *expo.DeviceNotRegisteredError
+		if err := receipt.ValidateResponse(); errors.As(err, &notRegistered) {
+			if err := pruneChannel(t.FloorId, ChannelExpo, t.Token); err != nil {
+				logger.Error("expoReceiptChecker pruning token", slog.Any("error", err), slog.Any("floor id", t.FloorId))
+				continue
+			}
+			pruned++
+		} else if err != nil {
+			logger.Error("expoReceiptChecker receipt", slog.Any("error", err), slog.String("ticket", t.Id), slog.Any("details", receipt.Details))
+		}
+		done = append(done, t.Id)
+	}
+	if err := deleteExpoTickets(done); err != nil {
+		return pruned, fmt.Errorf("expoReceiptChecker deleting tickets: %w", err)
+	}
+	return pruned, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	expo "github.com/oliveroneill/exponent-server-sdk-golang/sdk"
+)
+
+// fakeExpo answers push requests with its tickets, or an ok ticket per message if none are set,
+// and receipts from its receipts map.
+type fakeExpo struct {
+	mu       sync.Mutex
+	tickets  []map[string]any
+	receipts map[string]map[string]any
+	auth     string
+	batches  []int
+}
+
+func (f *fakeExpo) server() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+expo.DefaultBaseAPIURL+"/push/send", func(w http.ResponseWriter, r *http.Request) {
+		var messages []expo.PushMessage
+		json.NewDecoder(r.Body).Decode(&messages)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.auth = r.Header.Get("Authorization")
+		f.batches = append(f.batches, len(messages))
+		tickets := f.tickets
+		if tickets == nil {
+			for i := range messages {
+				tickets = append(tickets, map[string]any{"status": "ok", "id": fmt.Sprintf("%s-%d", messages[i].To[0], i)})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": tickets})
+	})
+	mux.HandleFunc("POST "+expo.DefaultBaseAPIURL+"/push/getReceipts", func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Ids []string }
+		json.NewDecoder(r.Body).Decode(&req)
+		data := map[string]any{}
+		for _, id := range req.Ids {
+			if receipt, ok := f.receipts[id]; ok {
+				data[id] = receipt
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": data})
+	})
+	return httptest.NewServer(mux)
+}
+
+var deviceNotRegistered = map[string]any{"status": "error", "message": "not registered", "details": map[string]any{"error": "DeviceNotRegistered"}}
+
+func Test_ExpoNotifier(t *testing.T) {
+	fake := &fakeExpo{}
+	server := fake.server()
+	defer server.Close()
+	e := newExpoNotifier(server.URL, "secret")
+	var saved []ExpoTicket
+	e.saveTicket = func(ticket ExpoTicket) error {
+		saved = append(saved, ticket)
+		return nil
+	}
+	ch := Channel{Type: ChannelExpo, Address: "ExponentPushToken[a]"}
+
+	t.Run("should remember ticket of accepted message", func(t *testing.T) {
+		fake.tickets = []map[string]any{{"status": "ok", "id": "ticket-1"}}
+		if err := e.Send(ch, Notification{FloorId: floorId, Title: "title"}); err != nil {
+			t.Fatal(err)
+		}
+		if len(saved) != 1 || saved[0].Id != "ticket-1" || saved[0].Token != ch.Address || saved[0].FloorId.Hex() != floorId {
+			t.Errorf("wrong tickets saved: %+v", saved)
+		}
+		if fake.auth != "Bearer secret" {
+			t.Errorf("access token not sent: %v", fake.auth)
+		}
+	})
+
+	t.Run("should report unregistered device", func(t *testing.T) {
+		fake.tickets = []map[string]any{deviceNotRegistered}
+		if err := e.Send(ch, Notification{FloorId: floorId}); !errors.Is(err, ErrChannelGone) {
+			t.Errorf("expected ErrChannelGone, got %v", err)
+		}
+	})
+
+	t.Run("should send in batches of 100", func(t *testing.T) {
+		fake.tickets = nil
+		fake.batches = nil
+		e.saveTicket = func(ExpoTicket) error { return nil }
+		var ds []Delivery
+		for i := 0; i < 250; i++ {
+			ds = append(ds, Delivery{Channel: Channel{Type: ChannelExpo, Address: fmt.Sprintf("ExponentPushToken[%d]", i)}})
+		}
+		ds = append(ds, Delivery{Channel: Channel{Type: ChannelExpo, Address: "not a token"}})
+		errs := e.SendBatch(ds)
+		for i, err := range errs[:250] {
+			if err != nil {
+				t.Errorf("delivery %v failed: %v", i, err)
+			}
+		}
+		if errs[250] == nil {
+			t.Errorf("expected invalid token to fail on its own")
+		}
+		slices.Sort(fake.batches)
+		if !slices.Equal(fake.batches, []int{50, 100, 100}) {
+			t.Errorf("wrong batch sizes: %v", fake.batches)
+		}
+	})
+
+	t.Run("should return available receipts", func(t *testing.T) {
+		fake.receipts = map[string]map[string]any{"ticket-1": {"status": "ok"}, "ticket-2": deviceNotRegistered}
+		receipts, err := e.fetchReceipts([]string{"ticket-1", "ticket-2", "ticket-3"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(receipts) != 2 || receipts["ticket-1"].Status != "ok" || receipts["ticket-2"].Details["error"] != "DeviceNotRegistered" {
+			t.Errorf("wrong receipts: %+v", receipts)
+		}
+	})
+}
+
+func Test_expoPushMessage(t *testing.T) {
+	ch := Channel{Type: ChannelExpo, Address: "ExponentPushToken[a]"}
+	small := []byte(`[{"op":"replace","path":"/tasks/0/assignedTo","value":1}]`)
+	large := []byte(`[{"op":"replace","path":"/tasks","value":"` + strings.Repeat("x", 5000) + `"}]`)
+
+	m, err := expoPushMessage(Delivery{Channel: ch, Notification: Notification{FloorId: floorId, Revision: 7, Payload: small}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Data["Patch"] != string(small) || m.Data["Revision"] != "7" {
+		t.Errorf("small patch not pushed: %v", m.Data)
+	}
+
+	m, err = expoPushMessage(Delivery{Channel: ch, Notification: Notification{FloorId: floorId, Revision: 8, Payload: large}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Data["Patch"]; ok || m.Data["Revision"] != "8" {
+		t.Errorf("expected large patch to be left out and revision kept: %v", m.Data["Revision"])
+	}
+	if b, _ := json.Marshal(m); len(b) > expoMaxPayload {
+		t.Errorf("push payload of %v bytes exceeds the limit", len(b))
+	}
+}
+
+func Test_expoReceiptChecker(t *testing.T) {
+	f, err := insertTestFloor(FloorStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := f.Rooms[2].Resident.Channels[0].Address
+	alive := f.Rooms[3].Resident.Channels[0].Address
+	fake := &fakeExpo{receipts: map[string]map[string]any{"dead": deviceNotRegistered, "alive": {"status": "ok"}}}
+	server := fake.server()
+	defer server.Close()
+
+	now := time.Now()
+	sentAt := now.Add(-expoReceiptDelay - time.Minute)
+	for _, ticket := range []ExpoTicket{
+		{Id: "dead", FloorId: f.Id, Token: dead, CreatedAt: sentAt},
+		{Id: "alive", FloorId: f.Id, Token: alive, CreatedAt: sentAt},
+		{Id: "pending", FloorId: f.Id, Token: alive, CreatedAt: sentAt},
+		{Id: "recent", FloorId: f.Id, Token: alive, CreatedAt: now},
+	} {
+		if err := insertExpoTicket(ticket); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer deleteExpoTickets([]string{"dead", "alive", "pending", "recent"})
+
+	pruned, err := newExpoReceiptChecker(fakeClock{now}, time.Minute, newExpoNotifier(server.URL, "")).runOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 1 {
+		t.Errorf("expected one pruned token, got %v", pruned)
+	}
+	fUp, err := getUpdatedFloor(f.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range fUp.Rooms {
+		for _, ch := range r.Resident.Channels {
+			if ch.Address == dead {
+				t.Errorf("dead token still registered for room %v", r.Id)
+			}
+		}
+	}
+	if len(fUp.Rooms[3].Resident.Channels) != 1 {
+		t.Errorf("alive token was pruned: %+v", fUp.Rooms[3].Resident.Channels)
+	}
+	left, err := findExpoTickets(now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, ticket := range left {
+		ids = append(ids, ticket.Id)
+	}
+	if len(ids) != 2 || ids[0] != "pending" && ids[1] != "pending" {
+		t.Errorf("expected pending and recent ticket to be kept, got %v", ids)
+	}
+}
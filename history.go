@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// HistoryEntry is an immutable record of a task transition or reminder, entries are only ever inserted.
+type HistoryEntry struct {
+	Id             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	FloorId        primitive.ObjectID `bson:"floorId" json:"floorId"`
+	TaskId         string             `bson:"taskId" json:"taskId"`
+	TaskName       string             `bson:"taskName" json:"taskName"`
+	Action         string             `bson:"action" json:"action"`
+	FromRoom       int                `bson:"fromRoom" json:"fromRoom"`
+	ToRoom         int                `bson:"toRoom" json:"toRoom"`
+	FromResident   string             `bson:"fromResident,omitempty" json:"fromResident,omitempty"`
+	ToResident     string             `bson:"toResident,omitempty" json:"toResident,omitempty"`
+	ActorId        string             `bson:"actorId" json:"actorId"`
+	Reminders      int                `bson:"reminders" json:"reminders"`
+	AssignmentDate time.Time          `bson:"assignmentDate" json:"assignmentDate"`
+	Timestamp      time.Time          `bson:"timestamp" json:"timestamp"`
+}
+
+type HistoryFilter struct {
+	TaskId     string
+	ResidentId string
+	Action     string
+	From       time.Time
+	To         time.Time
+	Cursor     primitive.ObjectID
+	Limit      int64
+}
+
+type HistoryResponse struct {
+	Entries    []HistoryEntry `json:"entries"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+const defaultHistoryLimit = 50
+const maxHistoryLimit = 200
+
+// newHistoryEntry describes the move of task from its state before to after on floor f.
+func newHistoryEntry(f Floor, before Task, after Task, action string, actorId string, now time.Time) HistoryEntry {
+	return HistoryEntry{
+		FloorId:        f.Id,
+		TaskId:         before.Id,
+		TaskName:       before.Name,
+		Action:         action,
+		FromRoom:       before.AssignedTo,
+		ToRoom:         after.AssignedTo,
+		FromResident:   residentOfRoom(f.Rooms, before.AssignedTo),
+		ToResident:     residentOfRoom(f.Rooms, after.AssignedTo),
+		ActorId:        actorId,
+		Reminders:      before.Reminders,
+		AssignmentDate: before.AssignmentDate,
+		Timestamp:      now,
+	}
+}
+
+func residentOfRoom(rooms []Room, roomId int) string {
+	for _, r := range rooms {
+		if r.Id == roomId {
+			return r.Resident.Id
+		}
+	}
+	return ""
+}
+
+// recordHistory stores entries after the floor write went through. The state change is already
+// committed at that point, so a failure is logged and not reported to the caller.
+func recordHistory(entries []HistoryEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	if err := insertHistoryEntries(entries); err != nil {
+		logger.Error("recordHistory inserting entries", slog.Any("error", err), slog.Any("entries", entries))
+	}
+}
+
+func HandleGetHistory(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerFloorFromPath(w, r)
+	if !ok {
+		return
+	}
+	fId, _ := primitive.ObjectIDFromHex(identity.FloorId)
+	filter, err := parseHistoryFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := findHistoryEntries(fId, filter)
+	if err != nil {
+		logger.Error("getHistory findHistoryEntries", slog.Any("error", err), slog.Any("floor id", fId), slog.Any("filter", filter))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := HistoryResponse{Entries: entries}
+	if int64(len(entries)) == filter.Limit {
+		resp.NextCursor = entries[len(entries)-1].Id.Hex()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func parseHistoryFilter(r *http.Request) (HistoryFilter, error) {
+	q := r.URL.Query()
+	filter := HistoryFilter{
+		TaskId:     q.Get("task"),
+		ResidentId: q.Get("resident"),
+		Action:     q.Get("action"),
+		Limit:      defaultHistoryLimit,
+	}
+	var err error
+	if v := q.Get("from"); v != "" {
+		if filter.From, err = time.Parse(time.RFC3339, v); err != nil {
+			return HistoryFilter{}, errBadQueryParam("from", err)
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if filter.To, err = time.Parse(time.RFC3339, v); err != nil {
+			return HistoryFilter{}, errBadQueryParam("to", err)
+		}
+	}
+	if v := q.Get("cursor"); v != "" {
+		if filter.Cursor, err = primitive.ObjectIDFromHex(v); err != nil {
+			return HistoryFilter{}, errBadQueryParam("cursor", err)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || limit <= 0 {
+			return HistoryFilter{}, errBadQueryParam("limit", err)
+		}
+		filter.Limit = min(limit, maxHistoryLimit)
+	}
+	return filter, nil
+}
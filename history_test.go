@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_parseHistoryFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    HistoryFilter
+		wantErr bool
+	}{
+		{name: "should default limit", query: "", want: HistoryFilter{Limit: defaultHistoryLimit}},
+		{name: "should read filters", query: "?task=0&resident=2&action=DONE&limit=10", want: HistoryFilter{TaskId: "0", ResidentId: "2", Action: "DONE", Limit: 10}},
+		{name: "should cap limit", query: "?limit=100000", want: HistoryFilter{Limit: maxHistoryLimit}},
+		{name: "should reject negative limit", query: "?limit=-1", wantErr: true},
+		{name: "should reject bad time", query: "?from=yesterday", wantErr: true},
+		{name: "should reject bad cursor", query: "?cursor=abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/floor/"+floorId+"/history"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseHistoryFilter(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("wrong filter: got %v want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("should parse time range", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "/floor/"+floorId+"/history?from=2024-01-01T00:00:00Z&to=2024-02-01T00:00:00Z", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parseHistoryFilter(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.From.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) || !got.To.Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("wrong range: got %v - %v", got.From, got.To)
+		}
+	})
+}
+
+func Test_history(t *testing.T) {
+	f, err := insertTestFloor(FloorStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /floor/{id}/history", HandleGetHistory)
+
+	getHistory := func(t *testing.T, query string) HistoryResponse {
+		req, err := http.NewRequest("GET", "/floor/"+f.Id.Hex()+"/history"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(req, "1", f.Id.Hex()))
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		var resp HistoryResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp
+	}
+
+	t.Run("should record done task", func(t *testing.T) {
+		tuStub := TaskUpdateRequest{
+			FloorId: f.Id.Hex(),
+			Task:    f.Tasks[0],
+			Action:  "DONE",
+		}
+		tuStubStr, err := json.Marshal(tuStub)
+		req, err := http.NewRequest("POST", "/task-update", bytes.NewReader(tuStubStr))
+		if err != nil {
+			t.Error(err)
+		}
+		rr := httptest.NewRecorder()
+		services := services{taskService: TaskUpdateRequest{}}
+		handler := http.HandlerFunc(services.taskService.HandleTaskUpdate)
+		handler.ServeHTTP(rr, asResident(req, "1", f.Id.Hex()))
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+
+		resp := getHistory(t, "?task=0")
+		if len(resp.Entries) != 1 {
+			t.Fatalf("expected 1 history entry, got %v", len(resp.Entries))
+		}
+		e := resp.Entries[0]
+		if e.Action != "DONE" || e.FromRoom != f.Tasks[0].AssignedTo || e.FromResident != "1" || e.ActorId != "1" {
+			t.Errorf("wrong history entry: %+v", e)
+		}
+	})
+
+	t.Run("should page with cursor", func(t *testing.T) {
+		base := time.Now()
+		var entries []HistoryEntry
+		for i := 0; i < 3; i++ {
+			entries = append(entries, newHistoryEntry(f, f.Tasks[1], f.Tasks[1], "REMIND", "2", base.Add(time.Duration(i)*time.Second)))
+		}
+		if err := insertHistoryEntries(entries); err != nil {
+			t.Fatal(err)
+		}
+
+		first := getHistory(t, "?action=REMIND&limit=2")
+		if len(first.Entries) != 2 || first.NextCursor == "" {
+			t.Fatalf("expected a full first page with cursor, got %v entries cursor %q", len(first.Entries), first.NextCursor)
+		}
+		second := getHistory(t, "?action=REMIND&limit=2&cursor="+first.NextCursor)
+		if len(second.Entries) != 1 || second.NextCursor != "" {
+			t.Errorf("expected last page with 1 entry, got %v entries cursor %q", len(second.Entries), second.NextCursor)
+		}
+	})
+
+	t.Run("should not show other floors", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "/floor/"+f.Id.Hex()+"/history", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(req, "1", floorId))
+		if status := rr.Code; status != http.StatusForbidden {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusForbidden)
+		}
+	})
+}
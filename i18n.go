@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// locale used for keys a locale misses and for texts without a known reader
+const fallbackLocale = "en"
+
+var supportedLocales = []string{"de", "en"}
+
+// locale of residents that did not choose a language
+var defaultLocale = getEnv("DEFAULT_LOCALE", "de")
+
+// catalogueSources holds the text/template source of every user facing text per locale. Push
+// notifications have a .title and a .body template.
+var catalogueSources = map[string]map[string]string{
+	"en": {
+		"task.assigned.title":          "{{.Task}} has been assigned to you!",
+		"task.assigned.body":           "Open WG-Planer to see your tasks.",
+		"task.remind.title":            "You have been reminded about {{.Task}}!",
+		"task.remind.body":             "Your flatmates are waiting for {{.Task}} to be done.",
+		"task.due.title":               "Reminder: {{.Task}} is due!",
+		"task.due.body":                "Mark {{.Task}} as done once you finished it.",
+		"task.pooled.title":            "Nobody is available for {{.Task}}",
+		"task.pooled.body":             "Claim {{.Task}} in WG-Planer if you can take it.",
+		"voting.create.title":          "Request to create a new task",
+		"voting.create.body":           "Vote on creating {{.Task}}.",
+		"voting.delete.title":          "Request to delete a task",
+		"voting.delete.body":           "Vote on deleting {{.Task}}.",
+		"voting.rename.title":          "Request to rename a task",
+		"voting.rename.body":           "Vote on renaming {{.Task}} to {{.Name}}.",
+		"voting.recurrence.title":      "Request to change the schedule of a task",
+		"voting.recurrence.body":       "Vote on the new schedule of {{.Task}}.",
+		"voting.rotation.title":        "Request to change the rotation order",
+		"voting.rotation.body":         "Vote on the new order of the rooms.",
+		"voting.admit.title":           "Request to admit a new resident",
+		"voting.admit.body":            "Vote on admitting {{.Resident}}.",
+		"voting.remove.title":          "Request to remove a resident",
+		"voting.remove.body":           "Vote on removing {{.Resident}}.",
+		"voting.settings.title":        "Request to change the floor settings",
+		"voting.settings.body":         "Vote on the new floor settings.",
+		"voting.resolved.title":        `Voting on {{if eq .Type "DELETE_TASK"}}deleting {{.Task}}{{else if eq .Type "RENAME_TASK"}}renaming {{.Task}}{{else if eq .Type "CHANGE_RECURRENCE"}}the schedule of {{.Task}}{{else if eq .Type "REORDER_ROTATION"}}the rotation order{{else if eq .Type "ADMIT_RESIDENT"}}admitting {{.Resident}}{{else if eq .Type "REMOVE_RESIDENT"}}removing {{.Resident}}{{else if eq .Type "CHANGE_SETTINGS"}}the floor settings{{else}}{{.Task}}{{end}} {{if eq .Outcome "ACCEPTED"}}passed{{else if eq .Outcome "REJECTED"}}was rejected{{else}}expired{{end}}`,
+		"voting.resolved.body":         "Open WG-Planer to see the result.",
+		"swap.proposed.title":          "{{.Resident}} wants to swap tasks with you",
+		"swap.proposed.body":           "{{.Resident}} offers {{.OtherTask}} in exchange for your {{.Task}}.",
+		"swap.accepted.title":          "Swap accepted: {{.OtherTask}} is yours now",
+		"swap.accepted.body":           "{{.Task}} has been handed over.",
+		"swap.declined.title":          "Your swap of {{.Task}} was declined",
+		"swap.declined.body":           "{{.Task}} stays with you.",
+		"swap.withdrawn.title":         "{{.Resident}} withdrew the swap",
+		"swap.withdrawn.body":          "{{.Task}} stays with you.",
+		"swap.expired.title":           "The swap of {{.Task}} for {{.OtherTask}} expired",
+		"swap.expired.body":            "{{.Task}} stays with you.",
+		"digest.title":                 "You have {{.Count}} new notifications",
+		"digest.body":                  "{{.Summary}}",
+		"error.floorNotFound":          "Floor not found",
+		"error.getFloor":               "Error getting floor{{if .Error}} {{.Error}}{{end}}",
+		"error.insertFloor":            "Error inserting new floor",
+		"error.userNotFound":           "User not found",
+		"error.userNotInFloor":         "User not found in floor",
+		"error.userProfile":            "Error getting user profile {{.Error}}",
+		"error.badRequestBody":         "Error reading request body, bad format",
+		"error.accessDenied":           "Access to floor denied",
+		"error.noFloor":                "User is not part of a floor",
+		"error.noToken":                "No token provided",
+		"error.invalidToken":           "Invalid token",
+		"error.notAuthenticated":       "Not authenticated",
+		"error.adminRequired":          "Admin access required",
+		"error.channelNotFound":        "Channel not found",
+		"error.webPushNotConfigured":   "Web push is not configured",
+		"error.invalidInvitationId":    "Invalid invitation id",
+		"error.invitationNotFound":     "Invitation not found",
+		"error.tooManyInvitations":     "Too many invitations for this floor, try again later",
+		"error.invalidFloorId":         "Invalid floor id",
+		"error.generateCode":           "Error generating code",
+		"error.tooManyAttempts":        "Too many attempts, try again later",
+		"error.codeNotFound":           "Code not found",
+		"error.roomChanged":            "Room changed since code generation",
+		"error.noRedeemedInvitation":   "No redeemed invitation for this room",
+		"error.noFailedMessage":        "No failed message with this key",
+		"error.unknownTimezone":        "Unknown time zone {{.Timezone}}",
+		"error.effortTooLow":           "Effort must be at least 1",
+		"error.unknownRotation":        "Unknown rotation strategy {{.Strategy}}",
+		"error.taskAssigneeChanged":    "Task assignee changed in between",
+		"error.notificationPreference": "Invalid notification preferences: {{.Error}}",
+		"error.invalidRecurrence":      "Invalid recurrence: {{.Error}}",
+		"error.invalidReminderPolicy":  "Invalid reminder policy: {{.Error}}",
+		"error.invalidChannel":         "Invalid channel: {{.Error}}",
+		"error.taskNotFound":           "Task not found",
+		"error.invalidLastEventId":     "Invalid Last-Event-ID, expected a floor revision",
+		"error.unknownVotingType":      "Unknown voting type {{.Type}}",
+		"error.invalidQuorumPolicy":    "Invalid quorum policy: {{.Error}}",
+		"error.unknownVoteAction":      "Unknown vote {{.Action}}, expected ACCEPT, REJECT or ABSTAIN",
+		"error.invalidVoting":          "Invalid voting: {{.Error}}",
+		"error.invalidSwap":            "Invalid swap: {{.Error}}",
+		"error.invalidSwapId":          "Invalid swap id",
+		"error.swapNotFound":           "Swap not found",
+		"error.notSwapCounterpart":     "Only the resident asked can answer this swap",
+		"error.invalidAbsence":         "Invalid absence: {{.Error}}",
+		"error.invalidAbsenceId":       "Invalid absence id",
+		"error.absenceNotFound":        "Absence not found",
+		"error.absenceOverlap":         "You are away from {{.From}} to {{.To}} already",
+	},
+	"de": {
+		"task.assigned.title":          "{{.Task}} wurde dir zugewiesen!",
+		"task.assigned.body":           "Öffne WG-Planer, um deine Aufgaben zu sehen.",
+		"task.remind.title":            "Du wurdest an {{.Task}} erinnert!",
+		"task.remind.body":             "Deine Mitbewohner warten darauf, dass {{.Task}} erledigt wird.",
+		"task.due.title":               "Erinnerung: {{.Task}} ist fällig!",
+		"task.due.body":                "Markiere {{.Task}} als erledigt, sobald du fertig bist.",
+		"task.pooled.title":            "Niemand ist für {{.Task}} verfügbar",
+		"task.pooled.body":             "Übernimm {{.Task}} in WG-Planer, wenn du kannst.",
+		"voting.create.title":          "Anfrage, eine neue Aufgabe anzulegen",
+		"voting.create.body":           "Stimme über das Anlegen von {{.Task}} ab.",
+		"voting.delete.title":          "Anfrage, eine Aufgabe zu löschen",
+		"voting.delete.body":           "Stimme über das Löschen von {{.Task}} ab.",
+		"voting.rename.title":          "Anfrage, eine Aufgabe umzubenennen",
+		"voting.rename.body":           "Stimme über das Umbenennen von {{.Task}} in {{.Name}} ab.",
+		"voting.recurrence.title":      "Anfrage, den Rhythmus einer Aufgabe zu ändern",
+		"voting.recurrence.body":       "Stimme über den neuen Rhythmus von {{.Task}} ab.",
+		"voting.rotation.title":        "Anfrage, die Reihenfolge der Rotation zu ändern",
+		"voting.rotation.body":         "Stimme über die neue Reihenfolge der Zimmer ab.",
+		"voting.admit.title":           "Anfrage, einen neuen Mitbewohner aufzunehmen",
+		"voting.admit.body":            "Stimme über die Aufnahme von {{.Resident}} ab.",
+		"voting.remove.title":          "Anfrage, einen Mitbewohner zu entfernen",
+		"voting.remove.body":           "Stimme über das Entfernen von {{.Resident}} ab.",
+		"voting.settings.title":        "Anfrage, die Etageneinstellungen zu ändern",
+		"voting.settings.body":         "Stimme über die neuen Etageneinstellungen ab.",
+		"voting.resolved.title":        `Abstimmung über {{if eq .Type "DELETE_TASK"}}das Löschen von {{.Task}}{{else if eq .Type "RENAME_TASK"}}das Umbenennen von {{.Task}}{{else if eq .Type "CHANGE_RECURRENCE"}}den Rhythmus von {{.Task}}{{else if eq .Type "REORDER_ROTATION"}}die Reihenfolge der Rotation{{else if eq .Type "ADMIT_RESIDENT"}}die Aufnahme von {{.Resident}}{{else if eq .Type "REMOVE_RESIDENT"}}das Entfernen von {{.Resident}}{{else if eq .Type "CHANGE_SETTINGS"}}die Etageneinstellungen{{else}}{{.Task}}{{end}} {{if eq .Outcome "ACCEPTED"}}angenommen{{else if eq .Outcome "REJECTED"}}abgelehnt{{else}}abgelaufen{{end}}`,
+		"voting.resolved.body":         "Öffne WG-Planer, um das Ergebnis zu sehen.",
+		"swap.proposed.title":          "{{.Resident}} möchte Aufgaben mit dir tauschen",
+		"swap.proposed.body":           "{{.Resident}} bietet {{.OtherTask}} im Tausch gegen deine Aufgabe {{.Task}} an.",
+		"swap.accepted.title":          "Tausch angenommen: {{.OtherTask}} gehört jetzt dir",
+		"swap.accepted.body":           "{{.Task}} wurde abgegeben.",
+		"swap.declined.title":          "Dein Tausch von {{.Task}} wurde abgelehnt",
+		"swap.declined.body":           "{{.Task}} bleibt bei dir.",
+		"swap.withdrawn.title":         "{{.Resident}} hat den Tausch zurückgezogen",
+		"swap.withdrawn.body":          "{{.Task}} bleibt bei dir.",
+		"swap.expired.title":           "Der Tausch von {{.Task}} gegen {{.OtherTask}} ist abgelaufen",
+		"swap.expired.body":            "{{.Task}} bleibt bei dir.",
+		"digest.title":                 "Du hast {{.Count}} neue Benachrichtigungen",
+		"digest.body":                  "{{.Summary}}",
+		"error.floorNotFound":          "Etage nicht gefunden",
+		"error.getFloor":               "Fehler beim Laden der Etage{{if .Error}} {{.Error}}{{end}}",
+		"error.insertFloor":            "Fehler beim Anlegen der Etage",
+		"error.userNotFound":           "Benutzer nicht gefunden",
+		"error.userNotInFloor":         "Benutzer wohnt nicht auf dieser Etage",
+		"error.userProfile":            "Fehler beim Laden des Benutzerprofils {{.Error}}",
+		"error.badRequestBody":         "Anfrage konnte nicht gelesen werden, ungültiges Format",
+		"error.accessDenied":           "Kein Zugriff auf diese Etage",
+		"error.noFloor":                "Benutzer gehört zu keiner Etage",
+		"error.noToken":                "Kein Token angegeben",
+		"error.invalidToken":           "Ungültiges Token",
+		"error.notAuthenticated":       "Nicht angemeldet",
+		"error.adminRequired":          "Administratorrechte erforderlich",
+		"error.channelNotFound":        "Kanal nicht gefunden",
+		"error.webPushNotConfigured":   "Web-Push ist nicht eingerichtet",
+		"error.invalidInvitationId":    "Ungültige Einladungs-ID",
+		"error.invitationNotFound":     "Einladung nicht gefunden",
+		"error.tooManyInvitations":     "Zu viele Einladungen für diese Etage, versuche es später erneut",
+		"error.invalidFloorId":         "Ungültige Etagen-ID",
+		"error.generateCode":           "Fehler beim Erzeugen des Codes",
+		"error.tooManyAttempts":        "Zu viele Versuche, versuche es später erneut",
+		"error.codeNotFound":           "Code nicht gefunden",
+		"error.roomChanged":            "Das Zimmer hat sich seit dem Erzeugen des Codes geändert",
+		"error.noRedeemedInvitation":   "Keine eingelöste Einladung für dieses Zimmer",
+		"error.noFailedMessage":        "Keine fehlgeschlagene Nachricht mit diesem Schlüssel",
+		"error.unknownTimezone":        "Unbekannte Zeitzone {{.Timezone}}",
+		"error.effortTooLow":           "Der Aufwand muss mindestens 1 sein",
+		"error.unknownRotation":        "Unbekannte Rotationsstrategie {{.Strategy}}",
+		"error.taskAssigneeChanged":    "Die Aufgabe wurde zwischenzeitlich jemand anderem zugewiesen",
+		"error.notificationPreference": "Ungültige Benachrichtigungseinstellungen: {{.Error}}",
+		"error.invalidRecurrence":      "Ungültige Wiederholung: {{.Error}}",
+		"error.invalidReminderPolicy":  "Ungültige Erinnerungsregel: {{.Error}}",
+		"error.invalidChannel":         "Ungültiger Kanal: {{.Error}}",
+		"error.taskNotFound":           "Aufgabe nicht gefunden",
+		"error.invalidLastEventId":     "Ungültige Last-Event-ID, erwartet wird eine Etagen-Revision",
+		"error.unknownVotingType":      "Unbekannte Abstimmungsart {{.Type}}",
+		"error.invalidQuorumPolicy":    "Ungültige Quorumsregel: {{.Error}}",
+		"error.unknownVoteAction":      "Unbekannte Stimme {{.Action}}, erwartet wird ACCEPT, REJECT oder ABSTAIN",
+		"error.invalidVoting":          "Ungültige Abstimmung: {{.Error}}",
+		"error.invalidSwap":            "Ungültiger Tausch: {{.Error}}",
+		"error.invalidSwapId":          "Ungültige Tausch-ID",
+		"error.swapNotFound":           "Tausch nicht gefunden",
+		"error.notSwapCounterpart":     "Nur der gefragte Mitbewohner kann auf diesen Tausch antworten",
+		"error.invalidAbsence":         "Ungültige Abwesenheit: {{.Error}}",
+		"error.invalidAbsenceId":       "Ungültige Abwesenheits-ID",
+		"error.absenceNotFound":        "Abwesenheit nicht gefunden",
+		"error.absenceOverlap":         "Du bist bereits vom {{.From}} bis {{.To}} abwesend",
+	},
+}
+
+var catalogue = compileCatalogue(catalogueSources)
+
+func compileCatalogue(sources map[string]map[string]string) map[string]map[string]*template.Template {
+	compiled := make(map[string]map[string]*template.Template, len(sources))
+	for locale, texts := range sources {
+		compiled[locale] = make(map[string]*template.Template, len(texts))
+		for key, text := range texts {
+			compiled[locale][key] = template.Must(template.New(locale + ":" + key).Option("missingkey=zero").Parse(text))
+		}
+	}
+	return compiled
+}
+
+// Message is a catalogue key with the arguments to render it with.
+type Message struct {
+	Key  string
+	Args map[string]string
+}
+
+func newMessage(key string, kv ...string) Message {
+	return Message{Key: key, Args: argsOf(kv...)}
+}
+
+func argsOf(kv ...string) map[string]string {
+	if len(kv) == 0 {
+		return nil
+	}
+	args := make(map[string]string, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		args[kv[i]] = kv[i+1]
+	}
+	return args
+}
+
+// localize renders key in locale, falling back to fallbackLocale for unknown locales and keys.
+// An unknown key renders as itself.
+func localize(locale string, key string, args map[string]string) string {
+	tmpl, ok := catalogue[locale][key]
+	if !ok {
+		tmpl, ok = catalogue[fallbackLocale][key]
+	}
+	if !ok {
+		return key
+	}
+	if args == nil {
+		args = map[string]string{}
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, args); err != nil {
+		return key
+	}
+	return sb.String()
+}
+
+// requestLocale picks the first supported language of the Accept-Language header.
+func requestLocale(r *http.Request) string {
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		lang, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if slices.Contains(supportedLocales, lang) {
+			return lang
+		}
+	}
+	return defaultLocale
+}
+
+func validLocale(locale string) error {
+	if locale != "" && !slices.Contains(supportedLocales, locale) {
+		return fmt.Errorf("Unsupported language %s", locale)
+	}
+	return nil
+}
+
+// writeError is http.Error with the message rendered from the catalogue in the caller's language,
+// kv are the template arguments as key value pairs.
+func writeError(w http.ResponseWriter, r *http.Request, key string, code int, kv ...string) {
+	http.Error(w, localize(requestLocale(r), key, argsOf(kv...)), code)
+}
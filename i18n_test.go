@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var sampleArgs = argsOf("Task", "Küche", "Type", "DELETE_TASK", "Outcome", "ACCEPTED", "Count", "3", "Summary", "a\nb", "Error", "boom", "Timezone", "Mars/Olympus", "Strategy", "RANDOM", "Action", "MAYBE", "Name", "Bad", "Resident", "Lena", "OtherTask", "Bad", "From", "2026-08-01", "To", "2026-08-14")
+
+func Test_catalogue(t *testing.T) {
+	want := catalogueKeys(fallbackLocale)
+	for _, locale := range supportedLocales {
+		t.Run("should render every template in "+locale, func(t *testing.T) {
+			got := catalogueKeys(locale)
+			if !slices.Equal(got, want) {
+				t.Errorf("locale %v has keys %v, want %v", locale, got, want)
+			}
+			for key, tmpl := range catalogue[locale] {
+				var sb strings.Builder
+				if err := tmpl.Execute(&sb, sampleArgs); err != nil {
+					t.Errorf("%v %v: %v", locale, key, err)
+				}
+				if sb.Len() == 0 || strings.Contains(sb.String(), "<no value>") {
+					t.Errorf("%v %v rendered %q", locale, key, sb.String())
+				}
+			}
+		})
+	}
+}
+
+func catalogueKeys(locale string) []string {
+	var keys []string
+	for key := range catalogueSources[locale] {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func Test_localize(t *testing.T) {
+	args := argsOf("Task", "Küche")
+	tests := []struct {
+		name   string
+		locale string
+		key    string
+		want   string
+	}{
+		{"german", "de", "task.assigned.title", "Küche wurde dir zugewiesen!"},
+		{"english", "en", "task.assigned.title", "Küche has been assigned to you!"},
+		{"unknown locale falls back", "fr", "task.assigned.title", "Küche has been assigned to you!"},
+		{"unknown key renders as key", "de", "task.unknown", "task.unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := localize(tt.locale, tt.key, args); got != tt.want {
+				t.Errorf("localize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_requestLocale(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"de-DE,de;q=0.9,en;q=0.8", "de"},
+		{"fr-FR, en-US;q=0.7", "en"},
+		{"fr", defaultLocale},
+		{"", defaultLocale},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Language", tt.header)
+		if got := requestLocale(req); got != tt.want {
+			t.Errorf("requestLocale(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func Test_writeError(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Language", "de")
+	rr := httptest.NewRecorder()
+	writeError(rr, req, "error.unknownTimezone", http.StatusBadRequest, "Timezone", "Mars/Olympus")
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	if got := strings.TrimSpace(rr.Body.String()); got != "Unbekannte Zeitzone Mars/Olympus" {
+		t.Errorf("wrong error message: %v", got)
+	}
+}
+
+func Test_renderNotification(t *testing.T) {
+	m := OutboxMessage{Type: "TASK_REMINDER", Title: "stored", Template: "task.due", Args: argsOf("Task", "Bad")}
+	if n := renderNotification(m, "de"); n.Title != "Erinnerung: Bad ist fällig!" || n.Body == "" {
+		t.Errorf("wrong german notification: %+v", n)
+	}
+	if n := renderNotification(m, "en"); n.Title != "Reminder: Bad is due!" {
+		t.Errorf("wrong english notification: %+v", n)
+	}
+	m.Template = ""
+	if n := renderNotification(m, "de"); n.Title != "stored" {
+		t.Errorf("expected message without template to keep its title, got %+v", n)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type Invitation struct {
+	Id         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Code       string             `bson:"code" json:"code"`
+	FloorId    primitive.ObjectID `bson:"floorId" json:"floorId"`
+	Room       Room               `bson:"room" json:"room"`
+	CreatedBy  string             `bson:"createdBy" json:"createdBy"`
+	CreatedAt  time.Time          `bson:"createdAt" json:"createdAt"`
+	ExpiresAt  time.Time          `bson:"expiresAt" json:"expiresAt"`
+	RedeemedBy string             `bson:"redeemedBy,omitempty" json:"redeemedBy,omitempty"`
+}
+
+const inviteCodeAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+var inviteCodeLength = getEnvInt("INVITE_CODE_LENGTH", 8)
+var inviteTTL = 20 * time.Minute
+
+// a redeemed invitation stays valid this long so that the new resident can finish joining
+var inviteRedeemWindow = 20 * time.Minute
+
+var codeSubmitLimiter = newAttemptLimiter(10, 15*time.Minute)
+var codeGenerationLimiter = newAttemptLimiter(20, time.Hour)
+
+func generateCode(length int) (string, error) {
+	code := make([]byte, length)
+	max := big.NewInt(int64(len(inviteCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = inviteCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// attemptLimiter allows at most limit attempts per key within a sliding window.
+type attemptLimiter struct {
+	mu        sync.Mutex
+	limit     int
+	window    time.Duration
+	attempts  map[string][]time.Time
+	lastPrune time.Time
+}
+
+func newAttemptLimiter(limit int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{limit: limit, window: window, attempts: make(map[string][]time.Time)}
+}
+
+// allow records an attempt for key and reports whether it is within the limit.
+func (l *attemptLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now)
+	recent := l.attempts[key][:0]
+	for _, t := range l.attempts[key] {
+		if now.Sub(t) < l.window {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= l.limit {
+		l.attempts[key] = recent
+		return false
+	}
+	l.attempts[key] = append(recent, now)
+	return true
+}
+
+// prune drops the keys whose window has emptied, at most once per window,
+// so that clients that never come back do not pile up.
+func (l *attemptLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.window {
+		return
+	}
+	l.lastPrune = now
+	for key, attempts := range l.attempts {
+		if len(attempts) == 0 || now.Sub(attempts[len(attempts)-1]) >= l.window {
+			delete(l.attempts, key)
+		}
+	}
+}
+
+func (l *attemptLimiter) reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.attempts, key)
+}
+
+// clientKey identifies the submitter for attempt limiting by user and address.
+func clientKey(r *http.Request, identity Identity) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return identity.UserId + "@" + host
+}
+
+func HandleListInvitations(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerFloorFromPath(w, r)
+	if !ok {
+		return
+	}
+	fId, _ := primitive.ObjectIDFromHex(identity.FloorId)
+	invitations, err := findOpenInvitations(fId, time.Now())
+	if err != nil {
+		logger.Error("listInvitations findOpenInvitations", slog.Any("error", err), slog.Any("floor id", fId))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invitations)
+}
+
+func HandleRevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerFloorFromPath(w, r)
+	if !ok {
+		return
+	}
+	fId, _ := primitive.ObjectIDFromHex(identity.FloorId)
+	invitationId, err := primitive.ObjectIDFromHex(r.PathValue("invitationId"))
+	if err != nil {
+		writeError(w, r, "error.invalidInvitationId", http.StatusBadRequest)
+		return
+	}
+	deleted, err := deleteInvitation(fId, invitationId)
+	if err != nil {
+		logger.Error("revokeInvitation deleteInvitation", slog.Any("error", err), slog.Any("floor id", fId), slog.Any("invitation id", invitationId))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		writeError(w, r, "error.invitationNotFound", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
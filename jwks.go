@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type publicKeyProvider interface {
+	publicKey(kid string, alg string) (*rsa.PublicKey, error)
+}
+
+type Jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type Jwks struct {
+	Keys []Jwk `json:"keys"`
+}
+
+type cachedJwk struct {
+	pubKey *rsa.PublicKey
+	alg    string
+}
+
+// JwksCache holds the auth server's signing keys indexed by kid. It is refreshed on a
+// schedule and refetched when a token with an unknown kid shows up, at most once per minRefetchGap.
+type JwksCache struct {
+	url             string
+	httpClient      *http.Client
+	refreshInterval time.Duration
+	minRefetchGap   time.Duration
+
+	mu        sync.RWMutex
+	keys      map[string]cachedJwk
+	lastFetch time.Time
+	fetchMu   sync.Mutex
+}
+
+func newJwksCache(url string, refreshInterval time.Duration, minRefetchGap time.Duration) *JwksCache {
+	return &JwksCache{
+		url:             url,
+		httpClient:      &http.Client{Timeout: 10 * time.Second},
+		refreshInterval: refreshInterval,
+		minRefetchGap:   minRefetchGap,
+		keys:            make(map[string]cachedJwk),
+	}
+}
+
+// start refreshes the keys every refreshInterval until ctx is done.
+func (c *JwksCache) start(ctx context.Context) {
+	ticker := time.NewTicker(c.refreshInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := c.refresh(); err != nil {
+					logger.Error("jwksCache scheduled refresh", slog.Any("error", err), slog.String("url", c.url))
+				}
+			}
+		}
+	}()
+}
+
+func (c *JwksCache) refresh() error {
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+	return c.fetch()
+}
+
+func (c *JwksCache) fetch() error {
+	c.mu.Lock()
+	c.lastFetch = time.Now()
+	c.mu.Unlock()
+
+	jwks, err := getJwksFromAuthServer(c.httpClient, c.url)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]cachedJwk)
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		pubKey, err := jwk.rsaPublicKey()
+		if err != nil {
+			logger.Error("jwksCache skipping key", slog.Any("error", err), slog.String("kid", jwk.Kid))
+			continue
+		}
+		keys[jwk.Kid] = cachedJwk{pubKey: pubKey, alg: jwk.Alg}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no usable RSA keys in JWKS from %s", c.url)
+	}
+
+	c.mu.Lock()
+	c.keys = keys
+	c.mu.Unlock()
+	return nil
+}
+
+// publicKey returns the key for kid, refetching the JWKS once if the kid is unknown.
+// If the JWK pins an algorithm, the token must be signed with exactly that one.
+func (c *JwksCache) publicKey(kid string, alg string) (*rsa.PublicKey, error) {
+	jwk, err := c.lookup(kid)
+	if err != nil {
+		return nil, err
+	}
+	if jwk.alg != "" && jwk.alg != alg {
+		return nil, fmt.Errorf("token alg %s does not match key alg %s for kid %q", alg, jwk.alg, kid)
+	}
+	return jwk.pubKey, nil
+}
+
+func (c *JwksCache) lookup(kid string) (cachedJwk, error) {
+	if jwk, ok := c.cachedKey(kid); ok {
+		return jwk, nil
+	}
+
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+	//another request may have refetched while we were waiting
+	if jwk, ok := c.cachedKey(kid); ok {
+		return jwk, nil
+	}
+	c.mu.RLock()
+	sinceLastFetch := time.Since(c.lastFetch)
+	c.mu.RUnlock()
+	if sinceLastFetch < c.minRefetchGap {
+		return cachedJwk{}, fmt.Errorf("unknown kid %q, refetch rate limited", kid)
+	}
+	if err := c.fetch(); err != nil {
+		return cachedJwk{}, fmt.Errorf("unknown kid %q, refetching JWKS: %w", kid, err)
+	}
+	if jwk, ok := c.cachedKey(kid); ok {
+		return jwk, nil
+	}
+	return cachedJwk{}, fmt.Errorf("unknown kid %q", kid)
+}
+
+func (c *JwksCache) cachedKey(kid string) (cachedJwk, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	jwk, ok := c.keys[kid]
+	return jwk, ok
+}
+
+func (jwk Jwk) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding modulus: %w", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding exponent: %w", err)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+func getJwksFromAuthServer(httpClient *http.Client, url string) (Jwks, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return Jwks{}, fmt.Errorf("Error creating http request: %w", err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return Jwks{}, fmt.Errorf("Error getting JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Jwks{}, fmt.Errorf("Error getting JWKS: status %d", resp.StatusCode)
+	}
+	var jwks Jwks
+	err = json.NewDecoder(resp.Body).Decode(&jwks)
+	if err != nil {
+		return Jwks{}, fmt.Errorf("Error decoding JWKS: %w", err)
+	}
+	return jwks, nil
+}
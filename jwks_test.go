@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// staticPublicKey serves a single key regardless of kid.
+type staticPublicKey struct {
+	key *rsa.PublicKey
+}
+
+func (s staticPublicKey) publicKey(kid string, alg string) (*rsa.PublicKey, error) {
+	return s.key, nil
+}
+
+type jwksServerStub struct {
+	mu       sync.Mutex
+	keys     map[string]*rsa.PrivateKey
+	requests int
+}
+
+func (s *jwksServerStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	var jwks Jwks
+	for kid, key := range s.keys {
+		jwks.Keys = append(jwks.Keys, Jwk{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jwks)
+}
+
+func (s *jwksServerStub) rotate(kid string, key *rsa.PrivateKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = map[string]*rsa.PrivateKey{kid: key}
+}
+
+func (s *jwksServerStub) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func signTestTokenWithKid(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"user_id":  "1",
+		"floor_id": "669fca69d244526d709f6d76",
+		"iss":      "http://auth.test",
+		"aud":      []string{"wg-planer"},
+		"exp":      time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func Test_jwksCache(t *testing.T) {
+	key1, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should pick key by kid", func(t *testing.T) {
+		stub := &jwksServerStub{keys: map[string]*rsa.PrivateKey{"k1": key1, "k2": key2}}
+		server := httptest.NewServer(stub)
+		defer server.Close()
+		cache := newJwksCache(server.URL, time.Hour, time.Minute)
+		if err := cache.refresh(); err != nil {
+			t.Fatal(err)
+		}
+		as := AuthServiceImpl{keys: cache, issuer: "http://auth.test", audience: "wg-planer"}
+
+		for kid, key := range stub.keys {
+			identity, err := as.verifyToken(signTestTokenWithKid(t, key, kid, validClaims()))
+			if err != nil {
+				t.Errorf("token with kid %s rejected: %v", kid, err)
+			}
+			if identity.UserId != "1" {
+				t.Errorf("wrong user id: got %v want %v", identity.UserId, "1")
+			}
+		}
+		if stub.requestCount() != 1 {
+			t.Errorf("known kids must not refetch: got %v requests want %v", stub.requestCount(), 1)
+		}
+	})
+	t.Run("should refetch on unknown kid after rotation", func(t *testing.T) {
+		stub := &jwksServerStub{keys: map[string]*rsa.PrivateKey{"k1": key1}}
+		server := httptest.NewServer(stub)
+		defer server.Close()
+		cache := newJwksCache(server.URL, time.Hour, 0)
+		if err := cache.refresh(); err != nil {
+			t.Fatal(err)
+		}
+		as := AuthServiceImpl{keys: cache}
+
+		stub.rotate("k2", key2)
+		if _, err := as.verifyToken(signTestTokenWithKid(t, key2, "k2", validClaims())); err != nil {
+			t.Errorf("token signed with rotated key rejected: %v", err)
+		}
+		if _, err := as.verifyToken(signTestTokenWithKid(t, key1, "k1", validClaims())); err == nil {
+			t.Errorf("token signed with retired key accepted")
+		}
+	})
+	t.Run("should rate limit refetch on unknown kid", func(t *testing.T) {
+		stub := &jwksServerStub{keys: map[string]*rsa.PrivateKey{"k1": key1}}
+		server := httptest.NewServer(stub)
+		defer server.Close()
+		cache := newJwksCache(server.URL, time.Hour, time.Minute)
+		if err := cache.refresh(); err != nil {
+			t.Fatal(err)
+		}
+		as := AuthServiceImpl{keys: cache}
+
+		for i := 0; i < 5; i++ {
+			if _, err := as.verifyToken(signTestTokenWithKid(t, key2, "unknown", validClaims())); err == nil {
+				t.Errorf("token with unknown kid accepted")
+			}
+		}
+		if stub.requestCount() != 1 {
+			t.Errorf("unknown kid refetch not rate limited: got %v requests want %v", stub.requestCount(), 1)
+		}
+	})
+	t.Run("should refresh on schedule", func(t *testing.T) {
+		stub := &jwksServerStub{keys: map[string]*rsa.PrivateKey{"k1": key1}}
+		server := httptest.NewServer(stub)
+		defer server.Close()
+		cache := newJwksCache(server.URL, 20*time.Millisecond, time.Hour)
+		if err := cache.refresh(); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cache.start(ctx)
+
+		stub.rotate("k2", key2)
+		time.Sleep(100 * time.Millisecond)
+		if _, ok := cache.cachedKey("k2"); !ok {
+			t.Errorf("rotated key not picked up by scheduled refresh")
+		}
+	})
+}
+
+func Test_verifyTokenClaims(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &jwksServerStub{keys: map[string]*rsa.PrivateKey{"k1": key}}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	cache := newJwksCache(server.URL, time.Hour, time.Hour)
+	if err := cache.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	as := AuthServiceImpl{keys: cache, issuer: "http://auth.test", audience: "wg-planer"}
+
+	tests := []struct {
+		name    string
+		modify  func(c jwt.MapClaims)
+		token   func(c jwt.MapClaims) string
+		wantErr bool
+	}{
+		{name: "should accept valid token", modify: func(c jwt.MapClaims) {}},
+		{name: "should reject wrong issuer", modify: func(c jwt.MapClaims) { c["iss"] = "http://evil.test" }, wantErr: true},
+		{name: "should reject wrong audience", modify: func(c jwt.MapClaims) { c["aud"] = "other-app" }, wantErr: true},
+		{name: "should reject missing exp", modify: func(c jwt.MapClaims) { delete(c, "exp") }, wantErr: true},
+		{name: "should reject expired", modify: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, wantErr: true},
+		{
+			name:   "should reject HS256",
+			modify: func(c jwt.MapClaims) {},
+			token: func(c jwt.MapClaims) string {
+				token := jwt.NewWithClaims(jwt.SigningMethodHS256, c)
+				token.Header["kid"] = "k1"
+				signed, _ := token.SignedString([]byte("secret"))
+				return signed
+			},
+			wantErr: true,
+		},
+		{
+			name:   "should reject alg differing from key alg",
+			modify: func(c jwt.MapClaims) {},
+			token: func(c jwt.MapClaims) string {
+				token := jwt.NewWithClaims(jwt.SigningMethodRS512, c)
+				token.Header["kid"] = "k1"
+				signed, _ := token.SignedString(key)
+				return signed
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			tt.modify(claims)
+			var token string
+			if tt.token != nil {
+				token = tt.token(claims)
+			} else {
+				token = signTestTokenWithKid(t, key, "k1", claims)
+			}
+			_, err := as.verifyToken(token)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyToken error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
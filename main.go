@@ -4,16 +4,15 @@ import (
 	"context"
 	"crypto/rsa"
 	"crypto/x509"
-	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"log"
 	"log/slog"
-	"math/big"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -22,19 +21,40 @@ import (
 
 type Floor struct {
 	Id        primitive.ObjectID `bson:"_id,omitempty"`
+	Revision  int64              `bson:"revision"`
 	FloorName string             `bson:"floorName"`
 	Residents []string           `bson:"residents"`
 	Tasks     []Task             `bson:"tasks"`
 	Rooms     []Room             `bson:"rooms"`
 	Votings   []Voting           `bson:"votings"`
+	//IANA name, empty means server time
+	Timezone       string          `bson:"timezone,omitempty"`
+	ReminderPolicy *ReminderPolicy `bson:"reminderPolicy,omitempty"`
+	Rotation       string          `bson:"rotation,omitempty"`
+	//by voting type, types without one use defaultQuorumPolicies
+	QuorumPolicies map[string]QuorumPolicy `bson:"quorumPolicies,omitempty"`
+	//task swaps waiting for the counterpart's answer
+	Swaps []Swap `bson:"swaps,omitempty"`
+	//registered absences, past ones are removed once they ended
+	Absences      []Absence       `bson:"absences,omitempty"`
+	PendingOutbox []OutboxMessage `bson:"pendingOutbox,omitempty" json:"-"`
 }
 
 type Task struct {
-	Id             string    `bson:"id"`
-	Name           string    `bson:"name"`
-	AssignedTo     int       `bson:"assignedTo"`
-	Reminders      int       `bson:"reminders"`
-	AssignmentDate time.Time `bson:"assignmentDate"`
+	Id             string     `bson:"id"`
+	Name           string     `bson:"name"`
+	AssignedTo     int        `bson:"assignedTo"`
+	Reminders      int        `bson:"reminders"`
+	AssignmentDate time.Time  `bson:"assignmentDate"`
+	Recurrence     Recurrence `bson:"recurrence"`
+	DueDate        time.Time  `bson:"dueDate"`
+	AutoReminders  int        `bson:"autoReminders"`
+	LastReminderAt time.Time  `bson:"lastReminderAt"`
+	//rotation strategy of this task, empty means the floor's
+	Rotation string               `bson:"rotation,omitempty"`
+	Effort   int                  `bson:"effort"`
+	LastDone map[string]time.Time `bson:"lastDone,omitempty"`
+	Overdue  bool                 `bson:"-"`
 }
 
 type Room struct {
@@ -45,21 +65,38 @@ type Room struct {
 }
 
 type Resident struct {
-	Id            string `bson:"id"`
-	Name          string `bson:"name"`
-	Available     bool   `bson:"available"`
-	ExpoPushToken string `bson:"expoPushToken"`
+	Id        string `bson:"id"`
+	Name      string `bson:"name"`
+	Available bool   `bson:"available"`
+	//push tokens, subscriptions and addresses stay on the server, residents read their own via /me/channels
+	Channels []Channel `bson:"channels" json:"-"`
 }
 
 type Voting struct {
-	Id           int           `bson:"id"`
-	Type         string        `bson:"type"`
+	Id      int           `bson:"id"`
+	Type    string        `bson:"type"`
+	Payload VotingPayload `bson:"payload"`
+	//task of CREATE_TASK and DELETE_TASK votings for clients from before Payload
 	Data         Task          `bson:"data"`
 	Accepts      []string      `bson:"accepts"`
 	Rejects      []string      `bson:"rejects"`
+	Abstains     []string      `bson:"abstains,omitempty"`
 	LaunchDate   time.Time     `bson:"date"`
 	VotingWindow time.Duration `bson:"votingWindow"`
 	CreatedBy    string        `bson:"createdBy"`
+	//policy of the floor when the voting was launched
+	Quorum QuorumPolicy `bson:"quorum,omitempty"`
+}
+
+// ResolvedVoting is the archived record of a voting, with the votes it ended with and why it ended.
+type ResolvedVoting struct {
+	Id         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	FloorId    primitive.ObjectID `bson:"floorId" json:"floorId"`
+	Voting     Voting             `bson:"voting" json:"voting"`
+	Outcome    string             `bson:"outcome" json:"outcome"`
+	Tally      Tally              `bson:"tally" json:"tally"`
+	Reason     string             `bson:"reason" json:"reason"`
+	ResolvedAt time.Time          `bson:"resolvedAt" json:"resolvedAt"`
 }
 
 type UserProfile struct {
@@ -78,19 +115,27 @@ type GetFloorResponse struct {
 
 type RegisterTokenRequest struct {
 	ExpoPushToken string `json:"expoPushToken"`
+	Platform      string `json:"platform"`
 	FloorId       string `json:"floorId"`
 	UserId        string `json:"userId"`
 }
 
+type ConflictResponse struct {
+	Error string `json:"error"`
+	Floor Floor  `json:"floor"`
+}
+
 // type Resident struct {
 //   Name       string `bson:"name"`
 //   AssignedTo string `bson:"assignedTo"`
 // }
 
 var IsTest bool
-var userId string
-var floorId = "669fca69d244526d709f6d76"
 var authService AuthService
+var userProfileUrl = getEnv("USER_PROFILE_URL", "http://192.168.0.108:8082/userprofile")
+var jwksUrl = getEnv("JWKS_URL", "http://192.168.0.108:8081/oauth2/jwks")
+var authIssuer = getEnv("AUTH_ISSUER", "http://192.168.0.108:8081")
+var authAudience = getEnv("AUTH_AUDIENCE", "")
 
 type services struct {
 	taskService TaskService
@@ -103,13 +148,28 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 	initMongo(ctx)
+	migrateTaskRecurrences()
+	migrateExpoPushTokens()
+	initNotifiers()
 	services := services{taskService: TaskUpdateRequest{}}
-	// pubKey, err := initAuthServerPubKey()
-	// if err != nil {
-	// 	log.Fatal("Error initing public key", err)
-	// }
+	jwksCache := newJwksCache(jwksUrl, 15*time.Minute, 30*time.Second)
+	if err := jwksCache.refresh(); err != nil {
+		log.Fatal("Error initing public keys ", err)
+	}
+	jwksCache.start(context.Background())
+	if authAudience == "" {
+		logger.Warn("AUTH_AUDIENCE not set, token audience is not checked")
+	}
 
-	// initAuthService(AuthServiceImpl{pubKey: pubKey})
+	initAuthService(AuthServiceImpl{keys: jwksCache, issuer: authIssuer, audience: authAudience, userProfileUrl: userProfileUrl})
+	newVotingExpiryScheduler(realClock{}, time.Minute).start(context.Background())
+	newReminderScheduler(realClock{}, 15*time.Minute).start(context.Background())
+	newSwapExpiryScheduler(realClock{}, time.Minute).start(context.Background())
+	newAbsenceScheduler(realClock{}, time.Minute).start(context.Background())
+	newOutboxDispatcher(realClock{}, 5*time.Second, sendOutboxMessages).start(context.Background())
+	if e, ok := notifiers[ChannelExpo].(*ExpoNotifier); ok {
+		newExpoReceiptChecker(realClock{}, 15*time.Minute, e).start(context.Background())
+	}
 
 	http.HandleFunc("/floor/", crudFloor)
 	http.HandleFunc("/post-login", startupInfo)
@@ -118,6 +178,31 @@ func main() {
 	http.HandleFunc("/remind-task", services.taskService.HandleTaskRemind)
 	http.HandleFunc("/update-availability", HandleAvailabilityStatusChange)
 	http.HandleFunc("/generate-code", HandleCodeGeneration)
+	http.HandleFunc("GET /floor/{id}/invitations", HandleListInvitations)
+	http.HandleFunc("DELETE /floor/{id}/invitations/{invitationId}", HandleRevokeInvitation)
+	http.HandleFunc("GET /floor/{id}/history", HandleGetHistory)
+	http.HandleFunc("GET /floor/{id}/stats", HandleGetStats)
+	http.HandleFunc("GET /floor/{id}/events", HandleFloorEvents)
+	http.HandleFunc("PUT /floor/{id}/tasks/{taskId}/recurrence", HandleTaskRecurrenceUpdate)
+	http.HandleFunc("PUT /floor/{id}/reminder-policy", HandleReminderPolicyUpdate)
+	http.HandleFunc("PUT /floor/{id}/rotation", HandleFloorRotationUpdate)
+	http.HandleFunc("PUT /floor/{id}/tasks/{taskId}/rotation", HandleTaskRotationUpdate)
+	http.HandleFunc("PUT /floor/{id}/quorum-policies/{votingType}", HandleQuorumPolicyUpdate)
+	http.HandleFunc("POST /floor/{id}/votings", HandleLaunchVoting)
+	http.HandleFunc("GET /floor/{id}/votings", HandleListVotings)
+	http.HandleFunc("POST /floor/{id}/swaps", HandleProposeSwap)
+	http.HandleFunc("POST /floor/{id}/swaps/{swapId}/accept", HandleAcceptSwap)
+	http.HandleFunc("POST /floor/{id}/swaps/{swapId}/decline", HandleDeclineSwap)
+	http.HandleFunc("POST /floor/{id}/absences", HandleAddAbsence)
+	http.HandleFunc("DELETE /floor/{id}/absences/{absenceId}", HandleDeleteAbsence)
+	http.HandleFunc("GET /me/channels", HandleListChannels)
+	http.HandleFunc("POST /me/channels", HandleAddChannel)
+	http.HandleFunc("DELETE /me/channels", HandleDeleteChannel)
+	http.HandleFunc("GET /webpush/public-key", HandleVapidPublicKey)
+	http.HandleFunc("GET /me/notification-preferences", HandleGetNotificationPreferences)
+	http.HandleFunc("PUT /me/notification-preferences", HandleUpdateNotificationPreferences)
+	http.HandleFunc("GET /admin/outbox", HandleListOutbox)
+	http.HandleFunc("POST /admin/outbox/{key}/retry", HandleRetryOutbox)
 	http.HandleFunc("/submit-code", HandleCodeSubmit)
 	http.HandleFunc("/add-newResident", HandleAddNewResident)
 	http.HandleFunc("/create-del-task", HandleTaskCreateDelete)
@@ -125,7 +210,23 @@ func main() {
 
 	defer disconnectMongo(ctx)
 	log.Println("Server running on port 8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	log.Fatal(http.ListenAndServe(":8080", authMiddleware(authService, http.DefaultServeMux)))
+}
+
+func getEnv(key string, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	v, err := strconv.Atoi(getEnv(key, strconv.Itoa(fallback)))
+	if err != nil {
+		log.Printf("invalid %s, using %d: %v", key, fallback, err)
+		return fallback
+	}
+	return v
 }
 
 func initAuthService(as AuthService) {
@@ -134,42 +235,28 @@ func initAuthService(as AuthService) {
 
 func startupInfo(w http.ResponseWriter, r *http.Request) {
 	corsHandler(w)
-	// authToken := r.Header.Get("Authorization")
-	// if authToken == "" {
-	// 	http.Error(w, "No token provided", http.StatusUnauthorized)
-	// }
-	// authToken = authToken[7:]
-	// floorId, err := authService.verifyToken(authToken)
-	// if err != nil {
-	// 	return
-	// }
-
-	floorId := "669fca69d244526d709f6d76"
-	floor, err := FindFloor(floorId)
+	identity, ok := callerFloorIdentity(w, r)
+	if !ok {
+		return
+	}
+
+	floor, err := FindFloor(identity.FloorId)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			http.Error(w, "Floor not found", http.StatusNotFound)
+			writeError(w, r, "error.floorNotFound", http.StatusNotFound)
 			return
 		}
-		http.Error(w, "Error getting floor "+err.Error(), http.StatusInternalServerError)
+		writeError(w, r, "error.getFloor", http.StatusInternalServerError, "Error", err.Error())
 		return
 	}
 
-	userprofile := UserProfile{
-		Id:         2,
-		Username:   "Paulo",
-		Email:      "maxmuster@gmail.com",
-		FloorId:    "66603e2a00afb9bb44b3cadb",
-		Oid:        1,
-		AuthServer: "HOME_BREW",
+	userprofile, err := authService.getUserProfile(authTokenFromContext(r.Context()))
+	if err != nil {
+		writeError(w, r, "error.userProfile", http.StatusInternalServerError, "Error", err.Error())
+		return
 	}
-	// userprofile, err := authService.getUserProfile(authToken)
-	// if err != nil {
-	// 	http.Error(w, "Error getting user profile "+err.Error(), http.StatusInternalServerError)
-	// 	return
-	// }
 	if userprofile == (UserProfile{}) {
-		http.Error(w, "User not found", http.StatusNotFound)
+		writeError(w, r, "error.userNotFound", http.StatusNotFound)
 		return
 	}
 	getFloorResponse := GetFloorResponse{Floor: floor, UserProfile: userprofile}
@@ -185,25 +272,34 @@ func crudFloor(w http.ResponseWriter, r *http.Request) {
 		err := json.NewDecoder(r.Body).Decode(&floor)
 		if err != nil {
 			fmt.Println("Error reading request body", err)
-			http.Error(w, "Error reading request body, bad format", http.StatusBadRequest)
+			writeError(w, r, "error.badRequestBody", http.StatusBadRequest)
 			return
 		}
 		newFloor, err := insertNewFloor(floor)
 		if err != nil {
-			http.Error(w, "Error inserting new floor", http.StatusInternalServerError)
+			writeError(w, r, "error.insertFloor", http.StatusInternalServerError)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(newFloor)
 	case http.MethodGet:
+		identity, ok := callerFloorIdentity(w, r)
+		if !ok {
+			return
+		}
 		floorId := r.URL.Path[len("/floor/"):]
+		if floorId != identity.FloorId {
+			writeError(w, r, "error.accessDenied", http.StatusForbidden)
+			return
+		}
 		floor, err := FindFloor(floorId)
 		if err != nil {
 			if err == mongo.ErrNoDocuments {
-				http.Error(w, "Floor not found", http.StatusNotFound)
-				// http.Error(w, "Error getting floor "+err.Error(), http.StatusInternalServerError)
+				writeError(w, r, "error.floorNotFound", http.StatusNotFound)
 				return
 			}
+			writeError(w, r, "error.getFloor", http.StatusInternalServerError, "Error", err.Error())
+			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(floor)
@@ -217,6 +313,10 @@ func crudFloor(w http.ResponseWriter, r *http.Request) {
 
 func registerExpoPushToken(w http.ResponseWriter, r *http.Request) {
 	corsHandler(w)
+	identity, ok := callerFloorIdentity(w, r)
+	if !ok {
+		return
+	}
 	var registerTokenRequest RegisterTokenRequest
 	err := json.NewDecoder(r.Body).Decode(&registerTokenRequest)
 	if err != nil {
@@ -224,17 +324,25 @@ func registerExpoPushToken(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Error reading request body %v", err), http.StatusBadRequest)
 		return
 	}
+	registerTokenRequest.FloorId = identity.FloorId
+	registerTokenRequest.UserId = identity.UserId
 	floor, err := FindFloor(registerTokenRequest.FloorId)
 	if err != nil {
 		logger.Error("registerTokenRequest getFloor", slog.Any("error", err), slog.Any("registerTokenRequest", registerTokenRequest))
-		http.Error(w, "Error getting floor", http.StatusUnprocessableEntity)
+		writeError(w, r, "error.getFloor", http.StatusUnprocessableEntity)
 		return
 	}
 	var found bool
 	var roomIndex int
+	now := time.Now()
+	ch := Channel{Type: ChannelExpo, Address: registerTokenRequest.ExpoPushToken, Platform: registerTokenRequest.Platform, CreatedAt: now, LastSeen: now}
+	if err := validateChannel(ch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	for i, room := range floor.Rooms {
 		if room.Resident.Id == registerTokenRequest.UserId {
-			floor.Rooms[i].Resident.ExpoPushToken = registerTokenRequest.ExpoPushToken
+			addChannel(&floor.Rooms[i].Resident, ch)
 			roomIndex = i
 			found = true
 			break
@@ -243,81 +351,61 @@ func registerExpoPushToken(w http.ResponseWriter, r *http.Request) {
 	}
 	if !found {
 		logger.Error("registerTokenRequest", slog.Any("error", "User not found in floor"), slog.Any("registerTokenRequest", registerTokenRequest), slog.Any("floor", floor))
-		http.Error(w, "User not found in floor", http.StatusUnprocessableEntity)
+		writeError(w, r, "error.userNotInFloor", http.StatusUnprocessableEntity)
 		return
 	}
-	floor, err = updateExpoPushToken(floor, roomIndex)
+	fUp, err := updateRoom(floor, roomIndex)
 	if err != nil {
-		logger.Error("registerTokenRequest", slog.Any("error", err), slog.Any("registerTokenRequest", registerTokenRequest), slog.Any("floor", floor))
-		http.Error(w, "Error updating expo push token in DB", http.StatusInternalServerError)
+		writeDBError(w, err, floor.Id, "registerTokenRequest", slog.Any("registerTokenRequest", registerTokenRequest), slog.Any("floor", floor))
 		return
 	}
+	floor = fUp
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(floor)
 }
 
-func getJwksFromAuthServer() (map[string][]map[string]interface{}, error) {
-	httpClient := &http.Client{}
-
-	req, err := http.NewRequest("GET", "http://192.168.0.108:8081/oauth2/jwks", nil)
-	if err != nil {
-		return nil, fmt.Errorf("Error creating http request: %w", err)
+// checkClientRevision writes a 409 with the current floor if the client saw an older revision.
+// Clients that do not send a revision are only protected by the conditional write.
+func checkClientRevision(w http.ResponseWriter, floor Floor, clientRevision *int64) bool {
+	if clientRevision == nil || *clientRevision == floor.Revision {
+		return true
 	}
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("Error getting JWKS: %w", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Error getting JWKS: %w", err)
-	}
-	// var jwks string
-	var jwks map[string][]map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&jwks)
-	if err != nil {
-		return nil, fmt.Errorf("Error decoding JWKS: %w", err)
-	}
-	return jwks, nil
+	writeConflict(w, floor)
+	return false
 }
 
-func initAuthServerPubKey() (*rsa.PublicKey, error) {
-	// jwksJSON := `{"keys":[{"kty":"RSA","e":"AQAB","kid":"63c96dd9-bcca-45f8-8bad-744bb02f3872","n":"4IVGlvJZni-xZ7sgOetXegIKqA6ffQKAMOqp2TjO7b80o7oUGVmr7f6lwQ3L43HT9Lx-PRP5h61Zay3RaI47lsmCqBUHfuutp3ijVpeL5c1YDI9RUjEHrrgK78Rocx8LP2pXgl70TbL9275ugkcCSKm-9_qxTjTjO5azRqtQY0PCZmzt_kfmkNEEw7l6vjzPEY-CEk5EL-bp1g7UEkD3jdlif2fHGpb-Ql5KL7O3ytBt-c8LwDhhtCeFoyejK1p7L8BOr1xcaMVZuXNsDavbpPdh7ml6mSRxrBkSckY4Y2OB3SdOJMS_6CduZkz-LVi9RPian5xJVLmPcs2l_gU6mw"}]}`
-	// jwksJSON := `{"keys":[{"kty":"RSA","e":"AQAB","kid":"4e807cc8-a4fe-4b2c-ba40-571f64c8517d","n":"wGJpVlli_km_JISEmamXdrDPASbZXys0yhCJCZncfmrTt9MM-tKQRJXpvSHK2rILVBtW4KOjguU42kfNHgNxS_xg6O5nsfa5jMsLOJg1lku8a56QA6xrLJ1_mNHFgX1B0psQTUkQXtVWZQZD1shnqNbOEDrwwxx1LbRWbb86KSZnVccPhSQOUxklP3HI64ZS0P3AQlAqDJ6bsRs3hqI12NcQalzALFHWCl0eqZZa19jL3XDqyfCzg8uJ3KJ5Vcvmj-b56aFised8WIhHBSO5ZsYYhjPABFcMaZIOdM5jM-QUGA1WfHV4mGmR6XDmfDsOnDru5xNFqlPMSSBGdTN9kw"}]}`
-	jwks, err := getJwksFromAuthServer()
+func writeConflict(w http.ResponseWriter, floor Floor) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(ConflictResponse{Error: ErrRevisionConflict.Error(), Floor: floor})
+}
+
+// writeConflictWithCurrentFloor reloads the floor that a conditional write lost against and sends it with a 409.
+func writeConflictWithCurrentFloor(w http.ResponseWriter, fId primitive.ObjectID) {
+	floor, err := getUpdatedFloor(fId)
 	if err != nil {
-		return nil, fmt.Errorf("Error initing pub key, getting JWKS failed: %w", err)
+		logger.Error("writeConflict getFloor", slog.Any("error", err), slog.Any("floor id", fId))
+		http.Error(w, ErrRevisionConflict.Error(), http.StatusConflict)
+		return
 	}
+	writeConflict(w, floor)
+}
 
-	// Parse the JWKS
-	// var jwks map[string][]map[string]interface{}
-	// if err := json.Unmarshal([]byte(jwksJSON), &jwks); err != nil {
-	// 	log.Println("Error parsing JWKS:", err)
-	// 	return nil, fmt.Errorf("Error initing pub key, parsing failed: %w", err)
-	// }
-
-	// Extract the public key
-	var pubKey *rsa.PublicKey
-	for _, key := range jwks["keys"] {
-		modulus := key["n"].(string)
-		exponent := key["e"].(string)
-		n, err := base64.RawURLEncoding.DecodeString(modulus)
-		if err != nil {
-			log.Println("Error decoding modulus:", err)
-			return nil, fmt.Errorf("Error initing pub key, extract public key failed: %w", err)
-		}
-		e, err := base64.RawURLEncoding.DecodeString(exponent)
-		if err != nil {
-			log.Println("Error decoding exponent:", err)
-			return nil, fmt.Errorf("Error initing pub key, error decoding exponent: %w", err)
-		}
-		pubKey = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
-		break
+// writeDBError answers a failed floor write, a lost revision race becomes a 409 with the current floor.
+func writeDBError(w http.ResponseWriter, err error, fId primitive.ObjectID, msg string, attrs ...any) {
+	logger.Error(msg, append([]any{slog.Any("error", err)}, attrs...)...)
+	if errors.Is(err, ErrRevisionConflict) {
+		writeConflictWithCurrentFloor(w, fId)
+		return
 	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
 
-	if pubKey == nil {
-		return nil, fmt.Errorf("public key not found")
+func errBadQueryParam(name string, err error) error {
+	if err != nil {
+		return fmt.Errorf("Invalid query parameter %s: %w", name, err)
 	}
-	return pubKey, nil
+	return fmt.Errorf("Invalid query parameter %s", name)
 }
 
 func corsHandler(w http.ResponseWriter) {
@@ -326,8 +414,8 @@ func corsHandler(w http.ResponseWriter) {
 	headers.Add("Vary", "Origin")
 	headers.Add("Vary", "Access-Control-Request-Method")
 	headers.Add("Vary", "Access-Control-Request-Headers")
-	headers.Add("Access-Control-Allow-Headers", "Content-Type, Origin, Accept, token")
-	headers.Add("Access-Control-Allow-Methods", "GET, POST,OPTIONS")
+	headers.Add("Access-Control-Allow-Headers", "Content-Type, Origin, Accept, Authorization, token, Last-Event-ID")
+	headers.Add("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 }
 
 func loadPublicKey(pemEncodedKey string) (*rsa.PublicKey, error) {
@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -10,6 +12,9 @@ import (
 	"os"
 	"testing"
 	"time"
+
+	"github.com/golang-jwt/jwt"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 var floorStub = `{
@@ -86,8 +91,7 @@ var floorStub = `{
       "Resident": {
         "Id": "3",
         "Name": "Donald Trump",
-        "Available": true,
-        "ExpoPushToken" : "ExponentPushToken[iSzbFwJHI9J81X3klu3AQ3]"
+        "Available": true
       }
     },
     {
@@ -97,8 +101,7 @@ var floorStub = `{
       "Resident": {
         "Id": "4",
         "Name": "Nodir Shirinov",
-        "Available": true,
-        "ExpoPushToken" : "ExponentPushToken[CMWSpRDXr79n96TN9a43ei]"
+        "Available": true
       }
     },
     {
@@ -108,8 +111,7 @@ var floorStub = `{
       "Resident": {
         "Id": "5",
         "Name": "Benjamin Renert",
-        "Available": false,
-        "ExpoPushToken" : "ExponentPushToken[iSzbFwJHI9J81X3klu3AQ3]"
+        "Available": false
       }
     },
     {
@@ -119,8 +121,7 @@ var floorStub = `{
       "Resident": {
         "Id": "6",
         "Name": "Abdul Majeed Nethyahu",
-        "Available": true,
-        "ExpoPushToken" : "ExponentPushToken[CMWSpRDXr79n96TN9a43ei]"
+        "Available": true
       }
     },
     {
@@ -182,6 +183,10 @@ var floor = `{
 
 var FloorStub Floor
 
+// identity used by the handler tests in place of the one set by authMiddleware
+var floorId = "669fca69d244526d709f6d76"
+var userId = "1"
+
 func TestMain(m *testing.M) {
 	log.Println("setting up test environment")
 	IsTest = true
@@ -189,6 +194,12 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		log.Fatal("TestSetUp could not unmarshal FloorStub ", err)
 	}
+	//channels are not part of the floor JSON, residents 3 to 6 get a push token
+	for i, token := range []string{"ExponentPushToken[iSzbFwJHI9J81X3klu3AQ3]", "ExponentPushToken[CMWSpRDXr79n96TN9a43ei]"} {
+		for r := 2 + i; r <= 5; r += 2 {
+			FloorStub.Rooms[r].Resident.Channels = []Channel{{Type: ChannelExpo, Address: token}}
+		}
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 	initMongo(ctx)
@@ -307,6 +318,113 @@ func TestMain(m *testing.M) {
 // 	return args.String(0), args.String(1), args.Error(2)
 // }
 
+func asResident(req *http.Request, userId string, floorId string) *http.Request {
+	return req.WithContext(contextWithIdentity(req.Context(), Identity{UserId: userId, FloorId: floorId}))
+}
+
+func signTestToken(t *testing.T, key *rsa.PrivateKey, claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func Test_authMiddleware(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as := AuthServiceImpl{keys: staticPublicKey{&key.PublicKey}}
+
+	var got Identity
+	handler := authMiddleware(as, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = identityFromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name       string
+		authHeader string
+		wantStatus int
+		wantId     Identity
+	}{
+		{
+			name:       "should put identity into context",
+			authHeader: "Bearer " + signTestToken(t, key, jwt.MapClaims{"user_id": "2", "floor_id": "669fca69d244526d709f6d76", "exp": time.Now().Add(time.Hour).Unix()}),
+			wantStatus: http.StatusOK,
+			wantId:     Identity{UserId: "2", FloorId: "669fca69d244526d709f6d76"},
+		},
+		{
+			name:       "should accept numeric user id",
+			authHeader: "Bearer " + signTestToken(t, key, jwt.MapClaims{"user_id": 3, "exp": time.Now().Add(time.Hour).Unix()}),
+			wantStatus: http.StatusOK,
+			wantId:     Identity{UserId: "3"},
+		},
+		{
+			name:       "should 401 without token",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "should 401 when signed with other key",
+			authHeader: "Bearer " + signTestToken(t, otherKey, jwt.MapClaims{"user_id": "2", "exp": time.Now().Add(time.Hour).Unix()}),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "should 401 when expired",
+			authHeader: "Bearer " + signTestToken(t, key, jwt.MapClaims{"user_id": "2", "exp": time.Now().Add(-time.Hour).Unix()}),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "should 401 without user id",
+			authHeader: "Bearer " + signTestToken(t, key, jwt.MapClaims{"floor_id": "669fca69d244526d709f6d76", "exp": time.Now().Add(time.Hour).Unix()}),
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = Identity{}
+			req, err := http.NewRequest("GET", "/post-login", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.authHeader != "" {
+				req.Header.Set("Authorization", tt.authHeader)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.wantStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, tt.wantStatus)
+			}
+			if got != tt.wantId {
+				t.Errorf("wrong identity in context: got %v want %v", got, tt.wantId)
+			}
+		})
+	}
+
+	t.Run("should answer preflight for method-only routes", func(t *testing.T) {
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /me/channels", func(w http.ResponseWriter, r *http.Request) {})
+		req, err := http.NewRequest("OPTIONS", "/me/channels", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		authMiddleware(as, mux).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		if rr.Header().Get("Access-Control-Allow-Origin") != "*" {
+			t.Errorf("missing CORS headers on preflight: %v", rr.Header())
+		}
+	})
+}
+
 func Test_RegisterExpoToken(t *testing.T) {
 	f, err := insertTestFloor(FloorStub)
 	if err != nil {
@@ -324,18 +442,65 @@ func Test_RegisterExpoToken(t *testing.T) {
 	}
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(registerExpoPushToken)
-	handler.ServeHTTP(rr, req)
+	handler.ServeHTTP(rr, asResident(req, regExpoToken.UserId, regExpoToken.FloorId))
 
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("handler returned wrong status code: got %v want %v",
 			status, http.StatusOK)
 	}
 
-	var updatedFloor Floor
-	json.Unmarshal(rr.Body.Bytes(), &updatedFloor)
+	updatedFloor, err := getUpdatedFloor(f.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channels := updatedFloor.Rooms[0].Resident.Channels
+	if len(channels) != 1 || channels[0].Type != ChannelExpo || channels[0].Address != regExpoToken.ExpoPushToken {
+		t.Errorf("expected expo channel %v, got %+v", regExpoToken.ExpoPushToken, channels)
+	}
 
-	if updatedFloor.Rooms[0].Resident.ExpoPushToken != "ExponentPushToken[iSzbFwJHI9J81X3klu3AQ3]" {
-		t.Errorf("handler returned wrong body: got %v want %v", updatedFloor.Rooms[0].Resident.ExpoPushToken, "ExponentPushToken[iSzbFwJHI9J81X3klu3AQ3]")
+	//registering the same token again must not add a second channel
+	req, _ = http.NewRequest("POST", "/task-update", bytes.NewReader(regExpTokenJson))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, asResident(req, regExpoToken.UserId, regExpoToken.FloorId))
+	updatedFloor, _ = getUpdatedFloor(f.Id)
+	if got := len(updatedFloor.Rooms[0].Resident.Channels); got != 1 {
+		t.Errorf("expected token to be registered once, got %v channels", got)
+	}
+
+}
+
+func Test_migrateExpoPushTokens(t *testing.T) {
+	f, err := insertTestFloor(FloorStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := "ExponentPushToken[legacy]"
+	//residents stored before channels existed carry the token on the resident
+	_, err = collection.UpdateOne(context.Background(), bson.M{"_id": f.Id},
+		bson.M{"$set": bson.M{"rooms.0.resident.expoPushToken": token}})
+	if err != nil {
+		t.Fatal(err)
 	}
 
+	migrateExpoPushTokens()
+
+	left, err := collection.CountDocuments(context.Background(),
+		bson.M{"_id": f.Id, "rooms.resident.expoPushToken": bson.M{"$exists": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Errorf("legacy expoPushToken not removed")
+	}
+	updatedFloor, err := getUpdatedFloor(f.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channels := updatedFloor.Rooms[0].Resident.Channels
+	if len(channels) != 1 || channels[0].Type != ChannelExpo || channels[0].Address != token {
+		t.Errorf("expected expo channel %v, got %+v", token, channels)
+	}
+	if updatedFloor.Revision != f.Revision+1 {
+		t.Errorf("expected one migration write, got revision %v from %v", updatedFloor.Revision, f.Revision)
+	}
 }
@@ -1,45 +1,129 @@
 package main
 
 import (
-	"fmt"
-
-	expo "github.com/oliveroneill/exponent-server-sdk-golang/sdk"
+	"strconv"
+	"strings"
 )
 
-func sendNotification(r Room, patch []byte, fId string, nType string, title string) error {
-	pushToken, err := expo.NewExponentPushToken(r.Resident.ExpoPushToken)
-	if err != nil {
-		return fmt.Errorf("error creating push token from %s: %w", r.Resident.ExpoPushToken, err)
+// taskUpdateMessages announces to room the tasks it got from a task update or, of the tasks a
+// resident becoming unavailable handed on, the ones that went to room.
+func taskUpdateMessages(f Floor, tu TaskUpdateRequest, room Room, tasksUpdated []Task) []OutboxMessage {
+	roomIndex, err := findRoomById(f.Rooms, room.Id)
+	if err != nil || !notifiable(f.Rooms[roomIndex]) || len(tasksUpdated) == 0 {
+		return nil
 	}
+	if tu.Action == "RESIDENT_UNAVAILABLE" {
+		var taskNames []string
+		for _, t := range tasksUpdated {
+			if t.AssignedTo == room.Id {
+				taskNames = append(taskNames, t.Name)
+			}
+		}
+		if len(taskNames) == 0 {
+			return nil
+		}
+		msg := newMessage("task.assigned", "Task", strings.Join(taskNames, ", "))
+		return []OutboxMessage{newOutboxMessage(f, f.Rooms[roomIndex], "RESIDENT_UNAVAILABLE", msg, "")}
+	}
+	msg := newMessage("task.assigned", "Task", tasksUpdated[0].Name)
+	return []OutboxMessage{newOutboxMessage(f, f.Rooms[roomIndex], "TASK_"+tu.Action, msg, "")}
+}
 
-	client := expo.NewPushClient(nil)
-
-	var m map[string]string = make(map[string]string)
+// taskPooledMessages tells every room but the one of skipUserId that nobody is available for the
+// pooled tasks, so that someone claims them.
+func taskPooledMessages(f Floor, pooled []Task, skipUserId string) []OutboxMessage {
+	if len(pooled) == 0 {
+		return nil
+	}
+	var taskNames []string
+	for _, t := range pooled {
+		taskNames = append(taskNames, t.Name)
+	}
+	msg := newMessage("task.pooled", "Task", strings.Join(taskNames, ", "))
+	var msgs []OutboxMessage
+	for _, r := range f.Rooms {
+		if !notifiable(r) || r.Resident.Id == skipUserId {
+			continue
+		}
+		msgs = append(msgs, newOutboxMessage(f, r, "TASK_POOLED", msg, ""))
+	}
+	return msgs
+}
 
-	m["FloorId"] = fId
-	m["Type"] = nType
-	//TODO reanme to payload
-	m["Patch"] = string(patch)
+// pickedUpMessages announces to every room but the one of skipUserId the pooled tasks it picked up.
+func pickedUpMessages(f Floor, picked []Task, skipUserId string) []OutboxMessage {
+	var msgs []OutboxMessage
+	for _, r := range f.Rooms {
+		if !notifiable(r) || r.Resident.Id == skipUserId {
+			continue
+		}
+		var taskNames []string
+		for _, t := range picked {
+			if t.AssignedTo == r.Id {
+				taskNames = append(taskNames, t.Name)
+			}
+		}
+		if len(taskNames) == 0 {
+			continue
+		}
+		msg := newMessage("task.assigned", "Task", strings.Join(taskNames, ", "))
+		msgs = append(msgs, newOutboxMessage(f, r, "TASK_ASSIGN", msg, ""))
+	}
+	return msgs
+}
 
-	pushMessage := &expo.PushMessage{
-		To:       []expo.ExponentPushToken{pushToken},
-		Body:     "",
-		Data:     m,
-		Sound:    "default",
-		Title:    title,
-		Priority: expo.DefaultPriority,
+// taskReminderMessages reminds the assignee of task with the catalogue message key, which gets the task name.
+func taskReminderMessages(f Floor, task Task, key string) []OutboxMessage {
+	roomIndex, err := findRoomById(f.Rooms, task.AssignedTo)
+	if err != nil || !notifiable(f.Rooms[roomIndex]) {
+		return nil
 	}
+	return []OutboxMessage{newOutboxMessage(f, f.Rooms[roomIndex], "TASK_REMINDER", newMessage(key, "Task", task.Name), task.Id)}
+}
 
-	response, err := client.Publish(pushMessage)
+// votingMessages announces a change of the floor's votings to every room except the one of skipUserId.
+func votingMessages(f Floor, nType string, msg Message, skipUserId string) []OutboxMessage {
+	var msgs []OutboxMessage
+	for _, r := range f.Rooms {
+		if !notifiable(r) || r.Resident.Id == skipUserId {
+			continue
+		}
+		msgs = append(msgs, newOutboxMessage(f, r, nType, msg, ""))
+	}
+	return msgs
+}
 
-	if err != nil {
-		return fmt.Errorf("error publishing expo notification push message: %v, error: %w", pushMessage, err)
+// swapMessages tells the residents of roomIds about swap s. Task is the task the recipient had
+// when the swap was proposed, OtherTask the one offered to them and Resident the proposer.
+func swapMessages(f Floor, s Swap, nType string, key string, roomIds ...int) []OutboxMessage {
+	proposer := ""
+	if i, err := findRoom(f.Rooms, s.ProposedBy); err == nil {
+		proposer = f.Rooms[i].Resident.Name
+	}
+	var msgs []OutboxMessage
+	for _, roomId := range roomIds {
+		roomIndex, err := findRoomById(f.Rooms, roomId)
+		if err != nil || !notifiable(f.Rooms[roomIndex]) {
+			continue
+		}
+		task, other := taskNameOf(f, s.TaskId), taskNameOf(f, s.CounterTaskId)
+		if roomId == s.CounterRoomId {
+			task, other = other, task
+		}
+		msg := newMessage(key, "Task", task, "OtherTask", other, "Resident", proposer)
+		msgs = append(msgs, newOutboxMessage(f, f.Rooms[roomIndex], nType, msg, strconv.Itoa(s.Id)))
 	}
+	return msgs
+}
 
-	if response.ValidateResponse() != nil {
-		return fmt.Errorf("error invalid response when sending notification reponse: %v", response)
+func withoutVoting(votings []Voting, votingId int) []Voting {
+	var rest []Voting
+	for _, v := range votings {
+		if v.Id != votingId {
+			rest = append(rest, v)
+		}
 	}
-	return nil
+	return rest
 }
 
 // func taskToMap(t Task, m map[string]string) {
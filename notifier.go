@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	expo "github.com/oliveroneill/exponent-server-sdk-golang/sdk"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ChannelExpo    = "EXPO"
+	ChannelWebPush = "WEBPUSH"
+	ChannelEmail   = "EMAIL"
+)
+
+// Channel is one way to reach a resident. Address is the Expo push token, the Web Push endpoint
+// or the email address. P256dh and Auth are the keys of a Web Push subscription.
+// Platform is the device the channel was registered from and LastSeen when it was last registered.
+type Channel struct {
+	Type      string    `bson:"type"`
+	Address   string    `bson:"address"`
+	P256dh    string    `bson:"p256dh,omitempty"`
+	Auth      string    `bson:"auth,omitempty"`
+	Platform  string    `bson:"platform,omitempty"`
+	CreatedAt time.Time `bson:"createdAt"`
+	LastSeen  time.Time `bson:"lastSeen"`
+}
+
+// Notification is rendered for its recipient, Title and Body are in the recipient's language.
+// Payload is the JSON Patch taking the floor to Revision, clients without the revision before
+// catch up through /floor/{id}/changes. Push notifiers leave it out when it does not fit the
+// push service's size limit, clients then catch up the same way.
+type Notification struct {
+	FloorId  string
+	Type     string
+	Title    string
+	Body     string
+	Revision int64
+	Payload  []byte
+}
+
+// ErrChannelGone is returned by a Notifier when the push service no longer knows the channel.
+var ErrChannelGone = errors.New("channel is no longer registered")
+
+// Notifier delivers a notification over one kind of channel.
+type Notifier interface {
+	Send(ch Channel, n Notification) error
+}
+
+// notifiers holds a backend per channel type, channels without a configured backend are skipped.
+var notifiers = map[string]Notifier{}
+
+func initNotifiers() {
+	notifiers[ChannelExpo] = newExpoNotifier(getEnv("EXPO_BASE_URL", expo.DefaultHost), getEnv("EXPO_ACCESS_TOKEN", ""))
+	if key := getEnv("VAPID_PRIVATE_KEY", ""); key != "" {
+		wp, err := newWebPushNotifier(key, getEnv("VAPID_SUBJECT", "mailto:admin@wg-planer.de"))
+		if err != nil {
+			logger.Error("initNotifiers web push", slog.Any("error", err))
+		} else {
+			notifiers[ChannelWebPush] = wp
+		}
+	}
+	if host := getEnv("SMTP_HOST", ""); host != "" {
+		notifiers[ChannelEmail] = newEmailNotifier(host, getEnv("SMTP_PORT", "587"), getEnv("SMTP_USER", ""), getEnv("SMTP_PASSWORD", ""), getEnv("SMTP_FROM", "noreply@wg-planer.de"))
+	}
+}
+
+// Delivery is one notification on one channel.
+type Delivery struct {
+	Channel      Channel
+	Notification Notification
+}
+
+// BatchNotifier is a Notifier that can hand many deliveries to its service at once. The result
+// holds an error per delivery.
+type BatchNotifier interface {
+	Notifier
+	SendBatch(ds []Delivery) []error
+}
+
+// number of deliveries sent concurrently to notifiers that cannot batch
+var notifyWorkers = getEnvInt("OUTBOX_WORKERS", 4)
+
+// notifyResidents sends ns[i] on every channel of residents[i]. Deliveries are batched per channel
+// type, the result holds an error per recipient. A recipient fails only if none of its channels got
+// the notification, single channels failing are logged. Channels the push service reports as gone
+// are pruned from the floor.
+func notifyResidents(residents []Resident, ns []Notification) []error {
+	var ds []Delivery
+	var owner []int
+	for i, res := range residents {
+		for _, ch := range res.Channels {
+			if _, ok := notifiers[ch.Type]; !ok {
+				continue
+			}
+			ds = append(ds, Delivery{Channel: ch, Notification: ns[i]})
+			owner = append(owner, i)
+		}
+	}
+	sent := make([]int, len(residents))
+	failures := make([][]error, len(residents))
+	pruned := map[string]bool{}
+	for k, err := range sendDeliveries(ds) {
+		i, d := owner[k], ds[k]
+		switch {
+		case errors.Is(err, ErrChannelGone):
+			key := d.Notification.FloorId + ":" + d.Channel.Type + ":" + d.Channel.Address
+			if pruned[key] {
+				continue
+			}
+			pruned[key] = true
+			fId, _ := primitive.ObjectIDFromHex(d.Notification.FloorId)
+			if err := pruneChannel(fId, d.Channel.Type, d.Channel.Address); err != nil {
+				logger.Error("notifyResidents pruning channel", slog.Any("error", err), slog.String("resident", residents[i].Id), slog.String("channel", d.Channel.Type))
+			}
+		case err != nil:
+			failures[i] = append(failures[i], fmt.Errorf("%s channel: %w", d.Channel.Type, err))
+		default:
+			sent[i]++
+		}
+	}
+	errs := make([]error, len(residents))
+	for i, res := range residents {
+		if len(failures[i]) == 0 {
+			continue
+		}
+		if sent[i] == 0 {
+			errs[i] = errors.Join(failures[i]...)
+			continue
+		}
+		logger.Error("notifyResidents some channels failed", slog.Any("error", errors.Join(failures[i]...)), slog.String("resident", res.Id), slog.String("type", ns[i].Type))
+	}
+	return errs
+}
+
+// sendDeliveries sends each delivery with the notifier of its channel type. Notifiers that can
+// batch get all their deliveries at once, the others are sent by a pool of notifyWorkers.
+func sendDeliveries(ds []Delivery) []error {
+	errs := make([]error, len(ds))
+	byType := map[string][]int{}
+	for i, d := range ds {
+		byType[d.Channel.Type] = append(byType[d.Channel.Type], i)
+	}
+	var single []int
+	var wg sync.WaitGroup
+	for chType, idx := range byType {
+		batcher, ok := notifiers[chType].(BatchNotifier)
+		if !ok {
+			single = append(single, idx...)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batch := make([]Delivery, len(idx))
+			for j, i := range idx {
+				batch[j] = ds[i]
+			}
+			for j, err := range batcher.SendBatch(batch) {
+				errs[idx[j]] = err
+			}
+		}()
+	}
+	jobs := make(chan int)
+	for w := 0; w < notifyWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				errs[i] = notifiers[ds[i].Channel.Type].Send(ds[i].Channel, ds[i].Notification)
+			}
+		}()
+	}
+	for _, i := range single {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return errs
+}
+
+type EmailNotifier struct {
+	addr     string
+	auth     smtp.Auth
+	from     string
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func newEmailNotifier(host string, port string, user string, password string, from string) *EmailNotifier {
+	var auth smtp.Auth
+	if user != "" {
+		auth = smtp.PlainAuth("", user, password, host)
+	}
+	return &EmailNotifier{addr: host + ":" + port, auth: auth, from: from, sendMail: smtp.SendMail}
+}
+
+func (e *EmailNotifier) Send(ch Channel, n Notification) error {
+	subject := mime.QEncoding.Encode("utf-8", strings.ReplaceAll(strings.ReplaceAll(n.Title, "\r", ""), "\n", " "))
+	msg := "From: " + e.from + "\r\n" +
+		"To: " + ch.Address + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		n.Title + "\r\n"
+	if n.Body != "" {
+		msg += "\r\n" + n.Body + "\r\n"
+	}
+	if err := e.sendMail(e.addr, e.auth, e.from, []string{ch.Address}, []byte(msg)); err != nil {
+		return fmt.Errorf("error sending mail to %s: %w", ch.Address, err)
+	}
+	return nil
+}
+
+// MemoryNotifier records notifications instead of sending them, for tests and local runs.
+type MemoryNotifier struct {
+	mu   sync.Mutex
+	sent []SentNotification
+	fail error
+}
+
+type SentNotification struct {
+	Channel      Channel
+	Notification Notification
+}
+
+func (m *MemoryNotifier) Send(ch Channel, n Notification) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return m.fail
+	}
+	m.sent = append(m.sent, SentNotification{Channel: ch, Notification: n})
+	return nil
+}
+
+func (m *MemoryNotifier) Sent() []SentNotification {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]SentNotification(nil), m.sent...)
+}
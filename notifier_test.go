@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func Test_notifyResidentsChannels(t *testing.T) {
+	saved := notifiers
+	defer func() { notifiers = saved }()
+	expoFake := &MemoryNotifier{}
+	mailFake := &MemoryNotifier{}
+	notifiers = map[string]Notifier{ChannelExpo: expoFake, ChannelEmail: mailFake}
+	res := Resident{Id: "1", Channels: []Channel{
+		{Type: ChannelExpo, Address: "ExponentPushToken[a]"},
+		{Type: ChannelExpo, Address: "ExponentPushToken[b]"},
+		{Type: ChannelEmail, Address: "max@example.com"},
+		{Type: ChannelWebPush, Address: "https://push.example.com/1"},
+	}}
+	expoOnly := Resident{Id: "2", Channels: []Channel{{Type: ChannelExpo, Address: "ExponentPushToken[c]"}}}
+	n := Notification{FloorId: "f", Type: "TASK_REMINDER", Title: "title"}
+	residents := []Resident{res, expoOnly}
+	ns := []Notification{n, n}
+
+	t.Run("should send on every configured channel", func(t *testing.T) {
+		for i, err := range notifyResidents(residents, ns) {
+			if err != nil {
+				t.Errorf("recipient %d: %v", i, err)
+			}
+		}
+		if got := len(expoFake.Sent()); got != 3 {
+			t.Errorf("expected 3 expo notifications, got %v", got)
+		}
+		if got := len(mailFake.Sent()); got != 1 {
+			t.Errorf("expected 1 email, got %v", got)
+		}
+	})
+
+	t.Run("should succeed for a recipient if one of its channels got it", func(t *testing.T) {
+		expoFake.fail = errors.New("expo down")
+		errs := notifyResidents(residents, ns)
+		if errs[0] != nil {
+			t.Errorf("expected partial failure to pass, got %v", errs[0])
+		}
+		if errs[1] == nil {
+			t.Errorf("expected error for recipient without delivered channel")
+		}
+	})
+
+	t.Run("should fail if all channels failed", func(t *testing.T) {
+		mailFake.fail = errors.New("smtp down")
+		if err := notifyResidents(residents, ns)[0]; err == nil {
+			t.Errorf("expected error when no channel delivered")
+		}
+	})
+}
+
+func Test_EmailNotifier(t *testing.T) {
+	e := newEmailNotifier("smtp.example.com", "587", "", "", "noreply@wg-planer.de")
+	var gotTo []string
+	var gotMsg string
+	e.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		gotTo, gotMsg = to, string(msg)
+		return nil
+	}
+	err := e.Send(Channel{Type: ChannelEmail, Address: "max@example.com"}, Notification{Title: "Küche ist dran\r\nBcc: x@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotTo) != 1 || gotTo[0] != "max@example.com" {
+		t.Errorf("wrong recipients: %v", gotTo)
+	}
+	headers, _, _ := strings.Cut(gotMsg, "\r\n\r\n")
+	if strings.Contains(headers, "\r\nBcc:") {
+		t.Errorf("title injected a header: %q", gotMsg)
+	}
+}
+
+func Test_validateChannel(t *testing.T) {
+	p256dh := base64.RawURLEncoding.EncodeToString(make([]byte, 65))
+	auth := base64.RawURLEncoding.EncodeToString(make([]byte, 16))
+	tests := []struct {
+		name    string
+		ch      Channel
+		wantErr bool
+	}{
+		{"expo token", Channel{Type: ChannelExpo, Address: "ExponentPushToken[abc]"}, false},
+		{"bad expo token", Channel{Type: ChannelExpo, Address: "abc"}, true},
+		{"web push", Channel{Type: ChannelWebPush, Address: "https://push.example.com/x", P256dh: p256dh, Auth: auth}, false},
+		{"web push over http", Channel{Type: ChannelWebPush, Address: "http://push.example.com/x", P256dh: p256dh, Auth: auth}, true},
+		{"web push without keys", Channel{Type: ChannelWebPush, Address: "https://push.example.com/x"}, true},
+		{"email", Channel{Type: ChannelEmail, Address: "max@example.com"}, false},
+		{"email with name", Channel{Type: ChannelEmail, Address: "Max <max@example.com>"}, true},
+		{"unknown type", Channel{Type: "SMS", Address: "123"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateChannel(tt.ch); (err != nil) != tt.wantErr {
+				t.Errorf("validateChannel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_addChannel(t *testing.T) {
+	res := Resident{}
+	addChannel(&res, Channel{Type: ChannelExpo, Address: "a"})
+	addChannel(&res, Channel{Type: ChannelExpo, Address: "a"})
+	addChannel(&res, Channel{Type: ChannelEmail, Address: "a"})
+	if len(res.Channels) != 2 {
+		t.Errorf("expected 2 channels, got %+v", res.Channels)
+	}
+	if !removeChannel(&res, ChannelExpo, "a") || len(res.Channels) != 1 || res.Channels[0].Type != ChannelEmail {
+		t.Errorf("wrong channels after remove: %+v", res.Channels)
+	}
+}
+
+func Test_WebPushNotifier(t *testing.T) {
+	vapid, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wp, err := newWebPushNotifier(base64.RawURLEncoding.EncodeToString(vapid.Bytes()), "mailto:test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wp.publicKey() != base64.RawURLEncoding.EncodeToString(vapid.PublicKey().Bytes()) {
+		t.Errorf("public key does not match private key")
+	}
+	ua, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := make([]byte, 16)
+	io.ReadFull(rand.Reader, authSecret)
+
+	var body []byte
+	var header http.Header
+	status := http.StatusCreated
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	ch := Channel{
+		Type:    ChannelWebPush,
+		Address: server.URL + "/push/1",
+		P256dh:  base64.RawURLEncoding.EncodeToString(ua.PublicKey().Bytes()),
+		Auth:    base64.RawURLEncoding.EncodeToString(authSecret),
+	}
+
+	t.Run("should send encrypted payload with VAPID authorization", func(t *testing.T) {
+		if err := wp.Send(ch, Notification{FloorId: "f", Type: "TASK_REMINDER", Title: "Küche", Revision: 7}); err != nil {
+			t.Fatal(err)
+		}
+		if header.Get("Content-Encoding") != "aes128gcm" || header.Get("TTL") == "" {
+			t.Errorf("missing web push headers: %v", header)
+		}
+		if !strings.HasPrefix(header.Get("Authorization"), "vapid t=") || !strings.HasSuffix(header.Get("Authorization"), "k="+wp.publicKey()) {
+			t.Errorf("wrong authorization header: %v", header.Get("Authorization"))
+		}
+		plain := decryptWebPush(t, body, ua, authSecret)
+		var msg map[string]any
+		if err := json.Unmarshal(plain, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg["title"] != "Küche" || msg["type"] != "TASK_REMINDER" || msg["revision"] != 7.0 {
+			t.Errorf("wrong payload: %v", msg)
+		}
+	})
+
+	t.Run("should leave out a patch too large for the record", func(t *testing.T) {
+		patch := []byte(`[{"op":"replace","path":"/tasks","value":"` + strings.Repeat("x", 5000) + `"}]`)
+		if err := wp.Send(ch, Notification{FloorId: "f", Type: "TASK_UPDATE", Title: "Küche", Revision: 8, Payload: patch}); err != nil {
+			t.Fatal(err)
+		}
+		plain := decryptWebPush(t, body, ua, authSecret)
+		if len(plain)+webPushRecordOverhead > webPushRecordSize {
+			t.Errorf("payload of %v bytes does not fit the record", len(plain))
+		}
+		var msg map[string]any
+		if err := json.Unmarshal(plain, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := msg["patch"]; ok || msg["revision"] != 8.0 {
+			t.Errorf("expected patch to be left out and revision kept: %v", msg["revision"])
+		}
+	})
+
+	t.Run("should report expired subscription", func(t *testing.T) {
+		status = http.StatusGone
+		if err := wp.Send(ch, Notification{Title: "x"}); !errors.Is(err, ErrChannelGone) {
+			t.Errorf("expected ErrChannelGone, got %v", err)
+		}
+	})
+}
+
+// decryptWebPush is the user agent side of RFC 8291.
+func decryptWebPush(t *testing.T, body []byte, ua *ecdh.PrivateKey, authSecret []byte) []byte {
+	t.Helper()
+	salt := body[:16]
+	if rs := binary.BigEndian.Uint32(body[16:20]); rs != 4096 {
+		t.Errorf("wrong record size %v", rs)
+	}
+	keyLen := int(body[20])
+	asPublicBytes := body[21 : 21+keyLen]
+	asPublic, err := ecdh.P256().NewPublicKey(asPublicBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := ua.ECDH(asPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyInfo := append([]byte("WebPush: info\x00"), ua.PublicKey().Bytes()...)
+	keyInfo = append(keyInfo, asPublicBytes...)
+	ikm := hkdfExpand(hkdfExtract(authSecret, shared), keyInfo, 32)
+	prk := hkdfExtract(salt, ikm)
+	block, _ := aes.NewCipher(hkdfExpand(prk, []byte("Content-Encoding: aes128gcm\x00"), 16))
+	gcm, _ := cipher.NewGCM(block)
+	plain, err := gcm.Open(nil, hkdfExpand(prk, []byte("Content-Encoding: nonce\x00"), 12), body[21+keyLen:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain[len(plain)-1] != 0x02 {
+		t.Errorf("missing last record delimiter")
+	}
+	return plain[:len(plain)-1]
+}
+
+// memoryBatchNotifier is a MemoryNotifier that also takes batches.
+type memoryBatchNotifier struct {
+	MemoryNotifier
+	batches int
+}
+
+func (m *memoryBatchNotifier) SendBatch(ds []Delivery) []error {
+	m.batches++
+	errs := make([]error, len(ds))
+	for i, d := range ds {
+		errs[i] = m.Send(d.Channel, d.Notification)
+	}
+	return errs
+}
+
+func Test_notifyResidents(t *testing.T) {
+	saved := notifiers
+	defer func() { notifiers = saved }()
+	expoFake := &memoryBatchNotifier{}
+	mailFake := &MemoryNotifier{}
+	notifiers = map[string]Notifier{ChannelExpo: expoFake, ChannelEmail: mailFake}
+	var residents []Resident
+	var ns []Notification
+	for i := 0; i < 7; i++ {
+		residents = append(residents, Resident{Id: strconv.Itoa(i), Channels: []Channel{{Type: ChannelExpo, Address: strconv.Itoa(i)}}})
+		ns = append(ns, Notification{Type: "VOTING_ADD"})
+	}
+	residents[3].Channels = append(residents[3].Channels, Channel{Type: ChannelEmail, Address: "max@example.com"})
+	residents[5].Channels = nil
+
+	errs := notifyResidents(residents, ns)
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("recipient %v failed: %v", i, err)
+		}
+	}
+	if expoFake.batches != 1 || len(expoFake.Sent()) != 6 {
+		t.Errorf("expected one batch of 6 expo deliveries, got %v batches with %v", expoFake.batches, len(expoFake.Sent()))
+	}
+	if len(mailFake.Sent()) != 1 {
+		t.Errorf("expected one email, got %v", len(mailFake.Sent()))
+	}
+
+	mailFake.fail = errors.New("smtp down")
+	expoFake.fail = errors.New("expo down")
+	errs = notifyResidents(residents[3:5], ns[3:5])
+	if errs[0] == nil || errs[1] == nil {
+		t.Errorf("expected both recipients to fail on their own, got %v", errs)
+	}
+}
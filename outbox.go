@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	OutboxPending = "PENDING"
+	OutboxSending = "SENDING"
+	OutboxSent    = "SENT"
+	OutboxDead    = "DEAD"
+	OutboxSkipped = "SKIPPED"
+)
+
+// OutboxMessage is a notification waiting for delivery. Messages are pushed into the floor
+// document in the same write as the state change they announce (Floor.PendingOutbox) and then
+// relayed into the outbox collection, so a crash in between cannot lose them. Key is the
+// idempotency key, a message with a key that is already in the outbox is dropped.
+type OutboxMessage struct {
+	Key     string             `bson:"_id" json:"key"`
+	FloorId primitive.ObjectID `bson:"floorId" json:"floorId"`
+	RoomId  int                `bson:"roomId" json:"roomId"`
+	Type    string             `bson:"type" json:"type"`
+	Title   string             `bson:"title" json:"title"`
+	//floor revision of the write the message announces, its patch is sent along
+	Revision int64 `bson:"revision,omitempty" json:"revision,omitempty"`
+	//data sent by messages stored before floor changes were recorded
+	Payload       string     `bson:"payload,omitempty" json:"payload,omitempty"`
+	Status        string     `bson:"status" json:"status"`
+	Attempts      int        `bson:"attempts" json:"attempts"`
+	NextAttemptAt time.Time  `bson:"nextAttemptAt" json:"nextAttemptAt"`
+	LockedUntil   time.Time  `bson:"lockedUntil,omitempty" json:"-"`
+	LastError     string     `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	CreatedAt     time.Time  `bson:"createdAt" json:"createdAt"`
+	SentAt        *time.Time `bson:"sentAt,omitempty" json:"sentAt,omitempty"`
+	//held back for the resident's daily digest
+	Digest bool `bson:"digest,omitempty" json:"digest,omitempty"`
+	//catalogue key and arguments the title and body are rendered from in the resident's language,
+	//Title is the rendering in the default locale
+	Template string            `bson:"template,omitempty" json:"template,omitempty"`
+	Args     map[string]string `bson:"args,omitempty" json:"args,omitempty"`
+}
+
+var outboxMaxAttempts = getEnvInt("OUTBOX_MAX_ATTEMPTS", 6)
+var outboxBaseBackoff = 2 * time.Second
+var outboxMaxBackoff = 10 * time.Minute
+
+// a claimed message not finished within this time is handed out again
+var outboxLease = time.Minute
+
+var outboxWakeup = make(chan struct{}, 1)
+
+var adminUserIds = strings.Split(getEnv("ADMIN_USER_IDS", ""), ",")
+
+// newOutboxMessage builds a message for room announcing the write that takes f to its next revision.
+// discriminator tells apart several messages of the same type to the same room in one write.
+func newOutboxMessage(f Floor, room Room, nType string, msg Message, discriminator string) OutboxMessage {
+	key := fmt.Sprintf("%s:%d:%s:%d", f.Id.Hex(), f.Revision+1, nType, room.Id)
+	if discriminator != "" {
+		key += ":" + discriminator
+	}
+	return OutboxMessage{
+		Key:       key,
+		FloorId:   f.Id,
+		RoomId:    room.Id,
+		Type:      nType,
+		Title:     localize(defaultLocale, msg.Key+".title", msg.Args),
+		Template:  msg.Key,
+		Args:      msg.Args,
+		Revision:  f.Revision + 1,
+		Status:    OutboxPending,
+		CreatedAt: time.Now(),
+	}
+}
+
+// notifiable reports whether a room has someone to send notifications to.
+func notifiable(r Room) bool {
+	return r.Resident.Id != "" && len(r.Resident.Channels) > 0
+}
+
+func floorRevisionKey(fId primitive.ObjectID, revision int64) string {
+	return fId.Hex() + ":" + strconv.FormatInt(revision, 10)
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxBaseBackoff << (attempts - 1)
+	if backoff <= 0 || backoff > outboxMaxBackoff {
+		return outboxMaxBackoff
+	}
+	return backoff
+}
+
+// relayOutbox moves the pending messages of f into the outbox collection and wakes up the dispatcher.
+func relayOutbox(f Floor) error {
+	if len(f.PendingOutbox) == 0 {
+		return nil
+	}
+	if err := insertOutboxMessages(f.PendingOutbox); err != nil {
+		return err
+	}
+	keys := make([]string, len(f.PendingOutbox))
+	for i, m := range f.PendingOutbox {
+		keys[i] = m.Key
+	}
+	if err := removePendingOutbox(f.Id, keys); err != nil {
+		return err
+	}
+	select {
+	case outboxWakeup <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// most messages claimed and handed to the notifiers at once
+var outboxBatchSize = 500
+
+// OutboxDispatcher delivers outbox messages in batches, so a floor-wide announcement goes out in
+// as few push requests as possible while every message keeps its own delivery status.
+type OutboxDispatcher struct {
+	clock        Clock
+	pollInterval time.Duration
+	send         func([]OutboxMessage) []error
+}
+
+func newOutboxDispatcher(clock Clock, pollInterval time.Duration, send func([]OutboxMessage) []error) *OutboxDispatcher {
+	return &OutboxDispatcher{clock: clock, pollInterval: pollInterval, send: send}
+}
+
+func (d *OutboxDispatcher) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(d.pollInterval)
+		defer ticker.Stop()
+		for {
+			if _, err := d.runOnce(); err != nil {
+				logger.Error("outboxDispatcher run", slog.Any("error", err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-outboxWakeup:
+			}
+		}
+	}()
+}
+
+// runOnce relays messages left in floors by an earlier crash, then claims due messages and
+// delivers them batch by batch. It returns the number of messages handled.
+func (d *OutboxDispatcher) runOnce() (int, error) {
+	floors, err := findFloorsWithPendingOutbox()
+	if err != nil {
+		return 0, fmt.Errorf("outboxDispatcher finding floors: %w", err)
+	}
+	for _, f := range floors {
+		if err := relayOutbox(f); err != nil {
+			logger.Error("outboxDispatcher relay", slog.Any("error", err), slog.Any("floor id", f.Id))
+		}
+	}
+
+	handled := 0
+	for {
+		batch, err := d.claimBatch()
+		if len(batch) > 0 {
+			for i, sendErr := range d.send(batch) {
+				d.finish(batch[i], sendErr)
+			}
+			handled += len(batch)
+		}
+		if err != nil {
+			return handled, fmt.Errorf("outboxDispatcher claiming message: %w", err)
+		}
+		if len(batch) < outboxBatchSize {
+			return handled, nil
+		}
+	}
+}
+
+func (d *OutboxDispatcher) claimBatch() ([]OutboxMessage, error) {
+	var batch []OutboxMessage
+	for len(batch) < outboxBatchSize {
+		now := d.clock.Now()
+		m, err := claimOutboxMessage(now, now.Add(outboxLease))
+		if err == mongo.ErrNoDocuments {
+			break
+		}
+		if err != nil {
+			return batch, err
+		}
+		batch = append(batch, m)
+	}
+	return batch, nil
+}
+
+// finish records the result of sending m, a failed message is retried with backoff until it is dead.
+// Messages muted or held back by the resident's preferences do not count as attempts.
+func (d *OutboxDispatcher) finish(m OutboxMessage, err error) {
+	now := d.clock.Now()
+	var held *HeldError
+	switch {
+	case err == nil:
+		if err := markOutboxSent(m.Key, now); err != nil {
+			logger.Error("outboxDispatcher marking sent", slog.Any("error", err), slog.String("key", m.Key))
+		}
+		return
+	case errors.Is(err, ErrMuted):
+		if err := markOutboxSkipped(m.Key, now); err != nil {
+			logger.Error("outboxDispatcher marking skipped", slog.Any("error", err), slog.String("key", m.Key))
+		}
+		return
+	case errors.As(err, &held):
+		if err := markOutboxHeld(m.Key, held.Until, held.Digest); err != nil {
+			logger.Error("outboxDispatcher marking held", slog.Any("error", err), slog.String("key", m.Key))
+		}
+		return
+	}
+	attempts := m.Attempts + 1
+	status := OutboxPending
+	if attempts >= outboxMaxAttempts {
+		status = OutboxDead
+	}
+	logger.Error("outboxDispatcher send attempt: "+strconv.Itoa(attempts), slog.Any("error", err), slog.String("key", m.Key), slog.String("status", status))
+	if err := markOutboxFailed(m.Key, status, attempts, now.Add(outboxBackoff(attempts)), err.Error()); err != nil {
+		logger.Error("outboxDispatcher marking failed", slog.Any("error", err), slog.String("key", m.Key))
+	}
+}
+
+// sendOutboxMessages delivers each message on all channels of the current resident of its room,
+// unless the resident's notification preferences mute or hold it. Messages held for a digest go
+// out as one notification per resident. The result holds an error per message.
+func sendOutboxMessages(msgs []OutboxMessage) []error {
+	errs := make([]error, len(msgs))
+	floors := map[primitive.ObjectID]Floor{}
+	recipients := make([]Resident, len(msgs))
+	var userIds []string
+	for i, m := range msgs {
+		f, ok := floors[m.FloorId]
+		if !ok {
+			var err error
+			f, err = FindFloor(m.FloorId.Hex())
+			if err != nil {
+				errs[i] = fmt.Errorf("finding floor: %w", err)
+				continue
+			}
+			floors[m.FloorId] = f
+		}
+		roomIndex, err := findRoomById(f.Rooms, m.RoomId)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		recipients[i] = f.Rooms[roomIndex].Resident
+		userIds = append(userIds, recipients[i].Id)
+	}
+	prefs, err := findNotificationPreferences(userIds)
+	if err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = fmt.Errorf("finding notification preferences: %w", err)
+			}
+		}
+		return errs
+	}
+	revisions := map[primitive.ObjectID][]int64{}
+	for i, m := range msgs {
+		if errs[i] == nil && m.Revision > 0 {
+			revisions[m.FloorId] = append(revisions[m.FloorId], m.Revision)
+		}
+	}
+	changes, err := findFloorChangesAt(revisions)
+	if err != nil {
+		//the notification still goes out, the client catches up through /changes
+		logger.Error("sendOutboxMessages finding floor changes", slog.Any("error", err))
+	}
+
+	now := time.Now()
+	var residents []Resident
+	var ns []Notification
+	var groups [][]int
+	digests := map[string][]int{}
+	for i, m := range msgs {
+		if errs[i] != nil {
+			continue
+		}
+		if err := applyPreferences(prefs[recipients[i].Id], m, now, floorLocation(floors[m.FloorId])); err != nil {
+			errs[i] = err
+			continue
+		}
+		if m.Digest {
+			key := m.FloorId.Hex() + ":" + strconv.Itoa(m.RoomId)
+			digests[key] = append(digests[key], i)
+			continue
+		}
+		residents = append(residents, recipients[i])
+		n := renderNotification(m, prefs[recipients[i].Id].locale())
+		if change, ok := changes[floorRevisionKey(m.FloorId, m.Revision)]; ok {
+			if n.Payload, err = json.Marshal(change.Patch); err != nil {
+				errs[i] = err
+				continue
+			}
+		}
+		ns = append(ns, n)
+		groups = append(groups, []int{i})
+	}
+	for _, idx := range digests {
+		held := make([]OutboxMessage, len(idx))
+		for j, i := range idx {
+			held[j] = msgs[i]
+		}
+		n, err := digestNotification(held[0].FloorId.Hex(), held, prefs[recipients[idx[0]].Id].locale())
+		if err != nil {
+			for _, i := range idx {
+				errs[i] = err
+			}
+			continue
+		}
+		residents = append(residents, recipients[idx[0]])
+		ns = append(ns, n)
+		groups = append(groups, idx)
+	}
+	for j, err := range notifyResidents(residents, ns) {
+		for _, i := range groups[j] {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// callerAdmin is callerIdentity for the operator endpoints, only users listed in ADMIN_USER_IDS pass.
+func callerAdmin(w http.ResponseWriter, r *http.Request) (Identity, bool) {
+	identity, ok := callerIdentity(w, r)
+	if !ok {
+		return Identity{}, false
+	}
+	if !slices.Contains(adminUserIds, identity.UserId) {
+		writeError(w, r, "error.adminRequired", http.StatusForbidden)
+		return Identity{}, false
+	}
+	return identity, true
+}
+
+func HandleListOutbox(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	if _, ok := callerAdmin(w, r); !ok {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = OutboxDead
+	}
+	limit := int64(defaultHistoryLimit)
+	if v := r.URL.Query().Get("limit"); v != "" {
+		l, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || l <= 0 {
+			http.Error(w, errBadQueryParam("limit", err).Error(), http.StatusBadRequest)
+			return
+		}
+		limit = min(l, maxHistoryLimit)
+	}
+	messages, err := findOutboxMessages(status, limit)
+	if err != nil {
+		logger.Error("listOutbox findOutboxMessages", slog.Any("error", err), slog.String("status", status))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+func HandleRetryOutbox(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	if _, ok := callerAdmin(w, r); !ok {
+		return
+	}
+	key := r.PathValue("key")
+	retried, err := retryOutboxMessage(key, time.Now())
+	if err != nil {
+		logger.Error("retryOutbox retryOutboxMessage", slog.Any("error", err), slog.String("key", key))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !retried {
+		writeError(w, r, "error.noFailedMessage", http.StatusNotFound)
+		return
+	}
+	select {
+	case outboxWakeup <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func Test_outboxBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: outboxBaseBackoff},
+		{attempts: 2, want: 2 * outboxBaseBackoff},
+		{attempts: 4, want: 8 * outboxBaseBackoff},
+		{attempts: 40, want: outboxMaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := outboxBackoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff after %v attempts: got %v want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func Test_withOutbox(t *testing.T) {
+	msgs := []OutboxMessage{{Key: "k"}}
+	update := withOutbox(bson.M{"$push": bson.M{"votings": Voting{Id: 1}}}, msgs)
+	push := update["$push"].(bson.M)
+	if _, ok := push["votings"]; !ok {
+		t.Errorf("existing push was dropped: %v", update)
+	}
+	if _, ok := push["pendingOutbox"]; !ok {
+		t.Errorf("outbox not pushed: %v", update)
+	}
+	if update := withOutbox(bson.M{"$set": bson.M{}}, nil); update["$push"] != nil {
+		t.Errorf("expected no push without messages: %v", update)
+	}
+}
+
+func Test_newOutboxMessage(t *testing.T) {
+	f := Floor{Id: primitive.NewObjectID(), Revision: 4}
+	m := newOutboxMessage(f, Room{Id: 2}, "TASK_REMINDER", newMessage("task.due", "Task", "Küche"), "7")
+	want := f.Id.Hex() + ":5:TASK_REMINDER:2:7"
+	if m.Key != want {
+		t.Errorf("wrong idempotency key: got %v want %v", m.Key, want)
+	}
+	if m.Status != OutboxPending {
+		t.Errorf("wrong status: got %v want %v", m.Status, OutboxPending)
+	}
+	if m.Revision != 5 {
+		t.Errorf("message not tied to the revision of its write: got %v want 5", m.Revision)
+	}
+}
+
+func Test_taskUpdateMessages(t *testing.T) {
+	f := Floor{
+		Rooms: []Room{
+			{Id: 0, Resident: Resident{Id: "1", Channels: []Channel{{Type: ChannelExpo, Address: "ExponentPushToken[a]"}}}},
+			{Id: 1, Resident: Resident{Id: "2"}},
+		},
+		Tasks: []Task{{Id: "0", Name: "Küche", AssignedTo: 0}},
+	}
+	msgs := taskUpdateMessages(f, TaskUpdateRequest{Action: "DONE"}, f.Rooms[0], f.Tasks)
+	if len(msgs) != 1 || msgs[0].Type != "TASK_DONE" || msgs[0].RoomId != 0 {
+		t.Errorf("wrong messages: %+v", msgs)
+	}
+	msgs = taskUpdateMessages(f, TaskUpdateRequest{Action: "DONE"}, f.Rooms[1], f.Tasks)
+	if len(msgs) != 0 {
+		t.Errorf("expected no message to room without push token, got %+v", msgs)
+	}
+	tasks := []Task{{Id: "0", Name: "Küche", AssignedTo: 0}, {Id: "1", Name: "Bad", AssignedTo: 1}, {Id: "2", Name: "Flur", AssignedTo: 0}}
+	msgs = taskUpdateMessages(f, TaskUpdateRequest{Action: "RESIDENT_UNAVAILABLE"}, f.Rooms[0], tasks)
+	if len(msgs) != 1 || msgs[0].Args["Task"] != "Küche, Flur" {
+		t.Errorf("expected only the tasks of the room, got %+v", msgs)
+	}
+}
+
+func Test_outboxDispatcher(t *testing.T) {
+	f, err := insertTestFloor(FloorStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	t.Run("should relay and deliver message written with the floor", func(t *testing.T) {
+		msg := newOutboxMessage(f, f.Rooms[0], "TASK_REMINDER", newMessage("task.due", "Task", "Küche"), "relay")
+		f, err = updateTasks(f, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sent int32
+		d := newOutboxDispatcher(fakeClock{now}, time.Second, func(msgs []OutboxMessage) []error {
+			for _, m := range msgs {
+				if m.Key == msg.Key {
+					atomic.AddInt32(&sent, 1)
+				}
+			}
+			return make([]error, len(msgs))
+		})
+		if _, err := d.runOnce(); err != nil {
+			t.Fatal(err)
+		}
+		if sent != 1 {
+			t.Errorf("expected message to be sent once, got %v", sent)
+		}
+		var stored OutboxMessage
+		if err := outboxCollection.FindOne(context.Background(), bson.M{"_id": msg.Key}).Decode(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if stored.Status != OutboxSent {
+			t.Errorf("wrong status: got %v want %v", stored.Status, OutboxSent)
+		}
+
+		//relaying the same key again must not send twice
+		if err := insertOutboxMessages([]OutboxMessage{msg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.runOnce(); err != nil {
+			t.Fatal(err)
+		}
+		if sent != 1 {
+			t.Errorf("duplicate key delivered again, sent %v times", sent)
+		}
+	})
+
+	t.Run("should back off and dead letter failing message", func(t *testing.T) {
+		msg := newOutboxMessage(f, f.Rooms[0], "TASK_REMINDER", newMessage("task.due", "Task", "Küche"), "fail")
+		msg.NextAttemptAt = now
+		if err := insertOutboxMessages([]OutboxMessage{msg}); err != nil {
+			t.Fatal(err)
+		}
+		failing := func(msgs []OutboxMessage) []error {
+			errs := make([]error, len(msgs))
+			for i := range msgs {
+				errs[i] = errors.New("push service down")
+			}
+			return errs
+		}
+		clock := now
+		for i := 0; i < outboxMaxAttempts; i++ {
+			if _, err := newOutboxDispatcher(fakeClock{clock}, time.Second, failing).runOnce(); err != nil {
+				t.Fatal(err)
+			}
+			clock = clock.Add(outboxMaxBackoff)
+		}
+		var stored OutboxMessage
+		if err := outboxCollection.FindOne(context.Background(), bson.M{"_id": msg.Key}).Decode(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if stored.Status != OutboxDead || stored.Attempts != outboxMaxAttempts || stored.LastError == "" {
+			t.Errorf("expected dead message, got %+v", stored)
+		}
+
+		adminUserIds = []string{"admin"}
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /admin/outbox/{key}/retry", HandleRetryOutbox)
+		req, err := http.NewRequest("POST", "/admin/outbox/"+msg.Key+"/retry", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(req, "1", floorId))
+		if status := rr.Code; status != http.StatusForbidden {
+			t.Errorf("non admin retried: got %v want %v", status, http.StatusForbidden)
+		}
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(req, "admin", ""))
+		if status := rr.Code; status != http.StatusAccepted {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusAccepted)
+		}
+		if err := outboxCollection.FindOne(context.Background(), bson.M{"_id": msg.Key}).Decode(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if stored.Status != OutboxPending || stored.Attempts != 0 {
+			t.Errorf("expected message to be pending again, got %+v", stored)
+		}
+	})
+}
+
+// failingAddressNotifier takes batches and fails deliveries to one address.
+type failingAddressNotifier struct {
+	address string
+	batches int32
+}
+
+func (n *failingAddressNotifier) Send(ch Channel, _ Notification) error {
+	if ch.Address == n.address {
+		return errors.New("device unreachable")
+	}
+	return nil
+}
+
+func (n *failingAddressNotifier) SendBatch(ds []Delivery) []error {
+	atomic.AddInt32(&n.batches, 1)
+	errs := make([]error, len(ds))
+	for i, d := range ds {
+		errs[i] = n.Send(d.Channel, d.Notification)
+	}
+	return errs
+}
+
+func Test_outboxFloorBroadcast(t *testing.T) {
+	saved := notifiers
+	defer func() { notifiers = saved }()
+	f, err := insertTestFloor(FloorStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := f.Rooms[3].Resident.Channels[0].Address
+	fake := &failingAddressNotifier{address: unreachable}
+	notifiers = map[string]Notifier{ChannelExpo: fake}
+
+	msgs := votingMessages(f, "VOTING_ADD", newMessage("voting.create", "Task", "Küche"), "")
+	if len(msgs) != 4 {
+		t.Fatalf("expected a message per resident with a channel, got %v", len(msgs))
+	}
+	if _, err := updateTasks(f, msgs...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newOutboxDispatcher(fakeClock{time.Now()}, time.Second, sendOutboxMessages).runOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if fake.batches != 1 {
+		t.Errorf("expected the broadcast to go out in one batch, got %v", fake.batches)
+	}
+	for _, m := range msgs {
+		var stored OutboxMessage
+		if err := outboxCollection.FindOne(context.Background(), bson.M{"_id": m.Key}).Decode(&stored); err != nil {
+			t.Fatal(err)
+		}
+		reachable := f.Rooms[m.RoomId].Resident.Channels[0].Address != unreachable
+		if reachable && stored.Status != OutboxSent {
+			t.Errorf("room %v: got status %v want %v", m.RoomId, stored.Status, OutboxSent)
+		}
+		if !reachable && (stored.Status != OutboxPending || stored.Attempts != 1) {
+			t.Errorf("room %v: expected message to be retried on its own, got %+v", m.RoomId, stored)
+		}
+	}
+}
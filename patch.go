@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// most changes handed out by /changes, a client further behind refetches the floor
+var maxFloorChanges = int64(getEnvInt("MAX_FLOOR_CHANGES", 200))
+
+// how long the patch of a revision is kept
+var floorChangeRetention = 7 * 24 * time.Hour
+
+// PatchOp is one RFC 6902 JSON Patch operation. Value is left out for remove.
+type PatchOp struct {
+	Op    string          `bson:"op" json:"op"`
+	Path  string          `bson:"path" json:"path"`
+	Value json.RawMessage `bson:"value,omitempty" json:"value,omitempty"`
+}
+
+// FloorChange is the JSON Patch that takes the floor JSON from Revision-1 to Revision.
+type FloorChange struct {
+	Id        primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	FloorId   primitive.ObjectID `bson:"floorId" json:"-"`
+	Revision  int64              `bson:"revision" json:"revision"`
+	Patch     []PatchOp          `bson:"patch" json:"patch"`
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// ChangesResponse answers /changes. If Refetch is set the patches after the client's revision are
+// no longer complete and the client has to load the whole floor.
+type ChangesResponse struct {
+	Revision int64         `json:"revision"`
+	Refetch  bool          `json:"refetch"`
+	Changes  []FloorChange `json:"changes"`
+}
+
+// floorPatch returns the JSON Patch from before to after, both as sent to clients at now.
+func floorPatch(before Floor, after Floor, now time.Time) ([]PatchOp, error) {
+	markOverdue(&before, now)
+	markOverdue(&after, now)
+	var from, to any
+	for _, v := range []struct {
+		f   Floor
+		dst *any
+	}{{before, &from}, {after, &to}} {
+		data, err := json.Marshal(v.f)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, v.dst); err != nil {
+			return nil, err
+		}
+	}
+	return diffJSON(nil, "", from, to)
+}
+
+// diffJSON appends the operations turning from into to at path. Both are decoded JSON values.
+func diffJSON(ops []PatchOp, path string, from any, to any) ([]PatchOp, error) {
+	switch f := from.(type) {
+	case map[string]any:
+		t, ok := to.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(f)+len(t))
+		for k := range f {
+			keys = append(keys, k)
+		}
+		for k := range t {
+			if _, ok := f[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		var err error
+		for _, k := range keys {
+			fv, inFrom := f[k]
+			tv, inTo := t[k]
+			p := path + "/" + escapePointer(k)
+			switch {
+			case !inTo:
+				ops = append(ops, PatchOp{Op: "remove", Path: p})
+			case !inFrom:
+				ops, err = appendValueOp(ops, "add", p, tv)
+			default:
+				ops, err = diffJSON(ops, p, fv, tv)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return ops, nil
+	case []any:
+		t, ok := to.([]any)
+		if !ok {
+			break
+		}
+		return diffArray(ops, path, f, t)
+	}
+	if reflect.DeepEqual(from, to) {
+		return ops, nil
+	}
+	return appendValueOp(ops, "replace", path, to)
+}
+
+// diffArray keeps the common head and tail of the arrays and replaces, removes or adds the
+// elements in between, so a single insert or delete does not shift every later element.
+func diffArray(ops []PatchOp, path string, from []any, to []any) ([]PatchOp, error) {
+	head := 0
+	for head < len(from) && head < len(to) && reflect.DeepEqual(from[head], to[head]) {
+		head++
+	}
+	tail := 0
+	for tail < len(from)-head && tail < len(to)-head && reflect.DeepEqual(from[len(from)-1-tail], to[len(to)-1-tail]) {
+		tail++
+	}
+	fromMid, toMid := from[head:len(from)-tail], to[head:len(to)-tail]
+	common := min(len(fromMid), len(toMid))
+	var err error
+	for i := 0; i < common; i++ {
+		if ops, err = diffJSON(ops, path+"/"+strconv.Itoa(head+i), fromMid[i], toMid[i]); err != nil {
+			return nil, err
+		}
+	}
+	//remove from the back so the indexes of the remaining elements stay valid
+	for i := len(fromMid) - 1; i >= common; i-- {
+		ops = append(ops, PatchOp{Op: "remove", Path: path + "/" + strconv.Itoa(head+i)})
+	}
+	for i := common; i < len(toMid); i++ {
+		if ops, err = appendValueOp(ops, "add", path+"/"+strconv.Itoa(head+i), toMid[i]); err != nil {
+			return nil, err
+		}
+	}
+	return ops, nil
+}
+
+func appendValueOp(ops []PatchOp, op string, path string, value any) ([]PatchOp, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return append(ops, PatchOp{Op: op, Path: path, Value: data}), nil
+}
+
+// escapePointer escapes a key for use as JSON Pointer reference token (RFC 6901).
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// recordFloorChange stores the patch of a write that took the floor from before to after. The
+// write went through already, a missing patch only makes clients that need it refetch.
+func recordFloorChange(before Floor, after Floor, now time.Time) (FloorChange, error) {
+	ops, err := floorPatch(before, after, now)
+	if err != nil {
+		return FloorChange{}, err
+	}
+	if ops == nil {
+		ops = []PatchOp{}
+	}
+	change := FloorChange{FloorId: after.Id, Revision: after.Revision, Patch: ops, CreatedAt: now}
+	if err := insertFloorChange(change); err != nil {
+		return change, err
+	}
+	return change, nil
+}
+
+func HandleGetFloorChanges(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerFloorFromPath(w, r)
+	if !ok {
+		return
+	}
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil || since < 0 {
+		http.Error(w, errBadQueryParam("since", err).Error(), http.StatusBadRequest)
+		return
+	}
+	floor, err := FindFloor(identity.FloorId)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, "error.floorNotFound", http.StatusNotFound)
+			return
+		}
+		writeError(w, r, "error.getFloor", http.StatusInternalServerError, "Error", err.Error())
+		return
+	}
+	resp := ChangesResponse{Revision: floor.Revision, Changes: []FloorChange{}}
+	switch {
+	case since > floor.Revision || floor.Revision-since > maxFloorChanges:
+		resp.Refetch = true
+	case since < floor.Revision:
+		changes, err := findFloorChanges(floor.Id, since, floor.Revision)
+		if err != nil {
+			logger.Error("getFloorChanges findFloorChanges", slog.Any("error", err), slog.Any("floor id", floor.Id))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !completeChanges(changes, since, floor.Revision) {
+			resp.Refetch = true
+			break
+		}
+		resp.Changes = changes
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// completeChanges reports whether changes, sorted by revision, hold every revision after since up to revision.
+func completeChanges(changes []FloorChange, since int64, revision int64) bool {
+	if int64(len(changes)) != revision-since {
+		return false
+	}
+	for i, c := range changes {
+		if c.Revision != since+1+int64(i) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// applyPatch applies the add, remove and replace operations of ops to doc, a decoded JSON value.
+func applyPatch(t *testing.T, doc any, ops []PatchOp) any {
+	t.Helper()
+	for _, op := range ops {
+		tokens := strings.Split(op.Path, "/")[1:]
+		for i, tok := range tokens {
+			tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(tok)
+		}
+		var value any
+		if op.Op != "remove" {
+			if err := json.Unmarshal(op.Value, &value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		doc = applyOp(t, doc, tokens, op.Op, value)
+	}
+	return doc
+}
+
+func applyOp(t *testing.T, doc any, tokens []string, op string, value any) any {
+	if len(tokens) == 0 {
+		return value
+	}
+	switch d := doc.(type) {
+	case map[string]any:
+		if len(tokens) > 1 {
+			d[tokens[0]] = applyOp(t, d[tokens[0]], tokens[1:], op, value)
+		} else if op == "remove" {
+			delete(d, tokens[0])
+		} else {
+			d[tokens[0]] = value
+		}
+		return d
+	case []any:
+		i, err := strconv.Atoi(tokens[0])
+		if err != nil || i > len(d) {
+			t.Fatalf("bad array index %v", tokens[0])
+		}
+		switch {
+		case len(tokens) > 1:
+			d[i] = applyOp(t, d[i], tokens[1:], op, value)
+		case op == "remove":
+			d = append(d[:i], d[i+1:]...)
+		case op == "add":
+			d = append(d[:i], append([]any{value}, d[i:]...)...)
+		default:
+			d[i] = value
+		}
+		return d
+	}
+	t.Fatalf("cannot apply %v at %v to %v", op, tokens, doc)
+	return nil
+}
+
+func decodeJSON(t *testing.T, s string) any {
+	var v any
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func Test_diffJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    string
+		to      string
+		wantOps int
+	}{
+		{"equal", `{"a":[1,2],"b":{"c":null}}`, `{"a":[1,2],"b":{"c":null}}`, 0},
+		{"replace value", `{"a":1}`, `{"a":2}`, 1},
+		{"add and remove key", `{"a":1}`, `{"b":1}`, 2},
+		{"escaped key", `{"a/b":1,"c~d":1}`, `{"a/b":2,"c~d":1}`, 1},
+		{"insert in the middle", `[1,2,3]`, `[1,4,2,3]`, 1},
+		{"delete in the middle", `[1,2,3,4]`, `[1,4]`, 2},
+		{"change nested element", `{"Tasks":[{"Id":"0","Name":"a"},{"Id":"1","Name":"b"}]}`, `{"Tasks":[{"Id":"0","Name":"a"},{"Id":"1","Name":"c"}]}`, 1},
+		{"type change", `{"a":[1]}`, `{"a":{"b":1}}`, 1},
+		{"null to array", `{"Votings":null}`, `{"Votings":[{"Id":1}]}`, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops, err := diffJSON(nil, "", decodeJSON(t, tt.from), decodeJSON(t, tt.to))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ops) != tt.wantOps {
+				t.Errorf("expected %v operations, got %+v", tt.wantOps, ops)
+			}
+			if got := applyPatch(t, decodeJSON(t, tt.from), ops); !reflect.DeepEqual(got, decodeJSON(t, tt.to)) {
+				t.Errorf("patch %+v does not lead to %v, got %v", ops, tt.to, got)
+			}
+		})
+	}
+}
+
+func Test_floorPatch(t *testing.T) {
+	now := time.Now()
+	before := Floor{Revision: 3, Tasks: []Task{{Id: "0", Name: "Küche"}, {Id: "1", Name: "Bad"}}}
+	after := Floor{Revision: 4, Tasks: []Task{{Id: "1", Name: "Bad"}}}
+	ops, err := floorPatch(before, after, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PatchOp{
+		{Op: "replace", Path: "/Revision", Value: json.RawMessage("4")},
+		{Op: "remove", Path: "/Tasks/0"},
+	}
+	if !reflect.DeepEqual(ops, want) {
+		t.Errorf("wrong patch: got %+v want %+v", ops, want)
+	}
+	data, _ := json.Marshal(ops[1])
+	if string(data) != `{"op":"remove","path":"/Tasks/0"}` {
+		t.Errorf("remove must not carry a value: %s", data)
+	}
+}
+
+func Test_completeChanges(t *testing.T) {
+	changes := []FloorChange{{Revision: 3}, {Revision: 4}}
+	if !completeChanges(changes, 2, 4) {
+		t.Errorf("expected revisions 3 and 4 to be complete")
+	}
+	if completeChanges(changes, 1, 4) {
+		t.Errorf("expected missing revision 2 to be incomplete")
+	}
+	if completeChanges([]FloorChange{{Revision: 3}, {Revision: 5}}, 2, 4) {
+		t.Errorf("expected gap to be incomplete")
+	}
+}
+
+func Test_floorChanges(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /floor/{id}/changes", HandleGetFloorChanges)
+	f, err := insertTestFloor(FloorStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := f.Revision
+	startJSON, _ := json.Marshal(f)
+	f.Tasks[0].Name = "Bad putzen"
+	if f, err = updateTasks(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Rooms[2].Resident.Available = false
+	if f, err = updateRoom(f, 2); err != nil {
+		t.Fatal(err)
+	}
+	get := func(since string) (ChangesResponse, int) {
+		req, _ := http.NewRequest("GET", "/floor/"+f.Id.Hex()+"/changes?since="+since, nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(req, userId, f.Id.Hex()))
+		var resp ChangesResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp, rr.Code
+	}
+
+	t.Run("should return the patches since the revision", func(t *testing.T) {
+		resp, code := get(strconv.FormatInt(start, 10))
+		if code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", code, http.StatusOK)
+		}
+		if resp.Refetch || resp.Revision != f.Revision || len(resp.Changes) != 2 {
+			t.Fatalf("wrong changes: %+v", resp)
+		}
+		doc := decodeJSON(t, string(startJSON))
+		for _, c := range resp.Changes {
+			doc = applyPatch(t, doc, c.Patch)
+		}
+		current, _ := json.Marshal(f)
+		if !reflect.DeepEqual(doc, decodeJSON(t, string(current))) {
+			t.Errorf("patches do not lead to the current floor")
+		}
+	})
+
+	t.Run("should return no changes for current revision", func(t *testing.T) {
+		if resp, _ := get(strconv.FormatInt(f.Revision, 10)); resp.Refetch || len(resp.Changes) != 0 {
+			t.Errorf("wrong changes: %+v", resp)
+		}
+	})
+
+	t.Run("should ask for refetch if a patch is missing", func(t *testing.T) {
+		if _, err := floorChangeCollection.DeleteOne(context.Background(), bson.M{"floorId": f.Id, "revision": start + 1}); err != nil {
+			t.Fatal(err)
+		}
+		if resp, _ := get(strconv.FormatInt(start, 10)); !resp.Refetch || len(resp.Changes) != 0 {
+			t.Errorf("expected refetch, got %+v", resp)
+		}
+		if resp, _ := get(strconv.FormatInt(f.Revision+5, 10)); !resp.Refetch {
+			t.Errorf("expected refetch for unknown revision, got %+v", resp)
+		}
+	})
+
+	t.Run("should reject missing since", func(t *testing.T) {
+		if _, code := get(""); code != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code: got %v want %v", code, http.StatusBadRequest)
+		}
+	})
+}
+
+func Test_notificationPatch(t *testing.T) {
+	saved := notifiers
+	defer func() { notifiers = saved }()
+	fake := &MemoryNotifier{}
+	notifiers = map[string]Notifier{ChannelExpo: fake}
+	f, err := insertTestFloor(FloorStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Tasks[0].AssignedTo = 2
+	f.Tasks[0].Reminders++
+	fUp, err := updateTasks(f, taskReminderMessages(f, f.Tasks[0], "task.remind")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newOutboxDispatcher(fakeClock{time.Now()}, time.Second, sendOutboxMessages).runOnce(); err != nil {
+		t.Fatal(err)
+	}
+	sent := fake.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("expected one notification, got %v", len(sent))
+	}
+	n := sent[0].Notification
+	var ops []PatchOp
+	if err := json.Unmarshal(n.Payload, &ops); err != nil {
+		t.Fatalf("payload is no JSON Patch: %s", n.Payload)
+	}
+	if n.Revision != fUp.Revision || !strings.Contains(string(n.Payload), `"/Tasks/0/Reminders"`) {
+		t.Errorf("wrong patch for revision %v: %v %s", fUp.Revision, n.Revision, n.Payload)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notification types a resident can mute
+var notificationTypes = []string{"TASK_DONE", "TASK_ASSIGN", "TASK_UNASSIGN", "TASK_REMINDER", "TASK_POOLED", "VOTING_ADD", "VOTING_RESOLVED", "RESIDENT_UNAVAILABLE", "SWAP_PROPOSED", "SWAP_ACCEPTED", "SWAP_DECLINED", "SWAP_EXPIRED"}
+
+const defaultDigestTime = "18:00"
+
+// NotificationPreferences is stored per resident. Quiet hours and the digest time are "15:04"
+// clock times in the floor's timezone. In digest mode notifications are held and sent together
+// once a day at DigestTime. Language is the locale notifications are rendered in, defaultLocale
+// if empty.
+type NotificationPreferences struct {
+	UserId     string    `bson:"_id" json:"-"`
+	Muted      []string  `bson:"muted" json:"muted"`
+	QuietStart string    `bson:"quietStart" json:"quietStart"`
+	QuietEnd   string    `bson:"quietEnd" json:"quietEnd"`
+	Digest     bool      `bson:"digest" json:"digest"`
+	DigestTime string    `bson:"digestTime" json:"digestTime"`
+	Language   string    `bson:"language" json:"language"`
+	UpdatedAt  time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// ErrMuted is the delivery result of a notification the resident does not want.
+var ErrMuted = errors.New("notification type muted by resident")
+
+// HeldError is the delivery result of a notification held back by the resident's preferences
+// until Until. Digest marks it as part of the resident's next digest.
+type HeldError struct {
+	Until  time.Time
+	Digest bool
+}
+
+func (e *HeldError) Error() string {
+	return fmt.Sprintf("notification held until %v", e.Until)
+}
+
+// locale returns the language notifications for the resident are rendered in.
+func (p NotificationPreferences) locale() string {
+	if p.Language == "" {
+		return defaultLocale
+	}
+	return p.Language
+}
+
+func defaultNotificationPreferences(userId string) NotificationPreferences {
+	return NotificationPreferences{UserId: userId, Muted: []string{}, DigestTime: defaultDigestTime}
+}
+
+func validateNotificationPreferences(p NotificationPreferences) error {
+	for _, t := range p.Muted {
+		if !slices.Contains(notificationTypes, t) {
+			return fmt.Errorf("Unknown notification type %s", t)
+		}
+	}
+	if (p.QuietStart == "") != (p.QuietEnd == "") {
+		return fmt.Errorf("Quiet hours need a start and an end")
+	}
+	for _, c := range []string{p.QuietStart, p.QuietEnd, p.DigestTime} {
+		if _, err := parseClock(c); err != nil {
+			return fmt.Errorf("Invalid time %s, expected HH:MM", c)
+		}
+	}
+	if p.Digest && p.DigestTime == "" {
+		return fmt.Errorf("Digest mode needs a digest time")
+	}
+	return validLocale(p.Language)
+}
+
+// nextClockTime returns the first time at or after now (in loc) the wall clock shows clock.
+func nextClockTime(clock string, now time.Time, loc *time.Location) time.Time {
+	minute, _ := parseClock(clock)
+	local := now.In(loc)
+	next := time.Date(local.Year(), local.Month(), local.Day(), minute/60, minute%60, 0, 0, loc)
+	if next.Before(local) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// applyPreferences decides what happens to m at now: nil sends it, ErrMuted drops it and a
+// *HeldError holds it back. Messages already held for a digest are due as part of it.
+func applyPreferences(p NotificationPreferences, m OutboxMessage, now time.Time, loc *time.Location) error {
+	if slices.Contains(p.Muted, m.Type) {
+		return ErrMuted
+	}
+	if p.Digest && !m.Digest {
+		return &HeldError{Until: nextClockTime(p.DigestTime, now, loc), Digest: true}
+	}
+	if inQuietHours(p.QuietStart, p.QuietEnd, now.In(loc)) {
+		return &HeldError{Until: nextClockTime(p.QuietEnd, now, loc), Digest: m.Digest}
+	}
+	return nil
+}
+
+// renderNotification renders m for a reader of locale. Messages written before the catalogue
+// existed only have their title.
+func renderNotification(m OutboxMessage, locale string) Notification {
+	n := Notification{FloorId: m.FloorId.Hex(), Type: m.Type, Title: m.Title, Revision: m.Revision, Payload: []byte(m.Payload)}
+	if m.Template != "" {
+		n.Title = localize(locale, m.Template+".title", m.Args)
+		n.Body = localize(locale, m.Template+".body", m.Args)
+	}
+	return n
+}
+
+// digestNotification sums up the messages held for one resident's digest in one notification.
+func digestNotification(floorId string, msgs []OutboxMessage, locale string) (Notification, error) {
+	type item struct {
+		Type  string
+		Title string
+	}
+	items := make([]item, len(msgs))
+	titles := make([]string, len(msgs))
+	for i, m := range msgs {
+		titles[i] = renderNotification(m, locale).Title
+		items[i] = item{Type: m.Type, Title: titles[i]}
+	}
+	payload, err := json.Marshal(items)
+	if err != nil {
+		return Notification{}, err
+	}
+	args := argsOf("Count", strconv.Itoa(len(msgs)), "Summary", strings.Join(titles, "\n"))
+	return Notification{
+		FloorId: floorId,
+		Type:    "DIGEST",
+		Title:   localize(locale, "digest.title", args),
+		Body:    localize(locale, "digest.body", args),
+		Payload: payload,
+	}, nil
+}
+
+func HandleGetNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerIdentity(w, r)
+	if !ok {
+		return
+	}
+	prefs, err := findNotificationPreferences([]string{identity.UserId})
+	if err != nil {
+		logger.Error("getNotificationPreferences findNotificationPreferences", slog.Any("error", err), slog.String("user id", identity.UserId))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs[identity.UserId])
+}
+
+func HandleUpdateNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerIdentity(w, r)
+	if !ok {
+		return
+	}
+	prefs := defaultNotificationPreferences(identity.UserId)
+	err := json.NewDecoder(r.Body).Decode(&prefs)
+	if err != nil {
+		logger.Error("updateNotificationPreferences decoding data payload", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = validateNotificationPreferences(prefs); err != nil {
+		writeError(w, r, "error.notificationPreference", http.StatusBadRequest, "Error", err.Error())
+		return
+	}
+	if prefs.Muted == nil {
+		prefs.Muted = []string{}
+	}
+	prefs.UserId = identity.UserId
+	prefs.UpdatedAt = time.Now()
+	if err = upsertNotificationPreferences(prefs); err != nil {
+		logger.Error("updateNotificationPreferences upsertNotificationPreferences", slog.Any("error", err), slog.String("user id", identity.UserId))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func Test_validateNotificationPreferences(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       NotificationPreferences
+		wantErr bool
+	}{
+		{"defaults", defaultNotificationPreferences("1"), false},
+		{"muted and quiet", NotificationPreferences{Muted: []string{"TASK_REMINDER"}, QuietStart: "22:00", QuietEnd: "07:00"}, false},
+		{"unknown type", NotificationPreferences{Muted: []string{"SPAM"}}, true},
+		{"quiet start only", NotificationPreferences{QuietStart: "22:00"}, true},
+		{"bad clock", NotificationPreferences{QuietStart: "25:00", QuietEnd: "07:00"}, true},
+		{"digest without time", NotificationPreferences{Digest: true}, true},
+		{"english", NotificationPreferences{Language: "en"}, false},
+		{"unsupported language", NotificationPreferences{Language: "fr"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateNotificationPreferences(tt.p); (err != nil) != tt.wantErr {
+				t.Errorf("validateNotificationPreferences() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_applyPreferences(t *testing.T) {
+	loc, _ := time.LoadLocation("Europe/Berlin")
+	night := time.Date(2024, 6, 10, 23, 30, 0, 0, loc)
+	day := time.Date(2024, 6, 10, 12, 0, 0, 0, loc)
+	quiet := NotificationPreferences{QuietStart: "22:00", QuietEnd: "07:00"}
+	digest := NotificationPreferences{Digest: true, DigestTime: "18:00"}
+	reminder := OutboxMessage{Type: "TASK_REMINDER"}
+
+	t.Run("should mute type", func(t *testing.T) {
+		p := NotificationPreferences{Muted: []string{"TASK_REMINDER"}}
+		if err := applyPreferences(p, reminder, day, loc); !errors.Is(err, ErrMuted) {
+			t.Errorf("expected ErrMuted, got %v", err)
+		}
+		if err := applyPreferences(p, OutboxMessage{Type: "VOTING_ADD"}, day, loc); err != nil {
+			t.Errorf("expected other types to be sent, got %v", err)
+		}
+	})
+
+	t.Run("should hold until quiet hours end in floor time", func(t *testing.T) {
+		var held *HeldError
+		if err := applyPreferences(quiet, reminder, night, loc); !errors.As(err, &held) {
+			t.Fatalf("expected held message, got %v", err)
+		}
+		want := time.Date(2024, 6, 11, 7, 0, 0, 0, loc)
+		if !held.Until.Equal(want) || held.Digest {
+			t.Errorf("wrong hold: got %+v want until %v", held, want)
+		}
+		if err := applyPreferences(quiet, reminder, day, loc); err != nil {
+			t.Errorf("expected message outside quiet hours to be sent, got %v", err)
+		}
+	})
+
+	t.Run("should hold for digest and send it at digest time", func(t *testing.T) {
+		var held *HeldError
+		if err := applyPreferences(digest, reminder, day, loc); !errors.As(err, &held) {
+			t.Fatalf("expected held message, got %v", err)
+		}
+		if want := time.Date(2024, 6, 10, 18, 0, 0, 0, loc); !held.Until.Equal(want) || !held.Digest {
+			t.Errorf("wrong hold: got %+v want digest at %v", held, want)
+		}
+		if err := applyPreferences(digest, OutboxMessage{Type: "TASK_REMINDER", Digest: true}, held.Until, loc); err != nil {
+			t.Errorf("expected digest message to be due, got %v", err)
+		}
+	})
+}
+
+func Test_nextClockTime(t *testing.T) {
+	loc := time.UTC
+	now := time.Date(2024, 6, 10, 18, 0, 0, 0, loc)
+	if got := nextClockTime("18:00", now, loc); !got.Equal(now) {
+		t.Errorf("expected now, got %v", got)
+	}
+	if got := nextClockTime("07:30", now, loc); !got.Equal(time.Date(2024, 6, 11, 7, 30, 0, 0, loc)) {
+		t.Errorf("expected next morning, got %v", got)
+	}
+}
+
+func Test_digestNotification(t *testing.T) {
+	n, err := digestNotification(floorId, []OutboxMessage{{Type: "TASK_REMINDER", Title: "a"}, {Type: "VOTING_ADD", Title: "b"}}, "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Type != "DIGEST" || !strings.Contains(n.Title, "2") || !strings.Contains(string(n.Payload), `"Title":"b"`) {
+		t.Errorf("wrong digest: %+v", n)
+	}
+}
+
+func Test_notificationPreferences(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /me/notification-preferences", HandleGetNotificationPreferences)
+	mux.HandleFunc("PUT /me/notification-preferences", HandleUpdateNotificationPreferences)
+	user := "prefs-user"
+	defer preferencesCollection.DeleteOne(context.Background(), bson.M{"_id": user})
+
+	t.Run("should return defaults", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/me/notification-preferences", nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(req, user, floorId))
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		var got NotificationPreferences
+		json.Unmarshal(rr.Body.Bytes(), &got)
+		if len(got.Muted) != 0 || got.Digest || got.DigestTime != defaultDigestTime {
+			t.Errorf("wrong defaults: %+v", got)
+		}
+	})
+
+	t.Run("should reject invalid preferences", func(t *testing.T) {
+		req, _ := http.NewRequest("PUT", "/me/notification-preferences", strings.NewReader(`{"muted":["SPAM"]}`))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(req, user, floorId))
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("should store preferences", func(t *testing.T) {
+		req, _ := http.NewRequest("PUT", "/me/notification-preferences", strings.NewReader(`{"muted":["TASK_REMINDER"],"quietStart":"22:00","quietEnd":"07:00"}`))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(req, user, floorId))
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		prefs, err := findNotificationPreferences([]string{user})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := prefs[user]
+		if len(got.Muted) != 1 || got.QuietStart != "22:00" || got.QuietEnd != "07:00" {
+			t.Errorf("wrong preferences stored: %+v", got)
+		}
+	})
+}
+
+func Test_outboxPreferences(t *testing.T) {
+	saved := notifiers
+	defer func() { notifiers = saved }()
+	fake := &MemoryNotifier{}
+	notifiers = map[string]Notifier{ChannelExpo: fake}
+	f, err := insertTestFloor(FloorStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	muting, quiet := f.Rooms[2].Resident, f.Rooms[3].Resident
+	for _, p := range []NotificationPreferences{
+		{UserId: muting.Id, Muted: []string{"VOTING_ADD"}},
+		//quiet around the clock
+		{UserId: quiet.Id, QuietStart: "00:00", QuietEnd: "23:59"},
+	} {
+		if err := upsertNotificationPreferences(p); err != nil {
+			t.Fatal(err)
+		}
+		defer preferencesCollection.DeleteOne(context.Background(), bson.M{"_id": p.UserId})
+	}
+	msgs := votingMessages(f, "VOTING_ADD", newMessage("voting.create", "Task", "Küche"), "")
+	if _, err := updateTasks(f, msgs...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newOutboxDispatcher(fakeClock{time.Now()}, time.Second, sendOutboxMessages).runOnce(); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range msgs {
+		var stored OutboxMessage
+		if err := outboxCollection.FindOne(context.Background(), bson.M{"_id": m.Key}).Decode(&stored); err != nil {
+			t.Fatal(err)
+		}
+		switch f.Rooms[m.RoomId].Resident.Id {
+		case muting.Id:
+			if stored.Status != OutboxSkipped {
+				t.Errorf("muted message: got status %v want %v", stored.Status, OutboxSkipped)
+			}
+		case quiet.Id:
+			if stored.Status != OutboxPending || stored.Attempts != 0 || !stored.NextAttemptAt.After(time.Now()) {
+				t.Errorf("expected message held without attempt, got %+v", stored)
+			}
+		default:
+			if stored.Status != OutboxSent {
+				t.Errorf("room %v: got status %v want %v", m.RoomId, stored.Status, OutboxSent)
+			}
+		}
+	}
+	if got := len(fake.Sent()); got != 2 {
+		t.Errorf("expected 2 notifications sent, got %v", got)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	QuorumMajority  = "MAJORITY"
+	QuorumUnanimous = "UNANIMOUS"
+	QuorumThreshold = "THRESHOLD"
+	QuorumVeto      = "VETO"
+)
+
+const (
+	VoteAccept  = "ACCEPT"
+	VoteReject  = "REJECT"
+	VoteAbstain = "ABSTAIN"
+)
+
+// QuorumPolicy decides when a voting passes:
+//   - MAJORITY: more than half of the active residents that did not abstain accept. Once the
+//     window is closed only the residents that voted count, it expires if nobody voted.
+//   - UNANIMOUS: every active resident that did not abstain accepts, a single reject rejects.
+//   - THRESHOLD: Threshold accepts pass it, it is rejected once that many can no longer come together.
+//   - VETO: a single reject rejects, otherwise it passes once everyone voted or the window closes.
+type QuorumPolicy struct {
+	Type      string `bson:"type" json:"type"`
+	Threshold int    `bson:"threshold,omitempty" json:"threshold,omitempty"`
+}
+
+// policies of floors that did not choose one for a voting type
+var defaultQuorumPolicies = map[string]QuorumPolicy{
+	VotingCreateTask:       {Type: QuorumMajority},
+	VotingDeleteTask:       {Type: QuorumUnanimous},
+	VotingRenameTask:       {Type: QuorumMajority},
+	VotingChangeRecurrence: {Type: QuorumMajority},
+	VotingReorderRotation:  {Type: QuorumMajority},
+	VotingAdmitResident:    {Type: QuorumMajority},
+	VotingRemoveResident:   {Type: QuorumUnanimous},
+	VotingChangeSettings:   {Type: QuorumMajority},
+}
+
+type QuorumRequest struct {
+	Revision *int64 `json:"revision,omitempty"`
+	QuorumPolicy
+}
+
+// Tally holds the votes of the floor's active residents. The creator of a voting counts as
+// accepting unless they voted otherwise, votes of anyone else are ignored. A resident that is
+// voted out is not part of the electorate. Voted leaves out the creator's implicit accept.
+type Tally struct {
+	Electorate int `bson:"electorate" json:"electorate"`
+	Accepts    int `bson:"accepts" json:"accepts"`
+	Rejects    int `bson:"rejects" json:"rejects"`
+	Abstains   int `bson:"abstains" json:"abstains"`
+	Voted      int `bson:"voted" json:"voted"`
+}
+
+// outstanding is the number of active residents that did not vote yet.
+func (t Tally) outstanding() int {
+	return t.Electorate - t.Accepts - t.Rejects - t.Abstains
+}
+
+func tallyVoting(f Floor, v Voting) Tally {
+	var t Tally
+	removed := removedResident(f, v)
+	for _, r := range f.Rooms {
+		id := r.Resident.Id
+		if id == "" || !r.Resident.Available || id == removed {
+			continue
+		}
+		t.Electorate++
+		switch {
+		case slices.Contains(v.Rejects, id):
+			t.Rejects++
+		case slices.Contains(v.Accepts, id):
+			t.Accepts++
+		case slices.Contains(v.Abstains, id):
+			t.Abstains++
+		case id == v.CreatedBy:
+			t.Accepts++
+			continue
+		default:
+			continue
+		}
+		t.Voted++
+	}
+	return t
+}
+
+// quorumPolicyFor returns the policy v was launched with, votings from before quorum policies
+// get the floor's current one.
+func quorumPolicyFor(f Floor, v Voting) QuorumPolicy {
+	if v.Quorum.Type != "" {
+		return v.Quorum
+	}
+	if p, ok := f.QuorumPolicies[v.Type]; ok {
+		return p
+	}
+	return defaultQuorumPolicies[v.Type]
+}
+
+// decide returns the outcome of a voting with tally t, VotingPending while it is still open.
+func (p QuorumPolicy) decide(t Tally, windowClosed bool) string {
+	switch p.Type {
+	case QuorumMajority:
+		eligible := t.Electorate - t.Abstains
+		if windowClosed {
+			if t.Voted == 0 {
+				//nobody but the creator took part
+				return VotingExpired
+			}
+			eligible = t.Accepts + t.Rejects
+		}
+		if 2*t.Accepts > eligible {
+			return VotingAccepted
+		}
+		if eligible > 0 && 2*t.Rejects >= eligible {
+			return VotingRejected
+		}
+	case QuorumUnanimous:
+		if t.Rejects > 0 {
+			return VotingRejected
+		}
+		if t.Accepts > 0 && t.outstanding() == 0 {
+			return VotingAccepted
+		}
+	case QuorumThreshold:
+		if t.Accepts >= p.Threshold {
+			return VotingAccepted
+		}
+		if t.Accepts+t.outstanding() < p.Threshold {
+			return VotingRejected
+		}
+	case QuorumVeto:
+		if t.Rejects > 0 {
+			return VotingRejected
+		}
+		if windowClosed || t.outstanding() == 0 {
+			return VotingAccepted
+		}
+	}
+	if windowClosed {
+		return VotingExpired
+	}
+	return VotingPending
+}
+
+// requiredAccepts is the number of accepts that pass a voting on a floor of electorate active
+// residents when everyone votes.
+func (p QuorumPolicy) requiredAccepts(electorate int) int {
+	switch p.Type {
+	case QuorumMajority:
+		return electorate/2 + 1
+	case QuorumUnanimous:
+		return electorate
+	case QuorumThreshold:
+		return p.Threshold
+	}
+	return 0
+}
+
+// vetoes reports whether a single reject rejects a voting.
+func (p QuorumPolicy) vetoes() bool {
+	return p.Type == QuorumUnanimous || p.Type == QuorumVeto
+}
+
+// lowersQuorum reports whether to lets votings on f pass more easily than from in any respect,
+// with fewer accepts or without the single resident's veto.
+func lowersQuorum(f Floor, from QuorumPolicy, to QuorumPolicy) bool {
+	electorate := tallyVoting(f, Voting{}).Electorate
+	return to.requiredAccepts(electorate) < from.requiredAccepts(electorate) || from.vetoes() && !to.vetoes()
+}
+
+func validateQuorumPolicy(p QuorumPolicy) error {
+	switch p.Type {
+	case "":
+		return nil
+	case QuorumMajority, QuorumUnanimous, QuorumVeto:
+		if p.Threshold != 0 {
+			return fmt.Errorf("only %s takes a threshold", QuorumThreshold)
+		}
+		return nil
+	case QuorumThreshold:
+		if p.Threshold < 1 {
+			return fmt.Errorf("threshold must be at least 1")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown policy %s", p.Type)
+}
+
+// castVote records the vote of userId on v, replacing an earlier vote of theirs.
+func castVote(v *Voting, userId string, action string) bool {
+	if action != VoteAccept && action != VoteReject && action != VoteAbstain {
+		return false
+	}
+	without := func(ids []string) []string {
+		return slices.DeleteFunc(slices.Clone(ids), func(id string) bool { return id == userId })
+	}
+	v.Accepts, v.Rejects, v.Abstains = without(v.Accepts), without(v.Rejects), without(v.Abstains)
+	switch action {
+	case VoteAccept:
+		v.Accepts = append(v.Accepts, userId)
+	case VoteReject:
+		v.Rejects = append(v.Rejects, userId)
+	case VoteAbstain:
+		v.Abstains = append(v.Abstains, userId)
+	}
+	return true
+}
+
+// setQuorumPolicy sets the policy of f for votingType, an empty policy falls back to the default.
+func setQuorumPolicy(f *Floor, votingType string, p QuorumPolicy) {
+	if f.QuorumPolicies == nil {
+		f.QuorumPolicies = map[string]QuorumPolicy{}
+	}
+	if p.Type == "" {
+		delete(f.QuorumPolicies, votingType)
+	} else {
+		f.QuorumPolicies[votingType] = p
+	}
+}
+
+// HandleQuorumPolicyUpdate sets the policy for new votings of one type on the floor, an empty
+// type falls back to the default. A single resident may only make votings harder to pass, a
+// policy that lowers the bar launches a CHANGE_SETTINGS voting instead.
+func HandleQuorumPolicyUpdate(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerFloorFromPath(w, r)
+	if !ok {
+		return
+	}
+	votingType := r.PathValue("votingType")
+	if _, ok := votingTypes[votingType]; !ok {
+		writeError(w, r, "error.unknownVotingType", http.StatusNotFound, "Type", votingType)
+		return
+	}
+	var req QuorumRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.Error("quorumPolicyUpdate decoding data payload", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateQuorumPolicy(req.QuorumPolicy); err != nil {
+		writeError(w, r, "error.invalidQuorumPolicy", http.StatusBadRequest, "Error", err.Error())
+		return
+	}
+	floor, err := FindFloor(identity.FloorId)
+	if err != nil {
+		logger.Error("quorumPolicyUpdate getFloor", slog.Any("error", err), slog.String("floor id", identity.FloorId))
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, "error.floorNotFound", http.StatusUnprocessableEntity)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkClientRevision(w, floor, req.Revision) {
+		return
+	}
+	to := req.QuorumPolicy
+	if to.Type == "" {
+		to = defaultQuorumPolicies[votingType]
+	}
+	if lowersQuorum(floor, quorumPolicyFor(floor, Voting{Type: votingType}), to) {
+		settings := FloorSettings{QuorumPolicies: map[string]QuorumPolicy{votingType: req.QuorumPolicy}}
+		startVoting(w, r, floor, identity, VotingChangeSettings, VotingPayload{Settings: &settings})
+		return
+	}
+	setQuorumPolicy(&floor, votingType, req.QuorumPolicy)
+	fUp, err := updateQuorumPolicies(floor)
+	if err != nil {
+		writeDBError(w, err, floor.Id, "quorumPolicyUpdate updating DB", slog.Any("request", req))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fUp)
+}
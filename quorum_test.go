@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func Test_validateQuorumPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  QuorumPolicy
+		wantErr bool
+	}{
+		{name: "should accept reset to default", policy: QuorumPolicy{}},
+		{name: "should accept majority", policy: QuorumPolicy{Type: QuorumMajority}},
+		{name: "should accept threshold", policy: QuorumPolicy{Type: QuorumThreshold, Threshold: 2}},
+		{name: "should reject threshold below 1", policy: QuorumPolicy{Type: QuorumThreshold}, wantErr: true},
+		{name: "should reject threshold on veto", policy: QuorumPolicy{Type: QuorumVeto, Threshold: 2}, wantErr: true},
+		{name: "should reject unknown policy", policy: QuorumPolicy{Type: "DICTATOR"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateQuorumPolicy(tt.policy); (err != nil) != tt.wantErr {
+				t.Errorf("validateQuorumPolicy: got %v wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_castVote(t *testing.T) {
+	v := Voting{Accepts: []string{"1", "2"}, Rejects: []string{"3"}}
+	if !castVote(&v, "2", VoteReject) {
+		t.Fatal("reject not recorded")
+	}
+	if !slices.Equal(v.Accepts, []string{"1"}) || !slices.Equal(v.Rejects, []string{"3", "2"}) {
+		t.Errorf("vote not replaced: %+v", v)
+	}
+	castVote(&v, "3", VoteAbstain)
+	if !slices.Equal(v.Rejects, []string{"2"}) || !slices.Equal(v.Abstains, []string{"3"}) {
+		t.Errorf("abstain not recorded: %+v", v)
+	}
+	if castVote(&v, "1", "MAYBE") || !slices.Equal(v.Accepts, []string{"1"}) {
+		t.Errorf("unknown action must not change the voting: %+v", v)
+	}
+}
+
+func Test_quorumPolicyFor(t *testing.T) {
+	f := Floor{QuorumPolicies: map[string]QuorumPolicy{"CREATE_TASK": {Type: QuorumVeto}}}
+	if got := quorumPolicyFor(f, Voting{Type: "CREATE_TASK"}); got.Type != QuorumVeto {
+		t.Errorf("floor policy not used: %v", got)
+	}
+	if got := quorumPolicyFor(f, Voting{Type: "DELETE_TASK"}); got.Type != QuorumUnanimous {
+		t.Errorf("default policy not used: %v", got)
+	}
+	if got := quorumPolicyFor(f, Voting{Type: "CREATE_TASK", Quorum: QuorumPolicy{Type: QuorumMajority}}); got.Type != QuorumMajority {
+		t.Errorf("policy of the voting not kept: %v", got)
+	}
+}
+
+func Test_lowersQuorum(t *testing.T) {
+	f := Floor{Rooms: []Room{
+		{Id: 0, Resident: Resident{Id: "1", Available: true}},
+		{Id: 1, Resident: Resident{Id: "2", Available: true}},
+		{Id: 2, Resident: Resident{Id: "3", Available: true}},
+		{Id: 3, Resident: Resident{Id: "4", Available: true}},
+	}}
+	majority := QuorumPolicy{Type: QuorumMajority}
+	unanimous := QuorumPolicy{Type: QuorumUnanimous}
+	veto := QuorumPolicy{Type: QuorumVeto}
+	tests := []struct {
+		name string
+		from QuorumPolicy
+		to   QuorumPolicy
+		want bool
+	}{
+		{"majority to unanimous", majority, unanimous, false},
+		{"unanimous to majority", unanimous, majority, true},
+		{"majority to higher threshold", majority, QuorumPolicy{Type: QuorumThreshold, Threshold: 4}, false},
+		{"majority to lower threshold", majority, QuorumPolicy{Type: QuorumThreshold, Threshold: 2}, true},
+		{"majority to veto", majority, veto, true},
+		{"veto to unanimous", veto, unanimous, false},
+		{"unanimous to threshold of everyone", unanimous, QuorumPolicy{Type: QuorumThreshold, Threshold: 4}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lowersQuorum(f, tt.from, tt.to); got != tt.want {
+				t.Errorf("lowersQuorum: got %v want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_HandleQuorumPolicyUpdate(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /floor/{id}/quorum-policies/{votingType}", HandleQuorumPolicyUpdate)
+	f, err := insertTestFloor(FloorStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(votingType string, req QuorumRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(req)
+		r, _ := http.NewRequest("PUT", "/floor/"+f.Id.Hex()+"/quorum-policies/"+votingType, bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(r, userId, f.Id.Hex()))
+		return rr
+	}
+
+	t.Run("should set policy of voting type", func(t *testing.T) {
+		rr := put("CREATE_TASK", QuorumRequest{QuorumPolicy: QuorumPolicy{Type: QuorumThreshold, Threshold: 5}})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		var fUp Floor
+		json.Unmarshal(rr.Body.Bytes(), &fUp)
+		if got := fUp.QuorumPolicies["CREATE_TASK"]; got.Type != QuorumThreshold || got.Threshold != 5 {
+			t.Errorf("policy not stored: %v", fUp.QuorumPolicies)
+		}
+	})
+
+	t.Run("should launch voting when lowering a policy", func(t *testing.T) {
+		rr := put("DELETE_TASK", QuorumRequest{QuorumPolicy: QuorumPolicy{Type: QuorumThreshold, Threshold: 3}})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+		var fUp Floor
+		json.Unmarshal(rr.Body.Bytes(), &fUp)
+		if _, ok := fUp.QuorumPolicies["DELETE_TASK"]; ok {
+			t.Errorf("policy lowered without voting: %v", fUp.QuorumPolicies)
+		}
+		v := fUp.Votings[len(fUp.Votings)-1]
+		if v.Type != VotingChangeSettings || v.Payload.Settings.QuorumPolicies["DELETE_TASK"].Threshold != 3 {
+			t.Errorf("wrong voting launched: %+v", v)
+		}
+		if rr := put("CREATE_TASK", QuorumRequest{}); rr.Code != http.StatusCreated {
+			t.Errorf("reset to a weaker default: got %v want %v", rr.Code, http.StatusCreated)
+		}
+	})
+
+	t.Run("should reject invalid policy", func(t *testing.T) {
+		if rr := put("DELETE_TASK", QuorumRequest{QuorumPolicy: QuorumPolicy{Type: QuorumThreshold}}); rr.Code != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+		}
+		if rr := put("PAINT_WALLS", QuorumRequest{QuorumPolicy: QuorumPolicy{Type: QuorumMajority}}); rr.Code != http.StatusNotFound {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	RecurrenceNone       = "NONE"
+	RecurrenceDaily      = "DAILY"
+	RecurrenceWeekly     = "WEEKLY"
+	RecurrenceEveryNDays = "EVERY_N_DAYS"
+	RecurrenceMonthly    = "MONTHLY"
+)
+
+// Recurrence describes how often a task comes up. Depending on Type only some fields are used:
+// Weekdays for WEEKLY, Interval for EVERY_N_DAYS and DayOfMonth for MONTHLY.
+// A task without schedule has Type NONE, an empty Type stands for defaultRecurrence.
+type Recurrence struct {
+	Type       string         `bson:"type"`
+	Weekdays   []time.Weekday `bson:"weekdays,omitempty"`
+	Interval   int            `bson:"interval,omitempty"`
+	DayOfMonth int            `bson:"dayOfMonth,omitempty"`
+}
+
+// tasks stored before recurrences existed, and tasks created through a voting, come up weekly
+var defaultRecurrence = Recurrence{Type: RecurrenceEveryNDays, Interval: 7}
+
+// recurrenceOrDefault resolves an empty recurrence of a request or voting to defaultRecurrence.
+func recurrenceOrDefault(rec Recurrence) Recurrence {
+	if rec.Type == "" {
+		return defaultRecurrence
+	}
+	return rec
+}
+
+type RecurrenceUpdateRequest struct {
+	Revision   *int64     `json:"revision,omitempty"`
+	Recurrence Recurrence `json:"recurrence"`
+	DueDate    *time.Time `json:"dueDate,omitempty"`
+}
+
+func validateRecurrence(rec Recurrence) error {
+	switch rec.Type {
+	case "", RecurrenceNone, RecurrenceDaily:
+		return nil
+	case RecurrenceWeekly:
+		if len(rec.Weekdays) == 0 {
+			return fmt.Errorf("Weekly recurrence needs at least one weekday")
+		}
+		for _, d := range rec.Weekdays {
+			if d < time.Sunday || d > time.Saturday {
+				return fmt.Errorf("Invalid weekday %d", d)
+			}
+		}
+		return nil
+	case RecurrenceEveryNDays:
+		if rec.Interval < 1 || rec.Interval > 365 {
+			return fmt.Errorf("Interval must be between 1 and 365 days")
+		}
+		return nil
+	case RecurrenceMonthly:
+		if rec.DayOfMonth < 1 || rec.DayOfMonth > 31 {
+			return fmt.Errorf("Day of month must be between 1 and 31")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown recurrence type %s", rec.Type)
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// nextDueDate returns the start of the first day after the day of from on which the task comes up,
+// in the location of from. It is zero for tasks without schedule.
+func nextDueDate(rec Recurrence, from time.Time) time.Time {
+	day := startOfDay(from)
+	switch rec.Type {
+	case RecurrenceDaily:
+		return day.AddDate(0, 0, 1)
+	case RecurrenceEveryNDays:
+		return day.AddDate(0, 0, rec.Interval)
+	case RecurrenceWeekly:
+		for i := 1; i <= 7; i++ {
+			next := day.AddDate(0, 0, i)
+			for _, d := range rec.Weekdays {
+				if next.Weekday() == d {
+					return next
+				}
+			}
+		}
+	case RecurrenceMonthly:
+		for i := 0; i <= 1; i++ {
+			first := time.Date(day.Year(), day.Month()+time.Month(i), 1, 0, 0, 0, 0, day.Location())
+			lastDay := first.AddDate(0, 1, -1).Day()
+			next := first.AddDate(0, 0, min(rec.DayOfMonth, lastDay)-1)
+			if next.After(day) {
+				return next
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// advanceDueDate is the due date of the next round once a task is done. A task done ahead of time
+// keeps its schedule, a late one starts the next round from now.
+func advanceDueDate(t Task, now time.Time) time.Time {
+	from := now
+	if t.DueDate.After(now) {
+		from = t.DueDate.In(now.Location())
+	}
+	return nextDueDate(t.Recurrence, from)
+}
+
+// isOverdue reports whether the whole due day has passed without the task being done.
+func isOverdue(t Task, now time.Time) bool {
+	if t.DueDate.IsZero() || t.AssignedTo < 0 {
+		return false
+	}
+	return !now.Before(t.DueDate.AddDate(0, 0, 1))
+}
+
+func markOverdue(f *Floor, now time.Time) {
+	for i := range f.Tasks {
+		f.Tasks[i].Overdue = isOverdue(f.Tasks[i], now)
+	}
+}
+
+// migrateRecurrence gives the default recurrence to tasks stored before recurrences existed,
+// due a week after their last assignment.
+func migrateRecurrence(f Floor) (Floor, bool) {
+	migrated := false
+	for i, t := range f.Tasks {
+		if t.Recurrence.Type != "" {
+			continue
+		}
+		f.Tasks[i].Recurrence = defaultRecurrence
+		from := t.AssignmentDate
+		if from.IsZero() {
+			from = time.Now()
+		}
+		f.Tasks[i].DueDate = nextDueDate(defaultRecurrence, from)
+		migrated = true
+	}
+	return f, migrated
+}
+
+// HandleTaskRecurrenceUpdate launches a CHANGE_RECURRENCE voting on the recurrence and first due
+// date of a task.
+func HandleTaskRecurrenceUpdate(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerFloorFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req RecurrenceUpdateRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.Error("taskRecurrenceUpdate decoding data payload", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Recurrence = recurrenceOrDefault(req.Recurrence)
+	if err = validateRecurrence(req.Recurrence); err != nil {
+		writeError(w, r, "error.invalidRecurrence", http.StatusBadRequest, "Error", err.Error())
+		return
+	}
+	floor, err := FindFloor(identity.FloorId)
+	if err != nil {
+		logger.Error("taskRecurrenceUpdate getFloor", slog.Any("error", err), slog.String("floor id", identity.FloorId))
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, "error.floorNotFound", http.StatusUnprocessableEntity)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkClientRevision(w, floor, req.Revision) {
+		return
+	}
+	taskId := r.PathValue("taskId")
+	if _, err := findTaskIndex(floor.Tasks, taskId); err != nil {
+		writeError(w, r, "error.taskNotFound", http.StatusNotFound)
+		return
+	}
+	startVoting(w, r, floor, identity, VotingChangeRecurrence, VotingPayload{TaskId: taskId, Recurrence: &req.Recurrence, DueDate: req.DueDate})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func date(y int, m time.Month, d int) time.Time {
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func Test_nextDueDate(t *testing.T) {
+	// 2024-03-13 is a Wednesday
+	from := time.Date(2024, 3, 13, 18, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		rec  Recurrence
+		want time.Time
+	}{
+		{name: "should be tomorrow when daily", rec: Recurrence{Type: RecurrenceDaily}, want: date(2024, 3, 14)},
+		{name: "should add interval", rec: Recurrence{Type: RecurrenceEveryNDays, Interval: 3}, want: date(2024, 3, 16)},
+		{name: "should find next weekday", rec: Recurrence{Type: RecurrenceWeekly, Weekdays: []time.Weekday{time.Monday, time.Friday}}, want: date(2024, 3, 15)},
+		{name: "should wrap to next week", rec: Recurrence{Type: RecurrenceWeekly, Weekdays: []time.Weekday{time.Wednesday}}, want: date(2024, 3, 20)},
+		{name: "should take day later this month", rec: Recurrence{Type: RecurrenceMonthly, DayOfMonth: 20}, want: date(2024, 3, 20)},
+		{name: "should take day next month", rec: Recurrence{Type: RecurrenceMonthly, DayOfMonth: 1}, want: date(2024, 4, 1)},
+		{name: "should be zero without schedule", rec: Recurrence{Type: RecurrenceNone}, want: time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextDueDate(tt.rec, from); !got.Equal(tt.want) {
+				t.Errorf("got %v want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("should clamp to end of short month", func(t *testing.T) {
+		got := nextDueDate(Recurrence{Type: RecurrenceMonthly, DayOfMonth: 31}, date(2024, 2, 3))
+		if !got.Equal(date(2024, 2, 29)) {
+			t.Errorf("got %v want %v", got, date(2024, 2, 29))
+		}
+	})
+}
+
+func Test_advanceDueDate(t *testing.T) {
+	rec := Recurrence{Type: RecurrenceEveryNDays, Interval: 7}
+	t.Run("should keep schedule when done early", func(t *testing.T) {
+		task := Task{Recurrence: rec, DueDate: date(2024, 3, 15)}
+		if got := advanceDueDate(task, date(2024, 3, 13)); !got.Equal(date(2024, 3, 22)) {
+			t.Errorf("got %v want %v", got, date(2024, 3, 22))
+		}
+	})
+	t.Run("should start from now when done late", func(t *testing.T) {
+		task := Task{Recurrence: rec, DueDate: date(2024, 3, 15)}
+		if got := advanceDueDate(task, date(2024, 3, 18)); !got.Equal(date(2024, 3, 25)) {
+			t.Errorf("got %v want %v", got, date(2024, 3, 25))
+		}
+	})
+}
+
+func Test_isOverdue(t *testing.T) {
+	task := Task{AssignedTo: 1, DueDate: date(2024, 3, 15)}
+	if isOverdue(task, time.Date(2024, 3, 15, 23, 0, 0, 0, time.UTC)) {
+		t.Errorf("task should not be overdue on its due day")
+	}
+	if !isOverdue(task, date(2024, 3, 16)) {
+		t.Errorf("task should be overdue after its due day")
+	}
+	task.AssignedTo = -1
+	if isOverdue(task, date(2024, 3, 20)) {
+		t.Errorf("unassigned task should not be overdue")
+	}
+}
+
+func Test_validateRecurrence(t *testing.T) {
+	invalid := []Recurrence{
+		{Type: "YEARLY"},
+		{Type: RecurrenceWeekly},
+		{Type: RecurrenceWeekly, Weekdays: []time.Weekday{7}},
+		{Type: RecurrenceEveryNDays},
+		{Type: RecurrenceMonthly, DayOfMonth: 32},
+	}
+	for _, rec := range invalid {
+		if validateRecurrence(rec) == nil {
+			t.Errorf("expected %v to be invalid", rec)
+		}
+	}
+	if err := validateRecurrence(Recurrence{Type: RecurrenceWeekly, Weekdays: []time.Weekday{time.Sunday}}); err != nil {
+		t.Errorf("expected weekly recurrence to be valid: %v", err)
+	}
+}
+
+func Test_migrateRecurrence(t *testing.T) {
+	f := Floor{Tasks: []Task{
+		{Id: "0", AssignmentDate: date(2024, 3, 1)},
+		{Id: "1", Recurrence: Recurrence{Type: RecurrenceDaily}, DueDate: date(2024, 3, 2)},
+	}}
+	f, migrated := migrateRecurrence(f)
+	if !migrated {
+		t.Fatalf("expected floor to be migrated")
+	}
+	if f.Tasks[0].Recurrence.Type != defaultRecurrence.Type || !f.Tasks[0].DueDate.Equal(date(2024, 3, 8)) {
+		t.Errorf("wrong migrated task: %+v", f.Tasks[0])
+	}
+	if f.Tasks[1].Recurrence.Type != RecurrenceDaily || !f.Tasks[1].DueDate.Equal(date(2024, 3, 2)) {
+		t.Errorf("task with recurrence changed: %+v", f.Tasks[1])
+	}
+	if _, migrated := migrateRecurrence(f); migrated {
+		t.Errorf("expected migrated floor to be left alone")
+	}
+}
+
+func Test_taskRecurrenceUpdate(t *testing.T) {
+	f, err := insertTestFloor(FloorStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /floor/{id}/tasks/{taskId}/recurrence", HandleTaskRecurrenceUpdate)
+
+	t.Run("should launch voting on recurrence and due date", func(t *testing.T) {
+		due := time.Now().AddDate(0, 0, -3)
+		body, err := json.Marshal(RecurrenceUpdateRequest{
+			Recurrence: Recurrence{Type: RecurrenceWeekly, Weekdays: []time.Weekday{time.Monday}},
+			DueDate:    &due,
+		})
+		req, err := http.NewRequest("PUT", "/floor/"+f.Id.Hex()+"/tasks/1/recurrence", bytes.NewReader(body))
+		if err != nil {
+			t.Error(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(req, "1", f.Id.Hex()))
+
+		if status := rr.Code; status != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+		}
+		var updatedFloor Floor
+		json.Unmarshal(rr.Body.Bytes(), &updatedFloor)
+		if updatedFloor.Tasks[1].Recurrence.Type == RecurrenceWeekly {
+			t.Errorf("recurrence changed without voting")
+		}
+		v := updatedFloor.Votings[len(updatedFloor.Votings)-1]
+		if v.Type != VotingChangeRecurrence || v.Payload.TaskId != "1" || v.Payload.Recurrence.Type != RecurrenceWeekly || v.Payload.DueDate == nil {
+			t.Errorf("wrong voting launched: %+v", v)
+		}
+	})
+	t.Run("should 400 on invalid recurrence", func(t *testing.T) {
+		body, err := json.Marshal(RecurrenceUpdateRequest{Recurrence: Recurrence{Type: RecurrenceEveryNDays}})
+		req, err := http.NewRequest("PUT", "/floor/"+f.Id.Hex()+"/tasks/1/recurrence", bytes.NewReader(body))
+		if err != nil {
+			t.Error(err)
+		}
+		req.Header.Set("Accept-Language", "de")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(req, "1", f.Id.Hex()))
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+		}
+		if !strings.HasPrefix(rr.Body.String(), "Ungültige Wiederholung: ") {
+			t.Errorf("error not localized: %q", rr.Body.String())
+		}
+	})
+	t.Run("should 404 on unknown task", func(t *testing.T) {
+		body, err := json.Marshal(RecurrenceUpdateRequest{Recurrence: Recurrence{Type: RecurrenceDaily}})
+		req, err := http.NewRequest("PUT", "/floor/"+f.Id.Hex()+"/tasks/99/recurrence", bytes.NewReader(body))
+		if err != nil {
+			t.Error(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(req, "1", f.Id.Hex()))
+
+		if status := rr.Code; status != http.StatusNotFound {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+		}
+	})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// ReminderPolicy is how a floor wants the server to remind assignees. The first reminder goes out
+// FirstReminderHours before the end of the due day, further ones every RepeatHours, at most
+// MaxReminders per assignment. Nothing is sent between QuietStart and QuietEnd ("HH:MM", floor time).
+type ReminderPolicy struct {
+	Enabled            bool   `bson:"enabled" json:"enabled"`
+	FirstReminderHours int    `bson:"firstReminderHours" json:"firstReminderHours"`
+	RepeatHours        int    `bson:"repeatHours" json:"repeatHours"`
+	MaxReminders       int    `bson:"maxReminders" json:"maxReminders"`
+	QuietStart         string `bson:"quietStart" json:"quietStart"`
+	QuietEnd           string `bson:"quietEnd" json:"quietEnd"`
+}
+
+var defaultReminderPolicy = ReminderPolicy{
+	Enabled:            true,
+	FirstReminderHours: 24,
+	RepeatHours:        12,
+	MaxReminders:       3,
+	QuietStart:         "22:00",
+	QuietEnd:           "08:00",
+}
+
+type ReminderPolicyRequest struct {
+	Revision *int64         `json:"revision,omitempty"`
+	Policy   ReminderPolicy `json:"policy"`
+	Timezone string         `json:"timezone,omitempty"`
+}
+
+const systemActor = "system"
+
+func reminderPolicyOf(f Floor) ReminderPolicy {
+	if f.ReminderPolicy == nil {
+		return defaultReminderPolicy
+	}
+	return *f.ReminderPolicy
+}
+
+// floorLocation is the time zone due dates and quiet hours of the floor are in.
+func floorLocation(f Floor) *time.Location {
+	if f.Timezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(f.Timezone)
+	if err != nil {
+		logger.Error("floorLocation loading time zone", slog.Any("error", err), slog.Any("floor id", f.Id), slog.String("timezone", f.Timezone))
+		return time.Local
+	}
+	return loc
+}
+
+func validateReminderPolicy(p ReminderPolicy) error {
+	if !p.Enabled {
+		return nil
+	}
+	if p.FirstReminderHours < 0 || p.RepeatHours < 1 || p.MaxReminders < 1 {
+		return fmt.Errorf("Reminder hours and max reminders must be positive")
+	}
+	if _, err := parseClock(p.QuietStart); err != nil {
+		return fmt.Errorf("Invalid quiet start: %w", err)
+	}
+	if _, err := parseClock(p.QuietEnd); err != nil {
+		return fmt.Errorf("Invalid quiet end: %w", err)
+	}
+	return nil
+}
+
+// parseClock turns "HH:MM" into minutes after midnight, empty means midnight.
+func parseClock(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// inQuietHours reports whether now (already in floor time) falls into [start, end), wrapping past midnight.
+func inQuietHours(start string, end string, now time.Time) bool {
+	from, err := parseClock(start)
+	if err != nil {
+		return false
+	}
+	to, err := parseClock(end)
+	if err != nil || from == to {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if from < to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// reminderDue decides if the assignee of t gets an automatic reminder at now.
+func reminderDue(p ReminderPolicy, t Task, now time.Time, loc *time.Location) bool {
+	if !p.Enabled || t.AssignedTo < 0 || t.DueDate.IsZero() || t.AutoReminders >= p.MaxReminders {
+		return false
+	}
+	local := now.In(loc)
+	if inQuietHours(p.QuietStart, p.QuietEnd, local) {
+		return false
+	}
+	deadline := t.DueDate.In(loc).AddDate(0, 0, 1)
+	if local.Before(deadline.Add(-time.Duration(p.FirstReminderHours) * time.Hour)) {
+		return false
+	}
+	if t.AutoReminders == 0 {
+		return true
+	}
+	return !local.Before(t.LastReminderAt.Add(time.Duration(p.RepeatHours) * time.Hour))
+}
+
+// ReminderScheduler reminds assignees of tasks that are close to or past their due date
+// according to the reminder policy of their floor.
+type ReminderScheduler struct {
+	clock    Clock
+	interval time.Duration
+}
+
+func newReminderScheduler(clock Clock, interval time.Duration) *ReminderScheduler {
+	return &ReminderScheduler{clock: clock, interval: interval}
+}
+
+func (s *ReminderScheduler) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			if _, err := s.runOnce(); err != nil {
+				logger.Error("reminderScheduler run", slog.Any("error", err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// runOnce sends every reminder that is due and returns how many were sent. A floor written
+// concurrently is skipped and picked up on the next run.
+func (s *ReminderScheduler) runOnce() (int, error) {
+	now := s.clock.Now()
+	floors, err := findFloorsWithDueTasks()
+	if err != nil {
+		return 0, fmt.Errorf("reminderScheduler finding floors: %w", err)
+	}
+	sent := 0
+	for _, f := range floors {
+		n, err := remindDueTasks(f, now)
+		if err != nil {
+			logger.Error("reminderScheduler remind", slog.Any("error", err), slog.Any("floor id", f.Id))
+			continue
+		}
+		sent += n
+	}
+	return sent, nil
+}
+
+func remindDueTasks(f Floor, now time.Time) (int, error) {
+	policy := reminderPolicyOf(f)
+	loc := floorLocation(f)
+	var reminded []int
+	var history []HistoryEntry
+	var msgs []OutboxMessage
+	for i, t := range f.Tasks {
+		if !reminderDue(policy, t, now, loc) {
+			continue
+		}
+		f.Tasks[i].Reminders += 1
+		f.Tasks[i].AutoReminders += 1
+		f.Tasks[i].LastReminderAt = now
+		msgs = append(msgs, taskReminderMessages(f, f.Tasks[i], "task.due")...)
+		entry := newHistoryEntry(f, t, f.Tasks[i], "REMIND", systemActor, now)
+		entry.Reminders = f.Tasks[i].Reminders
+		history = append(history, entry)
+		reminded = append(reminded, i)
+	}
+	if len(reminded) == 0 {
+		return 0, nil
+	}
+	if _, err := updateTasks(f, msgs...); err != nil {
+		return 0, err
+	}
+	recordHistory(history)
+	return len(reminded), nil
+}
+
+// HandleReminderPolicyUpdate launches a CHANGE_SETTINGS voting on the reminder policy and time zone.
+func HandleReminderPolicyUpdate(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerFloorFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req ReminderPolicyRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.Error("reminderPolicyUpdate decoding data payload", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = validateReminderPolicy(req.Policy); err != nil {
+		writeError(w, r, "error.invalidReminderPolicy", http.StatusBadRequest, "Error", err.Error())
+		return
+	}
+	settings := FloorSettings{ReminderPolicy: &req.Policy}
+	if req.Timezone != "" {
+		if _, err = time.LoadLocation(req.Timezone); err != nil {
+			writeError(w, r, "error.unknownTimezone", http.StatusBadRequest, "Timezone", req.Timezone)
+			return
+		}
+		settings.Timezone = &req.Timezone
+	}
+	launchVoting(w, r, identity, req.Revision, VotingChangeSettings, VotingPayload{Settings: &settings})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_inQuietHours(t *testing.T) {
+	at := func(h, m int) time.Time { return time.Date(2024, 3, 13, h, m, 0, 0, time.UTC) }
+	tests := []struct {
+		name       string
+		start, end string
+		now        time.Time
+		want       bool
+	}{
+		{name: "should be quiet late at night", start: "22:00", end: "08:00", now: at(23, 30), want: true},
+		{name: "should be quiet early morning", start: "22:00", end: "08:00", now: at(7, 59), want: true},
+		{name: "should not be quiet at end", start: "22:00", end: "08:00", now: at(8, 0), want: false},
+		{name: "should handle same day range", start: "13:00", end: "15:00", now: at(14, 0), want: true},
+		{name: "should not be quiet when start equals end", start: "00:00", end: "00:00", now: at(3, 0), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inQuietHours(tt.start, tt.end, tt.now); got != tt.want {
+				t.Errorf("got %v want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_reminderDue(t *testing.T) {
+	policy := defaultReminderPolicy
+	// due on the 15th, the due day ends on the 16th at midnight
+	task := Task{AssignedTo: 1, DueDate: time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)}
+	tests := []struct {
+		name string
+		task func(Task) Task
+		now  time.Time
+		want bool
+	}{
+		{name: "should not remind too early", now: time.Date(2024, 3, 14, 23, 0, 0, 0, time.UTC), want: false},
+		{name: "should remind 24h before end of due day", now: time.Date(2024, 3, 15, 9, 0, 0, 0, time.UTC), want: true},
+		{name: "should not remind in quiet hours", now: time.Date(2024, 3, 15, 23, 0, 0, 0, time.UTC), want: false},
+		{
+			name: "should wait for repeat interval",
+			task: func(t Task) Task {
+				t.AutoReminders = 1
+				t.LastReminderAt = time.Date(2024, 3, 15, 9, 0, 0, 0, time.UTC)
+				return t
+			},
+			now:  time.Date(2024, 3, 15, 20, 0, 0, 0, time.UTC),
+			want: false,
+		},
+		{
+			name: "should repeat after interval",
+			task: func(t Task) Task {
+				t.AutoReminders = 1
+				t.LastReminderAt = time.Date(2024, 3, 15, 9, 0, 0, 0, time.UTC)
+				return t
+			},
+			now:  time.Date(2024, 3, 16, 9, 0, 0, 0, time.UTC),
+			want: true,
+		},
+		{
+			name: "should stop at max reminders",
+			task: func(t Task) Task {
+				t.AutoReminders = policy.MaxReminders
+				return t
+			},
+			now:  time.Date(2024, 3, 20, 12, 0, 0, 0, time.UTC),
+			want: false,
+		},
+		{
+			name: "should not remind unassigned task",
+			task: func(t Task) Task {
+				t.AssignedTo = -1
+				return t
+			},
+			now:  time.Date(2024, 3, 16, 12, 0, 0, 0, time.UTC),
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tk := task
+			if tt.task != nil {
+				tk = tt.task(task)
+			}
+			if got := reminderDue(policy, tk, tt.now, time.UTC); got != tt.want {
+				t.Errorf("got %v want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("should not remind when disabled", func(t *testing.T) {
+		disabled := ReminderPolicy{}
+		if reminderDue(disabled, task, time.Date(2024, 3, 16, 12, 0, 0, 0, time.UTC), time.UTC) {
+			t.Errorf("expected no reminder with disabled policy")
+		}
+	})
+}
+
+func Test_validateReminderPolicy(t *testing.T) {
+	if err := validateReminderPolicy(defaultReminderPolicy); err != nil {
+		t.Errorf("expected default policy to be valid: %v", err)
+	}
+	invalid := defaultReminderPolicy
+	invalid.QuietStart = "25:00"
+	if validateReminderPolicy(invalid) == nil {
+		t.Errorf("expected invalid quiet start to be rejected")
+	}
+	invalid = defaultReminderPolicy
+	invalid.RepeatHours = 0
+	if validateReminderPolicy(invalid) == nil {
+		t.Errorf("expected zero repeat hours to be rejected")
+	}
+}
+
+func Test_reminderScheduler(t *testing.T) {
+	f := FloorStub
+	f.Tasks = append([]Task(nil), FloorStub.Tasks...)
+	now := time.Now()
+	f.Tasks[0].DueDate = startOfDay(now).AddDate(0, 0, -1)
+	f.Tasks[0].AssignedTo = 0
+	policy := defaultReminderPolicy
+	policy.QuietStart, policy.QuietEnd = "", ""
+	f.ReminderPolicy = &policy
+	fIns, err := insertTestFloor(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should send due reminders once per interval", func(t *testing.T) {
+		if _, err := newReminderScheduler(fakeClock{now}, time.Minute).runOnce(); err != nil {
+			t.Fatal(err)
+		}
+		fUp, err := getUpdatedFloor(fIns.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fUp.Tasks[0].AutoReminders != 1 || fUp.Tasks[0].Reminders != f.Tasks[0].Reminders+1 {
+			t.Errorf("expected one automatic reminder, got %+v", fUp.Tasks[0])
+		}
+
+		if _, err := newReminderScheduler(fakeClock{now.Add(time.Hour)}, time.Minute).runOnce(); err != nil {
+			t.Fatal(err)
+		}
+		fUp, err = getUpdatedFloor(fIns.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fUp.Tasks[0].AutoReminders != 1 {
+			t.Errorf("expected no second reminder within repeat interval, got %v", fUp.Tasks[0].AutoReminders)
+		}
+	})
+}
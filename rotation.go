@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	RotationRoundRobin           = "ROUND_ROBIN"
+	RotationLeastLoaded          = "LEAST_LOADED"
+	RotationEffortWeighted       = "EFFORT_WEIGHTED"
+	RotationLongestSinceLastDone = "LONGEST_SINCE_LAST_DONE"
+)
+
+// RotationStrategy picks the room a task goes to next. Implementations only hand out tasks to
+// available residents other than the current assignee and return "No next assignee available" otherwise.
+type RotationStrategy interface {
+	next(f Floor, t Task) (Room, error)
+}
+
+var rotationStrategies = map[string]RotationStrategy{
+	RotationRoundRobin:           roundRobin{},
+	RotationLeastLoaded:          leastLoaded{},
+	RotationEffortWeighted:       effortWeighted{},
+	RotationLongestSinceLastDone: longestSinceLastDone{},
+}
+
+type RotationRequest struct {
+	Revision *int64 `json:"revision,omitempty"`
+	Strategy string `json:"strategy"`
+	Effort   *int   `json:"effort,omitempty"`
+}
+
+// rotationStrategyFor returns the strategy of the task, falling back to the floor's and then to round-robin.
+func rotationStrategyFor(f Floor, t Task) RotationStrategy {
+	for _, name := range []string{t.Rotation, f.Rotation} {
+		if s, ok := rotationStrategies[name]; ok {
+			return s
+		}
+	}
+	return roundRobin{}
+}
+
+func selectNextAssignee(f Floor, t Task) (Room, error) {
+	return rotationStrategyFor(f, t).next(f, t)
+}
+
+type roundRobin struct{}
+
+func (roundRobin) next(f Floor, t Task) (Room, error) {
+	return nextAssignee(f, t)
+}
+
+// candidates lists the available rooms in rotation order after the task's current room, so that
+// strategies break ties the way round-robin would.
+func candidates(f Floor, t Task) []Room {
+	start := 0
+	for _, r := range f.Rooms {
+		if r.Id == t.AssignedTo {
+			start = r.Order + 1
+			break
+		}
+	}
+	var rooms []Room
+	for i := 0; i < len(f.Rooms); i++ {
+		order := (start + i) % len(f.Rooms)
+		for _, r := range f.Rooms {
+			if r.Order == order && r.Id != t.AssignedTo && r.Resident.Available {
+				rooms = append(rooms, r)
+				break
+			}
+		}
+	}
+	return rooms
+}
+
+// pickLowest returns the first candidate with the lowest score.
+func pickLowest(f Floor, t Task, score func(r Room) float64) (Room, error) {
+	rooms := candidates(f, t)
+	if len(rooms) == 0 {
+		return Room{}, fmt.Errorf("No next assignee available")
+	}
+	best := rooms[0]
+	bestScore := score(best)
+	for _, r := range rooms[1:] {
+		if s := score(r); s < bestScore {
+			best, bestScore = r, s
+		}
+	}
+	return best, nil
+}
+
+func effortOf(t Task) int {
+	if t.Effort <= 0 {
+		return 1
+	}
+	return t.Effort
+}
+
+// leastLoaded gives the task to the resident with the fewest other open tasks.
+type leastLoaded struct{}
+
+func (leastLoaded) next(f Floor, t Task) (Room, error) {
+	return pickLowest(f, t, func(r Room) float64 {
+		open := 0
+		for _, other := range f.Tasks {
+			if other.Id != t.Id && other.AssignedTo == r.Id {
+				open++
+			}
+		}
+		return float64(open)
+	})
+}
+
+// effortWeighted gives the task to the resident with the fewest effort points in other open tasks.
+type effortWeighted struct{}
+
+func (effortWeighted) next(f Floor, t Task) (Room, error) {
+	return pickLowest(f, t, func(r Room) float64 {
+		effort := 0
+		for _, other := range f.Tasks {
+			if other.Id != t.Id && other.AssignedTo == r.Id {
+				effort += effortOf(other)
+			}
+		}
+		return float64(effort)
+	})
+}
+
+// longestSinceLastDone gives the task to the resident who did it longest ago, residents who
+// never did it come first.
+type longestSinceLastDone struct{}
+
+func (longestSinceLastDone) next(f Floor, t Task) (Room, error) {
+	return pickLowest(f, t, func(r Room) float64 {
+		done, ok := t.LastDone[r.Resident.Id]
+		if !ok {
+			return 0
+		}
+		return float64(done.Unix())
+	})
+}
+
+// markDone remembers when the current assignee last did the task, for longestSinceLastDone.
+func markDone(f *Floor, taskIndex int, now time.Time) {
+	residentId := residentOfRoom(f.Rooms, f.Tasks[taskIndex].AssignedTo)
+	if residentId == "" {
+		return
+	}
+	if f.Tasks[taskIndex].LastDone == nil {
+		f.Tasks[taskIndex].LastDone = make(map[string]time.Time)
+	}
+	f.Tasks[taskIndex].LastDone[residentId] = now
+}
+
+func validRotation(name string) bool {
+	_, ok := rotationStrategies[name]
+	return ok || name == ""
+}
+
+// HandleFloorRotationUpdate launches a CHANGE_SETTINGS voting on the strategy used for all tasks
+// of the floor without their own.
+func HandleFloorRotationUpdate(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerFloorFromPath(w, r)
+	if !ok {
+		return
+	}
+	req, ok := readRotationRequest(w, r)
+	if !ok {
+		return
+	}
+	launchVoting(w, r, identity, req.Revision, VotingChangeSettings, VotingPayload{Settings: &FloorSettings{Rotation: &req.Strategy}})
+}
+
+// HandleTaskRotationUpdate sets the strategy and effort of a single task, an empty strategy
+// falls back to the floor's. No voting decides on these, so they change right away.
+func HandleTaskRotationUpdate(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerFloorFromPath(w, r)
+	if !ok {
+		return
+	}
+	req, ok := readRotationRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Effort != nil && *req.Effort < 1 {
+		writeError(w, r, "error.effortTooLow", http.StatusBadRequest)
+		return
+	}
+	floor, err := FindFloor(identity.FloorId)
+	if err != nil {
+		logger.Error("taskRotationUpdate getFloor", slog.Any("error", err), slog.String("floor id", identity.FloorId))
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, "error.floorNotFound", http.StatusUnprocessableEntity)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkClientRevision(w, floor, req.Revision) {
+		return
+	}
+	taskIndex, err := findTaskIndex(floor.Tasks, r.PathValue("taskId"))
+	if err != nil {
+		writeError(w, r, "error.taskNotFound", http.StatusNotFound)
+		return
+	}
+	floor.Tasks[taskIndex].Rotation = req.Strategy
+	if req.Effort != nil {
+		floor.Tasks[taskIndex].Effort = *req.Effort
+	}
+	fUp, err := updateTasks(floor)
+	if err != nil {
+		writeDBError(w, err, floor.Id, "taskRotationUpdate updating DB tasks", slog.Any("request", req))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fUp)
+}
+
+func readRotationRequest(w http.ResponseWriter, r *http.Request) (RotationRequest, bool) {
+	var req RotationRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.Error("rotationUpdate decoding data payload", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return RotationRequest{}, false
+	}
+	if !validRotation(req.Strategy) {
+		writeError(w, r, "error.unknownRotation", http.StatusBadRequest, "Strategy", req.Strategy)
+		return RotationRequest{}, false
+	}
+	return req, true
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func rotationFloor(available ...bool) Floor {
+	f := Floor{}
+	for i, a := range available {
+		f.Rooms = append(f.Rooms, Room{Id: i + 1, Order: i, Resident: Resident{Id: string(rune('a' + i)), Available: a}})
+	}
+	return f
+}
+
+type rotationTest struct {
+	name     string
+	floor    Floor
+	task     Task
+	wantRoom int
+	wantErr  bool
+}
+
+func runRotationTests(t *testing.T, s RotationStrategy, tests []rotationTest) {
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			room, err := s.next(tt.floor, tt.task)
+			if tt.wantErr {
+				if err == nil || err.Error() != "No next assignee available" {
+					t.Errorf("expected no next assignee, got room %v err %v", room.Id, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if room.Id != tt.wantRoom {
+				t.Errorf("wrong next assignee: got %v want %v", room.Id, tt.wantRoom)
+			}
+		})
+	}
+}
+
+func withTasks(f Floor, tasks ...Task) Floor {
+	f.Tasks = tasks
+	return f
+}
+
+func Test_roundRobin(t *testing.T) {
+	runRotationTests(t, roundRobin{}, []rotationTest{
+		{name: "should take next in order", floor: rotationFloor(true, true, true), task: Task{Id: "1", AssignedTo: 1}, wantRoom: 2},
+		{name: "should wrap around", floor: rotationFloor(true, true, true), task: Task{Id: "1", AssignedTo: 3}, wantRoom: 1},
+		{name: "should skip unavailable", floor: rotationFloor(true, false, true), task: Task{Id: "1", AssignedTo: 1}, wantRoom: 3},
+		{name: "should fail when nobody else available", floor: rotationFloor(true, false, false), task: Task{Id: "1", AssignedTo: 1}, wantErr: true},
+	})
+}
+
+func Test_leastLoaded(t *testing.T) {
+	f := rotationFloor(true, true, true, true)
+	runRotationTests(t, leastLoaded{}, []rotationTest{
+		{
+			name:     "should take resident with fewest open tasks",
+			floor:    withTasks(f, Task{Id: "1", AssignedTo: 1}, Task{Id: "2", AssignedTo: 2}, Task{Id: "3", AssignedTo: 3}, Task{Id: "4", AssignedTo: 2}),
+			task:     Task{Id: "1", AssignedTo: 1},
+			wantRoom: 4,
+		},
+		{
+			name:     "should break ties in rotation order",
+			floor:    withTasks(f, Task{Id: "1", AssignedTo: 3}),
+			task:     Task{Id: "1", AssignedTo: 3},
+			wantRoom: 4,
+		},
+		{
+			name:     "should skip unavailable resident",
+			floor:    withTasks(rotationFloor(true, true, false), Task{Id: "1", AssignedTo: 1}, Task{Id: "2", AssignedTo: 2}),
+			task:     Task{Id: "1", AssignedTo: 1},
+			wantRoom: 2,
+		},
+		{name: "should fail when nobody else available", floor: rotationFloor(true, false), task: Task{Id: "1", AssignedTo: 1}, wantErr: true},
+	})
+}
+
+func Test_effortWeighted(t *testing.T) {
+	f := rotationFloor(true, true, true)
+	runRotationTests(t, effortWeighted{}, []rotationTest{
+		{
+			name:     "should balance by effort not count",
+			floor:    withTasks(f, Task{Id: "1", AssignedTo: 1}, Task{Id: "2", AssignedTo: 2, Effort: 5}, Task{Id: "3", AssignedTo: 3}, Task{Id: "4", AssignedTo: 3}),
+			task:     Task{Id: "1", AssignedTo: 1},
+			wantRoom: 3,
+		},
+		{
+			name:     "should count tasks without effort as 1",
+			floor:    withTasks(f, Task{Id: "1", AssignedTo: 1}, Task{Id: "2", AssignedTo: 2}, Task{Id: "3", AssignedTo: 3, Effort: 2}),
+			task:     Task{Id: "1", AssignedTo: 1},
+			wantRoom: 2,
+		},
+		{name: "should fail when nobody else available", floor: rotationFloor(true, false, false), task: Task{Id: "1", AssignedTo: 1}, wantErr: true},
+	})
+}
+
+func Test_longestSinceLastDone(t *testing.T) {
+	f := rotationFloor(true, true, true, true)
+	now := time.Now()
+	runRotationTests(t, longestSinceLastDone{}, []rotationTest{
+		{
+			name:     "should take resident who did it longest ago",
+			floor:    f,
+			task:     Task{Id: "1", AssignedTo: 1, LastDone: map[string]time.Time{"a": now, "b": now.Add(-time.Hour), "c": now.Add(-48 * time.Hour), "d": now.Add(-2 * time.Hour)}},
+			wantRoom: 3,
+		},
+		{
+			name:     "should prefer resident who never did it",
+			floor:    f,
+			task:     Task{Id: "1", AssignedTo: 1, LastDone: map[string]time.Time{"b": now.Add(-48 * time.Hour), "c": now.Add(-72 * time.Hour)}},
+			wantRoom: 4,
+		},
+		{
+			name:     "should follow rotation order without history",
+			floor:    f,
+			task:     Task{Id: "1", AssignedTo: 2},
+			wantRoom: 3,
+		},
+		{name: "should fail when nobody else available", floor: rotationFloor(true, false), task: Task{Id: "1", AssignedTo: 1}, wantErr: true},
+	})
+}
+
+func Test_rotationStrategyFor(t *testing.T) {
+	tests := []struct {
+		name          string
+		floorRotation string
+		taskRotation  string
+		want          RotationStrategy
+	}{
+		{name: "should default to round-robin", want: roundRobin{}},
+		{name: "should use floor strategy", floorRotation: RotationLeastLoaded, want: leastLoaded{}},
+		{name: "should prefer task strategy", floorRotation: RotationLeastLoaded, taskRotation: RotationEffortWeighted, want: effortWeighted{}},
+		{name: "should ignore unknown strategy", taskRotation: "RANDOM", want: roundRobin{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rotationStrategyFor(Floor{Rotation: tt.floorRotation}, Task{Rotation: tt.taskRotation})
+			if got != tt.want {
+				t.Errorf("got %T want %T", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_markDone(t *testing.T) {
+	f := withTasks(rotationFloor(true, true), Task{Id: "1", AssignedTo: 2})
+	now := time.Now()
+	markDone(&f, 0, now)
+	if !f.Tasks[0].LastDone["b"].Equal(now) {
+		t.Errorf("last done not recorded: %v", f.Tasks[0].LastDone)
+	}
+}
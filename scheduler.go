@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+const (
+	VotingPending  = "PENDING"
+	VotingAccepted = "ACCEPTED"
+	VotingRejected = "REJECTED"
+	VotingExpired  = "EXPIRED"
+)
+
+// why a voting was resolved
+const (
+	ResolvedByVote         = "VOTE"
+	ResolvedByWindowClosed = "WINDOW_CLOSED"
+	//accepted, but the floor changed so that it could no longer be applied
+	ResolvedNotApplicable = "NOT_APPLICABLE"
+)
+
+// VotingExpiryScheduler resolves votings whose window has closed. Expiry lives in the DB
+// (LaunchDate + VotingWindow), so votings that closed while the server was down are picked up on start.
+type VotingExpiryScheduler struct {
+	clock    Clock
+	interval time.Duration
+}
+
+func newVotingExpiryScheduler(clock Clock, interval time.Duration) *VotingExpiryScheduler {
+	return &VotingExpiryScheduler{clock: clock, interval: interval}
+}
+
+// start resolves overdue votings right away and then every interval until ctx is done.
+func (s *VotingExpiryScheduler) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			if _, err := s.runOnce(); err != nil {
+				logger.Error("votingExpiryScheduler run", slog.Any("error", err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// runOnce resolves every voting whose window has closed and returns how many were resolved.
+func (s *VotingExpiryScheduler) runOnce() (int, error) {
+	now := s.clock.Now()
+	floors, err := findFloorsWithVotings()
+	if err != nil {
+		return 0, fmt.Errorf("votingExpiryScheduler finding floors: %w", err)
+	}
+	resolved := 0
+	for _, f := range floors {
+		for _, v := range f.Votings {
+			if !votingWindowClosed(v, now) {
+				continue
+			}
+			if err := expireVoting(f.Id.Hex(), v.Id, now); err != nil {
+				logger.Error("votingExpiryScheduler resolve", slog.Any("error", err), slog.Any("floor id", f.Id), slog.Any("voting", v))
+				continue
+			}
+			resolved++
+		}
+	}
+	return resolved, nil
+}
+
+func votingWindowClosed(v Voting, now time.Time) bool {
+	return !now.Before(v.LaunchDate.Add(v.VotingWindow))
+}
+
+// evaluateVoting applies the voting's quorum policy to the votes cast so far. Votes and the
+// closing window go through the same rules, once the window is closed a voting is decided.
+func evaluateVoting(f Floor, v Voting, windowClosed bool) string {
+	return quorumPolicyFor(f, v).decide(tallyVoting(f, v), windowClosed)
+}
+
+// expireVoting resolves a closed voting on the latest floor revision, retrying when a
+// resident writes the floor at the same time.
+func expireVoting(floorId string, votingId int, now time.Time) error {
+	var err error
+	for i := 0; i < 3; i++ {
+		var f Floor
+		f, err = FindFloor(floorId)
+		if err != nil {
+			return err
+		}
+		var v Voting
+		v, err = findVoting(f.Votings, votingId)
+		if err != nil {
+			//resolved by a vote in the meantime
+			return nil
+		}
+		outcome := evaluateVoting(f, v, true)
+		_, err = resolveVoting(f, v, outcome, now)
+		if errors.Is(err, ErrRevisionConflict) {
+			continue
+		}
+		return err
+	}
+	return err
+}
+
+// resolveVoting applies an accepted voting and removes it from the floor in one conditional write,
+// so a retry after a revision conflict cannot apply it twice. It tells every resident the outcome
+// and archives the voting. An accepted voting the floor changed too much for in the meantime
+// expires instead.
+func resolveVoting(f Floor, v Voting, outcome string, now time.Time) (Floor, error) {
+	reason := ResolvedByVote
+	if votingWindowClosed(v, now) {
+		reason = ResolvedByWindowClosed
+	}
+	var set bson.M
+	var applyMsgs []OutboxMessage
+	if outcome == VotingAccepted {
+		applied := f
+		var err error
+		set, applyMsgs, err = applyVoting(&applied, v, now)
+		if err != nil {
+			logger.Error("resolveVoting applying", slog.Any("error", err), slog.Any("floor id", f.Id), slog.Any("voting", v))
+			outcome, reason = VotingExpired, ResolvedNotApplicable
+		}
+	}
+	//sent to the residents from before the voting took effect, a removed resident learns about it too
+	msgs := votingMessages(f, "VOTING_RESOLVED", votingResolvedMessage(f, v, outcome), "")
+	fUp, err := closeVoting(f, v.Id, set, append(msgs, applyMsgs...)...)
+	if err != nil {
+		return Floor{}, fmt.Errorf("resolveVoting closing voting: %w", err)
+	}
+	rv := ResolvedVoting{FloorId: f.Id, Voting: v, Outcome: outcome, Tally: tallyVoting(f, v), Reason: reason, ResolvedAt: now}
+	err = insertResolvedVoting(rv)
+	if err != nil {
+		//the voting is resolved on the floor already, a missing record must not undo that
+		logger.Error("resolveVoting recording outcome", slog.Any("error", err), slog.Any("floor id", f.Id), slog.Any("voting", v), slog.String("outcome", outcome))
+	}
+	return fUp, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c fakeClock) Now() time.Time {
+	return c.now
+}
+
+func Test_evaluateVoting(t *testing.T) {
+	f := Floor{Rooms: []Room{
+		{Id: 0, Resident: Resident{Id: "1", Available: true}},
+		{Id: 1, Resident: Resident{Id: "2", Available: true}},
+		{Id: 2, Resident: Resident{Id: "3", Available: true}},
+		{Id: 3, Resident: Resident{Id: "4", Available: true}},
+		{Id: 4, Resident: Resident{Id: "5", Available: false}},
+		{Id: 5},
+	}}
+	threshold := QuorumPolicy{Type: QuorumThreshold, Threshold: 3}
+	veto := QuorumPolicy{Type: QuorumVeto}
+	tests := []struct {
+		name         string
+		voting       Voting
+		windowClosed bool
+		want         string
+	}{
+		{name: "create stays pending without votes", voting: Voting{Type: "CREATE_TASK", CreatedBy: "1"}, want: VotingPending},
+		{name: "create expires without votes", voting: Voting{Type: "CREATE_TASK", CreatedBy: "1"}, windowClosed: true, want: VotingExpired},
+		{name: "create pending with half of the residents", voting: Voting{Type: "CREATE_TASK", CreatedBy: "1", Accepts: []string{"2"}}, want: VotingPending},
+		{name: "create accepted by majority", voting: Voting{Type: "CREATE_TASK", CreatedBy: "1", Accepts: []string{"2", "3"}}, want: VotingAccepted},
+		{name: "create accepted by majority of the rest after abstain", voting: Voting{Type: "CREATE_TASK", CreatedBy: "1", Accepts: []string{"2"}, Abstains: []string{"3"}}, want: VotingAccepted},
+		{name: "create pending on single reject", voting: Voting{Type: "CREATE_TASK", CreatedBy: "1", Rejects: []string{"2"}}, want: VotingPending},
+		{name: "create rejected once majority is out of reach", voting: Voting{Type: "CREATE_TASK", CreatedBy: "1", Rejects: []string{"2", "3"}}, want: VotingRejected},
+		{name: "create decided by cast votes on close", voting: Voting{Type: "CREATE_TASK", CreatedBy: "1", Accepts: []string{"2"}, Rejects: []string{"3"}}, windowClosed: true, want: VotingAccepted},
+		{name: "create rejected on tie on close", voting: Voting{Type: "CREATE_TASK", CreatedBy: "1", Rejects: []string{"2"}}, windowClosed: true, want: VotingRejected},
+		{name: "votes of inactive residents are ignored", voting: Voting{Type: "CREATE_TASK", CreatedBy: "1", Accepts: []string{"5", "9"}}, want: VotingPending},
+		{name: "delete pending with some accepts", voting: Voting{Type: "DELETE_TASK", CreatedBy: "1", Accepts: []string{"2", "3"}}, want: VotingPending},
+		{name: "delete expires with some accepts", voting: Voting{Type: "DELETE_TASK", CreatedBy: "1", Accepts: []string{"2", "3"}}, windowClosed: true, want: VotingExpired},
+		{name: "delete accepted by all active residents", voting: Voting{Type: "DELETE_TASK", CreatedBy: "1", Accepts: []string{"2", "3", "4"}}, want: VotingAccepted},
+		{name: "delete accepted with abstain", voting: Voting{Type: "DELETE_TASK", CreatedBy: "1", Accepts: []string{"2", "3"}, Abstains: []string{"4"}}, want: VotingAccepted},
+		{name: "delete rejected on reject", voting: Voting{Type: "DELETE_TASK", CreatedBy: "1", Accepts: []string{"2", "3"}, Rejects: []string{"4"}}, want: VotingRejected},
+		{name: "policy of the voting applies", voting: Voting{Type: "DELETE_TASK", CreatedBy: "1", Accepts: []string{"2"}, Quorum: QuorumPolicy{Type: QuorumMajority}}, want: VotingPending},
+		{name: "threshold accepted", voting: Voting{Type: "DELETE_TASK", CreatedBy: "1", Accepts: []string{"2", "3"}, Quorum: threshold}, want: VotingAccepted},
+		{name: "threshold rejected when out of reach", voting: Voting{Type: "DELETE_TASK", CreatedBy: "1", Rejects: []string{"2", "3"}, Quorum: threshold}, want: VotingRejected},
+		{name: "threshold expires on close", voting: Voting{Type: "DELETE_TASK", CreatedBy: "1", Accepts: []string{"2"}, Quorum: threshold}, windowClosed: true, want: VotingExpired},
+		{name: "veto pending while votes are outstanding", voting: Voting{Type: "CREATE_TASK", CreatedBy: "1", Accepts: []string{"2"}, Quorum: veto}, want: VotingPending},
+		{name: "veto accepted on close", voting: Voting{Type: "CREATE_TASK", CreatedBy: "1", Quorum: veto}, windowClosed: true, want: VotingAccepted},
+		{name: "veto accepted once everyone voted", voting: Voting{Type: "CREATE_TASK", CreatedBy: "1", Accepts: []string{"2", "3"}, Abstains: []string{"4"}, Quorum: veto}, want: VotingAccepted},
+		{name: "veto rejected on reject", voting: Voting{Type: "CREATE_TASK", CreatedBy: "1", Rejects: []string{"4"}, Quorum: veto}, want: VotingRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := evaluateVoting(f, tt.voting, tt.windowClosed); got != tt.want {
+				t.Errorf("evaluateVoting: got %v want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_votingExpiryScheduler(t *testing.T) {
+	launch := time.Now().Add(-time.Hour)
+	fStub := FloorStub
+	fStub.Votings = []Voting{
+		{Id: 1, Type: "CREATE_TASK", Data: Task{Name: "Fenster putzen"}, LaunchDate: launch, VotingWindow: 30 * time.Minute, CreatedBy: "1", Accepts: []string{}, Rejects: []string{}},
+		{Id: 2, Type: "CREATE_TASK", Data: Task{Name: "Keller aufräumen"}, LaunchDate: launch, VotingWindow: 2 * time.Hour, CreatedBy: "1", Accepts: []string{}, Rejects: []string{}},
+	}
+	f, err := insertTestFloor(fStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should only resolve closed votings", func(t *testing.T) {
+		_, err := newVotingExpiryScheduler(fakeClock{now: time.Now()}, time.Minute).runOnce()
+		if err != nil {
+			t.Error(err)
+		}
+		fUp, err := FindFloor(f.Id.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fUp.Votings) != 1 || fUp.Votings[0].Id != 2 {
+			t.Errorf("wrong votings left open: got %v want voting 2", fUp.Votings)
+		}
+		for _, task := range fUp.Tasks {
+			if task.Name == "Fenster putzen" {
+				t.Errorf("expired voting must not create task")
+			}
+		}
+		var rv ResolvedVoting
+		err = votingArchiveCollection.FindOne(context.Background(), bson.M{"floorId": f.Id, "voting.id": 1}).Decode(&rv)
+		if err != nil {
+			t.Fatalf("resolved voting not recorded: %v", err)
+		}
+		if rv.Outcome != VotingExpired || rv.Reason != ResolvedByWindowClosed {
+			t.Errorf("wrong outcome recorded: got %v %v want %v %v", rv.Outcome, rv.Reason, VotingExpired, ResolvedByWindowClosed)
+		}
+		if rv.Tally.Accepts != 1 || rv.Tally.Voted != 0 {
+			t.Errorf("wrong tally recorded: %+v", rv.Tally)
+		}
+	})
+	t.Run("should resolve later votings once the clock passes their window", func(t *testing.T) {
+		_, err := newVotingExpiryScheduler(fakeClock{now: time.Now().Add(2 * time.Hour)}, time.Minute).runOnce()
+		if err != nil {
+			t.Error(err)
+		}
+		fUp, err := FindFloor(f.Id.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fUp.Votings) != 0 {
+			t.Errorf("voting not resolved: got %v want %v", len(fUp.Votings), 0)
+		}
+	})
+}
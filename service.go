@@ -1,50 +1,59 @@
 package main
 
 import (
-	"crypto/rsa"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt"
 )
 
 type AuthService interface {
 	getUserProfile(authToken string) (UserProfile, error)
-	verifyToken(authToken string) (string, error)
+	verifyToken(authToken string) (Identity, error)
 }
 
 type AuthServiceImpl struct {
-	pubKey *rsa.PublicKey
+	keys           publicKeyProvider
+	issuer         string
+	audience       string
+	userProfileUrl string
 }
 
+// only asymmetric algorithms, the auth server never shares a secret with us
+var validSigningMethods = []string{"RS256", "RS384", "RS512"}
+
+// Identity is the authenticated caller as taken from the verified token.
+// FloorId is empty for users that have not joined a floor yet.
+type Identity struct {
+	UserId  string
+	FloorId string
+}
+
+type identityCtxKey struct{}
+type authTokenCtxKey struct{}
+
 func (as AuthServiceImpl) getUserProfile(authToken string) (UserProfile, error) {
 	httpClient := &http.Client{}
-	req, err := http.NewRequest("GET", "http://192.168.0.108:8082/userprofile", nil)
-	req.Header.Add("Authorization", "Bearer "+authToken)
+	req, err := http.NewRequest("GET", as.userProfileUrl, nil)
 	if err != nil {
 		return UserProfile{}, fmt.Errorf("Error creating http request: %w", err)
 	}
+	req.Header.Add("Authorization", "Bearer "+authToken)
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
 		return UserProfile{}, fmt.Errorf("Error getting user profile: %w", err)
 	}
-	//convert response body to byte stream and then to string
-
-	// Read the entire body into a byte slice
-	// bodyBytes, err := io.ReadAll(resp.Body)
-	// if err != nil {
-	//   panic(err)
-	// }
-
-	// // Convert the byte slice to a string
-	// bodyString := string(bodyBytes)
-
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return UserProfile{}, fmt.Errorf("Error getting user profile: %w", err)
+		return UserProfile{}, fmt.Errorf("Error getting user profile: status %d", resp.StatusCode)
 	}
 
 	var userProfile UserProfile
@@ -55,20 +64,16 @@ func (as AuthServiceImpl) getUserProfile(authToken string) (UserProfile, error)
 	return userProfile, nil
 }
 
-func (as AuthServiceImpl) verifyToken(authToken string) (string, error) {
-	var claims jwt.MapClaims
-	token, err := jwt.Parse(authToken, func(token *jwt.Token) (interface{}, error) {
-		return as.pubKey, nil
+func (as AuthServiceImpl) verifyToken(authToken string) (Identity, error) {
+	parser := jwt.Parser{ValidMethods: validSigningMethods}
+	token, err := parser.Parse(authToken, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return as.keys.publicKey(kid, token.Method.Alg())
 	})
-
 	if err != nil {
-		log.Println("Error parsing token:", err)
-		return "", fmt.Errorf("Error parsing token: %w", err)
-	}
-
-	if token.Valid {
-		claims = token.Claims.(jwt.MapClaims)
-	} else {
 		if ve, ok := err.(*jwt.ValidationError); ok {
 			if ve.Errors&jwt.ValidationErrorMalformed != 0 {
 				log.Println("Token is malformed")
@@ -77,9 +82,121 @@ func (as AuthServiceImpl) verifyToken(authToken string) (string, error) {
 			} else {
 				log.Println("Token is not valid:", err)
 			}
-		} else {
-			log.Println("Token is not valid:", err)
 		}
+		return Identity{}, fmt.Errorf("Error parsing token: %w", err)
+	}
+	if !token.Valid {
+		return Identity{}, fmt.Errorf("Token is not valid")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return Identity{}, fmt.Errorf("Token claims have unexpected format")
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return Identity{}, fmt.Errorf("Token has no valid exp claim")
+	}
+	if as.issuer != "" && !claims.VerifyIssuer(as.issuer, true) {
+		return Identity{}, fmt.Errorf("Token issuer %v is not %s", claims["iss"], as.issuer)
+	}
+	if as.audience != "" && !claims.VerifyAudience(as.audience, true) {
+		return Identity{}, fmt.Errorf("Token audience %v does not contain %s", claims["aud"], as.audience)
+	}
+	userId := claimString(claims, "user_id")
+	if userId == "" {
+		return Identity{}, fmt.Errorf("Token has no user_id claim")
+	}
+	return Identity{UserId: userId, FloorId: claimString(claims, "floor_id")}, nil
+}
+
+// claimString reads a claim that the auth server may send either as string or as number.
+func claimString(claims jwt.MapClaims, key string) string {
+	switch v := claims[key].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatInt(int64(v), 10)
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
+
+// authMiddleware verifies the bearer token of every request and stores the caller's
+// identity in the request context. Preflight requests are passed through untouched.
+func authMiddleware(as AuthService, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//preflight requests carry no token and method-only routes have no OPTIONS pattern
+		if r.Method == http.MethodOptions {
+			corsHandler(w)
+			return
+		}
+		authToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || authToken == "" {
+			corsHandler(w)
+			writeError(w, r, "error.noToken", http.StatusUnauthorized)
+			return
+		}
+		identity, err := as.verifyToken(authToken)
+		if err != nil {
+			logger.Error("authMiddleware verifyToken", slog.Any("error", err), slog.String("path", r.URL.Path))
+			corsHandler(w)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeError(w, r, "error.invalidToken", http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), identityCtxKey{}, identity)
+		ctx = context.WithValue(ctx, authTokenCtxKey{}, authToken)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func contextWithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityCtxKey{}, identity)
+}
+
+func identityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityCtxKey{}).(Identity)
+	return identity, ok && identity.UserId != ""
+}
+
+func authTokenFromContext(ctx context.Context) string {
+	authToken, _ := ctx.Value(authTokenCtxKey{}).(string)
+	return authToken
+}
+
+// callerIdentity returns the identity set by authMiddleware and writes a 401 if there is none.
+func callerIdentity(w http.ResponseWriter, r *http.Request) (Identity, bool) {
+	identity, ok := identityFromContext(r.Context())
+	if !ok {
+		writeError(w, r, "error.notAuthenticated", http.StatusUnauthorized)
+		return Identity{}, false
+	}
+	return identity, true
+}
+
+// callerFloorIdentity is callerIdentity for handlers that need the caller to belong to a floor.
+func callerFloorIdentity(w http.ResponseWriter, r *http.Request) (Identity, bool) {
+	identity, ok := callerIdentity(w, r)
+	if !ok {
+		return Identity{}, false
+	}
+	if identity.FloorId == "" {
+		writeError(w, r, "error.noFloor", http.StatusForbidden)
+		return Identity{}, false
+	}
+	return identity, true
+}
+
+// callerFloorFromPath is callerFloorIdentity for /floor/{id}/... routes, residents only get to see their own floor.
+func callerFloorFromPath(w http.ResponseWriter, r *http.Request) (Identity, bool) {
+	identity, ok := callerFloorIdentity(w, r)
+	if !ok {
+		return Identity{}, false
+	}
+	if r.PathValue("id") != identity.FloorId {
+		writeError(w, r, "error.accessDenied", http.StatusForbidden)
+		return Identity{}, false
 	}
-	return claims["floor_id"].(string), nil
+	return identity, true
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type ResidentStats struct {
+	ResidentId         string  `json:"residentId"`
+	Name               string  `json:"name"`
+	RoomId             int     `json:"roomId"`
+	TasksCompleted     int     `json:"tasksCompleted"`
+	AvgCompletionHours float64 `json:"avgCompletionHours"`
+	RemindersReceived  int     `json:"remindersReceived"`
+	TasksPassedOn      int     `json:"tasksPassedOn"`
+	DaysUnavailable    float64 `json:"daysUnavailable"`
+}
+
+type StatsResponse struct {
+	From          time.Time       `json:"from"`
+	To            time.Time       `json:"to"`
+	Residents     []ResidentStats `json:"residents"`
+	FairnessIndex float64         `json:"fairnessIndex"`
+}
+
+const defaultStatsWindow = 30 * 24 * time.Hour
+
+func HandleGetStats(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerFloorFromPath(w, r)
+	if !ok {
+		return
+	}
+	from, to, err := parseStatsWindow(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	floor, err := FindFloor(identity.FloorId)
+	if err != nil {
+		logger.Error("getStats getFloor", slog.Any("error", err), slog.String("floor id", identity.FloorId))
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, "error.floorNotFound", http.StatusUnprocessableEntity)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	entries, err := findHistoryEntries(floor.Id, HistoryFilter{From: from, To: to})
+	if err != nil {
+		logger.Error("getStats findHistoryEntries", slog.Any("error", err), slog.Any("floor id", floor.Id))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	availability, err := findAvailabilityHistory(floor.Id, to)
+	if err != nil {
+		logger.Error("getStats findAvailabilityHistory", slog.Any("error", err), slog.Any("floor id", floor.Id))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(computeStats(floor, entries, availability, from, to, time.Now()))
+}
+
+// parseStatsWindow reads from/to (RFC3339), the window defaults to the last 30 days.
+func parseStatsWindow(r *http.Request, now time.Time) (time.Time, time.Time, error) {
+	q := r.URL.Query()
+	to := now
+	var err error
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return time.Time{}, time.Time{}, errBadQueryParam("to", err)
+		}
+	}
+	from := to.Add(-defaultStatsWindow)
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return time.Time{}, time.Time{}, errBadQueryParam("from", err)
+		}
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, errBadQueryParam("from", nil)
+	}
+	return from, to, nil
+}
+
+// computeStats aggregates the history of the window [from, to) per current resident of the floor.
+// availability holds the resident level RESIDENT_AVAILABLE/UNAVAILABLE entries up to to, oldest first,
+// so that a resident who went away before the window started is counted from its beginning.
+func computeStats(f Floor, entries []HistoryEntry, availability []HistoryEntry, from time.Time, to time.Time, now time.Time) StatsResponse {
+	stats := make(map[string]*ResidentStats)
+	var residents []ResidentStats
+	for _, r := range f.Rooms {
+		if r.Resident.Id == "" {
+			continue
+		}
+		residents = append(residents, ResidentStats{ResidentId: r.Resident.Id, Name: r.Resident.Name, RoomId: r.Id})
+	}
+	for i := range residents {
+		stats[residents[i].ResidentId] = &residents[i]
+	}
+
+	completionHours := make(map[string]float64)
+	timedCompletions := make(map[string]int)
+	for _, e := range entries {
+		switch e.Action {
+		case "DONE":
+			if s, ok := stats[e.FromResident]; ok {
+				s.TasksCompleted++
+				if !e.AssignmentDate.IsZero() && e.Timestamp.After(e.AssignmentDate) {
+					completionHours[e.FromResident] += e.Timestamp.Sub(e.AssignmentDate).Hours()
+					timedCompletions[e.FromResident]++
+				}
+			}
+		case "REMIND":
+			if s, ok := stats[e.ToResident]; ok {
+				s.RemindersReceived++
+			}
+		case "UNASSIGN":
+			if s, ok := stats[e.FromResident]; ok {
+				s.TasksPassedOn++
+			}
+		}
+	}
+	for id, n := range timedCompletions {
+		stats[id].AvgCompletionHours = completionHours[id] / float64(n)
+	}
+
+	end := to
+	if now.Before(end) {
+		end = now
+	}
+	for id, d := range unavailableDurations(availability, from, end) {
+		if s, ok := stats[id]; ok {
+			s.DaysUnavailable = d.Hours() / 24
+		}
+	}
+
+	completed := make([]float64, len(residents))
+	for i, s := range residents {
+		completed[i] = float64(s.TasksCompleted)
+	}
+	if residents == nil {
+		residents = []ResidentStats{}
+	}
+	return StatsResponse{From: from, To: to, Residents: residents, FairnessIndex: jainIndex(completed)}
+}
+
+// unavailableDurations sums per resident how long they were marked unavailable within [from, end).
+func unavailableDurations(availability []HistoryEntry, from time.Time, end time.Time) map[string]time.Duration {
+	sorted := append([]HistoryEntry(nil), availability...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Timestamp.Before(sorted[j].Timestamp) })
+
+	durations := make(map[string]time.Duration)
+	awaySince := make(map[string]time.Time)
+	for _, e := range sorted {
+		if !e.Timestamp.Before(end) {
+			break
+		}
+		start := e.Timestamp
+		if start.Before(from) {
+			start = from
+		}
+		switch e.Action {
+		case "RESIDENT_UNAVAILABLE":
+			if _, away := awaySince[e.FromResident]; !away {
+				awaySince[e.FromResident] = start
+			}
+		case "RESIDENT_AVAILABLE":
+			if since, away := awaySince[e.FromResident]; away {
+				durations[e.FromResident] += start.Sub(since)
+				delete(awaySince, e.FromResident)
+			}
+		}
+	}
+	for id, since := range awaySince {
+		durations[id] += end.Sub(since)
+	}
+	return durations
+}
+
+// jainIndex is Jain's fairness index of the shares, 1 when everyone did the same amount
+// and 1/n when a single resident did everything.
+func jainIndex(shares []float64) float64 {
+	var sum, sumSq float64
+	for _, x := range shares {
+		sum += x
+		sumSq += x * x
+	}
+	if sumSq == 0 {
+		return 1
+	}
+	return sum * sum / (float64(len(shares)) * sumSq)
+}
+
+func newAvailabilityEntry(f Floor, room Room, action string, now time.Time) HistoryEntry {
+	return HistoryEntry{
+		FloorId:      f.Id,
+		Action:       action,
+		FromRoom:     room.Id,
+		ToRoom:       room.Id,
+		FromResident: room.Resident.Id,
+		ToResident:   room.Resident.Id,
+		ActorId:      room.Resident.Id,
+		Timestamp:    now,
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_jainIndex(t *testing.T) {
+	tests := []struct {
+		name   string
+		shares []float64
+		want   float64
+	}{
+		{name: "should be 1 when equal", shares: []float64{3, 3, 3}, want: 1},
+		{name: "should be 1 when nobody did anything", shares: []float64{0, 0}, want: 1},
+		{name: "should be 1/n when one did everything", shares: []float64{4, 0, 0, 0}, want: 0.25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jainIndex(tt.shares); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("got %v want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_computeStats(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(10 * 24 * time.Hour)
+	f := Floor{Rooms: []Room{
+		{Id: 0, Resident: Resident{Id: "1", Name: "Max"}},
+		{Id: 1, Resident: Resident{Id: "2", Name: "Leona"}},
+		{Id: 2},
+	}}
+	entries := []HistoryEntry{
+		{Action: "DONE", FromResident: "1", AssignmentDate: from, Timestamp: from.Add(2 * time.Hour)},
+		{Action: "DONE", FromResident: "1", AssignmentDate: from, Timestamp: from.Add(4 * time.Hour)},
+		{Action: "REMIND", FromResident: "2", ToResident: "2", Timestamp: from.Add(time.Hour)},
+		{Action: "UNASSIGN", FromResident: "2", Timestamp: from.Add(time.Hour)},
+		{Action: "DONE", FromResident: "9", Timestamp: from.Add(time.Hour)},
+	}
+	availability := []HistoryEntry{
+		{Action: "RESIDENT_UNAVAILABLE", FromResident: "2", Timestamp: from.Add(-24 * time.Hour)},
+		{Action: "RESIDENT_AVAILABLE", FromResident: "2", Timestamp: from.Add(2 * 24 * time.Hour)},
+		{Action: "RESIDENT_UNAVAILABLE", FromResident: "1", Timestamp: from.Add(9 * 24 * time.Hour)},
+	}
+
+	stats := computeStats(f, entries, availability, from, to, to.Add(time.Hour))
+
+	if len(stats.Residents) != 2 {
+		t.Fatalf("expected stats for 2 residents, got %v", len(stats.Residents))
+	}
+	max, leona := stats.Residents[0], stats.Residents[1]
+	if max.TasksCompleted != 2 || max.AvgCompletionHours != 3 || max.DaysUnavailable != 1 {
+		t.Errorf("wrong stats for max: %+v", max)
+	}
+	if leona.RemindersReceived != 1 || leona.TasksPassedOn != 1 || leona.DaysUnavailable != 2 {
+		t.Errorf("wrong stats for leona: %+v", leona)
+	}
+	if stats.FairnessIndex != 0.5 {
+		t.Errorf("wrong fairness index: got %v want %v", stats.FairnessIndex, 0.5)
+	}
+}
+
+func Test_stats(t *testing.T) {
+	f, err := insertTestFloor(FloorStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	err = insertHistoryEntries([]HistoryEntry{
+		newHistoryEntry(f, f.Tasks[0], f.Tasks[1], "DONE", "1", now.Add(-time.Hour)),
+		newHistoryEntry(f, f.Tasks[1], f.Tasks[1], "REMIND", "1", now.Add(-time.Hour)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /floor/{id}/stats", HandleGetStats)
+
+	t.Run("should return stats of floor", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "/floor/"+f.Id.Hex()+"/stats", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(req, "1", f.Id.Hex()))
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		var stats StatsResponse
+		json.Unmarshal(rr.Body.Bytes(), &stats)
+		if stats.Residents[0].TasksCompleted != 1 {
+			t.Errorf("wrong completed count: got %v want %v", stats.Residents[0].TasksCompleted, 1)
+		}
+		if stats.Residents[1].RemindersReceived != 1 {
+			t.Errorf("wrong reminder count: got %v want %v", stats.Residents[1].RemindersReceived, 1)
+		}
+	})
+	t.Run("should 400 on inverted window", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "/floor/"+f.Id.Hex()+"/stats?from=2024-02-01T00:00:00Z&to=2024-01-01T00:00:00Z", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(req, "1", f.Id.Hex()))
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+		}
+	})
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// time the counterpart has to answer a swap
+var swapWindow = 2 * 24 * time.Hour
+
+// Swap is a resident's offer to hand their task to another resident in exchange for one of
+// theirs. RoomId and CounterRoomId are the assignees at proposal time, the swap only goes
+// through while both tasks are still with them.
+type Swap struct {
+	Id            int       `bson:"id" json:"id"`
+	TaskId        string    `bson:"taskId" json:"taskId"`
+	RoomId        int       `bson:"roomId" json:"roomId"`
+	CounterTaskId string    `bson:"counterTaskId" json:"counterTaskId"`
+	CounterRoomId int       `bson:"counterRoomId" json:"counterRoomId"`
+	ProposedBy    string    `bson:"proposedBy" json:"proposedBy"`
+	CreatedAt     time.Time `bson:"createdAt" json:"createdAt"`
+	ExpiresAt     time.Time `bson:"expiresAt" json:"expiresAt"`
+}
+
+// SwapRequest proposes to exchange the caller's task TaskId for CounterTaskId.
+type SwapRequest struct {
+	Revision      *int64 `json:"revision,omitempty"`
+	TaskId        string `json:"taskId"`
+	CounterTaskId string `json:"counterTaskId"`
+}
+
+type SwapAnswerRequest struct {
+	Revision *int64 `json:"revision,omitempty"`
+}
+
+func findSwap(swaps []Swap, swapId int) (Swap, error) {
+	for _, s := range swaps {
+		if s.Id == swapId {
+			return s, nil
+		}
+	}
+	return Swap{}, fmt.Errorf("swap with id %d not found", swapId)
+}
+
+func swapExpired(s Swap, now time.Time) bool {
+	return !now.Before(s.ExpiresAt)
+}
+
+// validateSwap checks that both tasks of s are still with the rooms they were proposed for and
+// that both residents can take over the other task.
+func validateSwap(f Floor, s Swap) error {
+	if s.TaskId == s.CounterTaskId {
+		return fmt.Errorf("a task cannot be swapped for itself")
+	}
+	if s.RoomId == s.CounterRoomId {
+		return fmt.Errorf("both tasks are assigned to the same room")
+	}
+	for _, side := range []struct {
+		taskId string
+		roomId int
+	}{{s.TaskId, s.RoomId}, {s.CounterTaskId, s.CounterRoomId}} {
+		task, err := findTask(f.Tasks, side.taskId)
+		if err != nil {
+			return fmt.Errorf("task %s not found", side.taskId)
+		}
+		if task.AssignedTo != side.roomId {
+			return fmt.Errorf("%s is no longer assigned to room %d", task.Name, side.roomId)
+		}
+		roomIndex, err := findRoomById(f.Rooms, side.roomId)
+		if err != nil {
+			return fmt.Errorf("room %d not found", side.roomId)
+		}
+		if r := f.Rooms[roomIndex]; r.Resident.Id == "" || !r.Resident.Available {
+			return fmt.Errorf("resident of room %d is not available", side.roomId)
+		}
+	}
+	return nil
+}
+
+// applySwap exchanges the assignees of both tasks of s on f.
+func applySwap(f *Floor, s Swap) error {
+	if err := validateSwap(*f, s); err != nil {
+		return err
+	}
+	taskIndex, _ := findTaskIndex(f.Tasks, s.TaskId)
+	counterIndex, _ := findTaskIndex(f.Tasks, s.CounterTaskId)
+	roomIndex, _ := findRoomById(f.Rooms, s.RoomId)
+	counterRoomIndex, _ := findRoomById(f.Rooms, s.CounterRoomId)
+	f.Tasks = append([]Task(nil), f.Tasks...)
+	assignTask(f, taskIndex, f.Rooms[counterRoomIndex])
+	assignTask(f, counterIndex, f.Rooms[roomIndex])
+	return nil
+}
+
+// HandleProposeSwap offers the caller's task for a task of another resident and asks them.
+func HandleProposeSwap(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerFloorFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req SwapRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.Error("proposeSwap decoding data payload", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	floor, err := FindFloor(identity.FloorId)
+	if err != nil {
+		logger.Error("proposeSwap getFloor", slog.Any("error", err), slog.String("floor id", identity.FloorId))
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, "error.floorNotFound", http.StatusUnprocessableEntity)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkClientRevision(w, floor, req.Revision) {
+		return
+	}
+	roomIndex, err := findRoom(floor.Rooms, identity.UserId)
+	if err != nil {
+		writeError(w, r, "error.userNotInFloor", http.StatusUnprocessableEntity)
+		return
+	}
+	counterRoomId := -1
+	if t, err := findTask(floor.Tasks, req.CounterTaskId); err == nil {
+		counterRoomId = t.AssignedTo
+	}
+	now := time.Now()
+	swap := Swap{
+		Id:            1,
+		TaskId:        req.TaskId,
+		RoomId:        floor.Rooms[roomIndex].Id,
+		CounterTaskId: req.CounterTaskId,
+		CounterRoomId: counterRoomId,
+		ProposedBy:    identity.UserId,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(swapWindow),
+	}
+	if err := validateSwap(floor, swap); err != nil {
+		writeError(w, r, "error.invalidSwap", http.StatusBadRequest, "Error", err.Error())
+		return
+	}
+	if len(floor.Swaps) > 0 {
+		swap.Id = floor.Swaps[len(floor.Swaps)-1].Id + 1
+	}
+
+	msgs := swapMessages(floor, swap, "SWAP_PROPOSED", "swap.proposed", swap.CounterRoomId)
+	fUp, err := insertSwap(floor, swap, msgs...)
+	if err != nil {
+		writeDBError(w, err, floor.Id, "proposeSwap updating DB", slog.Any("swap", swap))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(fUp)
+}
+
+// HandleAcceptSwap lets the counterpart take the offered task, both assignees change in one write.
+func HandleAcceptSwap(w http.ResponseWriter, r *http.Request) {
+	answerSwap(w, r, true)
+}
+
+// HandleDeclineSwap lets the counterpart turn a swap down, or its proposer withdraw it.
+func HandleDeclineSwap(w http.ResponseWriter, r *http.Request) {
+	answerSwap(w, r, false)
+}
+
+func answerSwap(w http.ResponseWriter, r *http.Request, accept bool) {
+	corsHandler(w)
+	identity, ok := callerFloorFromPath(w, r)
+	if !ok {
+		return
+	}
+	swapId, err := strconv.Atoi(r.PathValue("swapId"))
+	if err != nil {
+		writeError(w, r, "error.invalidSwapId", http.StatusBadRequest)
+		return
+	}
+	var req SwapAnswerRequest
+	//the revision is optional, an empty body answers on the latest one
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		logger.Error("answerSwap decoding data payload", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	floor, err := FindFloor(identity.FloorId)
+	if err != nil {
+		logger.Error("answerSwap getFloor", slog.Any("error", err), slog.String("floor id", identity.FloorId))
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, "error.floorNotFound", http.StatusUnprocessableEntity)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkClientRevision(w, floor, req.Revision) {
+		return
+	}
+	swap, err := findSwap(floor.Swaps, swapId)
+	if err != nil || swapExpired(swap, time.Now()) {
+		writeError(w, r, "error.swapNotFound", http.StatusNotFound)
+		return
+	}
+	isCounterpart := residentOfRoom(floor.Rooms, swap.CounterRoomId) == identity.UserId
+	if !isCounterpart && (accept || swap.ProposedBy != identity.UserId) {
+		writeError(w, r, "error.notSwapCounterpart", http.StatusForbidden)
+		return
+	}
+
+	var set bson.M
+	var msgs []OutboxMessage
+	if accept {
+		applied := floor
+		if err := applySwap(&applied, swap); err != nil {
+			writeError(w, r, "error.invalidSwap", http.StatusUnprocessableEntity, "Error", err.Error())
+			return
+		}
+		set = bson.M{"tasks": applied.Tasks}
+		msgs = swapMessages(floor, swap, "SWAP_ACCEPTED", "swap.accepted", swap.RoomId, swap.CounterRoomId)
+	} else if isCounterpart {
+		msgs = swapMessages(floor, swap, "SWAP_DECLINED", "swap.declined", swap.RoomId)
+	} else {
+		msgs = swapMessages(floor, swap, "SWAP_DECLINED", "swap.withdrawn", swap.CounterRoomId)
+	}
+	fUp, err := closeSwap(floor, swap.Id, set, msgs...)
+	if err != nil {
+		writeDBError(w, err, floor.Id, "answerSwap updating DB", slog.Any("swap", swap), slog.Bool("accept", accept))
+		return
+	}
+	if accept {
+		now := time.Now()
+		var history []HistoryEntry
+		for _, taskId := range []string{swap.TaskId, swap.CounterTaskId} {
+			before, _ := findTask(floor.Tasks, taskId)
+			after, _ := findTask(fUp.Tasks, taskId)
+			history = append(history, newHistoryEntry(floor, before, after, "SWAP", identity.UserId, now))
+		}
+		recordHistory(history)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fUp)
+}
+
+// SwapExpiryScheduler drops swaps nobody answered in time and swaps whose tasks moved on in the
+// meantime, and tells both residents.
+type SwapExpiryScheduler struct {
+	clock    Clock
+	interval time.Duration
+}
+
+func newSwapExpiryScheduler(clock Clock, interval time.Duration) *SwapExpiryScheduler {
+	return &SwapExpiryScheduler{clock: clock, interval: interval}
+}
+
+// start drops expired swaps right away and then every interval until ctx is done.
+func (s *SwapExpiryScheduler) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			if _, err := s.runOnce(); err != nil {
+				logger.Error("swapExpiryScheduler run", slog.Any("error", err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// runOnce drops every expired or outdated swap and returns how many were dropped.
+func (s *SwapExpiryScheduler) runOnce() (int, error) {
+	now := s.clock.Now()
+	floors, err := findFloorsWithSwaps()
+	if err != nil {
+		return 0, fmt.Errorf("swapExpiryScheduler finding floors: %w", err)
+	}
+	dropped := 0
+	for _, f := range floors {
+		if len(staleSwaps(f, now)) == 0 {
+			continue
+		}
+		n, err := expireSwaps(f.Id.Hex(), now)
+		if err != nil {
+			logger.Error("swapExpiryScheduler expire", slog.Any("error", err), slog.Any("floor id", f.Id))
+			continue
+		}
+		dropped += n
+	}
+	return dropped, nil
+}
+
+// staleSwaps returns the swaps of f that expired or can no longer be applied.
+func staleSwaps(f Floor, now time.Time) []Swap {
+	var stale []Swap
+	for _, s := range f.Swaps {
+		if swapExpired(s, now) || validateSwap(f, s) != nil {
+			stale = append(stale, s)
+		}
+	}
+	return stale
+}
+
+// expireSwaps drops the stale swaps of the latest floor revision, retrying when a resident
+// writes the floor at the same time.
+func expireSwaps(floorId string, now time.Time) (int, error) {
+	var err error
+	for i := 0; i < 3; i++ {
+		var f Floor
+		f, err = FindFloor(floorId)
+		if err != nil {
+			return 0, err
+		}
+		stale := staleSwaps(f, now)
+		if len(stale) == 0 {
+			return 0, nil
+		}
+		var msgs []OutboxMessage
+		for _, s := range stale {
+			msgs = append(msgs, swapMessages(f, s, "SWAP_EXPIRED", "swap.expired", s.RoomId, s.CounterRoomId)...)
+		}
+		f.Swaps = withoutSwaps(f.Swaps, stale)
+		_, err = updateSwaps(f, msgs...)
+		if errors.Is(err, ErrRevisionConflict) {
+			continue
+		}
+		return len(stale), err
+	}
+	return 0, err
+}
+
+func withoutSwaps(swaps []Swap, drop []Swap) []Swap {
+	rest := []Swap{}
+	for _, s := range swaps {
+		if _, err := findSwap(drop, s.Id); err != nil {
+			rest = append(rest, s)
+		}
+	}
+	return rest
+}
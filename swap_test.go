@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_validateSwap(t *testing.T) {
+	f := votingFloor()
+	f.Tasks = append(f.Tasks, Task{Id: "2", Name: "Flur", AssignedTo: 2})
+	f.Rooms[2].Resident.Available = false
+	tests := []struct {
+		name    string
+		swap    Swap
+		wantErr bool
+	}{
+		{name: "should accept tasks of two residents", swap: Swap{TaskId: "0", RoomId: 0, CounterTaskId: "1", CounterRoomId: 1}},
+		{name: "should reject the same task", swap: Swap{TaskId: "0", RoomId: 0, CounterTaskId: "0", CounterRoomId: 1}, wantErr: true},
+		{name: "should reject the same room", swap: Swap{TaskId: "0", RoomId: 0, CounterTaskId: "1", CounterRoomId: 0}, wantErr: true},
+		{name: "should reject a task that moved on", swap: Swap{TaskId: "0", RoomId: 0, CounterTaskId: "1", CounterRoomId: 3}, wantErr: true},
+		{name: "should reject unknown task", swap: Swap{TaskId: "0", RoomId: 0, CounterTaskId: "9", CounterRoomId: 1}, wantErr: true},
+		{name: "should reject unavailable resident", swap: Swap{TaskId: "0", RoomId: 0, CounterTaskId: "2", CounterRoomId: 2}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateSwap(f, tt.swap); (err != nil) != tt.wantErr {
+				t.Errorf("validateSwap: got %v wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_applySwap(t *testing.T) {
+	f := votingFloor()
+	f.Tasks[0].Reminders = 2
+	before := f.Tasks
+	if err := applySwap(&f, Swap{TaskId: "0", RoomId: 0, CounterTaskId: "1", CounterRoomId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if f.Tasks[0].AssignedTo != 1 || f.Tasks[1].AssignedTo != 0 {
+		t.Errorf("assignees not swapped: %+v", f.Tasks)
+	}
+	if f.Tasks[0].Reminders != 0 {
+		t.Errorf("reminders not reset: got %v want 0", f.Tasks[0].Reminders)
+	}
+	if before[0].AssignedTo != 0 {
+		t.Errorf("tasks of the original floor changed")
+	}
+}
+
+func Test_staleSwaps(t *testing.T) {
+	now := time.Now()
+	f := votingFloor()
+	f.Swaps = []Swap{
+		{Id: 1, TaskId: "0", RoomId: 0, CounterTaskId: "1", CounterRoomId: 1, ExpiresAt: now.Add(time.Hour)},
+		{Id: 2, TaskId: "0", RoomId: 0, CounterTaskId: "1", CounterRoomId: 1, ExpiresAt: now},
+		{Id: 3, TaskId: "0", RoomId: 0, CounterTaskId: "1", CounterRoomId: 2, ExpiresAt: now.Add(time.Hour)},
+	}
+	stale := staleSwaps(f, now)
+	if len(stale) != 2 || stale[0].Id != 2 || stale[1].Id != 3 {
+		t.Errorf("wrong stale swaps: got %v want swaps 2 and 3", stale)
+	}
+	if rest := withoutSwaps(f.Swaps, stale); len(rest) != 1 || rest[0].Id != 1 {
+		t.Errorf("wrong swaps kept: got %v want swap 1", rest)
+	}
+}
+
+func Test_swapMessages(t *testing.T) {
+	f := votingFloor()
+	for i := range f.Rooms {
+		f.Rooms[i].Resident.Channels = []Channel{{Type: ChannelExpo, Address: "ExponentPushToken[" + f.Rooms[i].Resident.Id + "]"}}
+	}
+	s := Swap{Id: 1, TaskId: "0", RoomId: 0, CounterTaskId: "1", CounterRoomId: 1, ProposedBy: "a"}
+	msgs := swapMessages(f, s, "SWAP_ACCEPTED", "swap.accepted", s.RoomId, s.CounterRoomId)
+	if len(msgs) != 2 {
+		t.Fatalf("wrong number of messages: got %v want 2", len(msgs))
+	}
+	if msgs[0].RoomId != 0 || msgs[0].Args["Task"] != "Küche" || msgs[0].Args["OtherTask"] != "Bad" {
+		t.Errorf("wrong message to the proposer: %+v", msgs[0])
+	}
+	if msgs[1].RoomId != 1 || msgs[1].Args["Task"] != "Bad" || msgs[1].Args["OtherTask"] != "Küche" {
+		t.Errorf("wrong message to the counterpart: %+v", msgs[1])
+	}
+	if msgs[1].Args["Resident"] != "Resident a" {
+		t.Errorf("proposer not named: %+v", msgs[1].Args)
+	}
+}
+
+func Test_HandleSwap(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /floor/{id}/swaps", HandleProposeSwap)
+	mux.HandleFunc("POST /floor/{id}/swaps/{swapId}/accept", HandleAcceptSwap)
+	mux.HandleFunc("POST /floor/{id}/swaps/{swapId}/decline", HandleDeclineSwap)
+	f, err := insertTestFloor(FloorStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(path string, userId string, body any) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		r, _ := http.NewRequest("POST", "/floor/"+f.Id.Hex()+path, bytes.NewReader(b))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(r, userId, f.Id.Hex()))
+		return rr
+	}
+
+	t.Run("should reject swapping a task of someone else", func(t *testing.T) {
+		if rr := post("/swaps", "1", SwapRequest{TaskId: "1", CounterTaskId: "0"}); rr.Code != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("should propose and accept swap", func(t *testing.T) {
+		rr := post("/swaps", "1", SwapRequest{TaskId: "0", CounterTaskId: "1"})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+		var fUp Floor
+		json.Unmarshal(rr.Body.Bytes(), &fUp)
+		if len(fUp.Swaps) != 1 || fUp.Swaps[0].CounterRoomId != 1 || fUp.Swaps[0].ProposedBy != "1" {
+			t.Fatalf("swap not stored: %+v", fUp.Swaps)
+		}
+		swapPath := "/swaps/" + strconv.Itoa(fUp.Swaps[0].Id)
+		if rr := post(swapPath+"/accept", "1", SwapAnswerRequest{}); rr.Code != http.StatusForbidden {
+			t.Errorf("proposer accepted own swap: got %v want %v", rr.Code, http.StatusForbidden)
+		}
+		rr = post(swapPath+"/accept", "2", SwapAnswerRequest{})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		fUp = Floor{}
+		json.Unmarshal(rr.Body.Bytes(), &fUp)
+		if len(fUp.Swaps) != 0 {
+			t.Errorf("swap not closed: %+v", fUp.Swaps)
+		}
+		task0, _ := findTask(fUp.Tasks, "0")
+		task1, _ := findTask(fUp.Tasks, "1")
+		if task0.AssignedTo != 1 || task1.AssignedTo != 0 {
+			t.Errorf("assignees not swapped: got %v and %v want 1 and 0", task0.AssignedTo, task1.AssignedTo)
+		}
+	})
+
+	t.Run("should let the proposer withdraw swap", func(t *testing.T) {
+		rr := post("/swaps", "1", SwapRequest{TaskId: "1", CounterTaskId: "0"})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+		var fUp Floor
+		json.Unmarshal(rr.Body.Bytes(), &fUp)
+		if len(fUp.Swaps) != 1 {
+			t.Fatalf("swap not stored: %+v", fUp.Swaps)
+		}
+		swapPath := "/swaps/" + strconv.Itoa(fUp.Swaps[0].Id)
+		if rr := post(swapPath+"/decline", "3", SwapAnswerRequest{}); rr.Code != http.StatusForbidden {
+			t.Errorf("bystander declined swap: got %v want %v", rr.Code, http.StatusForbidden)
+		}
+		rr = post(swapPath+"/decline", "1", SwapAnswerRequest{})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		fUp = Floor{}
+		json.Unmarshal(rr.Body.Bytes(), &fUp)
+		if len(fUp.Swaps) != 0 {
+			t.Errorf("swap not withdrawn: %+v", fUp.Swaps)
+		}
+		if task1, _ := findTask(fUp.Tasks, "1"); task1.AssignedTo != 0 {
+			t.Errorf("declined swap changed assignee: got %v want 0", task1.AssignedTo)
+		}
+	})
+}
+
+func Test_swapExpiryScheduler(t *testing.T) {
+	fStub := FloorStub
+	fStub.Swaps = []Swap{{Id: 1, TaskId: "0", RoomId: 0, CounterTaskId: "1", CounterRoomId: 1, ProposedBy: "1", ExpiresAt: time.Now().Add(time.Hour)}}
+	f, err := insertTestFloor(fStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should keep open swaps", func(t *testing.T) {
+		if _, err := newSwapExpiryScheduler(fakeClock{now: time.Now()}, time.Minute).runOnce(); err != nil {
+			t.Error(err)
+		}
+		fUp, err := FindFloor(f.Id.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fUp.Swaps) != 1 {
+			t.Errorf("open swap dropped: %+v", fUp.Swaps)
+		}
+	})
+	t.Run("should drop swaps once the clock passes their expiry", func(t *testing.T) {
+		if _, err := newSwapExpiryScheduler(fakeClock{now: time.Now().Add(2 * time.Hour)}, time.Minute).runOnce(); err != nil {
+			t.Error(err)
+		}
+		fUp, err := FindFloor(f.Id.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fUp.Swaps) != 0 {
+			t.Errorf("expired swap not dropped: %+v", fUp.Swaps)
+		}
+		if task0, _ := findTask(fUp.Tasks, "0"); task0.AssignedTo != 0 {
+			t.Errorf("expired swap changed assignee: got %v want 0", task0.AssignedTo)
+		}
+	})
+}
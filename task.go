@@ -2,18 +2,23 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"reflect"
-	"strconv"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// AssignedTo of the tasks in the unassigned pool, nobody was available to take them. Residents
+// claim them, or they go to the next resident that becomes available.
+const unassignedRoom = -1
+
 type TaskService interface {
 	HandleTaskUpdate(w http.ResponseWriter, r *http.Request)
 	HandleTaskRemind(w http.ResponseWriter, r *http.Request)
@@ -21,6 +26,7 @@ type TaskService interface {
 
 type TaskUpdateRequest struct {
 	FloorId  string `json:"floorId"`
+	Revision *int64 `json:"revision,omitempty"`
 	Task     Task   `json:"task"`
 	Action   string `json:"action"`
 	NextRoom Room   `json:"nextRoom"`
@@ -29,17 +35,20 @@ type TaskUpdateRequest struct {
 type TaskUpdateResult struct {
 	Floor        Floor  `json:"floor"`
 	TasksUpdated []Task `json:"tasksUpdated"`
-	RoomToNotify Room   `json:"roomToNotify"`
+	//rooms that got one of TasksUpdated
+	RoomsToNotify []Room `json:"roomsToNotify"`
 }
 
 type TaskVotingRequest struct {
-	Task   Task   `json:"task"`
-	Action string `json:"action"`
+	Revision *int64 `json:"revision,omitempty"`
+	Task     Task   `json:"task"`
+	Action   string `json:"action"`
 }
 
 type VotingActionRequest struct {
-	Voting Voting `json:"voting"`
-	Action string `json:"action"`
+	Revision *int64 `json:"revision,omitempty"`
+	Voting   Voting `json:"voting"`
+	Action   string `json:"action"`
 }
 
 func (s TaskUpdateRequest) HandleTaskUpdate(w http.ResponseWriter, r *http.Request) {
@@ -47,6 +56,10 @@ func (s TaskUpdateRequest) HandleTaskUpdate(w http.ResponseWriter, r *http.Reque
 	if r.Method == http.MethodOptions {
 		return
 	}
+	identity, ok := callerFloorIdentity(w, r)
+	if !ok {
+		return
+	}
 	var taskUpdate TaskUpdateRequest
 	err := json.NewDecoder(r.Body).Decode(&taskUpdate)
 	if err != nil {
@@ -54,16 +67,43 @@ func (s TaskUpdateRequest) HandleTaskUpdate(w http.ResponseWriter, r *http.Reque
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	taskUpdate.FloorId = identity.FloorId
 	floor, err := FindFloor(taskUpdate.FloorId)
 	if err != nil {
 		logger.Error("taskUpdate getFloor", slog.Any("error", err), slog.Any("taskToUpdate", taskUpdate))
 		if err == mongo.ErrNoDocuments {
-			http.Error(w, "Floor not found", http.StatusUnprocessableEntity)
+			writeError(w, r, "error.floorNotFound", http.StatusUnprocessableEntity)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkClientRevision(w, floor, taskUpdate.Revision) {
+		return
+	}
+	if taskUpdate.Action == "RESIDENT_UNAVAILABLE" {
+		//the same as /update-availability, the room changes together with the tasks
+		roomIndex, err := findRoom(floor.Rooms, identity.UserId)
+		if err != nil {
+			logger.Error("taskUpdate findRoom", slog.Any("error", err), slog.Any("floor id", floor.Id), slog.Any("taskToUpdate", taskUpdate))
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		fUp, err := changeAvailability(floor, roomIndex, taskUpdate.Action, identity.UserId, time.Now())
+		if err != nil {
+			writeDBError(w, err, floor.Id, "taskUpdate updating DB", slog.Any("floor id", floor.Id), slog.Any("taskUpdate", taskUpdate))
 			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fUp)
+		return
 	}
-	taskUpdateResult, err := processTaskUpdate(&floor, taskUpdate)
+	taskUpdateResult, err := processTaskUpdate(&floor, taskUpdate, identity.UserId)
 	if err != nil {
+		if errors.Is(err, ErrRevisionConflict) {
+			writeConflictWithCurrentFloor(w, floor.Id)
+			return
+		}
 		if strings.HasPrefix(err.Error(), "taskUpdate updating DB tasks:") {
 			logger.Error("taskUpdate updating DB tasks", slog.Any("error", err), slog.Any("floor", taskUpdateResult.Floor), slog.Any("taskUpdate", taskUpdate))
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -76,31 +116,17 @@ func (s TaskUpdateRequest) HandleTaskUpdate(w http.ResponseWriter, r *http.Reque
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(taskUpdateResult.Floor)
-
-	//todo pointer check
-	//todo make this in a gorouting aka async
-	if !reflect.DeepEqual(taskUpdateResult.RoomToNotify, Room{}) {
-		taskJSON, err := json.Marshal(taskUpdateResult.TasksUpdated)
-		if err != nil {
-			logger.Error("taskUpdate marshalling task to json", slog.Any("error", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		for i := 0; i < 3; i++ {
-			err = sendNotification(taskUpdateResult.RoomToNotify, taskJSON, taskUpdateResult.Floor.Id.String()[10:len(taskUpdateResult.Floor.Id.String())-2], "TASK_"+taskUpdate.Action, fmt.Sprintf("%s has been assigned to you!", taskUpdateResult.TasksUpdated[0].Name))
-			if err != nil {
-				logger.Error("taskUpdate sendNotification attempt: "+strconv.Itoa(i+1), slog.Any("error", err), slog.Any("floor", floor), slog.Any("taskToUpdate", taskUpdate))
-			} else {
-				break
-			}
-			waitTime := 2 * time.Second << (i) // Exponential backoff with base 2
-			time.Sleep(waitTime)
-		}
-	}
 }
 
 func (s TaskUpdateRequest) HandleTaskRemind(w http.ResponseWriter, r *http.Request) {
 	corsHandler(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	identity, ok := callerFloorIdentity(w, r)
+	if !ok {
+		return
+	}
 	var tu TaskUpdateRequest
 	err := json.NewDecoder(r.Body).Decode(&tu)
 	if err != nil {
@@ -108,14 +134,21 @@ func (s TaskUpdateRequest) HandleTaskRemind(w http.ResponseWriter, r *http.Reque
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	tu.FloorId = identity.FloorId
 
 	f, err := FindFloor(tu.FloorId)
 	if err != nil {
 		logger.Error("taskRemind getFloor", slog.Any("error", err), slog.Any("taskToRemind", tu.Task))
 		if err == mongo.ErrNoDocuments {
-			http.Error(w, "Floor not found", http.StatusUnprocessableEntity)
+			writeError(w, r, "error.floorNotFound", http.StatusUnprocessableEntity)
 			return
 		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !checkClientRevision(w, f, tu.Revision) {
+		return
 	}
 
 	taskIndex, err := findTaskIndex(f.Tasks, tu.Task.Id)
@@ -127,46 +160,37 @@ func (s TaskUpdateRequest) HandleTaskRemind(w http.ResponseWriter, r *http.Reque
 
 	if f.Tasks[taskIndex].AssignedTo != tu.Task.AssignedTo {
 		logger.Error("taskRemind checkConsistency", slog.Any("error", err), slog.Any("floor", f), slog.Any("taskToRemind", tu.Task))
-		http.Error(w, "Task assignee changed in between", http.StatusUnprocessableEntity)
+		writeError(w, r, "error.taskAssigneeChanged", http.StatusUnprocessableEntity)
 		return
 	}
 
+	before := f.Tasks[taskIndex]
 	f.Tasks[taskIndex].Reminders += 1
 
-	f, err = updateTasks(f)
+	msgs := taskReminderMessages(f, f.Tasks[taskIndex], "task.remind")
+	fUp, err := updateTasks(f, msgs...)
 	if err != nil {
-		logger.Error("taskRemind updating DB", slog.Any("error", err), slog.Any("floor", f), slog.Any("taskToRemind", tu.Task))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, err, f.Id, "taskRemind updating DB", slog.Any("floor", f), slog.Any("taskToRemind", tu.Task))
 		return
 	}
+	reminder := newHistoryEntry(f, before, f.Tasks[taskIndex], "REMIND", identity.UserId, time.Now())
+	reminder.Reminders = f.Tasks[taskIndex].Reminders
+	recordHistory([]HistoryEntry{reminder})
+	f = fUp
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(f)
-
-	taskJSON, err := json.Marshal(f.Tasks[taskIndex])
-	if err != nil {
-		logger.Error("taskUpdate marshalling task to json", slog.Any("error", err))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	for i := 0; i < 3; i++ {
-		err = sendNotification(f.Rooms[taskIndex], taskJSON, f.Id.String()[10:len(f.Id.String())-2], "TASK_REMINDER", fmt.Sprintf("You have been remined about %s!", f.Tasks[taskIndex].Name))
-		if err != nil {
-			logger.Error("taskRemind sendNotification attempt: "+strconv.Itoa(i+1), slog.Any("error", err), slog.Any("floor", f), slog.Any("taskToRemind", tu.Task))
-		} else {
-			break
-		}
-		waitTime := 2 * time.Second << (i) // Exponential backoff with base 2
-		time.Sleep(waitTime)
-	}
 }
 
 func HandleTaskCreateDelete(w http.ResponseWriter, r *http.Request) {
-	userId := "1"
 	corsHandler(w)
 	if r.Method == http.MethodOptions {
 		return
 	}
+	identity, ok := callerFloorIdentity(w, r)
+	if !ok {
+		return
+	}
 	var request TaskVotingRequest
 	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
@@ -174,85 +198,11 @@ func HandleTaskCreateDelete(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	floor, err := FindFloor(floorId)
-	if err != nil {
-		logger.Error("createDeleteTask  getFloor", slog.Any("error", err), slog.Any("requst", request))
-		if err == mongo.ErrNoDocuments {
-			http.Error(w, "Floor not found", http.StatusUnprocessableEntity)
-			return
-		}
-	}
-
-	var nextVotId int
-	if len(floor.Votings) == 0 {
-		nextVotId = 1
-	} else {
-		nextVotId = floor.Votings[len(floor.Votings)-1].Id + 1
-	}
-
-	voting := Voting{
-		Id:         nextVotId,
-		Type:       request.Action,
-		Data:       request.Task,
-		Accepts:    []string{},
-		Rejects:    []string{},
-		LaunchDate: time.Now(),
-		// VotingWindow: 10 * time.Second,
-		CreatedBy:    userId,
-		VotingWindow: 2 * 24 * time.Hour,
-	}
-
-	floor, err = InsertVoting(floor.Id, voting)
-	if err != nil {
-		logger.Error("createDeleteTask updating DB", slog.Any("error", err), slog.Any("floor", floor), slog.Any("request", request), slog.Any("votingToCreate", voting))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	time.AfterFunc(voting.VotingWindow, func() {
-		floor, err := deleteVoting(floor.Id, voting.Id)
-		if err != nil {
-			logger.Error("createDeleteTask delete voting", slog.Any("error", err), slog.Any("floor", floor), slog.Any("request", request), slog.Any("votingToCreate", voting))
-			return
-		}
-		//TODO check if silent notification possbile
-	})
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(floor)
-
-	sendCreateDelTaskNotification(floor, voting, "VOTING_ADD")
-}
-
-func sendCreateDelTaskNotification(floor Floor, voting Voting, nType string) {
-	votingJson, err := json.Marshal(floor.Votings)
-	if err != nil {
-		logger.Error("sendCreateTaskNotification marshalling voting to json", slog.Any("error", err))
-		return
-	}
-
-	var notMsg string
-	if voting.Type == "CREATE_TASK" {
-		notMsg = "Request to create a new task"
-	} else if voting.Type == "DELETE_TASK" {
-		notMsg = "Request to delete a task"
-	}
-
-	for _, r := range floor.Rooms {
-		if r.Resident.Id != voting.CreatedBy {
-			for i := 0; i < 3; i++ {
-				err := sendNotification(r, votingJson, floor.Id.String()[10:len(floor.Id.String())-2], nType, notMsg)
-				if err != nil {
-					logger.Error("taskCreateDel sendNotification attempt: "+strconv.Itoa(i+1), slog.Any("error", err), slog.Any("floor", floor), slog.Any("voting", voting))
-				} else {
-					break
-				}
-				waitTime := 2 * time.Second << (i) // Exponential backoff with base 2
-				time.Sleep(waitTime)
-			}
-		}
+	p := VotingPayload{Task: &request.Task}
+	if request.Action == VotingDeleteTask {
+		p = VotingPayload{TaskId: request.Task.Id}
 	}
+	launchVoting(w, r, identity, request.Revision, request.Action, p)
 }
 
 func HandleTaskVotingResponse(w http.ResponseWriter, r *http.Request) {
@@ -260,6 +210,11 @@ func HandleTaskVotingResponse(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodOptions {
 		return
 	}
+	identity, ok := callerFloorIdentity(w, r)
+	if !ok {
+		return
+	}
+	userId := identity.UserId
 	var request VotingActionRequest
 	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
@@ -268,156 +223,90 @@ func HandleTaskVotingResponse(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fId, _ := primitive.ObjectIDFromHex(floorId)
-	voting, err := FindVoting(fId, request.Voting.Id)
+	floor, err := FindFloor(identity.FloorId)
 	if err != nil {
-		logger.Error("taskCreateAccept findVoting", slog.Any("error", err), slog.Any("floor id", fId), slog.Any("request", request))
-		if strings.Contains(err.Error(), "not found") {
-			//TODO just a hack as no notification is sent, some stale notifications can exist
-			// http.Error(w, "Voting not found", http.StatusUnprocessableEntity)
+		logger.Error("taskVotingResponse getFloor", slog.Any("error", err), slog.Any("floor id", identity.FloorId), slog.Any("request", request))
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, "error.floorNotFound", http.StatusUnprocessableEntity)
 			return
 		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if !checkClientRevision(w, floor, request.Revision) {
+		return
+	}
+	voting, err := findVoting(floor.Votings, request.Voting.Id)
+	if err != nil {
+		logger.Error("taskCreateAccept findVoting", slog.Any("error", err), slog.Any("floor id", floor.Id), slog.Any("request", request))
+		//TODO just a hack as no notification is sent, some stale notifications can exist
+		// http.Error(w, "Voting not found", http.StatusUnprocessableEntity)
+		return
+	}
 
 	if voting.CreatedBy == userId && !IsTest {
 		return
 	}
 
-	//action is accept, can be create or delete task
-	if request.Action == "ACCEPT" {
-		floor, err := FindFloor(floorId)
-		if err != nil {
-			logger.Error("taskVotingResponse getFloor", slog.Any("error", err), slog.Any("floor id", fId), slog.Any("request", request))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		if voting.Type == "CREATE_TASK" {
-			//TODO consistency check via accept count comparison
-			_, err = CreateTask(floor, voting.Data.Id)
-			if err != nil {
-				logger.Error("taskVotingResponse createTask", slog.Any("error", err), slog.Any("floor", floor), slog.Any("request", request), slog.Any("voting", voting))
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			//TODO send notification to all
-		} else if voting.Type == "DELETE_TASK" {
-			//check if all residents accepted delete, then delete else update voting
-
-			if contains(voting.Accepts, userId) {
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(floor)
-				return
-			}
-
-			voting.Accepts = append(voting.Accepts, userId)
-			if len(voting.Accepts) == len(floor.Rooms) {
-				_, err = deleteTask(floor.Id, voting.Data.Id)
-				if err != nil {
-					logger.Error("taskVotingResponse deleteTask", slog.Any("error", err), slog.Any("floor", floor), slog.Any("request", request), slog.Any("voting", voting))
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-					//TODO consistency check via accept count comparison
-				}
-			} else {
-				fUp, err := updateVoting(fId, voting)
-				if err != nil {
-					logger.Error("taskVotingResponse updateVoting", slog.Any("error", err), slog.Any("floor id", fId), slog.Any("request", request))
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(fUp)
-				return
-			}
-		}
+	if !castVote(&voting, userId, request.Action) {
+		writeError(w, r, "error.unknownVoteAction", http.StatusBadRequest, "Action", request.Action)
+		return
+	}
+	now := time.Now()
+	outcome := evaluateVoting(floor, voting, votingWindowClosed(voting, now))
+	var fUp Floor
+	if outcome == VotingPending {
+		fUp, err = updateVoting(floor, voting)
+	} else {
+		fUp, err = resolveVoting(floor, voting, outcome, now)
 	}
-
-	//action is reject, create and delete will get voting deleted on first reject
-	fUp, err := deleteVoting(fId, request.Voting.Id)
 	if err != nil {
-		logger.Error("taskVotingResponse deleteVoting", slog.Any("error", err), slog.Any("floor id", fId), slog.Any("request", request))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, err, floor.Id, "taskVotingResponse updating DB", slog.Any("floor id", floor.Id), slog.Any("request", request), slog.String("outcome", outcome))
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(fUp)
-
-	// voting.Accepts += 1
-	// fUp, err := updateVoting(fId, voting)
-	// if err != nil {
-	// 	logger.Error("taskCreateAccept updateVoting", slog.Any("error", err), slog.Any("floor id", fId), slog.Any("request", request))
-	// 	http.Error(w, err.Error(), http.StatusInternalServerError)
-	// 	return
-	// }
-
-	// w.Header().Set("Content-Type", "application/json")
-	// json.NewEncoder(w).Encode(fUp)
 }
 
-func CreateTask(floor Floor, taskname string) (Floor, error) {
-	taskId, err := strconv.Atoi(floor.Tasks[len(floor.Tasks)-1].Id)
-	if err != nil {
-		return Floor{}, err
-	}
-
-	newTask := Task{
-		Id:             strconv.Itoa(taskId + 1),
-		Name:           taskname,
-		AssignedTo:     -1,
-		AssignmentDate: time.Now(),
-		Reminders:      0,
-	}
-
-	fUp, err := InsertTask(floor.Id, newTask)
-	if err != nil {
-		return Floor{}, fmt.Errorf("createTask updating DB: %w, %v", err, newTask)
-	}
-	return fUp, nil
-}
-
-func processTaskUpdate(floor *Floor, tu TaskUpdateRequest) (TaskUpdateResult, error) {
-	var tasksToUpdate []Task
-	if tu.Action == "RESIDENT_UNAVAILABLE" {
-		roomId := 0
-		for _, t := range floor.Tasks {
-			if t.AssignedTo == roomId {
-				tasksToUpdate = append(tasksToUpdate, t)
-			}
+func processTaskUpdate(floor *Floor, tu TaskUpdateRequest, actorId string) (TaskUpdateResult, error) {
+	tasksToUpdate := []Task{tu.Task}
+	if tu.Action == "CLAIM" {
+		roomIndex, err := findRoom(floor.Rooms, actorId)
+		if err != nil {
+			return TaskUpdateResult{}, fmt.Errorf("taskUpdate findRoom: %w", err)
 		}
-	} else {
-		tasksToUpdate = append(tasksToUpdate, tu.Task)
-	}
-
-	if len(tasksToUpdate) == 0 {
-		return TaskUpdateResult{Floor: *floor}, nil
+		tu.NextRoom = floor.Rooms[roomIndex]
 	}
 
 	var nextRoom Room
 	var tasksUpdated []Task
+	var pooled []Task
+	var history []HistoryEntry
+	now := time.Now()
 	for _, t := range tasksToUpdate {
 		taskIndex, err := findTaskIndex(floor.Tasks, t.Id)
 		if err != nil {
 			return TaskUpdateResult{}, fmt.Errorf("taskUpdate findTaskIndex: %w", err)
 		}
+		before := floor.Tasks[taskIndex]
 
-		if tu.Action != "RESIDENT_UNAVAILABLE" {
-			isConsistent, err := checkConsistency(*floor, tu, taskIndex)
-			if err != nil || !isConsistent {
-				return TaskUpdateResult{}, fmt.Errorf("taskUpdate checkConsistency: %w", err)
-			}
+		isConsistent, err := checkConsistency(*floor, tu, taskIndex)
+		if err != nil || !isConsistent {
+			return TaskUpdateResult{}, fmt.Errorf("taskUpdate checkConsistency: %w", err)
 		}
 
 		nextRoom = tu.NextRoom
-		if tu.Action == "DONE" || tu.Action == "RESIDENT_UNAVAILABLE" {
-			nextRoom, err = nextAssignee(*floor, t)
+		if tu.Action == "DONE" {
+			//the task is done even when nobody can take it over
+			floor.Tasks[taskIndex].DueDate = advanceDueDate(before, now.In(floorLocation(*floor)))
+			markDone(floor, taskIndex, now)
+			nextRoom, err = selectNextAssignee(*floor, floor.Tasks[taskIndex])
 			if err != nil {
 				if err.Error() == "No next assignee available" {
 					unassignTask(floor, taskIndex)
+					pooled = append(pooled, floor.Tasks[taskIndex])
+					history = append(history, newHistoryEntry(*floor, before, floor.Tasks[taskIndex], tu.Action, actorId, now))
 					continue
 				}
 				return TaskUpdateResult{}, fmt.Errorf("taskUpdate nextAssignee: %w", err)
@@ -425,17 +314,79 @@ func processTaskUpdate(floor *Floor, tu TaskUpdateRequest) (TaskUpdateResult, er
 			assignTask(floor, taskIndex, nextRoom)
 		} else if tu.Action == "UNASSIGN" {
 			unassignTask(floor, taskIndex)
-		} else if tu.Action == "ASSIGN" {
+			pooled = append(pooled, floor.Tasks[taskIndex])
+		} else if tu.Action == "ASSIGN" || tu.Action == "CLAIM" {
 			assignTask(floor, taskIndex, nextRoom)
 		}
 		tasksUpdated = append(tasksUpdated, floor.Tasks[taskIndex])
+		history = append(history, newHistoryEntry(*floor, before, floor.Tasks[taskIndex], tu.Action, actorId, now))
+	}
+	var msgs []OutboxMessage
+	var roomsToNotify []Room
+	//a claimed task went to the caller, there is nobody to tell
+	if !reflect.DeepEqual(nextRoom, Room{}) && tu.Action != "CLAIM" {
+		msgs = taskUpdateMessages(*floor, tu, nextRoom, tasksUpdated)
+		roomsToNotify = []Room{nextRoom}
 	}
-	fUp, err := updateTasks(*floor)
+	msgs = append(msgs, taskPooledMessages(*floor, pooled, actorId)...)
+	fUp, err := updateTasks(*floor, msgs...)
 	if err != nil {
 		return TaskUpdateResult{}, fmt.Errorf("taskUpdate updating DB tasks: %w", err)
 	}
+	recordHistory(history)
+
+	return TaskUpdateResult{Floor: fUp, TasksUpdated: tasksUpdated, RoomsToNotify: roomsToNotify}, nil
+}
+
+// reassignTasks hands the tasks of the resident leaving room on and builds a message for every
+// recipient about their own new tasks only. Tasks nobody is available for go to the unassigned
+// pool. Nothing is written, the caller saves floor together with the messages.
+func reassignTasks(floor *Floor, room Room, actorId string, now time.Time) ([]Task, []Room, []OutboxMessage, []HistoryEntry) {
+	tasksUpdated, pooled, roomsToNotify, history := spreadTasks(floor, room, actorId, now)
+	var msgs []OutboxMessage
+	tu := TaskUpdateRequest{Action: "RESIDENT_UNAVAILABLE"}
+	for _, r := range roomsToNotify {
+		msgs = append(msgs, taskUpdateMessages(*floor, tu, r, tasksUpdated)...)
+	}
+	msgs = append(msgs, taskPooledMessages(*floor, pooled, room.Resident.Id)...)
+	return tasksUpdated, roomsToNotify, msgs, history
+}
+
+// spreadTasks moves the tasks of room to the available residents by their current effort load,
+// heavier tasks first, ties go in rotation order. It returns the reassigned and the pooled tasks,
+// the rooms that got any and the history of every move.
+func spreadTasks(floor *Floor, room Room, actorId string, now time.Time) ([]Task, []Task, []Room, []HistoryEntry) {
+	var leaving []int
+	for i, t := range floor.Tasks {
+		if t.AssignedTo == room.Id {
+			leaving = append(leaving, i)
+		}
+	}
+	sort.SliceStable(leaving, func(a, b int) bool {
+		return effortOf(floor.Tasks[leaving[a]]) > effortOf(floor.Tasks[leaving[b]])
+	})
 
-	return TaskUpdateResult{Floor: fUp, TasksUpdated: tasksUpdated, RoomToNotify: nextRoom}, nil
+	var tasksUpdated []Task
+	var pooled []Task
+	var roomsToNotify []Room
+	var history []HistoryEntry
+	for _, taskIndex := range leaving {
+		before := floor.Tasks[taskIndex]
+		//the loads change with every task handed on, so each pick sees the previous ones
+		nextRoom, err := effortWeighted{}.next(*floor, before)
+		if err != nil {
+			unassignTask(floor, taskIndex)
+			pooled = append(pooled, floor.Tasks[taskIndex])
+		} else {
+			assignTask(floor, taskIndex, nextRoom)
+			tasksUpdated = append(tasksUpdated, floor.Tasks[taskIndex])
+			if !slices.ContainsFunc(roomsToNotify, func(r Room) bool { return r.Id == nextRoom.Id }) {
+				roomsToNotify = append(roomsToNotify, nextRoom)
+			}
+		}
+		history = append(history, newHistoryEntry(*floor, before, floor.Tasks[taskIndex], "RESIDENT_UNAVAILABLE", actorId, now))
+	}
+	return tasksUpdated, pooled, roomsToNotify, history
 }
 
 // TODO replace with ok
@@ -482,6 +433,9 @@ func checkConsistency(f Floor, tu TaskUpdateRequest, taskIndex int) (bool, error
 	if tu.Action == "DONE" || tu.Action == "UNASSIGN" {
 		return true, nil
 	}
+	if tu.Action == "CLAIM" && f.Tasks[taskIndex].AssignedTo != unassignedRoom {
+		return false, fmt.Errorf("Task is not unassigned")
+	}
 
 	var roomToAssign Room
 	var roomFound bool
@@ -541,13 +495,37 @@ func nextAssignee(f Floor, t Task) (Room, error) {
 }
 
 func unassignTask(f *Floor, taskIndex int) {
-	f.Tasks[taskIndex].AssignedTo = -1
+	f.Tasks[taskIndex].AssignedTo = unassignedRoom
 	f.Tasks[taskIndex].AssignmentDate = time.Now()
 	f.Tasks[taskIndex].Reminders = 0
+	f.Tasks[taskIndex].AutoReminders = 0
+	f.Tasks[taskIndex].LastReminderAt = time.Time{}
 }
 
 func assignTask(f *Floor, taskIndex int, r Room) {
 	f.Tasks[taskIndex].AssignedTo = r.Id
 	f.Tasks[taskIndex].AssignmentDate = time.Now()
 	f.Tasks[taskIndex].Reminders = 0
+	f.Tasks[taskIndex].AutoReminders = 0
+	f.Tasks[taskIndex].LastReminderAt = time.Time{}
+}
+
+// pickUpPooledTasks spreads the tasks of the unassigned pool across the available residents by
+// their effort load, once someone becomes available, and returns them with their history entries.
+func pickUpPooledTasks(f *Floor, actorId string, now time.Time) ([]Task, []HistoryEntry) {
+	var picked []Task
+	var history []HistoryEntry
+	for i, t := range f.Tasks {
+		if t.AssignedTo != unassignedRoom {
+			continue
+		}
+		room, err := effortWeighted{}.next(*f, t)
+		if err != nil {
+			continue
+		}
+		assignTask(f, i, room)
+		picked = append(picked, f.Tasks[i])
+		history = append(history, newHistoryEntry(*f, t, f.Tasks[i], "PICKUP", actorId, now))
+	}
+	return picked, history
 }
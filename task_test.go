@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
@@ -230,7 +231,7 @@ func Test_updateTask(t *testing.T) {
 		rr := httptest.NewRecorder()
 		services := services{taskService: TaskUpdateRequest{}}
 		handler := http.HandlerFunc(services.taskService.HandleTaskUpdate)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", tuStub.FloorId))
 
 		if status := rr.Code; status != http.StatusOK {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -261,7 +262,7 @@ func Test_updateTask(t *testing.T) {
 		rr := httptest.NewRecorder()
 		services := services{taskService: TaskUpdateRequest{}}
 		handler := http.HandlerFunc(services.taskService.HandleTaskUpdate)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", tuStub.FloorId))
 
 		if status := rr.Code; status != http.StatusUnprocessableEntity {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -283,7 +284,7 @@ func Test_updateTask(t *testing.T) {
 		rr := httptest.NewRecorder()
 		services := services{taskService: TaskUpdateRequest{}}
 		handler := http.HandlerFunc(services.taskService.HandleTaskUpdate)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", tuStub.FloorId))
 
 		if status := rr.Code; status != http.StatusUnprocessableEntity {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -309,7 +310,7 @@ func Test_updateTask(t *testing.T) {
 		rr := httptest.NewRecorder()
 		services := services{taskService: TaskUpdateRequest{}}
 		handler := http.HandlerFunc(services.taskService.HandleTaskUpdate)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", tuStub.FloorId))
 
 		if status := rr.Code; status != http.StatusOK {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -382,7 +383,7 @@ func Test_updateTask(t *testing.T) {
 		rr := httptest.NewRecorder()
 		services := services{taskService: TaskUpdateRequest{}}
 		handler := http.HandlerFunc(services.taskService.HandleTaskUpdate)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", tuStub.FloorId))
 
 		if status := rr.Code; status != http.StatusOK {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -463,7 +464,7 @@ func Test_updateTask(t *testing.T) {
 		rr := httptest.NewRecorder()
 		services := services{taskService: TaskUpdateRequest{}}
 		handler := http.HandlerFunc(services.taskService.HandleTaskUpdate)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", tuStub.FloorId))
 
 		if status := rr.Code; status != http.StatusOK {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -545,7 +546,7 @@ func Test_updateTask(t *testing.T) {
 		rr := httptest.NewRecorder()
 		services := services{taskService: TaskUpdateRequest{}}
 		handler := http.HandlerFunc(services.taskService.HandleTaskUpdate)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", tuStub.FloorId))
 
 		if status := rr.Code; status != http.StatusOK {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -569,7 +570,9 @@ func Test_updateTask(t *testing.T) {
   		    "Name": "Küche reinigen",
   		    "AssignedTo": 0,
   		    "Reminders": 1,
-  		    "AssignmentDate": "2024-06-13T14:48:00.000Z"
+  		    "AssignmentDate": "2024-06-13T14:48:00.000Z",
+  		    "Recurrence": {"Type": "EVERY_N_DAYS", "Interval": 7},
+  		    "DueDate": "2024-06-13T00:00:00Z"
   		  }
   		],
   		"Rooms": [
@@ -606,7 +609,7 @@ func Test_updateTask(t *testing.T) {
 		rr := httptest.NewRecorder()
 		services := services{taskService: TaskUpdateRequest{}}
 		handler := http.HandlerFunc(services.taskService.HandleTaskUpdate)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", tuStub.FloorId))
 
 		if status := rr.Code; status != http.StatusOK {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -619,6 +622,9 @@ func Test_updateTask(t *testing.T) {
 		if updatedFloor.Tasks[0].AssignedTo != -1 {
 			t.Errorf("task not assigned: got %v want %v", updatedFloor.Tasks[0].AssignedTo, -1)
 		}
+		if !updatedFloor.Tasks[0].DueDate.After(time.Now()) {
+			t.Errorf("due date not advanced for pooled task: got %v", updatedFloor.Tasks[0].DueDate)
+		}
 	})
 
 	t.Run("should done with cycled to first", func(t *testing.T) {
@@ -688,7 +694,7 @@ func Test_updateTask(t *testing.T) {
 		rr := httptest.NewRecorder()
 		services := services{taskService: TaskUpdateRequest{}}
 		handler := http.HandlerFunc(services.taskService.HandleTaskUpdate)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", tuStub.FloorId))
 
 		if status := rr.Code; status != http.StatusOK {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -789,7 +795,7 @@ func Test_updateTask(t *testing.T) {
 		rr := httptest.NewRecorder()
 		services := services{taskService: TaskUpdateRequest{}}
 		handler := http.HandlerFunc(services.taskService.HandleTaskUpdate)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", tuStub.FloorId))
 
 		if status := rr.Code; status != http.StatusOK {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -824,7 +830,7 @@ func Test_remindTask(t *testing.T) {
 		rr := httptest.NewRecorder()
 		services := services{taskService: TaskUpdateRequest{}}
 		handler := http.HandlerFunc(services.taskService.HandleTaskRemind)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", tuStub.FloorId))
 
 		if status := rr.Code; status != http.StatusOK {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -841,8 +847,13 @@ func Test_remindTask(t *testing.T) {
 }
 
 func Test_residentUnavailable(t *testing.T) {
-	t.Run("should pass all tasks of RESIDENT_UNAVAILABLE", func(t *testing.T) {
-		f, err := insertTestFloor(FloorStub)
+	t.Run("should spread all tasks of RESIDENT_UNAVAILABLE by load", func(t *testing.T) {
+		fStub := FloorStub
+		fStub.Rooms = append([]Room(nil), FloorStub.Rooms...)
+		for i := range fStub.Rooms {
+			fStub.Rooms[i].Resident.Available = fStub.Rooms[i].Id != 4 && fStub.Rooms[i].Resident.Id != ""
+		}
+		f, err := insertTestFloor(fStub)
 		if err != nil {
 			t.Error(err)
 		}
@@ -857,7 +868,7 @@ func Test_residentUnavailable(t *testing.T) {
 		}
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(HandleAvailabilityStatusChange)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "2", tuStub.FloorId))
 
 		if status := rr.Code; status != http.StatusOK {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -868,14 +879,52 @@ func Test_residentUnavailable(t *testing.T) {
 		json.Unmarshal(rr.Body.Bytes(), &updatedFloor)
 
 		if updatedFloor.Rooms[1].Resident.Available != false {
-			t.Errorf("resident not unavailable: got %v want %v", updatedFloor.Rooms[0].Resident.Available, false)
+			t.Errorf("resident not unavailable: got %v want %v", updatedFloor.Rooms[1].Resident.Available, false)
 		}
-		for i := 1; i < len(updatedFloor.Tasks); i++ {
-			if updatedFloor.Tasks[i].AssignedTo != 3 {
-				t.Errorf("task not assigned correctly: got %v want %v", updatedFloor.Tasks[i].AssignedTo, 2)
+		//rooms 2, 3 and 5 are free, room 0 has task 0 already
+		want := map[string]int{"0": 0, "1": 2, "2": 3, "3": 5, "4": 2, "5": 3}
+		for _, task := range updatedFloor.Tasks {
+			if task.AssignedTo != want[task.Id] {
+				t.Errorf("task %v not assigned correctly: got %v want %v", task.Id, task.AssignedTo, want[task.Id])
 			}
 		}
 	})
+	t.Run("should make resident unavailable when sent as task update", func(t *testing.T) {
+		fStub := FloorStub
+		fStub.Rooms = append([]Room(nil), FloorStub.Rooms...)
+		for i := range fStub.Rooms {
+			fStub.Rooms[i].Resident.Available = fStub.Rooms[i].Resident.Id != ""
+		}
+		f, err := insertTestFloor(fStub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := json.Marshal(TaskUpdateRequest{Action: "RESIDENT_UNAVAILABLE"})
+		req, _ := http.NewRequest("POST", "/update-task", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(TaskUpdateRequest{}.HandleTaskUpdate).ServeHTTP(rr, asResident(req, "2", f.Id.Hex()))
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		var updatedFloor Floor
+		json.Unmarshal(rr.Body.Bytes(), &updatedFloor)
+		if updatedFloor.Rooms[1].Resident.Available {
+			t.Errorf("resident not unavailable")
+		}
+		for _, task := range updatedFloor.Tasks {
+			if task.AssignedTo == 1 {
+				t.Errorf("task %v not handed on", task.Id)
+			}
+		}
+		history, err := findAvailabilityHistory(f.Id, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 1 || history[0].Action != "RESIDENT_UNAVAILABLE" || history[0].FromResident != "2" {
+			t.Errorf("availability change not recorded: %+v", history)
+		}
+	})
 	t.Run("should unassign all tasks RESIDENT_UNAVAILABLE", func(t *testing.T) {
 		for i := 0; i < len(FloorStub.Rooms); i++ {
 			if FloorStub.Rooms[i].Id != 1 {
@@ -898,7 +947,7 @@ func Test_residentUnavailable(t *testing.T) {
 		}
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(HandleAvailabilityStatusChange)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "2", tuStub.FloorId))
 
 		if status := rr.Code; status != http.StatusOK {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -909,7 +958,7 @@ func Test_residentUnavailable(t *testing.T) {
 		json.Unmarshal(rr.Body.Bytes(), &updatedFloor)
 
 		if updatedFloor.Rooms[1].Resident.Available != false {
-			t.Errorf("resident not unavailable: got %v want %v", updatedFloor.Rooms[0].Resident.Available, false)
+			t.Errorf("resident not unavailable: got %v want %v", updatedFloor.Rooms[1].Resident.Available, false)
 		}
 		for i := 1; i < len(updatedFloor.Tasks); i++ {
 			if updatedFloor.Tasks[i].AssignedTo != -1 {
@@ -935,7 +984,7 @@ func Test_residentUnavailable(t *testing.T) {
 		}
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(HandleAvailabilityStatusChange)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", tuStub.FloorId))
 
 		if status := rr.Code; status != http.StatusOK {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -969,7 +1018,7 @@ func Test_createTask(t *testing.T) {
 		}
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(HandleTaskCreateDelete)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", floorId))
 
 		if status := rr.Code; status != http.StatusCreated {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -986,7 +1035,7 @@ func Test_createTask(t *testing.T) {
 			VotingWindow: 2 * 24 * time.Hour,
 		}
 
-		if updatedFloor.Votings[0].Type != expectedVoting.Type && updatedFloor.Votings[0].Data != expectedVoting.Data && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow {
+		if updatedFloor.Votings[0].Type != expectedVoting.Type && !reflect.DeepEqual(updatedFloor.Votings[0].Data, expectedVoting.Data) && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow {
 			t.Errorf("voting not created: got %v want %v", updatedFloor.Votings[0], expectedVoting)
 		}
 
@@ -1004,7 +1053,7 @@ func Test_createTask(t *testing.T) {
 		}
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(HandleTaskCreateDelete)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", floorId))
 
 		if status := rr.Code; status != http.StatusCreated {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -1020,11 +1069,15 @@ func Test_createTask(t *testing.T) {
 			Data: Task{Name: randomTaskName},
 		}
 
-		if updatedFloor.Votings[0].Type != expectedVoting.Type && updatedFloor.Votings[0].Data != expectedVoting.Data {
+		if updatedFloor.Votings[0].Type != expectedVoting.Type && !reflect.DeepEqual(updatedFloor.Votings[0].Data, expectedVoting.Data) {
 			t.Errorf("voting not created: got %v want %v", updatedFloor.Votings[0], expectedVoting)
 		}
 
-		time.Sleep(12 * time.Second)
+		clock := fakeClock{now: time.Now().Add(2*24*time.Hour + time.Minute)}
+		_, err = newVotingExpiryScheduler(clock, time.Minute).runOnce()
+		if err != nil {
+			t.Error(err)
+		}
 
 		fId, err := primitive.ObjectIDFromHex("669fca69d244526d709f6d76")
 		if err != nil {
@@ -1068,7 +1121,7 @@ func Test_createTask(t *testing.T) {
 	// 		VotingWindow: 2 * 24 * time.Hour,
 	// 	}
 
-	// 	if updatedFloor.Votings[0].Type != expectedVoting.Type && updatedFloor.Votings[0].Data != expectedVoting.Data && updatedFloor.Votings[0].Accepts != expectedVoting.Accepts && updatedFloor.Votings[0].Rejects != expectedVoting.Rejects && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow {
+	// 	if updatedFloor.Votings[0].Type != expectedVoting.Type && !reflect.DeepEqual(updatedFloor.Votings[0].Data, expectedVoting.Data) && updatedFloor.Votings[0].Accepts != expectedVoting.Accepts && updatedFloor.Votings[0].Rejects != expectedVoting.Rejects && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow {
 
 	// 		t.Errorf("voting not created: got %v want %v", updatedFloor.Votings[0], expectedVoting)
 	// 	}
@@ -1101,7 +1154,7 @@ func Test_createTask(t *testing.T) {
 	// 		t.Errorf("voting not accepted: got %v want %v", updatedFloor.Votings[0].Accepts, 1)
 	// 	}
 
-	// 	deleteVoting(updatedFloor.Id, updatedFloor.Votings[0].Id)
+	// 	deleteVoting(updatedFloor, updatedFloor.Votings[0].Id)
 	// })
 	t.Run("should create task when accept", func(t *testing.T) {
 		randomTaskName := strconv.Itoa(rand.Intn(100)) + " new task"
@@ -1116,7 +1169,7 @@ func Test_createTask(t *testing.T) {
 		}
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(HandleTaskCreateDelete)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", floorId))
 
 		if status := rr.Code; status != http.StatusCreated {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -1133,34 +1186,15 @@ func Test_createTask(t *testing.T) {
 			VotingWindow: 2 * 24 * time.Hour,
 		}
 
-		if updatedFloor.Votings[0].Type != expectedVoting.Type && updatedFloor.Votings[0].Data != expectedVoting.Data && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow {
+		if updatedFloor.Votings[0].Type != expectedVoting.Type && !reflect.DeepEqual(updatedFloor.Votings[0].Data, expectedVoting.Data) && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow {
 			t.Errorf("voting not created: got %v want %v", updatedFloor.Votings[0], expectedVoting)
 		}
 
-		votingAccept := VotingActionRequest{
-			Voting: updatedFloor.Votings[0],
-			Action: "ACCEPT",
-		}
-
-		votingAcceptStr, err := json.Marshal(votingAccept)
-		if err != nil {
-			t.Error(err)
-		}
-		req, err = http.NewRequest("POST", "/update-voting", bytes.NewReader(votingAcceptStr))
-		if err != nil {
-			t.Error(err)
-		}
-		rr = httptest.NewRecorder()
-		handler = http.HandlerFunc(HandleTaskVotingResponse)
-		handler.ServeHTTP(rr, req)
-
-		if status := rr.Code; status != http.StatusOK {
-			t.Errorf("handler returned wrong status code: got %v want %v",
-				status, http.StatusOK)
+		//the creator counts as accepting, two more make a majority of the 5 active residents
+		for _, voter := range []string{"2", "3"} {
+			updatedFloor = castTestVote(t, updatedFloor.Votings[0], voter, "ACCEPT")
 		}
 
-		json.Unmarshal(rr.Body.Bytes(), &updatedFloor)
-
 		expectedNewTask := Task{
 			Name:       randomTaskName,
 			AssignedTo: -1,
@@ -1193,7 +1227,7 @@ func Test_createTask(t *testing.T) {
 		}
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(HandleTaskCreateDelete)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", floorId))
 
 		if status := rr.Code; status != http.StatusCreated {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -1210,34 +1244,15 @@ func Test_createTask(t *testing.T) {
 			VotingWindow: 2 * 24 * time.Hour,
 		}
 
-		if updatedFloor.Votings[0].Type != expectedVoting.Type && updatedFloor.Votings[0].Data != expectedVoting.Data && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow {
+		if updatedFloor.Votings[0].Type != expectedVoting.Type && !reflect.DeepEqual(updatedFloor.Votings[0].Data, expectedVoting.Data) && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow {
 			t.Errorf("voting not created: got %v want %v", updatedFloor.Votings[0], expectedVoting)
 		}
 
-		votingAccept := VotingActionRequest{
-			Voting: updatedFloor.Votings[0],
-			Action: "REJECT",
+		//3 of the 5 active residents rejecting leave the creation without majority
+		for _, voter := range []string{"2", "3", "4"} {
+			updatedFloor = castTestVote(t, updatedFloor.Votings[0], voter, "REJECT")
 		}
 
-		votingAcceptStr, err := json.Marshal(votingAccept)
-		if err != nil {
-			t.Error(err)
-		}
-		req, err = http.NewRequest("POST", "/update-voting", bytes.NewReader(votingAcceptStr))
-		if err != nil {
-			t.Error(err)
-		}
-		rr = httptest.NewRecorder()
-		handler = http.HandlerFunc(HandleTaskVotingResponse)
-		handler.ServeHTTP(rr, req)
-
-		if status := rr.Code; status != http.StatusOK {
-			t.Errorf("handler returned wrong status code: got %v want %v",
-				status, http.StatusOK)
-		}
-
-		json.Unmarshal(rr.Body.Bytes(), &updatedFloor)
-
 		for _, task := range updatedFloor.Tasks {
 			if task.Name == randomTaskName {
 				t.Errorf("task created on reject")
@@ -1273,7 +1288,7 @@ func Test_deleteTask(t *testing.T) {
 		}
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(HandleTaskCreateDelete)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", floorId))
 
 		if status := rr.Code; status != http.StatusCreated {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -1292,7 +1307,7 @@ func Test_deleteTask(t *testing.T) {
 			VotingWindow: 2 * 24 * time.Hour,
 		}
 
-		if updatedFloor.Votings[0].Type != expectedVoting.Type && updatedFloor.Votings[0].Data != expectedVoting.Data && len(updatedFloor.Votings[0].Accepts) != len(expectedVoting.Accepts) && len(updatedFloor.Votings[0].Rejects) != len(expectedVoting.Rejects) && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow {
+		if updatedFloor.Votings[0].Type != expectedVoting.Type && !reflect.DeepEqual(updatedFloor.Votings[0].Data, expectedVoting.Data) && len(updatedFloor.Votings[0].Accepts) != len(expectedVoting.Accepts) && len(updatedFloor.Votings[0].Rejects) != len(expectedVoting.Rejects) && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow {
 			t.Errorf("voting not created: got %v want %v", updatedFloor.Votings[0], expectedVoting)
 		}
 		deleteAllVotings(fId)
@@ -1309,7 +1324,7 @@ func Test_deleteTask(t *testing.T) {
 		}
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(HandleTaskCreateDelete)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", floorId))
 
 		if status := rr.Code; status != http.StatusCreated {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -1325,11 +1340,15 @@ func Test_deleteTask(t *testing.T) {
 			Data: tuStub.Task,
 		}
 
-		if updatedFloor.Votings[0].Type != expectedVoting.Type && updatedFloor.Votings[0].Data != expectedVoting.Data {
+		if updatedFloor.Votings[0].Type != expectedVoting.Type && !reflect.DeepEqual(updatedFloor.Votings[0].Data, expectedVoting.Data) {
 			t.Errorf("voting not created: got %v want %v", updatedFloor.Votings[0], expectedVoting)
 		}
 
-		time.Sleep(12 * time.Second)
+		clock := fakeClock{now: time.Now().Add(2*24*time.Hour + time.Minute)}
+		_, err = newVotingExpiryScheduler(clock, time.Minute).runOnce()
+		if err != nil {
+			t.Error(err)
+		}
 
 		fId, err := primitive.ObjectIDFromHex("669fca69d244526d709f6d76")
 		if err != nil {
@@ -1352,7 +1371,7 @@ func Test_deleteTask(t *testing.T) {
 		}
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(HandleTaskCreateDelete)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", floorId))
 
 		if status := rr.Code; status != http.StatusCreated {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -1369,7 +1388,7 @@ func Test_deleteTask(t *testing.T) {
 			VotingWindow: 2 * 24 * time.Hour,
 		}
 
-		if updatedFloor.Votings[0].Type != expectedVoting.Type && updatedFloor.Votings[0].Data != expectedVoting.Data && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow {
+		if updatedFloor.Votings[0].Type != expectedVoting.Type && !reflect.DeepEqual(updatedFloor.Votings[0].Data, expectedVoting.Data) && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow {
 			t.Errorf("voting not created: got %v want %v", updatedFloor.Votings[0], expectedVoting)
 		}
 
@@ -1388,7 +1407,7 @@ func Test_deleteTask(t *testing.T) {
 		}
 		rr = httptest.NewRecorder()
 		handler = http.HandlerFunc(HandleTaskVotingResponse)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, userId, floorId))
 
 		if status := rr.Code; status != http.StatusOK {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -1405,14 +1424,14 @@ func Test_deleteTask(t *testing.T) {
 			Accepts:      []string{"1"},
 		}
 
-		if updatedFloor.Votings[0].Type != expectedVoting.Type && updatedFloor.Votings[0].Data != expectedVoting.Data && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow && len(updatedFloor.Votings[0].Accepts) != len(expectedVoting.Accepts) && updatedFloor.Votings[0].Accepts[0] != expectedVoting.Accepts[0] {
+		if updatedFloor.Votings[0].Type != expectedVoting.Type && !reflect.DeepEqual(updatedFloor.Votings[0].Data, expectedVoting.Data) && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow && len(updatedFloor.Votings[0].Accepts) != len(expectedVoting.Accepts) && updatedFloor.Votings[0].Accepts[0] != expectedVoting.Accepts[0] {
 			t.Errorf("voting not updated: got %v want %v", updatedFloor.Votings[0], expectedVoting)
 		}
 
 		if updatedFloor.Tasks[0].Name != FloorStub.Tasks[0].Name && updatedFloor.Tasks[0].AssignedTo != FloorStub.Tasks[0].AssignedTo && updatedFloor.Tasks[0].Reminders != FloorStub.Tasks[0].Reminders && updatedFloor.Tasks[0].Id != FloorStub.Tasks[0].Id {
 			t.Errorf("task must not be updated: got %v want %v", updatedFloor.Tasks[0], FloorStub.Tasks[0])
 		}
-		deleteVoting(updatedFloor.Id, updatedFloor.Votings[0].Id)
+		deleteVoting(updatedFloor, updatedFloor.Votings[0].Id)
 	})
 
 	t.Run("should delete task when all residents accept", func(t *testing.T) {
@@ -1436,7 +1455,7 @@ func Test_deleteTask(t *testing.T) {
 		}
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(HandleTaskCreateDelete)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", floorId))
 
 		if status := rr.Code; status != http.StatusCreated {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -1453,7 +1472,7 @@ func Test_deleteTask(t *testing.T) {
 			VotingWindow: 2 * 24 * time.Hour,
 		}
 
-		if updatedFloor.Votings[0].Type != expectedVoting.Type && updatedFloor.Votings[0].Data != expectedVoting.Data && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow {
+		if updatedFloor.Votings[0].Type != expectedVoting.Type && !reflect.DeepEqual(updatedFloor.Votings[0].Data, expectedVoting.Data) && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow {
 			t.Errorf("voting not created: got %v want %v", updatedFloor.Votings[0], expectedVoting)
 		}
 
@@ -1474,7 +1493,7 @@ func Test_deleteTask(t *testing.T) {
 			}
 			rr = httptest.NewRecorder()
 			handler = http.HandlerFunc(HandleTaskVotingResponse)
-			handler.ServeHTTP(rr, req)
+			handler.ServeHTTP(rr, asResident(req, userId, floorId))
 
 			if status := rr.Code; status != http.StatusOK {
 				t.Errorf("handler returned wrong status code: got %v want %v",
@@ -1501,7 +1520,7 @@ func Test_deleteTask(t *testing.T) {
 					}
 				}
 			} else {
-				if updatedFloor.Votings[0].Type != expectedVoting.Type && updatedFloor.Votings[0].Data != expectedVoting.Data && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow && len(updatedFloor.Votings[0].Accepts) != i {
+				if updatedFloor.Votings[0].Type != expectedVoting.Type && !reflect.DeepEqual(updatedFloor.Votings[0].Data, expectedVoting.Data) && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow && len(updatedFloor.Votings[0].Accepts) != i {
 					t.Errorf("voting not updated: got %v want %v", updatedFloor.Votings[0], expectedVoting)
 				}
 
@@ -1528,7 +1547,7 @@ func Test_deleteTask(t *testing.T) {
 		}
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(HandleTaskCreateDelete)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", floorId))
 
 		if status := rr.Code; status != http.StatusCreated {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -1545,7 +1564,7 @@ func Test_deleteTask(t *testing.T) {
 			VotingWindow: 2 * 24 * time.Hour,
 		}
 
-		if updatedFloor.Votings[0].Type != expectedVoting.Type && updatedFloor.Votings[0].Data != expectedVoting.Data && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow {
+		if updatedFloor.Votings[0].Type != expectedVoting.Type && !reflect.DeepEqual(updatedFloor.Votings[0].Data, expectedVoting.Data) && updatedFloor.Votings[0].VotingWindow != expectedVoting.VotingWindow {
 			t.Errorf("voting not created: got %v want %v", updatedFloor.Votings[0], expectedVoting)
 		}
 
@@ -1564,7 +1583,7 @@ func Test_deleteTask(t *testing.T) {
 		}
 		rr = httptest.NewRecorder()
 		handler = http.HandlerFunc(HandleTaskVotingResponse)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, userId, floorId))
 
 		if status := rr.Code; status != http.StatusOK {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -1591,6 +1610,27 @@ func Test_deleteTask(t *testing.T) {
 	})
 }
 
+// castTestVote votes on voting as voter and returns the floor after the vote.
+func castTestVote(t *testing.T, voting Voting, voter string, action string) Floor {
+	t.Helper()
+	body, err := json.Marshal(VotingActionRequest{Voting: voting, Action: action})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "/update-voting", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(HandleTaskVotingResponse).ServeHTTP(rr, asResident(req, voter, floorId))
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var f Floor
+	json.Unmarshal(rr.Body.Bytes(), &f)
+	return f
+}
+
 func insertTestFloor(f Floor) (Floor, error) {
 	floor, err := insertNewFloor(f)
 	if err != nil {
@@ -1599,3 +1639,203 @@ func insertTestFloor(f Floor) (Floor, error) {
 	floorsCreated = append(floorsCreated, floor.Id)
 	return floor, nil
 }
+
+func Test_revisionConflict(t *testing.T) {
+	t.Run("should bump revision on every write", func(t *testing.T) {
+		f, err := insertTestFloor(FloorStub)
+		if err != nil {
+			t.Error(err)
+		}
+		fUp, err := updateTasks(f)
+		if err != nil {
+			t.Error(err)
+		}
+		if fUp.Revision != f.Revision+1 {
+			t.Errorf("revision not bumped: got %v want %v", fUp.Revision, f.Revision+1)
+		}
+	})
+	t.Run("should reject write on stale floor", func(t *testing.T) {
+		f, err := insertTestFloor(FloorStub)
+		if err != nil {
+			t.Error(err)
+		}
+		_, err = updateTasks(f)
+		if err != nil {
+			t.Error(err)
+		}
+		f.Tasks[0].Reminders += 1
+		_, err = updateTasks(f)
+		if !errors.Is(err, ErrRevisionConflict) {
+			t.Errorf("stale write not rejected: got %v want %v", err, ErrRevisionConflict)
+		}
+	})
+	t.Run("should 409 with current floor when client revision is stale", func(t *testing.T) {
+		f, err := insertTestFloor(FloorStub)
+		if err != nil {
+			t.Error(err)
+		}
+		staleRevision := f.Revision
+		for i, wantStatus := range []int{http.StatusOK, http.StatusConflict} {
+			tuStub := TaskUpdateRequest{
+				FloorId:  f.Id.Hex(),
+				Revision: &staleRevision,
+				Task:     FloorStub.Tasks[0],
+				Action:   "REMIND",
+			}
+			tuStubStr, err := json.Marshal(tuStub)
+			req, err := http.NewRequest("POST", "/remind-task", bytes.NewReader(tuStubStr))
+			if err != nil {
+				t.Error(err)
+			}
+			rr := httptest.NewRecorder()
+			services := services{taskService: TaskUpdateRequest{}}
+			handler := http.HandlerFunc(services.taskService.HandleTaskRemind)
+			handler.ServeHTTP(rr, asResident(req, "1", tuStub.FloorId))
+
+			if status := rr.Code; status != wantStatus {
+				t.Errorf("request %d returned wrong status code: got %v want %v", i, status, wantStatus)
+			}
+			if wantStatus == http.StatusConflict {
+				var conflict ConflictResponse
+				json.Unmarshal(rr.Body.Bytes(), &conflict)
+				if conflict.Floor.Revision != staleRevision+1 {
+					t.Errorf("conflict did not return current floor: got revision %v want %v", conflict.Floor.Revision, staleRevision+1)
+				}
+				if conflict.Floor.Tasks[0].Reminders != FloorStub.Tasks[0].Reminders+1 {
+					t.Errorf("second reminder must not be applied: got %v want %v", conflict.Floor.Tasks[0].Reminders, FloorStub.Tasks[0].Reminders+1)
+				}
+			}
+		}
+	})
+}
+
+func Test_reassignTasks(t *testing.T) {
+	f := Floor{
+		Rooms: []Room{
+			{Id: 0, Order: 0, Resident: Resident{Id: "1", Available: true}},
+			{Id: 1, Order: 1, Resident: Resident{Id: "2", Available: true}},
+			{Id: 2, Order: 2, Resident: Resident{Id: "3", Available: false}},
+		},
+		Tasks: []Task{{Id: "1", AssignedTo: 1}, {Id: "2", AssignedTo: 0}, {Id: "3", AssignedTo: 1}},
+	}
+	tasksUpdated, roomsToNotify, _, history := reassignTasks(&f, f.Rooms[1], "1", time.Now())
+	if f.Tasks[0].AssignedTo != 0 || f.Tasks[2].AssignedTo != 0 || f.Tasks[1].AssignedTo != 0 {
+		t.Errorf("tasks not handed on: %+v", f.Tasks)
+	}
+	if len(tasksUpdated) != 2 || len(roomsToNotify) != 1 || roomsToNotify[0].Id != 0 || len(history) != 2 {
+		t.Errorf("wrong result: %v %v %v", tasksUpdated, roomsToNotify, history)
+	}
+}
+
+func Test_pickUpPooledTasks(t *testing.T) {
+	f := votingFloor()
+	f.Tasks = append(f.Tasks, Task{Id: "2", Name: "Flur", AssignedTo: unassignedRoom, Reminders: 2}, Task{Id: "3", Name: "Keller", AssignedTo: 0, Effort: 3})
+	f.Tasks[0].AssignedTo = unassignedRoom
+	picked, history := pickUpPooledTasks(&f, "c", time.Now())
+	if len(picked) != 2 || picked[0].Id != "0" || picked[1].Id != "2" {
+		t.Fatalf("wrong tasks picked up: %+v", picked)
+	}
+	//spread by effort load, the resident with the heavy task gets none
+	if f.Tasks[0].AssignedTo != 2 || f.Tasks[1].AssignedTo != 1 || f.Tasks[2].AssignedTo != 1 {
+		t.Errorf("wrong assignees: %+v", f.Tasks)
+	}
+	if f.Tasks[2].Reminders != 0 {
+		t.Errorf("reminders not reset: got %v want 0", f.Tasks[2].Reminders)
+	}
+	if len(history) != 2 || history[0].Action != "PICKUP" || history[0].FromRoom != unassignedRoom || history[0].ToResident != "c" {
+		t.Errorf("wrong history: %+v", history)
+	}
+	for i := range f.Rooms {
+		f.Rooms[i].Resident.Channels = []Channel{{Type: ChannelExpo, Address: "ExponentPushToken[" + f.Rooms[i].Resident.Id + "]"}}
+	}
+	msgs := pickedUpMessages(f, picked, "c")
+	if len(msgs) != 1 || msgs[0].RoomId != 1 || msgs[0].Type != "TASK_ASSIGN" || msgs[0].Args["Task"] != "Flur" {
+		t.Errorf("wrong messages: %+v", msgs)
+	}
+}
+
+func Test_taskPooledMessages(t *testing.T) {
+	f := votingFloor()
+	for i := range f.Rooms {
+		f.Rooms[i].Resident.Channels = []Channel{{Type: ChannelExpo, Address: "ExponentPushToken[" + f.Rooms[i].Resident.Id + "]"}}
+	}
+	msgs := taskPooledMessages(f, []Task{{Name: "Küche"}, {Name: "Bad"}}, "a")
+	if len(msgs) != 2 || msgs[0].RoomId != 1 || msgs[1].RoomId != 2 {
+		t.Fatalf("wrong recipients: %+v", msgs)
+	}
+	if msgs[0].Type != "TASK_POOLED" || msgs[0].Args["Task"] != "Küche, Bad" {
+		t.Errorf("wrong message: %+v", msgs[0])
+	}
+	if msgs := taskPooledMessages(f, nil, "a"); len(msgs) != 0 {
+		t.Errorf("messages without pooled tasks: %+v", msgs)
+	}
+}
+
+func Test_claimTask(t *testing.T) {
+	fStub := FloorStub
+	fStub.Rooms = append([]Room(nil), FloorStub.Rooms...)
+	for i := range fStub.Rooms {
+		fStub.Rooms[i].Resident.Available = true
+	}
+	fStub.Tasks = append([]Task(nil), FloorStub.Tasks...)
+	fStub.Tasks[0].AssignedTo = unassignedRoom
+	f, err := insertTestFloor(fStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claim := func(task Task) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(TaskUpdateRequest{Task: task, Action: "CLAIM"})
+		req, _ := http.NewRequest("POST", "/update-task", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(TaskUpdateRequest{}.HandleTaskUpdate).ServeHTTP(rr, asResident(req, "2", f.Id.Hex()))
+		return rr
+	}
+
+	t.Run("should claim unassigned task", func(t *testing.T) {
+		rr := claim(fStub.Tasks[0])
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		var fUp Floor
+		json.Unmarshal(rr.Body.Bytes(), &fUp)
+		if fUp.Tasks[0].AssignedTo != fStub.Rooms[1].Id {
+			t.Errorf("task not claimed: got %v want %v", fUp.Tasks[0].AssignedTo, fStub.Rooms[1].Id)
+		}
+	})
+	t.Run("should not claim assigned task", func(t *testing.T) {
+		if rr := claim(fStub.Tasks[1]); rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+		}
+	})
+}
+
+func Test_spreadTasks(t *testing.T) {
+	t.Run("should spread tasks by effort load", func(t *testing.T) {
+		f := withTasks(rotationFloor(true, true, true, false),
+			Task{Id: "1", AssignedTo: 1},
+			Task{Id: "2", AssignedTo: 1, Effort: 3},
+			Task{Id: "3", AssignedTo: 1},
+			Task{Id: "x", AssignedTo: 2, Effort: 2},
+		)
+		tasksUpdated, pooled, rooms, history := spreadTasks(&f, f.Rooms[0], "a", time.Now())
+		want := map[string]int{"1": 2, "2": 3, "3": 2, "x": 2}
+		for _, task := range f.Tasks {
+			if task.AssignedTo != want[task.Id] {
+				t.Errorf("task %v not assigned correctly: got %v want %v", task.Id, task.AssignedTo, want[task.Id])
+			}
+		}
+		if len(tasksUpdated) != 3 || len(pooled) != 0 || len(history) != 3 {
+			t.Errorf("wrong result: updated %v pooled %v history %v", tasksUpdated, pooled, history)
+		}
+		if len(rooms) != 2 || rooms[0].Id != 3 || rooms[1].Id != 2 {
+			t.Errorf("wrong rooms to notify: %+v", rooms)
+		}
+	})
+	t.Run("should pool tasks nobody is available for", func(t *testing.T) {
+		f := withTasks(rotationFloor(true, false), Task{Id: "1", AssignedTo: 1})
+		tasksUpdated, pooled, rooms, _ := spreadTasks(&f, f.Rooms[0], "a", time.Now())
+		if f.Tasks[0].AssignedTo != unassignedRoom || len(pooled) != 1 || len(tasksUpdated) != 0 || len(rooms) != 0 {
+			t.Errorf("task not pooled: %+v", f.Tasks)
+		}
+	})
+}
@@ -2,15 +2,13 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"log/slog"
-	"math/rand"
 	"net/http"
 	"reflect"
-	"strconv"
 	"strings"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -18,11 +16,6 @@ type CodeGenRequest struct {
 	Room Room `json:"room"`
 }
 
-type CodeMapEntry struct {
-	FloorId string `json:"floorId"`
-	Room    Room   `json:"room"`
-}
-
 type CodeSubmitResponse struct {
 	Floor Floor `json:"floor"`
 	Room  Room  `json:"room"`
@@ -33,26 +26,20 @@ type CodeGenResponse struct {
 }
 
 type AddNewResidentRequest struct {
-	FloorId string `json:"floorId"`
-	Room    Room   `json:"room"`
+	FloorId  string `json:"floorId"`
+	Revision *int64 `json:"revision,omitempty"`
+	Room     Room   `json:"room"`
 }
 
-var codeMap = make(map[string]CodeMapEntry)
-
-var r = rand.New(rand.NewSource(time.Now().UnixNano()))
-
 func HandleAvailabilityStatusChange(w http.ResponseWriter, r *http.Request) {
-	floorId := "669fca69d244526d709f6d76"
-	var userId = "1"
-	if r.UserAgent() == "okhttp/4.9.2" {
-		userId = "2"
-	} else {
-		userId = "1"
-	}
 	corsHandler(w)
 	if r.Method == http.MethodOptions {
 		return
 	}
+	identity, ok := callerFloorIdentity(w, r)
+	if !ok {
+		return
+	}
 	var taskUpdate TaskUpdateRequest
 	err := json.NewDecoder(r.Body).Decode(&taskUpdate)
 	if err != nil {
@@ -60,17 +47,21 @@ func HandleAvailabilityStatusChange(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	floor, err := FindFloor(floorId)
+	taskUpdate.FloorId = identity.FloorId
+	floor, err := FindFloor(identity.FloorId)
 	if err != nil {
 		logger.Error("availabilityStatusChange getFloor", slog.Any("error", err), slog.Any("taskUpdate", taskUpdate))
 		if err == mongo.ErrNoDocuments {
-			http.Error(w, "Floor not found", http.StatusUnprocessableEntity)
+			writeError(w, r, "error.floorNotFound", http.StatusUnprocessableEntity)
 			return
 		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	var fUp Floor
-
-	roomIndex, err := findRoom(floor.Rooms, userId)
+	if !checkClientRevision(w, floor, taskUpdate.Revision) {
+		return
+	}
+	roomIndex, err := findRoom(floor.Rooms, identity.UserId)
 
 	if err != nil {
 		logger.Error("taskUpdate findRoom", slog.Any("error", err), slog.Any("floor", floor), slog.Any("taskToUpdate", taskUpdate))
@@ -78,69 +69,53 @@ func HandleAvailabilityStatusChange(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var taskUpdateResult TaskUpdateResult
-	if taskUpdate.Action == "RESIDENT_AVAILABLE" {
-		floor.Rooms[roomIndex].Resident.Available = true
-	} else if taskUpdate.Action == "RESIDENT_UNAVAILABLE" {
-		taskUpdateResult, err = processTaskUpdate(&floor, taskUpdate)
-		if err != nil {
-			if strings.HasPrefix(err.Error(), "taskUpdate updating DB tasks:") {
-				logger.Error("taskUpdate updating DB tasks", slog.Any("error", err), slog.Any("floor", taskUpdateResult.Floor), slog.Any("taskUpdate", taskUpdateResult.TasksUpdated))
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			logger.Error("taskUpdate processUpdate", slog.Any("error", err), slog.Any("floor", taskUpdateResult.Floor), slog.Any("taskToUpdate", taskUpdateResult.TasksUpdated))
-			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
-			return
-		}
-		taskUpdateResult.Floor.Rooms[roomIndex].Resident.Available = false
-		floor = taskUpdateResult.Floor
-	}
-
-	fUp, err = updateRoom(floor, roomIndex)
+	fUp, err := changeAvailability(floor, roomIndex, taskUpdate.Action, identity.UserId, time.Now())
 	if err != nil {
-		logger.Error("availabilityStatusChange updating DB room", slog.Any("error", err), slog.Any("floor", taskUpdateResult.Floor), slog.Any("taskUpdate", taskUpdateResult.TasksUpdated))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, err, floor.Id, "availabilityStatusChange updating DB", slog.Any("floor id", floor.Id), slog.Any("taskUpdate", taskUpdate))
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(fUp)
+}
 
-	//todo pointer check
-	if !reflect.DeepEqual(taskUpdateResult.RoomToNotify, Room{}) {
-		tasksJSON, err := json.Marshal(taskUpdateResult.Floor.Tasks)
-		if err != nil {
-			logger.Error("taskUpdate marshalling task to json", slog.Any("error", err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		var taskNames []string
-		for _, t := range taskUpdateResult.TasksUpdated {
-			taskNames = append(taskNames, t.Name)
+// changeAvailability makes the resident of the room at roomIndex available or unavailable as
+// action says. One who becomes available lets the unassigned pool be spread again, one who
+// becomes unavailable hands their tasks on. The tasks, the room and the notifications go in one
+// write.
+func changeAvailability(floor Floor, roomIndex int, action string, actorId string, now time.Time) (Floor, error) {
+	var history []HistoryEntry
+	var msgs []OutboxMessage
+	if action == "RESIDENT_AVAILABLE" {
+		//whatever nobody was available for is spread again once someone returns, not when one never left
+		if !floor.Rooms[roomIndex].Resident.Available {
+			floor.Rooms[roomIndex].Resident.Available = true
+			var picked []Task
+			picked, history = pickUpPooledTasks(&floor, actorId, now)
+			msgs = pickedUpMessages(floor, picked, actorId)
 		}
+	} else if action == "RESIDENT_UNAVAILABLE" {
+		_, _, msgs, history = reassignTasks(&floor, floor.Rooms[roomIndex], actorId, now)
+		floor.Rooms[roomIndex].Resident.Available = false
+	}
 
-		joinedNames := strings.Join(taskNames, ", ")
-		for i := 0; i < 3; i++ {
-			err = sendNotification(taskUpdateResult.RoomToNotify, tasksJSON, floor.Id.String()[10:len(floor.Id.String())-2], "RESIDENT_UNAVAILABLE", fmt.Sprintf("%s has been assigned to you!", joinedNames))
-			if err != nil {
-				logger.Error("taskUpdate sendNotification attempt: "+strconv.Itoa(i+1), slog.Any("error", err), slog.Any("floor", fUp), slog.Any("taskToUpdate", taskUpdateResult.TasksUpdated))
-			} else {
-				break
-			}
-			waitTime := 2 * time.Second << (i) // Exponential backoff with base 2
-			time.Sleep(waitTime)
-		}
+	fUp, err := updateAvailability(floor, roomIndex, msgs...)
+	if err != nil {
+		return Floor{}, err
 	}
+	recordHistory(append([]HistoryEntry{newAvailabilityEntry(fUp, fUp.Rooms[roomIndex], action, now)}, history...))
+	return fUp, nil
 }
 
 func HandleCodeGeneration(w http.ResponseWriter, r *http.Request) {
 	corsHandler(w)
-	floorId := "669fca69d244526d709f6d76"
 	if r.Method == http.MethodOptions {
 		return
 	}
+	identity, ok := callerFloorIdentity(w, r)
+	if !ok {
+		return
+	}
 	var args CodeGenRequest
 	err := json.NewDecoder(r.Body).Decode(&args)
 	if err != nil {
@@ -148,28 +123,56 @@ func HandleCodeGeneration(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	code := generateCode()
-	codeGenResponse := CodeGenResponse{
-		Code: code,
+	if !codeGenerationLimiter.allow(identity.FloorId, time.Now()) {
+		writeError(w, r, "error.tooManyInvitations", http.StatusTooManyRequests)
+		return
 	}
-	codeMap[code] = CodeMapEntry{
-		FloorId: floorId,
-		Room:    args.Room,
+	fId, err := primitive.ObjectIDFromHex(identity.FloorId)
+	if err != nil {
+		writeError(w, r, "error.invalidFloorId", http.StatusBadRequest)
+		return
+	}
+
+	var inv Invitation
+	for i := 0; i < 3; i++ {
+		var code string
+		code, err = generateCode(inviteCodeLength)
+		if err != nil {
+			break
+		}
+		now := time.Now()
+		inv, err = insertInvitation(Invitation{
+			Code:      code,
+			FloorId:   fId,
+			Room:      args.Room,
+			CreatedBy: identity.UserId,
+			CreatedAt: now,
+			ExpiresAt: now.Add(inviteTTL),
+		})
+		//retry only on the unlikely collision with an outstanding code
+		if !mongo.IsDuplicateKeyError(err) {
+			break
+		}
+	}
+	if err != nil {
+		logger.Error("codeGeneration insertInvitation", slog.Any("error", err), slog.Any("floor id", fId), slog.Any("args", args))
+		writeError(w, r, "error.generateCode", http.StatusInternalServerError)
+		return
 	}
-	time.AfterFunc(20*time.Minute, func() {
-		delete(codeMap, code)
-	})
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(codeGenResponse)
+	json.NewEncoder(w).Encode(CodeGenResponse{Code: inv.Code})
 }
 
 func HandleCodeSubmit(w http.ResponseWriter, r *http.Request) {
-	floorId := "669fca69d244526d709f6d76"
 	corsHandler(w)
 	if r.Method == http.MethodOptions {
 		return
 	}
+	identity, ok := callerIdentity(w, r)
+	if !ok {
+		return
+	}
 	var resp CodeGenResponse
 	err := json.NewDecoder(r.Body).Decode(&resp)
 	if err != nil {
@@ -178,36 +181,51 @@ func HandleCodeSubmit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	args, ok := codeMap[resp.Code]
-	if !ok {
-		http.Error(w, "Code not found", http.StatusUnprocessableEntity)
+	client := clientKey(r, identity)
+	if !codeSubmitLimiter.allow(client, time.Now()) {
+		logger.Warn("codeSubmit too many attempts", slog.String("client", client))
+		writeError(w, r, "error.tooManyAttempts", http.StatusTooManyRequests)
 		return
 	}
-	floor, err := FindFloor(floorId)
+
+	inv, err := redeemInvitation(strings.ToUpper(resp.Code), identity.UserId, time.Now())
 	if err != nil {
-		logger.Error("codeSubmit getFloor", slog.Any("error", err), slog.Any("args", args))
 		if err == mongo.ErrNoDocuments {
-			http.Error(w, "Floor not found", http.StatusUnprocessableEntity)
+			writeError(w, r, "error.codeNotFound", http.StatusUnprocessableEntity)
 			return
 		}
+		logger.Error("codeSubmit redeemInvitation", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	codeSubmitLimiter.reset(client)
 
-	roomIndex, err := findRoomById(floor.Rooms, args.Room.Id)
+	floor, err := FindFloor(inv.FloorId.Hex())
 	if err != nil {
-		logger.Error("codeSubmit findRoom", slog.Any("error", err), slog.Any("floor", floor), slog.Any("args", args))
+		logger.Error("codeSubmit getFloor", slog.Any("error", err), slog.Any("invitation", inv))
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, "error.floorNotFound", http.StatusUnprocessableEntity)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	roomIndex, err := findRoomById(floor.Rooms, inv.Room.Id)
+	if err != nil {
+		logger.Error("codeSubmit findRoom", slog.Any("error", err), slog.Any("floor", floor), slog.Any("invitation", inv))
 		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
 
 	//consistency check
-	if !reflect.DeepEqual(floor.Rooms[roomIndex], args.Room) {
-		http.Error(w, "Room changed since code generation", http.StatusUnprocessableEntity)
+	if !reflect.DeepEqual(floor.Rooms[roomIndex], inv.Room) {
+		writeError(w, r, "error.roomChanged", http.StatusUnprocessableEntity)
 		return
 	}
 
-	delete(codeMap, resp.Code)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(CodeSubmitResponse{Floor: floor, Room: args.Room})
+	json.NewEncoder(w).Encode(CodeSubmitResponse{Floor: floor, Room: inv.Room})
 }
 
 func HandleAddNewResident(w http.ResponseWriter, r *http.Request) {
@@ -215,6 +233,10 @@ func HandleAddNewResident(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodOptions {
 		return
 	}
+	identity, ok := callerIdentity(w, r)
+	if !ok {
+		return
+	}
 	var addResRequest AddNewResidentRequest
 	err := json.NewDecoder(r.Body).Decode(&addResRequest)
 	if err != nil {
@@ -226,9 +248,27 @@ func HandleAddNewResident(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		logger.Error("addNewResident getFloor", slog.Any("error", err), slog.Any("addResRequest", addResRequest))
 		if err == mongo.ErrNoDocuments {
-			http.Error(w, "Floor not found", http.StatusUnprocessableEntity)
+			writeError(w, r, "error.floorNotFound", http.StatusUnprocessableEntity)
 			return
 		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	//only residents that redeemed an invitation for the room may move in
+	inv, err := findRedeemedInvitation(floor.Id, addResRequest.Room.Id, identity.UserId, time.Now())
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, "error.noRedeemedInvitation", http.StatusForbidden)
+			return
+		}
+		logger.Error("addNewResident findRedeemedInvitation", slog.Any("error", err), slog.Any("addResRequest", addResRequest))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !checkClientRevision(w, floor, addResRequest.Revision) {
+		return
 	}
 
 	roomIndex, err := findRoomById(floor.Rooms, addResRequest.Room.Id)
@@ -238,23 +278,19 @@ func HandleAddNewResident(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//the joining resident can only add themselves, the id comes from the token
+	addResRequest.Room.Resident.Id = identity.UserId
 	floor.Rooms[roomIndex].Resident = addResRequest.Room.Resident
 	fUp, err := updateRoom(floor, roomIndex)
 	if err != nil {
-		logger.Error("addNewResident updating DB room", slog.Any("error", err), slog.Any("floor", fUp), slog.Any("addResRequest", addResRequest))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, err, floor.Id, "addNewResident updating DB room", slog.Any("floor", floor), slog.Any("addResRequest", addResRequest))
 		return
 	}
+	if _, err := deleteInvitation(floor.Id, inv.Id); err != nil {
+		//the TTL index removes it at the latest when it expires
+		logger.Error("addNewResident deleteInvitation", slog.Any("error", err), slog.Any("invitation", inv))
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(fUp)
 }
-
-func generateCode() string {
-	code := make([]byte, 4)
-	const samples = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	for i := 0; i < 4; i++ {
-		code[i] = samples[r.Intn(len(samples))]
-	}
-	return string(code)
-}
@@ -8,6 +8,9 @@ import (
 	"reflect"
 	"testing"
 	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func Test_codeGen(t *testing.T) {
@@ -23,7 +26,7 @@ func Test_codeGen(t *testing.T) {
 		}
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(HandleCodeGeneration)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", floorId))
 
 		if status := rr.Code; status != http.StatusOK {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -33,8 +36,8 @@ func Test_codeGen(t *testing.T) {
 		var resp CodeGenResponse
 		json.Unmarshal(rr.Body.Bytes(), &resp)
 
-		if len(resp.Code) != 4 {
-			t.Errorf("expected code to be 4 characters long, got %v", len(resp.Code))
+		if len(resp.Code) != inviteCodeLength {
+			t.Errorf("expected code to be %v characters long, got %v", inviteCodeLength, len(resp.Code))
 		}
 	})
 }
@@ -52,7 +55,7 @@ func Test_codeSubmit(t *testing.T) {
 		}
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(HandleCodeGeneration)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", floorId))
 
 		if status := rr.Code; status != http.StatusOK {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -62,11 +65,11 @@ func Test_codeSubmit(t *testing.T) {
 		var resp CodeGenResponse
 		json.Unmarshal(rr.Body.Bytes(), &resp)
 
-		if len(resp.Code) != 4 {
-			t.Errorf("expected code to be 4 characters long, got %v", len(resp.Code))
+		if len(resp.Code) != inviteCodeLength {
+			t.Errorf("expected code to be %v characters long, got %v", inviteCodeLength, len(resp.Code))
 		}
 
-		jsonCode, err := json.Marshal(resp.Code)
+		jsonCode, err := json.Marshal(CodeGenResponse{Code: resp.Code})
 		if err != nil {
 			t.Error(err)
 		}
@@ -76,7 +79,7 @@ func Test_codeSubmit(t *testing.T) {
 		}
 		rr = httptest.NewRecorder()
 		handler = http.HandlerFunc(HandleCodeSubmit)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", floorId))
 
 		if status := rr.Code; status != http.StatusOK {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -92,48 +95,51 @@ func Test_codeSubmit(t *testing.T) {
 		if !reflect.DeepEqual(submitResp.Room, FloorStub.Rooms[6]) {
 			t.Errorf("expected room to be %v, got %v", FloorStub.Rooms[6], submitResp.Room)
 		}
-	})
-	t.Run("should timeout", func(t *testing.T) {
-		codeStub := CodeGenRequest{
-			Room: FloorStub.Rooms[0],
-		}
 
-		tuStubStr, err := json.Marshal(codeStub)
-		req, err := http.NewRequest("POST", "/generate-code", bytes.NewReader(tuStubStr))
+		req, err = http.NewRequest("POST", "/submit-code", bytes.NewReader(jsonCode))
 		if err != nil {
 			t.Error(err)
 		}
-		rr := httptest.NewRecorder()
-		handler := http.HandlerFunc(HandleCodeGeneration)
-		handler.ServeHTTP(rr, req)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, asResident(req, "2", floorId))
 
-		if status := rr.Code; status != http.StatusOK {
-			t.Errorf("handler returned wrong status code: got %v want %v",
-				status, http.StatusOK)
+		if status := rr.Code; status != http.StatusUnprocessableEntity {
+			t.Errorf("code must be single use: got %v want %v", status, http.StatusUnprocessableEntity)
 		}
-
-		var resp CodeGenResponse
-		json.Unmarshal(rr.Body.Bytes(), &resp)
-
-		if len(resp.Code) != 4 {
-			t.Errorf("expected code to be 4 characters long, got %v", len(resp.Code))
+	})
+	t.Run("should timeout", func(t *testing.T) {
+		fId, err := primitive.ObjectIDFromHex(floorId)
+		if err != nil {
+			t.Error(err)
+		}
+		code, err := generateCode(inviteCodeLength)
+		if err != nil {
+			t.Error(err)
+		}
+		_, err = insertInvitation(Invitation{
+			Code:      code,
+			FloorId:   fId,
+			Room:      FloorStub.Rooms[0],
+			CreatedAt: time.Now().Add(-inviteTTL - time.Minute),
+			ExpiresAt: time.Now().Add(-time.Minute),
+		})
+		if err != nil {
+			t.Error(err)
 		}
 
-		time.Sleep(12 * time.Second)
-
-		jsonCode, err := json.Marshal(resp.Code)
+		jsonCode, err := json.Marshal(CodeGenResponse{Code: code})
 		if err != nil {
 			t.Error(err)
 		}
-		req, err = http.NewRequest("POST", "/submit-code", bytes.NewReader(jsonCode))
+		req, err := http.NewRequest("POST", "/submit-code", bytes.NewReader(jsonCode))
 		if err != nil {
 			t.Error(err)
 		}
-		rr = httptest.NewRecorder()
-		handler = http.HandlerFunc(HandleCodeSubmit)
-		handler.ServeHTTP(rr, req)
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(HandleCodeSubmit)
+		handler.ServeHTTP(rr, asResident(req, "1", floorId))
 
-		if status := rr.Code; status != http.StatusUnprocessableEntity && rr.Body.String() != "Code not found" {
+		if status := rr.Code; status != http.StatusUnprocessableEntity {
 			t.Errorf("handler returned wrong status code: got %v want %v",
 				status, http.StatusUnprocessableEntity)
 		}
@@ -150,7 +156,7 @@ func Test_codeSubmit(t *testing.T) {
 		}
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(HandleCodeSubmit)
-		handler.ServeHTTP(rr, req)
+		handler.ServeHTTP(rr, asResident(req, "1", floorId))
 
 		if status := rr.Code; status != http.StatusUnprocessableEntity && rr.Body.String() != "Code not found" {
 			t.Errorf("handler returned wrong status code: got %v want %v",
@@ -160,3 +166,95 @@ func Test_codeSubmit(t *testing.T) {
 	})
 
 }
+
+func Test_attemptLimiter(t *testing.T) {
+	now := time.Now()
+	l := newAttemptLimiter(3, time.Minute)
+	for i := 0; i < 3; i++ {
+		if !l.allow("client", now) {
+			t.Errorf("attempt %d should be allowed", i+1)
+		}
+	}
+	if l.allow("client", now) {
+		t.Errorf("attempt over the limit should be denied")
+	}
+	if !l.allow("other client", now) {
+		t.Errorf("limit must be per key")
+	}
+	if !l.allow("client", now.Add(time.Minute)) {
+		t.Errorf("attempt after the window should be allowed again")
+	}
+	if _, ok := l.attempts["other client"]; ok {
+		t.Errorf("key whose window has emptied should be dropped")
+	}
+	if len(l.attempts["client"]) != 1 {
+		t.Errorf("expected only the recent attempt of the active key, got %v", l.attempts["client"])
+	}
+}
+
+func Test_invitations(t *testing.T) {
+	f, err := insertTestFloor(FloorStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, err := insertInvitation(Invitation{
+		Code:      "INVITE01",
+		FloorId:   f.Id,
+		Room:      f.Rooms[6],
+		CreatedBy: "1",
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(inviteTTL),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /floor/{id}/invitations", HandleListInvitations)
+	mux.HandleFunc("DELETE /floor/{id}/invitations/{invitationId}", HandleRevokeInvitation)
+
+	t.Run("should list open invitations", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "/floor/"+f.Id.Hex()+"/invitations", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(req, "1", f.Id.Hex()))
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		var invitations []Invitation
+		json.Unmarshal(rr.Body.Bytes(), &invitations)
+		if len(invitations) != 1 || invitations[0].Code != inv.Code {
+			t.Errorf("wrong invitations: got %v want %v", invitations, inv)
+		}
+	})
+	t.Run("should not list other floors", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "/floor/"+f.Id.Hex()+"/invitations", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(req, "1", floorId))
+
+		if status := rr.Code; status != http.StatusForbidden {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusForbidden)
+		}
+	})
+	t.Run("should revoke invitation", func(t *testing.T) {
+		req, err := http.NewRequest("DELETE", "/floor/"+f.Id.Hex()+"/invitations/"+inv.Id.Hex(), nil)
+		if err != nil {
+			t.Error(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(req, "1", f.Id.Hex()))
+
+		if status := rr.Code; status != http.StatusNoContent {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNoContent)
+		}
+		_, err = redeemInvitation(inv.Code, "9", time.Now())
+		if err != mongo.ErrNoDocuments {
+			t.Errorf("revoked code still redeemable: got %v want %v", err, mongo.ErrNoDocuments)
+		}
+	})
+}
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	VotingCreateTask       = "CREATE_TASK"
+	VotingDeleteTask       = "DELETE_TASK"
+	VotingRenameTask       = "RENAME_TASK"
+	VotingChangeRecurrence = "CHANGE_RECURRENCE"
+	VotingReorderRotation  = "REORDER_ROTATION"
+	VotingAdmitResident    = "ADMIT_RESIDENT"
+	VotingRemoveResident   = "REMOVE_RESIDENT"
+	VotingChangeSettings   = "CHANGE_SETTINGS"
+)
+
+// version of VotingPayload written by this server, votings from before payloads are version 0
+const votingPayloadVersion = 1
+
+// VotingPayload is what a voting decides on. Only the fields of the voting's type are set:
+//   - CREATE_TASK: Task
+//   - DELETE_TASK: TaskId
+//   - RENAME_TASK: TaskId and Name
+//   - CHANGE_RECURRENCE: TaskId, Recurrence and optionally the first DueDate
+//   - REORDER_ROTATION: RoomOrder, the ids of all rooms in their new order
+//   - ADMIT_RESIDENT: RoomId of an empty room and Resident
+//   - REMOVE_RESIDENT: RoomId
+//   - CHANGE_SETTINGS: Settings
+//
+// An empty recurrence, of the new task or on its own, stands for defaultRecurrence. A task
+// without schedule has recurrence type NONE.
+type VotingPayload struct {
+	Version    int            `bson:"version" json:"version"`
+	Task       *Task          `bson:"task,omitempty" json:"task,omitempty"`
+	TaskId     string         `bson:"taskId,omitempty" json:"taskId,omitempty"`
+	Name       string         `bson:"name,omitempty" json:"name,omitempty"`
+	Recurrence *Recurrence    `bson:"recurrence,omitempty" json:"recurrence,omitempty"`
+	DueDate    *time.Time     `bson:"dueDate,omitempty" json:"dueDate,omitempty"`
+	RoomOrder  []int          `bson:"roomOrder,omitempty" json:"roomOrder,omitempty"`
+	RoomId     *int           `bson:"roomId,omitempty" json:"roomId,omitempty"`
+	Resident   *Resident      `bson:"resident,omitempty" json:"resident,omitempty"`
+	Settings   *FloorSettings `bson:"settings,omitempty" json:"settings,omitempty"`
+}
+
+// FloorSettings are the floor wide settings a CHANGE_SETTINGS voting can change, nil ones stay.
+// QuorumPolicies only changes the voting types it lists, an empty policy falls back to the default.
+type FloorSettings struct {
+	Timezone       *string                 `bson:"timezone,omitempty" json:"timezone,omitempty"`
+	ReminderPolicy *ReminderPolicy         `bson:"reminderPolicy,omitempty" json:"reminderPolicy,omitempty"`
+	Rotation       *string                 `bson:"rotation,omitempty" json:"rotation,omitempty"`
+	QuorumPolicies map[string]QuorumPolicy `bson:"quorumPolicies,omitempty" json:"quorumPolicies,omitempty"`
+}
+
+// VotingType is something a floor can vote on. validate checks a payload against the floor, at
+// launch and again before the accepted voting is applied to the floor as it is then. apply changes
+// f and returns the changed floor fields for the update with the messages to send along. message
+// announces the voting.
+type VotingType interface {
+	validate(f Floor, p VotingPayload) error
+	apply(f *Floor, p VotingPayload, now time.Time) (bson.M, []OutboxMessage)
+	message(f Floor, p VotingPayload) Message
+}
+
+var votingTypes = map[string]VotingType{
+	VotingCreateTask:       createTaskVoting{},
+	VotingDeleteTask:       deleteTaskVoting{},
+	VotingRenameTask:       renameTaskVoting{},
+	VotingChangeRecurrence: changeRecurrenceVoting{},
+	VotingReorderRotation:  reorderRotationVoting{},
+	VotingAdmitResident:    admitResidentVoting{},
+	VotingRemoveResident:   removeResidentVoting{},
+	VotingChangeSettings:   changeSettingsVoting{},
+}
+
+// VotingFilter selects the votings GET /floor/{id}/votings lists. Open votings are not paged.
+type VotingFilter struct {
+	State  string
+	Type   string
+	Cursor primitive.ObjectID
+	Limit  int64
+}
+
+// VotingsResponse lists votings as archive records, open ones with PENDING and their current tally.
+type VotingsResponse struct {
+	Votings    []ResolvedVoting `json:"votings"`
+	NextCursor string           `json:"nextCursor,omitempty"`
+}
+
+type LaunchVotingRequest struct {
+	Revision *int64        `json:"revision,omitempty"`
+	Type     string        `json:"type"`
+	Payload  VotingPayload `json:"payload"`
+}
+
+// payloadOf returns the payload of v, votings launched before payloads carry their task in Data.
+func payloadOf(v Voting) VotingPayload {
+	if v.Payload.Version > 0 {
+		return v.Payload
+	}
+	switch v.Type {
+	case VotingCreateTask:
+		task := v.Data
+		return VotingPayload{Version: votingPayloadVersion, Task: &task}
+	case VotingDeleteTask:
+		return VotingPayload{Version: votingPayloadVersion, TaskId: v.Data.Id}
+	}
+	return v.Payload
+}
+
+func validateVotingPayload(f Floor, votingType string, p VotingPayload) error {
+	vt, ok := votingTypes[votingType]
+	if !ok {
+		return fmt.Errorf("unknown voting type %s", votingType)
+	}
+	if p.Version > votingPayloadVersion {
+		return fmt.Errorf("unsupported payload version %d", p.Version)
+	}
+	return vt.validate(f, p)
+}
+
+// applyVoting carries out the accepted voting v on f and returns the floor fields to write with
+// the messages about the change. The tasks and rooms of f are copied first, f shares them with the
+// caller.
+func applyVoting(f *Floor, v Voting, now time.Time) (bson.M, []OutboxMessage, error) {
+	p := payloadOf(v)
+	if err := validateVotingPayload(*f, v.Type, p); err != nil {
+		return nil, nil, err
+	}
+	f.Tasks = slices.Clone(f.Tasks)
+	f.Rooms = slices.Clone(f.Rooms)
+	set, msgs := votingTypes[v.Type].apply(f, p, now)
+	return set, msgs, nil
+}
+
+func votingAddMessage(f Floor, v Voting) Message {
+	return votingTypes[v.Type].message(f, payloadOf(v))
+}
+
+// votingResolvedMessage carries the arguments of the voting's announcement, so the result names
+// the same task or resident.
+func votingResolvedMessage(f Floor, v Voting, outcome string) Message {
+	args := map[string]string{"Type": v.Type, "Outcome": outcome}
+	if vt, ok := votingTypes[v.Type]; ok {
+		for k, a := range vt.message(f, payloadOf(v)).Args {
+			args[k] = a
+		}
+	}
+	return Message{Key: "voting.resolved", Args: args}
+}
+
+func taskNameOf(f Floor, taskId string) string {
+	if t, err := findTask(f.Tasks, taskId); err == nil {
+		return t.Name
+	}
+	return ""
+}
+
+func validTaskName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("task name must not be empty")
+	}
+	return nil
+}
+
+// newTask is a task named name that is not assigned yet, with the id after the highest one.
+func newTask(f Floor, name string, rec Recurrence, now time.Time) Task {
+	lastId := -1
+	for _, t := range f.Tasks {
+		if id, err := strconv.Atoi(t.Id); err == nil && id > lastId {
+			lastId = id
+		}
+	}
+	return Task{
+		Id:             strconv.Itoa(lastId + 1),
+		Name:           strings.TrimSpace(name),
+		AssignedTo:     unassignedRoom,
+		AssignmentDate: now,
+		Recurrence:     rec,
+		DueDate:        nextDueDate(rec, now.In(floorLocation(f))),
+	}
+}
+
+type createTaskVoting struct{}
+
+func (createTaskVoting) validate(f Floor, p VotingPayload) error {
+	if p.Task == nil {
+		return fmt.Errorf("task missing")
+	}
+	if err := validTaskName(p.Task.Name); err != nil {
+		return err
+	}
+	return validateRecurrence(p.Task.Recurrence)
+}
+
+func (createTaskVoting) apply(f *Floor, p VotingPayload, now time.Time) (bson.M, []OutboxMessage) {
+	rec := recurrenceOrDefault(p.Task.Recurrence)
+	f.Tasks = append(f.Tasks, newTask(*f, p.Task.Name, rec, now))
+	return bson.M{"tasks": f.Tasks}, nil
+}
+
+func (createTaskVoting) message(f Floor, p VotingPayload) Message {
+	return newMessage("voting.create", "Task", p.Task.Name)
+}
+
+type deleteTaskVoting struct{}
+
+func (deleteTaskVoting) validate(f Floor, p VotingPayload) error {
+	_, err := findTask(f.Tasks, p.TaskId)
+	return err
+}
+
+func (deleteTaskVoting) apply(f *Floor, p VotingPayload, now time.Time) (bson.M, []OutboxMessage) {
+	f.Tasks = slices.DeleteFunc(f.Tasks, func(t Task) bool { return t.Id == p.TaskId })
+	return bson.M{"tasks": f.Tasks}, nil
+}
+
+func (deleteTaskVoting) message(f Floor, p VotingPayload) Message {
+	return newMessage("voting.delete", "Task", taskNameOf(f, p.TaskId))
+}
+
+type renameTaskVoting struct{}
+
+func (renameTaskVoting) validate(f Floor, p VotingPayload) error {
+	if _, err := findTask(f.Tasks, p.TaskId); err != nil {
+		return err
+	}
+	return validTaskName(p.Name)
+}
+
+func (renameTaskVoting) apply(f *Floor, p VotingPayload, now time.Time) (bson.M, []OutboxMessage) {
+	i, _ := findTaskIndex(f.Tasks, p.TaskId)
+	f.Tasks[i].Name = strings.TrimSpace(p.Name)
+	return bson.M{"tasks": f.Tasks}, nil
+}
+
+func (renameTaskVoting) message(f Floor, p VotingPayload) Message {
+	return newMessage("voting.rename", "Task", taskNameOf(f, p.TaskId), "Name", p.Name)
+}
+
+type changeRecurrenceVoting struct{}
+
+func (changeRecurrenceVoting) validate(f Floor, p VotingPayload) error {
+	if _, err := findTask(f.Tasks, p.TaskId); err != nil {
+		return err
+	}
+	if p.Recurrence == nil {
+		return fmt.Errorf("recurrence missing")
+	}
+	return validateRecurrence(*p.Recurrence)
+}
+
+func (changeRecurrenceVoting) apply(f *Floor, p VotingPayload, now time.Time) (bson.M, []OutboxMessage) {
+	rec := recurrenceOrDefault(*p.Recurrence)
+	i, _ := findTaskIndex(f.Tasks, p.TaskId)
+	f.Tasks[i].Recurrence = rec
+	if p.DueDate != nil {
+		f.Tasks[i].DueDate = startOfDay(p.DueDate.In(floorLocation(*f)))
+	} else {
+		f.Tasks[i].DueDate = nextDueDate(rec, now.In(floorLocation(*f)))
+	}
+	return bson.M{"tasks": f.Tasks}, nil
+}
+
+func (changeRecurrenceVoting) message(f Floor, p VotingPayload) Message {
+	return newMessage("voting.recurrence", "Task", taskNameOf(f, p.TaskId))
+}
+
+type reorderRotationVoting struct{}
+
+func (reorderRotationVoting) validate(f Floor, p VotingPayload) error {
+	if len(p.RoomOrder) != len(f.Rooms) {
+		return fmt.Errorf("room order must list all %d rooms", len(f.Rooms))
+	}
+	for _, r := range f.Rooms {
+		if !slices.Contains(p.RoomOrder, r.Id) {
+			return fmt.Errorf("room %d missing in room order", r.Id)
+		}
+	}
+	return nil
+}
+
+func (reorderRotationVoting) apply(f *Floor, p VotingPayload, now time.Time) (bson.M, []OutboxMessage) {
+	for i := range f.Rooms {
+		f.Rooms[i].Order = slices.Index(p.RoomOrder, f.Rooms[i].Id)
+	}
+	return bson.M{"rooms": f.Rooms}, nil
+}
+
+func (reorderRotationVoting) message(f Floor, p VotingPayload) Message {
+	return newMessage("voting.rotation")
+}
+
+type admitResidentVoting struct{}
+
+func (admitResidentVoting) validate(f Floor, p VotingPayload) error {
+	if p.RoomId == nil || p.Resident == nil || p.Resident.Id == "" {
+		return fmt.Errorf("room and resident missing")
+	}
+	i, err := findRoomById(f.Rooms, *p.RoomId)
+	if err != nil {
+		return err
+	}
+	if f.Rooms[i].Resident.Id != "" {
+		return fmt.Errorf("room %d is not empty", *p.RoomId)
+	}
+	if _, err := findRoom(f.Rooms, p.Resident.Id); err == nil {
+		return fmt.Errorf("resident already lives on the floor")
+	}
+	return nil
+}
+
+func (admitResidentVoting) apply(f *Floor, p VotingPayload, now time.Time) (bson.M, []OutboxMessage) {
+	i, _ := findRoomById(f.Rooms, *p.RoomId)
+	f.Rooms[i].Resident = Resident{Id: p.Resident.Id, Name: p.Resident.Name, Available: true}
+	return bson.M{"rooms": f.Rooms}, nil
+}
+
+func (admitResidentVoting) message(f Floor, p VotingPayload) Message {
+	return newMessage("voting.admit", "Resident", p.Resident.Name)
+}
+
+type removeResidentVoting struct{}
+
+func (removeResidentVoting) validate(f Floor, p VotingPayload) error {
+	if p.RoomId == nil {
+		return fmt.Errorf("room missing")
+	}
+	i, err := findRoomById(f.Rooms, *p.RoomId)
+	if err != nil {
+		return err
+	}
+	if f.Rooms[i].Resident.Id == "" {
+		return fmt.Errorf("room %d is empty", *p.RoomId)
+	}
+	return nil
+}
+
+// apply hands the tasks of the removed resident on along the rotation, as if they became
+// unavailable, and empties the room.
+func (removeResidentVoting) apply(f *Floor, p VotingPayload, now time.Time) (bson.M, []OutboxMessage) {
+	i, _ := findRoomById(f.Rooms, *p.RoomId)
+	_, _, msgs, _ := reassignTasks(f, f.Rooms[i], "", now)
+	f.Rooms[i].Resident = Resident{}
+	return bson.M{"rooms": f.Rooms, "tasks": f.Tasks}, msgs
+}
+
+func (removeResidentVoting) message(f Floor, p VotingPayload) Message {
+	name := ""
+	if i, err := findRoomById(f.Rooms, *p.RoomId); err == nil {
+		name = f.Rooms[i].Resident.Name
+	}
+	return newMessage("voting.remove", "Resident", name)
+}
+
+// removedResident is the resident a REMOVE_RESIDENT voting is about, they do not vote on it.
+func removedResident(f Floor, v Voting) string {
+	p := payloadOf(v)
+	if v.Type != VotingRemoveResident || p.RoomId == nil {
+		return ""
+	}
+	return residentOfRoom(f.Rooms, *p.RoomId)
+}
+
+type changeSettingsVoting struct{}
+
+func (changeSettingsVoting) validate(f Floor, p VotingPayload) error {
+	s := p.Settings
+	if s == nil || (s.Timezone == nil && s.ReminderPolicy == nil && s.Rotation == nil && len(s.QuorumPolicies) == 0) {
+		return fmt.Errorf("settings missing")
+	}
+	if s.Timezone != nil && *s.Timezone != "" {
+		if _, err := time.LoadLocation(*s.Timezone); err != nil {
+			return fmt.Errorf("unknown time zone %s", *s.Timezone)
+		}
+	}
+	if s.ReminderPolicy != nil {
+		if err := validateReminderPolicy(*s.ReminderPolicy); err != nil {
+			return err
+		}
+	}
+	if s.Rotation != nil && !validRotation(*s.Rotation) {
+		return fmt.Errorf("unknown rotation strategy %s", *s.Rotation)
+	}
+	for votingType, policy := range s.QuorumPolicies {
+		if _, ok := votingTypes[votingType]; !ok {
+			return fmt.Errorf("unknown voting type %s", votingType)
+		}
+		if err := validateQuorumPolicy(policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (changeSettingsVoting) apply(f *Floor, p VotingPayload, now time.Time) (bson.M, []OutboxMessage) {
+	set := bson.M{}
+	if s := p.Settings; s.Timezone != nil {
+		f.Timezone = *s.Timezone
+		set["timezone"] = f.Timezone
+	}
+	if s := p.Settings; s.ReminderPolicy != nil {
+		policy := *s.ReminderPolicy
+		f.ReminderPolicy = &policy
+		set["reminderPolicy"] = f.ReminderPolicy
+	}
+	if s := p.Settings; s.Rotation != nil {
+		f.Rotation = *s.Rotation
+		set["rotation"] = f.Rotation
+	}
+	if s := p.Settings; len(s.QuorumPolicies) > 0 {
+		f.QuorumPolicies = maps.Clone(f.QuorumPolicies)
+		for votingType, policy := range s.QuorumPolicies {
+			setQuorumPolicy(f, votingType, policy)
+		}
+		set["quorumPolicies"] = f.QuorumPolicies
+	}
+	return set, nil
+}
+
+func (changeSettingsVoting) message(f Floor, p VotingPayload) Message {
+	return newMessage("voting.settings")
+}
+
+// HandleLaunchVoting starts a voting of any type on the caller's floor.
+func HandleLaunchVoting(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerFloorFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req LaunchVotingRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.Error("launchVoting decoding data payload", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	launchVoting(w, r, identity, req.Revision, req.Type, req.Payload)
+}
+
+// launchVoting validates p, adds the voting to the floor and announces it to everyone but its creator.
+func launchVoting(w http.ResponseWriter, r *http.Request, identity Identity, revision *int64, votingType string, p VotingPayload) {
+	floor, err := FindFloor(identity.FloorId)
+	if err != nil {
+		logger.Error("launchVoting getFloor", slog.Any("error", err), slog.String("floor id", identity.FloorId))
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, "error.floorNotFound", http.StatusUnprocessableEntity)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkClientRevision(w, floor, revision) {
+		return
+	}
+	startVoting(w, r, floor, identity, votingType, p)
+}
+
+// startVoting is launchVoting on a floor the caller loaded and checked the revision of already.
+func startVoting(w http.ResponseWriter, r *http.Request, floor Floor, identity Identity, votingType string, p VotingPayload) {
+	if err := validateVotingPayload(floor, votingType, p); err != nil {
+		writeError(w, r, "error.invalidVoting", http.StatusBadRequest, "Error", err.Error())
+		return
+	}
+	p.Version = votingPayloadVersion
+
+	nextVotId := 1
+	if len(floor.Votings) > 0 {
+		nextVotId = floor.Votings[len(floor.Votings)-1].Id + 1
+	}
+	voting := Voting{
+		Id:           nextVotId,
+		Type:         votingType,
+		Payload:      p,
+		Accepts:      []string{},
+		Rejects:      []string{},
+		LaunchDate:   time.Now(),
+		CreatedBy:    identity.UserId,
+		VotingWindow: 2 * 24 * time.Hour,
+	}
+	//clients from before payloads read the task of task votings from Data
+	switch votingType {
+	case VotingCreateTask:
+		voting.Data = *p.Task
+	case VotingDeleteTask:
+		voting.Data, _ = findTask(floor.Tasks, p.TaskId)
+	}
+	voting.Quorum = quorumPolicyFor(floor, voting)
+
+	msgs := votingMessages(floor, "VOTING_ADD", votingAddMessage(floor, voting), identity.UserId)
+	fUp, err := InsertVoting(floor, voting, msgs...)
+	if err != nil {
+		writeDBError(w, err, floor.Id, "launchVoting updating DB", slog.Any("voting", voting))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(fUp)
+}
+
+// HandleListVotings lists the open votings of the caller's floor, or with state=resolved the
+// archived ones, latest first.
+func HandleListVotings(w http.ResponseWriter, r *http.Request) {
+	corsHandler(w)
+	identity, ok := callerFloorFromPath(w, r)
+	if !ok {
+		return
+	}
+	filter, err := parseVotingFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	floor, err := FindFloor(identity.FloorId)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, "error.floorNotFound", http.StatusNotFound)
+			return
+		}
+		writeError(w, r, "error.getFloor", http.StatusInternalServerError, "Error", err.Error())
+		return
+	}
+
+	resp := VotingsResponse{Votings: []ResolvedVoting{}}
+	if filter.State == "resolved" {
+		resp.Votings, err = findResolvedVotings(floor.Id, filter)
+		if err != nil {
+			logger.Error("listVotings findResolvedVotings", slog.Any("error", err), slog.Any("floor id", floor.Id), slog.Any("filter", filter))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if int64(len(resp.Votings)) == filter.Limit {
+			resp.NextCursor = resp.Votings[len(resp.Votings)-1].Id.Hex()
+		}
+	} else {
+		for _, v := range floor.Votings {
+			if filter.Type == "" || v.Type == filter.Type {
+				resp.Votings = append(resp.Votings, ResolvedVoting{FloorId: floor.Id, Voting: v, Outcome: VotingPending, Tally: tallyVoting(floor, v)})
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func parseVotingFilter(r *http.Request) (VotingFilter, error) {
+	q := r.URL.Query()
+	filter := VotingFilter{State: q.Get("state"), Type: q.Get("type"), Limit: defaultHistoryLimit}
+	if filter.State == "" {
+		filter.State = "open"
+	}
+	if filter.State != "open" && filter.State != "resolved" {
+		return VotingFilter{}, errBadQueryParam("state", nil)
+	}
+	var err error
+	if v := q.Get("cursor"); v != "" {
+		if filter.Cursor, err = primitive.ObjectIDFromHex(v); err != nil {
+			return VotingFilter{}, errBadQueryParam("cursor", err)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || limit <= 0 {
+			return VotingFilter{}, errBadQueryParam("limit", err)
+		}
+		filter.Limit = min(limit, maxHistoryLimit)
+	}
+	return filter, nil
+}
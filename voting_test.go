@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// votingFloor has rooms 0 to 3 with residents "a" to "c" and an empty room 3.
+func votingFloor() Floor {
+	f := rotationFloor(true, true, true, true)
+	for i := range f.Rooms {
+		f.Rooms[i].Id = i
+		f.Rooms[i].Resident.Name = "Resident " + f.Rooms[i].Resident.Id
+	}
+	f.Rooms[3].Resident = Resident{}
+	f.Tasks = []Task{{Id: "0", Name: "Küche", AssignedTo: 0}, {Id: "1", Name: "Bad", AssignedTo: 1}}
+	return f
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func Test_validateVotingPayload(t *testing.T) {
+	f := votingFloor()
+	tests := []struct {
+		name       string
+		votingType string
+		payload    VotingPayload
+		wantErr    bool
+	}{
+		{name: "should accept new task", votingType: VotingCreateTask, payload: VotingPayload{Task: &Task{Name: "Müll"}}},
+		{name: "should reject task without name", votingType: VotingCreateTask, payload: VotingPayload{Task: &Task{Name: " "}}, wantErr: true},
+		{name: "should reject deleting unknown task", votingType: VotingDeleteTask, payload: VotingPayload{TaskId: "7"}, wantErr: true},
+		{name: "should accept rename", votingType: VotingRenameTask, payload: VotingPayload{TaskId: "1", Name: "Badezimmer"}},
+		{name: "should reject invalid recurrence", votingType: VotingChangeRecurrence, payload: VotingPayload{TaskId: "1", Recurrence: &Recurrence{Type: RecurrenceWeekly}}, wantErr: true},
+		{name: "should reject incomplete room order", votingType: VotingReorderRotation, payload: VotingPayload{RoomOrder: []int{3, 2, 1}}, wantErr: true},
+		{name: "should accept room order", votingType: VotingReorderRotation, payload: VotingPayload{RoomOrder: []int{3, 2, 1, 0}}},
+		{name: "should reject admitting to occupied room", votingType: VotingAdmitResident, payload: VotingPayload{RoomId: intPtr(1), Resident: &Resident{Id: "x"}}, wantErr: true},
+		{name: "should reject admitting resident twice", votingType: VotingAdmitResident, payload: VotingPayload{RoomId: intPtr(3), Resident: &Resident{Id: "a"}}, wantErr: true},
+		{name: "should reject removing from empty room", votingType: VotingRemoveResident, payload: VotingPayload{RoomId: intPtr(3)}, wantErr: true},
+		{name: "should reject unknown time zone", votingType: VotingChangeSettings, payload: VotingPayload{Settings: &FloorSettings{Timezone: stringPtr("Mars/Olympus")}}, wantErr: true},
+		{name: "should reject empty settings", votingType: VotingChangeSettings, payload: VotingPayload{Settings: &FloorSettings{}}, wantErr: true},
+		{name: "should accept quorum policy", votingType: VotingChangeSettings, payload: VotingPayload{Settings: &FloorSettings{QuorumPolicies: map[string]QuorumPolicy{VotingDeleteTask: {Type: QuorumMajority}}}}},
+		{name: "should reject quorum policy of unknown type", votingType: VotingChangeSettings, payload: VotingPayload{Settings: &FloorSettings{QuorumPolicies: map[string]QuorumPolicy{"PAINT_WALLS": {Type: QuorumMajority}}}}, wantErr: true},
+		{name: "should reject newer payload version", votingType: VotingRenameTask, payload: VotingPayload{Version: votingPayloadVersion + 1, TaskId: "1", Name: "Bad"}, wantErr: true},
+		{name: "should reject unknown type", votingType: "PAINT_WALLS", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateVotingPayload(f, tt.votingType, tt.payload); (err != nil) != tt.wantErr {
+				t.Errorf("validateVotingPayload: got %v wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_applyVoting(t *testing.T) {
+	now := time.Now()
+	apply := func(t *testing.T, votingType string, p VotingPayload) Floor {
+		t.Helper()
+		f := votingFloor()
+		p.Version = votingPayloadVersion
+		if _, _, err := applyVoting(&f, Voting{Type: votingType, Payload: p}, now); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	t.Run("should create task with next id", func(t *testing.T) {
+		f := apply(t, VotingCreateTask, VotingPayload{Task: &Task{Name: "Müll"}})
+		task := f.Tasks[len(f.Tasks)-1]
+		if task.Id != "2" || task.Name != "Müll" || task.AssignedTo != -1 || !reflect.DeepEqual(task.Recurrence, defaultRecurrence) {
+			t.Errorf("wrong task created: %+v", task)
+		}
+	})
+	t.Run("should read empty recurrence as default", func(t *testing.T) {
+		f := apply(t, VotingChangeRecurrence, VotingPayload{TaskId: "1", Recurrence: &Recurrence{}})
+		if !reflect.DeepEqual(f.Tasks[1].Recurrence, defaultRecurrence) || f.Tasks[1].DueDate.IsZero() {
+			t.Errorf("wrong recurrence: %+v due %v", f.Tasks[1].Recurrence, f.Tasks[1].DueDate)
+		}
+		f = apply(t, VotingChangeRecurrence, VotingPayload{TaskId: "1", Recurrence: &Recurrence{Type: RecurrenceNone}})
+		if f.Tasks[1].Recurrence.Type != RecurrenceNone || !f.Tasks[1].DueDate.IsZero() {
+			t.Errorf("task not unscheduled: %+v due %v", f.Tasks[1].Recurrence, f.Tasks[1].DueDate)
+		}
+	})
+	t.Run("should rename task", func(t *testing.T) {
+		if f := apply(t, VotingRenameTask, VotingPayload{TaskId: "1", Name: "Badezimmer"}); f.Tasks[1].Name != "Badezimmer" {
+			t.Errorf("task not renamed: %+v", f.Tasks[1])
+		}
+	})
+	t.Run("should reorder rooms", func(t *testing.T) {
+		f := apply(t, VotingReorderRotation, VotingPayload{RoomOrder: []int{3, 2, 1, 0}})
+		if f.Rooms[0].Order != 3 || f.Rooms[3].Order != 0 {
+			t.Errorf("rooms not reordered: %+v", f.Rooms)
+		}
+	})
+	t.Run("should admit resident as available", func(t *testing.T) {
+		f := apply(t, VotingAdmitResident, VotingPayload{RoomId: intPtr(3), Resident: &Resident{Id: "d", Name: "Lena"}})
+		if r := f.Rooms[3].Resident; r.Id != "d" || r.Name != "Lena" || !r.Available {
+			t.Errorf("resident not admitted: %+v", r)
+		}
+	})
+	t.Run("should remove resident and hand their tasks on", func(t *testing.T) {
+		f := apply(t, VotingRemoveResident, VotingPayload{RoomId: intPtr(1)})
+		if f.Rooms[1].Resident.Id != "" || f.Tasks[1].AssignedTo != 2 || f.Tasks[0].AssignedTo != 0 {
+			t.Errorf("resident not removed: %+v %+v", f.Rooms[1], f.Tasks)
+		}
+	})
+	t.Run("should only change given settings", func(t *testing.T) {
+		f := votingFloor()
+		f.Timezone = "Europe/Berlin"
+		set, _, err := applyVoting(&f, Voting{Type: VotingChangeSettings, Payload: VotingPayload{Version: 1, Settings: &FloorSettings{Rotation: stringPtr(RotationLeastLoaded)}}}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Rotation != RotationLeastLoaded || f.Timezone != "Europe/Berlin" || len(set) != 1 {
+			t.Errorf("wrong settings applied: %v %v", f.Rotation, set)
+		}
+	})
+	t.Run("should change only the listed quorum policies", func(t *testing.T) {
+		f := votingFloor()
+		f.QuorumPolicies = map[string]QuorumPolicy{VotingCreateTask: {Type: QuorumVeto}, VotingRenameTask: {Type: QuorumUnanimous}}
+		before := f.QuorumPolicies
+		p := VotingPayload{Version: 1, Settings: &FloorSettings{QuorumPolicies: map[string]QuorumPolicy{VotingCreateTask: {}, VotingDeleteTask: {Type: QuorumMajority}}}}
+		if _, _, err := applyVoting(&f, Voting{Type: VotingChangeSettings, Payload: p}, now); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]QuorumPolicy{VotingRenameTask: {Type: QuorumUnanimous}, VotingDeleteTask: {Type: QuorumMajority}}
+		if !reflect.DeepEqual(f.QuorumPolicies, want) {
+			t.Errorf("wrong quorum policies: %v", f.QuorumPolicies)
+		}
+		if len(before) != 2 {
+			t.Errorf("caller's policies changed: %v", before)
+		}
+	})
+	t.Run("should set given due date with recurrence", func(t *testing.T) {
+		due := date(2024, 3, 4).Add(15 * time.Hour)
+		f := apply(t, VotingChangeRecurrence, VotingPayload{TaskId: "1", Recurrence: &Recurrence{Type: RecurrenceDaily}, DueDate: &due})
+		if !f.Tasks[1].DueDate.Equal(date(2024, 3, 4)) {
+			t.Errorf("due date not set: %v", f.Tasks[1].DueDate)
+		}
+	})
+	t.Run("should not change the caller's tasks", func(t *testing.T) {
+		f := votingFloor()
+		applied := f
+		if _, _, err := applyVoting(&applied, Voting{Type: VotingRenameTask, Payload: VotingPayload{Version: 1, TaskId: "0", Name: "Flur"}}, now); err != nil {
+			t.Fatal(err)
+		}
+		if f.Tasks[0].Name != "Küche" {
+			t.Errorf("caller's floor changed: %+v", f.Tasks[0])
+		}
+	})
+}
+
+func Test_payloadOf(t *testing.T) {
+	legacy := Voting{Type: VotingDeleteTask, Data: Task{Id: "1", Name: "Bad"}}
+	if p := payloadOf(legacy); p.TaskId != "1" || p.Version != votingPayloadVersion {
+		t.Errorf("legacy delete not migrated: %+v", p)
+	}
+	legacy = Voting{Type: VotingCreateTask, Data: Task{Name: "Müll"}}
+	if p := payloadOf(legacy); p.Task == nil || p.Task.Name != "Müll" {
+		t.Errorf("legacy create not migrated: %+v", p)
+	}
+	msg := votingResolvedMessage(votingFloor(), legacy, VotingAccepted)
+	if msg.Args["Task"] != "Müll" || msg.Args["Outcome"] != VotingAccepted {
+		t.Errorf("wrong resolved message: %+v", msg)
+	}
+}
+
+func Test_removedResidentDoesNotVote(t *testing.T) {
+	f := votingFloor()
+	v := Voting{Type: VotingRemoveResident, Payload: VotingPayload{Version: 1, RoomId: intPtr(2)}, CreatedBy: "a", Accepts: []string{"b"}, Rejects: []string{"c"}}
+	if tally := tallyVoting(f, v); tally.Electorate != 2 || tally.Rejects != 0 {
+		t.Errorf("removed resident counted: %+v", tally)
+	}
+	if got := evaluateVoting(f, v, false); got != VotingAccepted {
+		t.Errorf("evaluateVoting: got %v want %v", got, VotingAccepted)
+	}
+}
+
+func Test_HandleLaunchVoting(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /floor/{id}/votings", HandleLaunchVoting)
+	fStub := FloorStub
+	fStub.Votings = nil
+	f, err := insertTestFloor(fStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	launch := func(req LaunchVotingRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(req)
+		r, _ := http.NewRequest("POST", "/floor/"+f.Id.Hex()+"/votings", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(r, "1", f.Id.Hex()))
+		return rr
+	}
+
+	t.Run("should reject invalid payload", func(t *testing.T) {
+		if rr := launch(LaunchVotingRequest{Type: VotingRenameTask, Payload: VotingPayload{TaskId: f.Tasks[0].Id}}); rr.Code != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("should launch rename and apply it once accepted", func(t *testing.T) {
+		rr := launch(LaunchVotingRequest{Type: VotingRenameTask, Payload: VotingPayload{TaskId: f.Tasks[0].Id, Name: "Treppenhaus"}})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+		var fUp Floor
+		json.Unmarshal(rr.Body.Bytes(), &fUp)
+		v := fUp.Votings[len(fUp.Votings)-1]
+		if v.Payload.Version != votingPayloadVersion || v.Quorum.Type != QuorumMajority {
+			t.Fatalf("wrong voting launched: %+v", v)
+		}
+		fUp, err = resolveVoting(fUp, v, VotingAccepted, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fUp.Tasks[0].Name != "Treppenhaus" || len(fUp.Votings) != 0 {
+			t.Errorf("rename not applied: %+v %+v", fUp.Tasks[0], fUp.Votings)
+		}
+	})
+}
+
+func Test_parseVotingFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    VotingFilter
+		wantErr bool
+	}{
+		{name: "should default to open votings", query: "", want: VotingFilter{State: "open", Limit: defaultHistoryLimit}},
+		{name: "should read filters", query: "?state=resolved&type=DELETE_TASK&limit=10", want: VotingFilter{State: "resolved", Type: VotingDeleteTask, Limit: 10}},
+		{name: "should cap limit", query: "?state=resolved&limit=100000", want: VotingFilter{State: "resolved", Limit: maxHistoryLimit}},
+		{name: "should reject unknown state", query: "?state=draft", wantErr: true},
+		{name: "should reject bad cursor", query: "?state=resolved&cursor=abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/floor/"+floorId+"/votings"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseVotingFilter(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("wrong filter: got %v want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_HandleListVotings(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /floor/{id}/votings", HandleListVotings)
+	fStub := FloorStub
+	fStub.Votings = []Voting{
+		{Id: 1, Type: VotingCreateTask, Data: Task{Name: "Müll"}, CreatedBy: "1", Accepts: []string{"2"}, LaunchDate: time.Now(), VotingWindow: time.Hour},
+		{Id: 2, Type: VotingDeleteTask, Data: FloorStub.Tasks[0], CreatedBy: "1", Rejects: []string{"2"}, LaunchDate: time.Now(), VotingWindow: time.Hour},
+	}
+	f, err := insertTestFloor(fStub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, err = resolveVoting(f, f.Votings[1], VotingRejected, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	list := func(query string) (VotingsResponse, int) {
+		r, _ := http.NewRequest("GET", "/floor/"+f.Id.Hex()+"/votings"+query, nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, asResident(r, "1", f.Id.Hex()))
+		var resp VotingsResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp, rr.Code
+	}
+
+	t.Run("should list open votings with their tally", func(t *testing.T) {
+		resp, code := list("")
+		if code != http.StatusOK || len(resp.Votings) != 1 {
+			t.Fatalf("wrong open votings: %v %+v", code, resp)
+		}
+		if v := resp.Votings[0]; v.Voting.Id != 1 || v.Outcome != VotingPending || v.Tally.Accepts != 2 {
+			t.Errorf("wrong open voting: %+v", v)
+		}
+	})
+
+	t.Run("should list resolved votings with outcome and reason", func(t *testing.T) {
+		resp, code := list("?state=resolved")
+		if code != http.StatusOK || len(resp.Votings) != 1 {
+			t.Fatalf("wrong resolved votings: %v %+v", code, resp)
+		}
+		if v := resp.Votings[0]; v.Voting.Id != 2 || v.Outcome != VotingRejected || v.Reason != ResolvedByVote || v.Tally.Rejects != 1 {
+			t.Errorf("wrong resolved voting: %+v", v)
+		}
+	})
+
+	t.Run("should reject unknown state", func(t *testing.T) {
+		if _, code := list("?state=draft"); code != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code: got %v want %v", code, http.StatusBadRequest)
+		}
+	})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// the body is sent as a single record of webPushRecordSize bytes, which also holds the padding
+// delimiter and the 16 byte authentication tag
+const webPushRecordSize = 4096
+const webPushRecordOverhead = 17
+
+// WebPushNotifier sends standard Web Push messages (RFC 8030) with VAPID authentication (RFC 8292)
+// and an aes128gcm encrypted body (RFC 8291), for browser clients.
+type WebPushNotifier struct {
+	httpClient *http.Client
+	key        *ecdsa.PrivateKey
+	subject    string
+	ttl        time.Duration
+}
+
+// newWebPushNotifier takes the VAPID private key base64url encoded, either as the raw 32 byte scalar
+// or as PKCS#8 DER.
+func newWebPushNotifier(privateKey string, subject string) (*WebPushNotifier, error) {
+	key, err := parseVapidKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &WebPushNotifier{httpClient: &http.Client{Timeout: 10 * time.Second}, key: key, subject: subject, ttl: 24 * time.Hour}, nil
+}
+
+func parseVapidKey(privateKey string) (*ecdsa.PrivateKey, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("decoding VAPID key: %w", err)
+	}
+	if len(raw) == 32 {
+		ecdhKey, err := ecdh.P256().NewPrivateKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parsing VAPID key: %w", err)
+		}
+		pub := ecdhKey.PublicKey().Bytes()
+		return &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(pub[1:33]), Y: new(big.Int).SetBytes(pub[33:])},
+			D:         new(big.Int).SetBytes(raw),
+		}, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing VAPID key: %w", err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("VAPID key is not a P-256 key")
+	}
+	return key, nil
+}
+
+// publicKey is the application server key browsers subscribe with, base64url uncompressed point.
+func (wp *WebPushNotifier) publicKey() string {
+	pub, err := wp.key.PublicKey.ECDH()
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(pub.Bytes())
+}
+
+func (wp *WebPushNotifier) Send(ch Channel, n Notification) error {
+	msg := map[string]any{
+		"title":    n.Title,
+		"body":     n.Body,
+		"floorId":  n.FloorId,
+		"type":     n.Type,
+		"revision": n.Revision,
+		"patch":    string(n.Payload),
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	//the payload has to fit the single record, a patch too large is left out and the client
+	//catches up to revision through /changes
+	if len(body)+webPushRecordOverhead > webPushRecordSize {
+		delete(msg, "patch")
+		if body, err = json.Marshal(msg); err != nil {
+			return err
+		}
+	}
+	encrypted, err := encryptWebPush(body, ch.P256dh, ch.Auth, rand.Reader)
+	if err != nil {
+		return fmt.Errorf("encrypting web push payload: %w", err)
+	}
+	authorization, err := wp.vapidAuthorization(ch.Address)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", ch.Address, bytes.NewReader(encrypted))
+	if err != nil {
+		return fmt.Errorf("creating web push request: %w", err)
+	}
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprint(int(wp.ttl.Seconds())))
+	req.Header.Set("Urgency", "normal")
+	req.Header.Set("Authorization", authorization)
+	resp, err := wp.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending web push: %w", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return fmt.Errorf("%w: web push subscription expired or unsubscribed", ErrChannelGone)
+	case resp.StatusCode >= 300:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("web push service answered %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
+
+// vapidAuthorization signs a VAPID token for the origin of the push endpoint.
+func (wp *WebPushNotifier) vapidAuthorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("invalid web push endpoint %s", endpoint)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": wp.subject,
+	})
+	signed, err := token.SignedString(wp.key)
+	if err != nil {
+		return "", fmt.Errorf("signing VAPID token: %w", err)
+	}
+	return "vapid t=" + signed + ", k=" + wp.publicKey(), nil
+}
+
+// encryptWebPush encrypts payload for the subscription keys as a single aes128gcm record (RFC 8291).
+func encryptWebPush(payload []byte, p256dh string, auth string, random io.Reader) ([]byte, error) {
+	uaPublicBytes, err := base64.RawURLEncoding.DecodeString(p256dh)
+	if err != nil {
+		return nil, fmt.Errorf("decoding p256dh: %w", err)
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(auth)
+	if err != nil {
+		return nil, fmt.Errorf("decoding auth: %w", err)
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing p256dh: %w", err)
+	}
+	asPrivate, err := ecdh.P256().GenerateKey(random)
+	if err != nil {
+		return nil, err
+	}
+	asPublicBytes := asPrivate.PublicKey().Bytes()
+	sharedSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(random, salt); err != nil {
+		return nil, err
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublicBytes...)
+	keyInfo = append(keyInfo, asPublicBytes...)
+	ikm := hkdfExpand(hkdfExtract(authSecret, sharedSecret), keyInfo, 32)
+	prk := hkdfExtract(salt, ikm)
+	cek := hkdfExpand(prk, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdfExpand(prk, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	//0x02 marks the last and only record
+	ciphertext := gcm.Seal(nil, nonce, append(payload, 0x02), nil)
+
+	header := make([]byte, 0, 16+4+1+len(asPublicBytes))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(asPublicBytes)))
+	header = append(header, asPublicBytes...)
+	return append(header, ciphertext...), nil
+}
+
+func hkdfExtract(salt []byte, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// hkdfExpand is HKDF-Expand for outputs of at most one hash length, all Web Push needs.
+func hkdfExpand(prk []byte, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{0x01})
+	return mac.Sum(nil)[:length]
+}